@@ -0,0 +1,210 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/bjbloemker-google/stackdriver-prometheus-sidecar/metadata"
+	"github.com/bjbloemker-google/stackdriver-prometheus-sidecar/retrieval"
+	"github.com/bjbloemker-google/stackdriver-prometheus-sidecar/targets"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	promlabels "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/textparse"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/wal"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// benchScrapeIntervalMs is the simulated scrape interval between the sample
+// timestamps of consecutive cycles in a generated WAL.
+const benchScrapeIntervalMs = 15000
+
+// benchHistogramBuckets are the upper bucket bounds of generated histogram
+// series, followed by the implicit +Inf bucket.
+var benchHistogramBuckets = []float64{0.1, 1, 10}
+
+// benchSink counts the time series it receives without storing them, serving
+// as the write endpoint of a benchmark run.
+type benchSink struct {
+	written int
+}
+
+func (s *benchSink) Append(hash uint64, ts *monitoring_pb.TimeSeries) error {
+	s.written++
+	return nil
+}
+
+// generateBenchWAL writes a synthetic WAL with the given number of series to
+// dir and returns the matching static metadata along with the number of
+// samples written. Every series gets one sample per cycle. The histogram
+// ratio determines the fraction of series that are histograms; the churn
+// ratio determines the fraction of series that is replaced by a newly created
+// series each cycle.
+func generateBenchWAL(dir string, numSeries, cycles int, churnRatio, histogramRatio float64) ([]*metadata.Entry, int, error) {
+	w, err := wal.New(nil, nil, dir, false)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "creating WAL")
+	}
+	numHistograms := int(float64(numSeries) * histogramRatio)
+	numCounters := numSeries - numHistograms
+	churn := int(float64(numCounters) * churnRatio)
+
+	var (
+		enc            tsdb.RecordEncoder
+		staticMetadata []*metadata.Entry
+		series         []tsdb.RefSeries
+		nextRef        uint64
+	)
+	newSeries := func(lset labels.Labels) uint64 {
+		nextRef++
+		series = append(series, tsdb.RefSeries{Ref: nextRef, Labels: lset})
+		return nextRef
+	}
+	counterLabels := func(i, generation int) labels.Labels {
+		return labels.FromStrings(
+			"__name__", "bench_counter_"+strconv.Itoa(i),
+			"job", "bench", "instance", "localhost:9090",
+			"generation", strconv.Itoa(generation))
+	}
+	counterRefs := make([]uint64, numCounters)
+	for i := range counterRefs {
+		counterRefs[i] = newSeries(counterLabels(i, 0))
+		staticMetadata = append(staticMetadata, &metadata.Entry{
+			Metric:     "bench_counter_" + strconv.Itoa(i),
+			MetricType: textparse.MetricTypeCounter,
+		})
+	}
+	// A histogram consists of a sum and count series followed by one series
+	// per bucket, including the implicit +Inf bucket.
+	histogramRefs := make([][]uint64, numHistograms)
+	for i := range histogramRefs {
+		name := "bench_histogram_" + strconv.Itoa(i)
+		refs := []uint64{
+			newSeries(labels.FromStrings("__name__", name+"_sum", "job", "bench", "instance", "localhost:9090")),
+			newSeries(labels.FromStrings("__name__", name+"_count", "job", "bench", "instance", "localhost:9090")),
+		}
+		for _, bound := range benchHistogramBuckets {
+			refs = append(refs, newSeries(labels.FromStrings(
+				"__name__", name+"_bucket", "le", strconv.FormatFloat(bound, 'f', -1, 64),
+				"job", "bench", "instance", "localhost:9090")))
+		}
+		refs = append(refs, newSeries(labels.FromStrings(
+			"__name__", name+"_bucket", "le", "+Inf",
+			"job", "bench", "instance", "localhost:9090")))
+		histogramRefs[i] = refs
+		staticMetadata = append(staticMetadata, &metadata.Entry{
+			Metric:     name,
+			MetricType: textparse.MetricTypeHistogram,
+		})
+	}
+
+	written := 0
+	for c := 0; c < cycles; c++ {
+		// Churned series keep their metric name but start a new generation,
+		// so the pipeline sees them as fresh series.
+		for j := 0; j < churn && numCounters > 0; j++ {
+			i := (c*churn + j) % numCounters
+			counterRefs[i] = newSeries(counterLabels(i, c+1))
+		}
+		if len(series) > 0 {
+			if err := w.Log(enc.Series(series, nil)); err != nil {
+				return nil, 0, errors.Wrap(err, "writing series records")
+			}
+			series = series[:0]
+		}
+		t := int64(c+1) * benchScrapeIntervalMs
+		samples := make([]tsdb.RefSample, 0, numCounters+numHistograms*(len(benchHistogramBuckets)+3))
+		for _, ref := range counterRefs {
+			samples = append(samples, tsdb.RefSample{Ref: ref, T: t, V: float64(c)})
+		}
+		for _, refs := range histogramRefs {
+			count := float64(c * (len(refs) - 2))
+			samples = append(samples, tsdb.RefSample{Ref: refs[0], T: t, V: count / 2})
+			samples = append(samples, tsdb.RefSample{Ref: refs[1], T: t, V: count})
+			for k, ref := range refs[2:] {
+				samples = append(samples, tsdb.RefSample{Ref: ref, T: t, V: float64(c * (k + 1))})
+			}
+		}
+		if err := w.Log(enc.Samples(samples, nil)); err != nil {
+			return nil, 0, errors.Wrap(err, "writing sample records")
+		}
+		written += len(samples)
+	}
+	if err := w.Close(); err != nil {
+		return nil, 0, errors.Wrap(err, "closing WAL")
+	}
+	return staticMetadata, written, nil
+}
+
+// runBench implements the bench subcommand. It generates a synthetic WAL into
+// a temporary directory, replays it through the regular transformation
+// pipeline against an in-memory sink, and writes a throughput and memory
+// report to w.
+func runBench(ctx context.Context, logger log.Logger, w io.Writer, numSeries, cycles int, churnRatio, histogramRatio float64, cfg *mainConfig) error {
+	dir, err := ioutil.TempDir("", "sidecar-bench")
+	if err != nil {
+		return errors.Wrap(err, "creating WAL directory")
+	}
+	defer os.RemoveAll(dir)
+
+	staticMetadata, written, err := generateBenchWAL(dir, numSeries, cycles, churnRatio, histogramRatio)
+	if err != nil {
+		return errors.Wrap(err, "generating WAL")
+	}
+	staticTargets := staticTargets{
+		&targets.Target{
+			Labels: promlabels.FromStrings("job", "bench", "instance", "localhost:9090"),
+			DiscoveredLabels: promlabels.FromStrings(
+				retrieval.ProjectIDLabel, "bench-project",
+				retrieval.GenericNamespaceLabel, "bench", retrieval.GenericLocationLabel, "bench",
+				"job", "bench", "__address__", "localhost:9090"),
+		},
+	}
+	cfg.WALDirectory = dir
+
+	sink := &benchSink{}
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	if err := replayWAL(ctx, logger, sink, staticTargets, staticMetadata, nil, cfg); err != nil {
+		return errors.Wrap(err, "replaying WAL")
+	}
+
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	throughput := float64(written) / elapsed.Seconds()
+	allocated := after.TotalAlloc - before.TotalAlloc
+	fmt.Fprintf(w, "series:           %d (%d histograms)\n", numSeries, int(float64(numSeries)*histogramRatio))
+	fmt.Fprintf(w, "WAL samples:      %d\n", written)
+	fmt.Fprintf(w, "produced samples: %d\n", sink.written)
+	fmt.Fprintf(w, "wall time:        %s\n", elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "throughput:       %.0f samples/s\n", throughput)
+	fmt.Fprintf(w, "allocated:        %d MiB (%.0f B/sample)\n", allocated/1024/1024, float64(allocated)/float64(written))
+	fmt.Fprintf(w, "heap in use:      %d MiB\n", after.HeapInuse/1024/1024)
+	return nil
+}
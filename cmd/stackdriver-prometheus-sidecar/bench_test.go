@@ -0,0 +1,48 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestRunBench(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cfg := mainConfig{}
+	var buf bytes.Buffer
+	if err := runBench(ctx, log.NewNopLogger(), &buf, 10, 5, 0.1, 0.2, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	// 8 counters and 2 histograms with 6 member series each, one sample per
+	// series and cycle.
+	if !strings.Contains(out, "WAL samples:      100\n") {
+		t.Errorf("unexpected WAL sample count in report:\n%s", out)
+	}
+	if !strings.Contains(out, "samples/s") {
+		t.Errorf("missing throughput in report:\n%s", out)
+	}
+	if strings.Contains(out, "produced samples: 0\n") {
+		t.Errorf("expected produced samples in report:\n%s", out)
+	}
+}
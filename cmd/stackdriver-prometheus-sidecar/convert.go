@@ -0,0 +1,203 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/bjbloemker-google/stackdriver-prometheus-sidecar/metadata"
+	"github.com/bjbloemker-google/stackdriver-prometheus-sidecar/retrieval"
+	"github.com/bjbloemker-google/stackdriver-prometheus-sidecar/tail"
+	"github.com/bjbloemker-google/stackdriver-prometheus-sidecar/targets"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// staticTargets resolves series against a fixed list of targets loaded from a
+// file instead of the Prometheus targets API.
+type staticTargets []*targets.Target
+
+// parseTargetsFile reads a JSON file holding a list of targets in the format
+// of the Prometheus targets API, i.e. objects with "labels" and
+// "discoveredLabels" maps.
+func parseTargetsFile(filename string) (staticTargets, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading file")
+	}
+	var ts staticTargets
+	if err := json.Unmarshal(b, &ts); err != nil {
+		return nil, errors.Wrap(err, "invalid JSON")
+	}
+	return ts, nil
+}
+
+// Get returns the first target whose labels are all contained in lset,
+// mirroring how the target cache matches series to active targets.
+func (ts staticTargets) Get(ctx context.Context, lset labels.Labels) (*targets.Target, error) {
+Outer:
+	for _, t := range ts {
+		for _, tl := range t.Labels {
+			if v := lset.Get(tl.Name); v != "" && v != tl.Value {
+				continue Outer
+			}
+		}
+		return t, nil
+	}
+	return nil, nil
+}
+
+// staticOnlyMetadata serves metadata lookups purely from static entries keyed
+// by metric name, without falling back to a Prometheus server.
+type staticOnlyMetadata map[string]*metadata.Entry
+
+func (m staticOnlyMetadata) Get(ctx context.Context, job, instance, metric string) (*metadata.Entry, error) {
+	return m[metric], nil
+}
+
+// ndjsonAppender writes every appended time series as one JSON document per
+// line.
+type ndjsonAppender struct {
+	enc     *json.Encoder
+	written int
+}
+
+func (a *ndjsonAppender) Append(hash uint64, s *monitoring_pb.TimeSeries) error {
+	a.written++
+	return a.enc.Encode(s)
+}
+
+// runConvert implements the convert subcommand. It replays the WAL through
+// the regular transformation pipeline, resolving targets and metadata from
+// the given static sets, and writes every resulting time series to w as
+// newline-delimited JSON. It returns once the end of the WAL is reached.
+func runConvert(ctx context.Context, logger log.Logger, w io.Writer, staticTargets staticTargets, staticMetadata []*metadata.Entry, filtersets [][]*labels.Matcher, cfg *mainConfig) error {
+	appender := &ndjsonAppender{enc: json.NewEncoder(w)}
+	if err := replayWAL(ctx, logger, appender, staticTargets, staticMetadata, filtersets, cfg); err != nil {
+		return err
+	}
+	level.Info(logger).Log("msg", "Conversion complete", "series", appender.written)
+	return nil
+}
+
+// replayWAL runs the regular transformation pipeline over the complete WAL in
+// cfg.WALDirectory without talking to any APIs, sending every resulting time
+// series to the given appender. It returns once the end of the WAL is
+// reached.
+func replayWAL(ctx context.Context, logger log.Logger, appender retrieval.Appender, staticTargets staticTargets, staticMetadata []*metadata.Entry, filtersets [][]*labels.Matcher, cfg *mainConfig) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	tailer, err := tail.Tail(ctx, cfg.WALDirectory)
+	if err != nil {
+		return errors.Wrap(err, "tailing WAL")
+	}
+	defer tailer.Close()
+
+	metadataGetter := staticOnlyMetadata{}
+	for _, e := range staticMetadata {
+		metadataGetter[e.Metric] = e
+	}
+
+	counterAggregator, err := retrieval.NewCounterAggregator(logger, &cfg.Aggregations)
+	if err != nil {
+		return errors.Wrap(err, "creating counter aggregator")
+	}
+	defer counterAggregator.Close()
+	gaugeAggregator, err := retrieval.NewGaugeAggregator(logger, &cfg.GaugeAggregations)
+	if err != nil {
+		return errors.Wrap(err, "creating gauge aggregator")
+	}
+	defer gaugeAggregator.Close()
+
+	var deltaConfig *retrieval.DeltaConfig
+	if cfg.UseDeltaCounters || len(cfg.DeltaCounters) > 0 {
+		deltaConfig = &retrieval.DeltaConfig{All: cfg.UseDeltaCounters, Metrics: cfg.DeltaCounters}
+	}
+
+	reader := retrieval.NewPrometheusReader(
+		logger,
+		cfg.WALDirectory,
+		tailer,
+		filtersets,
+		cfg.MetricRenames,
+		staticTargets,
+		metadataGetter,
+		appender,
+		cfg.MetricsPrefix,
+		cfg.JobPrefixes,
+		cfg.NamespaceProjects,
+		cfg.SelfJobName,
+		cfg.UseGKEResource,
+		// Scrape health has no meaning for an offline conversion.
+		false,
+		counterAggregator,
+		gaugeAggregator,
+		cfg.BucketFilters,
+		// Age-based shedding and sample filters are disabled so that old
+		// WALs convert in full regardless of the wall clock.
+		0,
+		0,
+		0,
+		cfg.LabelJoins,
+		deltaConfig,
+		nil,
+		0,
+		0,
+		cfg.ValueTransforms,
+		nil,
+		cfg.GaugeIntervals,
+		retrieval.EscapingScheme(cfg.MetricNameEscaping),
+		nil,
+		cfg.LabelSplits,
+		cfg.HAMerges,
+		cfg.MinCumulativeInterval,
+		nil,
+		nil,
+		retrieval.LongNameAction(cfg.LongMetricNameAction),
+	)
+	reader.DisableProgressSaving()
+
+	// Cancel the tail once the reader has consumed the entire WAL. The tailer
+	// then reports EOF instead of waiting for Prometheus to append more data.
+	go func() {
+		tick := time.NewTicker(100 * time.Millisecond)
+		defer tick.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+				size, err := tailer.Size()
+				if err == nil && tailer.Offset() >= size {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	if err := reader.Run(ctx, 0); err != nil {
+		return errors.Wrap(err, "processing WAL")
+	}
+	return nil
+}
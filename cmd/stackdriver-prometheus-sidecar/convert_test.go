@@ -0,0 +1,116 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bjbloemker-google/stackdriver-prometheus-sidecar/metadata"
+	"github.com/bjbloemker-google/stackdriver-prometheus-sidecar/retrieval"
+	"github.com/bjbloemker-google/stackdriver-prometheus-sidecar/targets"
+	"github.com/go-kit/kit/log"
+	promlabels "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/textparse"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/wal"
+)
+
+func TestRunConvert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "convert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := wal.New(nil, nil, dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var enc tsdb.RecordEncoder
+	err = w.Log(enc.Series([]tsdb.RefSeries{
+		{Ref: 1, Labels: labels.FromStrings("__name__", "metric1", "job", "job1", "instance", "inst1")},
+	}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Log(enc.Samples([]tsdb.RefSample{
+		{Ref: 1, T: 1000, V: 3.5},
+		{Ref: 1, T: 2000, V: 4.5},
+	}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	staticTargets := staticTargets{
+		&targets.Target{
+			Labels: promlabels.FromStrings("job", "job1", "instance", "inst1"),
+			DiscoveredLabels: promlabels.FromStrings(
+				retrieval.ProjectIDLabel, "proj1",
+				retrieval.GenericNamespaceLabel, "ns1", retrieval.GenericLocationLabel, "loc1",
+				"job", "job1", "__address__", "inst1"),
+		},
+	}
+	staticMetadata := []*metadata.Entry{
+		{Metric: "metric1", MetricType: textparse.MetricTypeGauge, Help: "help"},
+	}
+	cfg := mainConfig{WALDirectory: dir}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var buf bytes.Buffer
+	if err := runConvert(ctx, log.NewNopLogger(), &buf, staticTargets, staticMetadata, nil, &cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var doc map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &doc); err != nil {
+			t.Fatalf("invalid JSON line %q: %s", scanner.Text(), err)
+		}
+		lines = append(lines, doc)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 output series, got %d", len(lines))
+	}
+	metric, ok := lines[0]["metric"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("missing metric in output %v", lines[0])
+	}
+	if typ, _ := metric["type"].(string); !strings.HasSuffix(typ, "/metric1") {
+		t.Errorf("unexpected metric type %q", typ)
+	}
+
+	// The WAL directory must stay untouched; in particular no progress file
+	// may have been written.
+	if _, err := os.Stat(filepath.Join(dir, "stackdriver_sidecar.json")); !os.IsNotExist(err) {
+		t.Errorf("expected no progress file, got err %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/bjbloemker-google/stackdriver-prometheus-sidecar/stackdriver"
+	"github.com/pkg/errors"
+)
+
+// runHealthSetup implements the install-monitoring subcommand. It emits the
+// standard sidecar health dashboard configuration and, if requested, creates
+// the matching alert policies in the destination project.
+func runHealthSetup(ctx context.Context, w io.Writer, client *stackdriver.Client, prefix, dashboardFile string, create bool) error {
+	policies := stackdriver.HealthAlertPolicies(prefix)
+	fmt.Fprintf(w, "Standard sidecar health alert policies:\n")
+	for _, p := range policies {
+		fmt.Fprintf(w, "  %s\n", p.DisplayName)
+	}
+	if create {
+		if err := client.CreateAlertPolicies(ctx, policies); err != nil {
+			return errors.Wrap(err, "create alert policies")
+		}
+		fmt.Fprintf(w, "\nCreated %d alert policies.\n", len(policies))
+	} else {
+		fmt.Fprintf(w, "\nWould create %d alert policies (pass --create-policies to create them).\n", len(policies))
+	}
+
+	dashboard := stackdriver.HealthDashboardJSON(prefix)
+	if dashboardFile == "" {
+		fmt.Fprintf(w, "\nDashboard configuration:\n\n%s", dashboard)
+		return nil
+	}
+	if err := ioutil.WriteFile(dashboardFile, []byte(dashboard), 0644); err != nil {
+		return errors.Wrap(err, "write dashboard configuration")
+	}
+	fmt.Fprintf(w, `
+Wrote the dashboard configuration to %s. Import it with
+
+  gcloud monitoring dashboards create --config-from-file=%s
+`, dashboardFile, dashboardFile)
+	return nil
+}
@@ -16,8 +16,12 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	_ "net/http/pprof" // Comment this line to disable pprof endpoint.
 	"net/url"
@@ -25,6 +29,7 @@ import (
 	"os/signal"
 	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strings"
 	"syscall"
@@ -33,11 +38,11 @@ import (
 	md "cloud.google.com/go/compute/metadata"
 	oc_prometheus "contrib.go.opencensus.io/exporter/prometheus"
 	oc_stackdriver "contrib.go.opencensus.io/exporter/stackdriver"
-	"github.com/Stackdriver/stackdriver-prometheus-sidecar/metadata"
-	"github.com/Stackdriver/stackdriver-prometheus-sidecar/retrieval"
-	"github.com/Stackdriver/stackdriver-prometheus-sidecar/stackdriver"
-	"github.com/Stackdriver/stackdriver-prometheus-sidecar/tail"
-	"github.com/Stackdriver/stackdriver-prometheus-sidecar/targets"
+	"github.com/bjbloemker-google/stackdriver-prometheus-sidecar/metadata"
+	"github.com/bjbloemker-google/stackdriver-prometheus-sidecar/retrieval"
+	"github.com/bjbloemker-google/stackdriver-prometheus-sidecar/stackdriver"
+	"github.com/bjbloemker-google/stackdriver-prometheus-sidecar/tail"
+	"github.com/bjbloemker-google/stackdriver-prometheus-sidecar/targets"
 	"github.com/ghodss/yaml"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -46,6 +51,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/promlog"
 	promlogflag "github.com/prometheus/common/promlog/flag"
 	"github.com/prometheus/common/version"
@@ -60,6 +66,7 @@ import (
 	"go.opencensus.io/stats/view"
 	"go.opencensus.io/tag"
 	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/resolver"
 	"google.golang.org/grpc/resolver/manual"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
@@ -76,10 +83,21 @@ var (
 		"agent.googleapis.com/agent/uptime",
 		"uptime of the Stackdriver Prometheus collector",
 		stats.UnitSeconds)
+
+	buildInfoMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sidecar_build_info",
+		Help: "A metric with constant value 1 labeled by the sidecar's build information.",
+	}, []string{"version", "revision", "branch", "goversion"})
+	configHashMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sidecar_config_hash",
+		Help: "A metric with constant value 1 labeled by the hash of the effective configuration.",
+	}, []string{"hash"})
 )
 
 func init() {
 	prometheus.MustRegister(version.NewCollector("prometheus"))
+	prometheus.MustRegister(buildInfoMetric, configHashMetric)
+	buildInfoMetric.WithLabelValues(version.Version, version.Revision, version.Branch, version.GoVersion).Set(1)
 
 	if err := view.Register(
 		&view.View{
@@ -144,45 +162,239 @@ type metricRenamesConfig struct {
 	To   string `json:"to"`
 }
 
+type metricPrefixConfig struct {
+	Job    string `json:"job"`
+	Prefix string `json:"prefix"`
+}
+
 type staticMetadataConfig struct {
 	Metric    string `json:"metric"`
 	Type      string `json:"type"`
 	ValueType string `json:"value_type"`
 	Help      string `json:"help"`
+	Unit      string `json:"unit"`
+}
+
+type namespaceProjectConfig struct {
+	Namespace string `json:"namespace"`
+	ProjectID string `json:"project_id"`
+}
+
+type histogramBucketFilterConfig struct {
+	Metric           string    `json:"metric"`
+	DropBounds       []float64 `json:"drop_bounds"`
+	KeepEvery        int       `json:"keep_every"`
+	CollapseEmpty    bool      `json:"collapse_empty"`
+	RebucketOnChange bool      `json:"rebucket_on_change"`
 }
 
 type aggregatedCountersConfig struct {
 	Metric  string   `json:"metric"`
 	Filters []string `json:"filters"`
 	Help    string   `json:"help"`
+	Kind    string   `json:"kind"`
+}
+
+type aggregatedGaugesConfig struct {
+	Metric  string   `json:"metric"`
+	Filters []string `json:"filters"`
+	Help    string   `json:"help"`
+	Op      string   `json:"op"`
+	By      []string `json:"by"`
+	Window  string   `json:"window"`
+}
+
+type deltaCounterConfig struct {
+	Metric string `json:"metric"`
+}
+
+type valueTransformConfig struct {
+	Metric     string   `json:"metric"`
+	Factor     float64  `json:"factor"`
+	ClampMin   *float64 `json:"clamp_min"`
+	ClampMax   *float64 `json:"clamp_max"`
+	InvertBool bool     `json:"invert_bool"`
+}
+
+type gaugeIntervalConfig struct {
+	Metric      string `json:"metric"`
+	MinInterval string `json:"min_interval"`
+	Op          string `json:"op"`
+}
+
+type externalLabelConfig struct {
+	Name          string `json:"name"`
+	ResourceLabel string `json:"resource_label"`
+	MetricLabel   string `json:"metric_label"`
+}
+
+type labelSplitConfig struct {
+	Metric string   `json:"metric"`
+	Label  string   `json:"label"`
+	Regex  string   `json:"regex"`
+	Labels []string `json:"labels"`
+	Keep   bool     `json:"keep"`
+}
+
+type haMergeConfig struct {
+	Metric   string `json:"metric"`
+	Strategy string `json:"strategy"`
+}
+
+type qosClassConfig struct {
+	Name       string   `json:"name"`
+	Patterns   []string `json:"patterns"`
+	Shards     int      `json:"shards"`
+	MaxRate    float64  `json:"max_rate"`
+	DropPolicy string   `json:"drop_policy"`
+}
+
+// qosClassSpec pairs a parsed QoS class with its queue settings.
+type qosClassSpec struct {
+	Class  *retrieval.QoSClass
+	Shards int
+}
+
+type labelJoinConfig struct {
+	InfoMetric string   `json:"info_metric"`
+	Keys       []string `json:"keys"`
+	Labels     []string `json:"labels"`
+}
+
+type staticMetricLabelConfig struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type queryJoinConfig struct {
+	Query    string   `json:"query"`
+	Keys     []string `json:"keys"`
+	Labels   []string `json:"labels"`
+	Interval string   `json:"interval"`
 }
 
 type fileConfig struct {
-	MetricRenames      []metricRenamesConfig      `json:"metric_renames"`
-	StaticMetadata     []staticMetadataConfig     `json:"static_metadata"`
-	AggregatedCounters []aggregatedCountersConfig `json:"aggregated_counters"`
+	MetricRenames          []metricRenamesConfig         `json:"metric_renames"`
+	StaticMetadata         []staticMetadataConfig        `json:"static_metadata"`
+	AggregatedCounters     []aggregatedCountersConfig    `json:"aggregated_counters"`
+	AggregatedGauges       []aggregatedGaugesConfig      `json:"aggregated_gauges"`
+	MetricPrefixes         []metricPrefixConfig          `json:"metric_prefixes"`
+	NamespaceProjects      []namespaceProjectConfig      `json:"namespace_projects"`
+	HistogramBucketFilters []histogramBucketFilterConfig `json:"histogram_bucket_filters"`
+	LabelJoins             []labelJoinConfig             `json:"label_joins"`
+	QueryJoins             []queryJoinConfig             `json:"query_joins"`
+	LabelSplits            []labelSplitConfig            `json:"label_splits"`
+	DeltaCounters          []deltaCounterConfig          `json:"delta_counters"`
+	ValueTransforms        []valueTransformConfig        `json:"value_transforms"`
+	GaugeIntervals         []gaugeIntervalConfig         `json:"gauge_intervals"`
+	ExternalLabels         []externalLabelConfig         `json:"external_labels"`
+	StaticMetricLabels     []staticMetricLabelConfig     `json:"static_metric_labels"`
+	QoSClasses             []qosClassConfig              `json:"qos_classes"`
+	HAMerges               []haMergeConfig               `json:"ha_merges"`
 }
 
 // Note: When adding a new config field, consider adding it to
 // statusz-tmpl.html
 type mainConfig struct {
 	ConfigFilename        string
+	ShadowConfigFilename  string
+	DescriptorsFilename   string
 	ProjectIDResource     string
+	ProjectAllowlist      []string
+	QuotaProject          string
+	MetadataHeaders       []string
+	GRPCMetadata          map[string]string
 	KubernetesLabels      kubernetesConfig
 	GenericLabels         genericConfig
+	ResourceAutodetect    bool
+	MetricNameEscaping    string
+	LongMetricNameAction  string
 	StackdriverAddress    *url.URL
+	StackdriverAddresses  []*url.URL
 	MetricsPrefix         string
 	UseGKEResource        bool
+	ExportScrapeHealth    bool
+	JobAvailabilityMetric string
 	StoreInFilesDirectory string
+	Sink                  string
+	BigQueryTable         string
+	PubSubTopic           string
 	WALDirectory          string
+	FederateInterval      time.Duration
 	PrometheusURL         *url.URL
+	TargetsAPIAddresses   []*url.URL
+	MetadataAPIAddresses  []*url.URL
+	MetadataRetryInterval time.Duration
+	MaxBacklogAge         time.Duration
+	MaxBackfillAge        time.Duration
+	MaxSampleAge          time.Duration
+	MinCumulativeInterval time.Duration
+	SeriesCacheGCInterval time.Duration
+	InactiveSeriesTTL     time.Duration
+	DroppedSeriesLimit    int
+	PromConfigFilename    string
+	ReplayRate            float64
+	MemoryBudgetBytes     int64
+	AuditLogFilename      string
+	DeadLetterFilename    string
+	SnapshotFilename      string
+	Handover              bool
+	InterceptorPlugin     string
+	EnforceSchema         bool
+	MetadataAPIMaxRate    float64
+	MetadataAPIMaxRetries int
+	ChaosErrorRate        float64
+	ChaosErrorCode        int
+	ChaosLatency          time.Duration
+	ChaosLatencyJitter    time.Duration
+	TargetsSource         string
+	MetadataSource        string
+	LifecycleMetric       bool
+	TracerInterval        time.Duration
+	StatusWindow          time.Duration
+	LabelAllowlist        []string
+	GaugeDedupWindow      time.Duration
+	SelfJobName           string
+	APIAttemptDeadline    time.Duration
+	APIMaxRetries         int
+	NumShards             int
+	APIMinBackoff         time.Duration
+	APIMaxBackoff         time.Duration
+	APIRetryStatuses      []string
+	LabelMismatchAction   string
+	HedgingDelay          time.Duration
+	APIDisableAuth        bool
+	APITLS                bool
+	DebugDumpDirectory    string
+	DebugDumpMaxBytes     int64
+	DebugDumpRedact       []string
 	ListenAddress         string
 	EnableStatusz         bool
 	Filters               []string
 	Filtersets            []string
 	Aggregations          retrieval.CounterAggregatorConfig
+	AggregationsStateDir  string
+	GaugeAggregations     retrieval.GaugeAggregatorConfig
 	MetricRenames         map[string]string
 	StaticMetadata        []*metadata.Entry
+	JobPrefixes           map[string]string
+	NamespaceProjects     map[string]string
+	BucketFilters         map[string]*retrieval.BucketFilter
+	LabelJoins            []*retrieval.LabelJoin
+	QueryJoins            []*retrieval.QueryJoin
+	LabelSplits           []*retrieval.LabelSplit
+	UseDeltaCounters      bool
+	DeltaCounters         map[string]bool
+	ValueTransforms       map[string]*retrieval.ValueTransform
+	GaugeIntervals        map[string]*retrieval.GaugeInterval
+	ExternalLabels        []retrieval.ExternalLabelMapping
+	MetricLabels          []string
+	StaticMetricLabels    map[string]string
+	QoSClasses            []qosClassSpec
+	HAMerges              map[string]retrieval.HAMergeStrategy
+	CheckPermissions      bool
+	KubernetesEvents      bool
+	ExportHelpText        bool
 	UseRestrictedIPs      bool
 	manualResolver        *manual.Resolver
 	MonitoringBackends    []string
@@ -203,18 +415,66 @@ func main() {
 
 	a.HelpFlag.Short('h')
 
+	// The sidecar runs by default; the check command only validates the
+	// Stackdriver permissions and exits.
+	a.Command("run", "Run the sidecar.").Default()
+	checkCommand := a.Command("check", "Validate that the configured credentials can write to the Monitoring API, then exit.")
+
+	migrateCommand := a.Command("migrate-prefix", "List the metric descriptors under an old metrics prefix, optionally create matching descriptors under a new prefix, and print a dual-write configuration for the migration, then exit.")
+	migrateOldPrefix := migrateCommand.Flag("old-prefix", "Metric type prefix currently in use, e.g. external.googleapis.com/prometheus.").Required().String()
+	migrateNewPrefix := migrateCommand.Flag("new-prefix", "Metric type prefix to migrate to.").Required().String()
+	migrateCreate := migrateCommand.Flag("create-descriptors", "Create a descriptor under the new prefix for every descriptor found under the old prefix.").Bool()
+
+	installCommand := a.Command("install-monitoring", "Print a standard sidecar health dashboard configuration and alert policies for WAL replay lag, sample drop rate, and Monitoring API errors, optionally creating the alert policies in the destination project, then exit.")
+	installCreate := installCommand.Flag("create-policies", "Create the alert policies in the project given by --stackdriver.project-id. Requires a role that includes alert policy creation, e.g. roles/monitoring.editor.").Bool()
+	installDashboardFile := installCommand.Flag("dashboard-file", "Write the dashboard configuration to this file instead of printing it. The file can be imported with 'gcloud monitoring dashboards create --config-from-file'.").String()
+
+	convertCommand := a.Command("convert", "Replay the write-ahead log through the configured transformation pipeline without talking to any APIs, resolving targets and metadata from static files, and write the resulting time series to stdout as newline-delimited JSON, then exit.")
+	convertTargetsFile := convertCommand.Flag("targets-file", "JSON file with the targets to resolve series against, a list of objects with \"labels\" and \"discoveredLabels\" maps as returned by the Prometheus targets API.").Required().String()
+	convertMetadataFile := convertCommand.Flag("metadata-file", "File in the configuration file format whose static_metadata section provides the metric metadata. If unset, the static metadata of --config-file is used.").String()
+
+	benchCommand := a.Command("bench", "Generate a synthetic write-ahead log and replay it through the transformation pipeline against an in-memory sink, reporting throughput and memory usage, then exit.")
+	benchSeries := benchCommand.Flag("series", "Number of time series in the generated WAL.").Default("1000").Int()
+	benchCycles := benchCommand.Flag("cycles", "Number of scrape cycles to generate; every series gets one sample per cycle.").Default("100").Int()
+	benchChurn := benchCommand.Flag("churn", "Fraction of the series that is replaced by a newly created series each cycle.").Default("0").Float64()
+	benchHistogramRatio := benchCommand.Flag("histogram-ratio", "Fraction of the series that are histograms.").Default("0").Float64()
+
 	a.Flag("config-file", "A configuration file.").StringVar(&cfg.ConfigFilename)
 
+	a.Flag("shadow.config-file", "Candidate configuration file to run as a shadow conversion pipeline. Its output is compared against the active pipeline instead of being written, with differences reported on /api/v1/shadow and as metrics.").
+		StringVar(&cfg.ShadowConfigFilename)
+
 	projectID := a.Flag("stackdriver.project-id", "The Google project ID where Stackdriver will store the metrics.").
 		Required().
 		String()
 
-	a.Flag("stackdriver.api-address", "Address of the Stackdriver Monitoring API.").
-		Default("https://monitoring.googleapis.com:443/").URLVar(&cfg.StackdriverAddress)
+	a.Flag("stackdriver.destination-project", "Project that series may be routed to when their monitored resource carries a project_id label, e.g. populated through federation of other clusters. May be repeated. If unset, all projects are permitted.").
+		StringsVar(&cfg.ProjectAllowlist)
+
+	a.Flag("stackdriver.quota-project", "Project that quota and billing of Monitoring API calls are attributed to, sent as the x-goog-user-project header. Required when the billing project differs from the destination project of the written series.").
+		StringVar(&cfg.QuotaProject)
+
+	a.Flag("stackdriver.grpc-metadata", "Additional gRPC metadata as key=value attached to every Monitoring API call. May be repeated.").
+		PlaceHolder("key=value").StringsVar(&cfg.MetadataHeaders)
+
+	a.Flag("stackdriver.api-address", "Address of the Stackdriver Monitoring API. May be repeated to spread requests across several endpoints; all endpoints must share the same scheme and credentials.").
+		Default("https://monitoring.googleapis.com:443/").URLListVar(&cfg.StackdriverAddresses)
 
 	a.Flag("stackdriver.use-restricted-ips", "If true, send all requests through restricted VIPs (EXPERIMENTAL).").
 		Default("false").BoolVar(&cfg.UseRestrictedIPs)
 
+	a.Flag("stackdriver.api-disable-auth", "If true, send requests without GCP OAuth credentials, e.g. to a custom backend implementing the Monitoring API. Connections use plaintext unless --stackdriver.api-tls is set.").
+		Default("false").BoolVar(&cfg.APIDisableAuth)
+
+	a.Flag("stackdriver.api-tls", "If true, use TLS for connections without GCP OAuth credentials. Authenticated connections always use TLS.").
+		Default("false").BoolVar(&cfg.APITLS)
+
+	a.Flag("stackdriver.check-permissions", "If true, validate at startup that the configured credentials can write to the Monitoring API and fail fast otherwise.").
+		Default("false").BoolVar(&cfg.CheckPermissions)
+
+	a.Flag("stackdriver.export-help-text", "If true, create metric descriptors whose description is the Prometheus HELP text of the metric, refreshing them when the HELP text changes.").
+		Default("false").BoolVar(&cfg.ExportHelpText)
+
 	a.Flag("stackdriver.kubernetes.location", "Value of the 'location' label in the Kubernetes Stackdriver MonitoredResources.").
 		StringVar(&cfg.KubernetesLabels.Location)
 
@@ -227,6 +487,15 @@ func main() {
 	a.Flag("stackdriver.generic.namespace", "Namespace for metrics written with the generic resource, e.g. a cluster or data center name.").
 		StringVar(&cfg.GenericLabels.Namespace)
 
+	a.Flag("stackdriver.resource-autodetect", "Probe the GCE, EC2, and Azure metadata services at startup to fill in missing generic resource labels.").
+		Default("true").BoolVar(&cfg.ResourceAutodetect)
+
+	a.Flag("stackdriver.metric-name-escaping", "How to translate UTF-8 metric and label names into Monitoring-compatible ones: 'underscores' replaces invalid characters, 'values' escapes them reversibly, 'none' passes them through.").
+		Default("underscores").EnumVar(&cfg.MetricNameEscaping, "underscores", "values", "none")
+
+	a.Flag("stackdriver.long-metric-name-action", "How to handle metric types exceeding the Monitoring length limit: 'drop' rejects the series during conversion, 'truncate' deterministically shortens the type with a hash suffix so it still exports.").
+		Default("drop").EnumVar(&cfg.LongMetricNameAction, "drop", "truncate")
+
 	a.Flag("stackdriver.metrics-prefix", "Customized prefix for Stackdriver metrics. If not set, external.googleapis.com/prometheus will be used").
 		StringVar(&cfg.MetricsPrefix)
 
@@ -234,15 +503,175 @@ func main() {
 		"Whether to use the legacy gke_container MonitoredResource type instead of k8s_container").
 		Default("false").BoolVar(&cfg.UseGKEResource)
 
+	a.Flag("stackdriver.descriptors-file", "A file declaring metric descriptors to create or update at startup.").
+		StringVar(&cfg.DescriptorsFilename)
+
+	a.Flag("stackdriver.api-attempt-deadline", "Deadline for a single CreateTimeSeries attempt against the Stackdriver Monitoring API.").
+		Default("10s").DurationVar(&cfg.APIAttemptDeadline)
+
+	a.Flag("stackdriver.api-max-retries", "Maximum number of attempts per sample batch on recoverable errors. 0 retries indefinitely.").
+		Default("0").IntVar(&cfg.APIMaxRetries)
+
+	a.Flag("stackdriver.num-shards", "If non-zero, use this fixed number of shards for parallel sends and disable dynamic resharding.").
+		Default("0").IntVar(&cfg.NumShards)
+
+	a.Flag("stackdriver.use-delta-counters", "Export all counters with the DELTA metric kind instead of CUMULATIVE. Individual counters can be selected through the configuration file.").
+		Default("false").BoolVar(&cfg.UseDeltaCounters)
+
+	a.Flag("stackdriver.api-min-backoff", "Initial backoff between retried CreateTimeSeries attempts.").
+		Default("30ms").DurationVar(&cfg.APIMinBackoff)
+
+	a.Flag("stackdriver.api-max-backoff", "Maximum backoff between retried CreateTimeSeries attempts.").
+		Default("100ms").DurationVar(&cfg.APIMaxBackoff)
+
+	a.Flag("stackdriver.api-retry-status", "gRPC status code to retry with backoff, e.g. UNAVAILABLE. May be repeated; overrides the default retryable set.").
+		StringsVar(&cfg.APIRetryStatuses)
+
+	a.Flag("stackdriver.on-descriptor-label-mismatch", "How to remediate writes rejected because an existing metric descriptor lacks a label: none, drop-label, or recreate. 'recreate' deletes and recreates the descriptor and discards the metric's history.").
+		Default(stackdriver.LabelMismatchIgnore).
+		EnumVar(&cfg.LabelMismatchAction, stackdriver.LabelMismatchIgnore, stackdriver.LabelMismatchDropLabel, stackdriver.LabelMismatchRecreate)
+
+	a.Flag("stackdriver.hedged-request-delay", "If set, send a second hedged CreateTimeSeries attempt when the first has not completed within this delay and use whichever result arrives first. 0 disables hedging.").
+		Default("0").DurationVar(&cfg.HedgingDelay)
+
+	a.Flag("stackdriver.debug-dump-directory", "If set, dump every failed CreateTimeSeries request as JSON to rotating files under this directory for offline inspection.").
+		StringVar(&cfg.DebugDumpDirectory)
+
+	a.Flag("stackdriver.debug-dump-max-bytes", "Maximum total size of the debug dump directory. Oldest dump files are deleted first.").
+		Default("67108864").Int64Var(&cfg.DebugDumpMaxBytes)
+
+	a.Flag("stackdriver.debug-dump-redact", "Regular expression matched against label values in debug dumps; matching values are redacted. May be repeated.").
+		StringsVar(&cfg.DebugDumpRedact)
+
 	a.Flag("stackdriver.store-in-files-directory", "If specified, store the CreateTimeSeriesRequest protobuf messages to files under this directory, instead of sending protobuf messages to Stackdriver Monitoring API.").
 		StringVar(&cfg.StoreInFilesDirectory)
 
+	a.Flag("stackdriver.kubernetes-events", "If true, emit Kubernetes Events on the sidecar's own Pod for fatal export conditions such as permission errors, metric descriptor conflicts, and persistent quota exhaustion. Requires in-cluster credentials and the POD_NAME and NAMESPACE_NAME downward API environment variables.").
+		Default("false").BoolVar(&cfg.KubernetesEvents)
+
+	a.Flag("sink", "Destination for converted samples. 'monitoring' writes to the Stackdriver Monitoring API, 'bigquery' streams rows into the BigQuery table given by --sink.bigquery-table, 'pubsub' publishes serialized TimeSeries protos to the Pub/Sub topic given by --sink.pubsub-topic.").
+		Default("monitoring").EnumVar(&cfg.Sink, "monitoring", "bigquery", "pubsub")
+
+	a.Flag("sink.bigquery-table", "BigQuery destination table in 'project.dataset.table' form. Required with --sink=bigquery.").
+		StringVar(&cfg.BigQueryTable)
+
+	a.Flag("sink.pubsub-topic", "Pub/Sub destination topic in 'projects/<project>/topics/<topic>' form. Required with --sink=pubsub.").
+		StringVar(&cfg.PubSubTopic)
+
+	a.Flag("aggregations.state-directory", "If set, periodically persist aggregated counter values to this directory and restore them on startup, so that restarts do not reset the exported counters to zero.").
+		StringVar(&cfg.AggregationsStateDir)
+
 	a.Flag("prometheus.wal-directory", "Directory from where to read the Prometheus TSDB WAL.").
 		Default("data/wal").StringVar(&cfg.WALDirectory)
 
+	a.Flag("prometheus.federate-interval", "Scrape the Prometheus /federate endpoint at this interval instead of tailing the WAL, for environments where the WAL is not accessible. 0 disables federation mode.").
+		Default("0").DurationVar(&cfg.FederateInterval)
+
 	a.Flag("prometheus.api-address", "Address to listen on for UI, API, and telemetry.").
 		Default("http://127.0.0.1:9090/").URLVar(&cfg.PrometheusURL)
 
+	a.Flag("prometheus.targets-api-address", "Address of the Prometheus server to query for targets. May be repeated for failover. Defaults to --prometheus.api-address.").
+		URLListVar(&cfg.TargetsAPIAddresses)
+
+	a.Flag("prometheus.metadata-api-address", "Address of the Prometheus server to query for metric metadata. May be repeated for failover. Defaults to --prometheus.api-address.").
+		URLListVar(&cfg.MetadataAPIAddresses)
+
+	a.Flag("prometheus.metadata-retry-interval", "How long a failed metadata lookup for a metric is cached before it is retried. Lower values let newly added metrics start exporting sooner at the cost of more lookups.").
+		Default("30s").DurationVar(&cfg.MetadataRetryInterval)
+
+	a.Flag("prometheus.targets-source", "Name of a target source registered with retrieval.RegisterTargetGetter to use instead of the Prometheus targets API.").
+		StringVar(&cfg.TargetsSource)
+
+	a.Flag("prometheus.metadata-source", "Name of a metadata source registered with retrieval.RegisterMetadataGetter to use instead of the Prometheus metadata API.").
+		StringVar(&cfg.MetadataSource)
+
+	a.Flag("export.scrape-health", "If true, export the synthetic up and scrape_* series even if they do not match any --include filter.").
+		Default("false").BoolVar(&cfg.ExportScrapeHealth)
+
+	a.Flag("export.job-availability-metric", "If set, export the per-job average of the up series as an aggregated gauge under this metric name, giving a simple availability ratio per scrape job.").
+		StringVar(&cfg.JobAvailabilityMetric)
+
+	a.Flag("prometheus.max-backlog-age", "If non-zero, skip WAL samples older than this duration and catch up to the WAL head, discarding the backlog.").
+		Default("0").DurationVar(&cfg.MaxBacklogAge)
+
+	a.Flag("startup.max-backfill-age", "If non-zero, skip WAL samples older than this duration when replaying existing data on startup.").
+		Default("0").DurationVar(&cfg.MaxBackfillAge)
+
+	a.Flag("prometheus.config-file", "Path of the Prometheus configuration file. If set, external labels and scrape job names are read directly from the file at startup instead of relying only on the Prometheus runtime APIs.").
+		StringVar(&cfg.PromConfigFilename)
+
+	a.Flag("prometheus.series-cache-gc-interval", "Interval at which the series cache drops entries that are no longer in the WAL.").
+		Default("1m").DurationVar(&cfg.SeriesCacheGCInterval)
+
+	a.Flag("prometheus.inactive-series-ttl", "If non-zero, drop cached series that have not received a sample for this duration, bounding cache growth on churny workloads.").
+		Default("0").DurationVar(&cfg.InactiveSeriesTTL)
+
+	a.Flag("debug.dropped-series-limit", "If non-zero, expose up to this many recently dropped series and their drop reasons on the sidecar's /metrics endpoint for debugging filter configurations.").
+		Default("0").IntVar(&cfg.DroppedSeriesLimit)
+
+	a.Flag("startup.replay-rate", "Maximum number of samples per second to send while the initial WAL replay is in progress. 0 disables the limit.").
+		Default("0").Float64Var(&cfg.ReplayRate)
+
+	a.Flag("export.self-job", "Name of the Prometheus job that scrapes the sidecar itself. Series of this job are never exported to avoid recursive growth of internal metrics. Set to empty to disable.").
+		Default("stackdriver-prometheus-sidecar").StringVar(&cfg.SelfJobName)
+
+	a.Flag("export.label-allowlist", "If set, keep only this metric label across all metrics and collapse the resulting duplicate series. May be repeated.").
+		StringsVar(&cfg.LabelAllowlist)
+
+	a.Flag("export.gauge-dedup-window", "If non-zero, suppress gauge points whose value is unchanged since the last exported point of the series, for at most this long.").
+		Default("0").DurationVar(&cfg.GaugeDedupWindow)
+
+	a.Flag("export.audit-log-file", "If set, write a per-minute digest of exported series counts and value checksums per metric to this file. 'stderr' logs the digests instead.").
+		StringVar(&cfg.AuditLogFilename)
+
+	a.Flag("stackdriver.dead-letter-file", "If set, append time series rejected with a non-retriable error to this file as JSON lines, along with the rejection error, for offline analysis and replay.").
+		StringVar(&cfg.DeadLetterFilename)
+
+	a.Flag("prometheus.snapshot-file", "If set, write the targets and metadata caches to this file on shutdown and load them on startup, so a restarting sidecar can resolve series before the Prometheus API is reachable.").
+		StringVar(&cfg.SnapshotFilename)
+
+	a.Flag("prometheus.handover", "If true, write a handover file with the final WAL position and counter reset state on shutdown and consume one on startup, so a replacement instance continues without gaps or duplicate counter resets.").
+		Default("false").BoolVar(&cfg.Handover)
+
+	a.Flag("stackdriver.interceptor-plugin", "Go plugin exporting a write interceptor that can inspect and mutate each time series before it is sent.").
+		StringVar(&cfg.InterceptorPlugin)
+
+	a.Flag("stackdriver.enforce-descriptor-schema", "If true, fetch the existing metric descriptor on first sight of each metric and drop series labels the descriptor does not define, instead of failing the write. Intended for projects with curated descriptors.").
+		Default("false").BoolVar(&cfg.EnforceSchema)
+
+	a.Flag("stackdriver.metadata-api.max-rate", "Maximum number of metric descriptor calls per second, enforced on a connection separate from the write path.").
+		Default("10").Float64Var(&cfg.MetadataAPIMaxRate)
+
+	a.Flag("stackdriver.metadata-api.max-retries", "Maximum number of attempts per metric descriptor call for retriable errors. 0 retries without limit.").
+		Default("3").IntVar(&cfg.MetadataAPIMaxRetries)
+
+	a.Flag("stackdriver.chaos.error-rate", "Fraction of write requests to fail with an artificial error before they reach the backend, between 0 and 1. For validating retry and shedding behavior in staging; never enable in production.").
+		Default("0").Float64Var(&cfg.ChaosErrorRate)
+
+	a.Flag("stackdriver.chaos.error-code", "gRPC status code of artificially injected write errors.").
+		Default("14").IntVar(&cfg.ChaosErrorCode)
+
+	a.Flag("stackdriver.chaos.latency", "Base artificial delay added to every write request.").
+		Default("0").DurationVar(&cfg.ChaosLatency)
+
+	a.Flag("stackdriver.chaos.latency-jitter", "Upper bound of an additional uniformly random artificial delay added to every write request.").
+		Default("0").DurationVar(&cfg.ChaosLatencyJitter)
+
+	a.Flag("stackdriver.metric-label", "Static metric label as key=value attached to every exported series, e.g. environment=prod. May be repeated and overrides labels of the same name from the configuration file.").
+		PlaceHolder("key=value").StringsVar(&cfg.MetricLabels)
+
+	a.Flag("stackdriver.lifecycle-metric", "If true, write a synthetic metric point on startup and shutdown, labeled with the sidecar version and a hash of its configuration.").
+		Default("false").BoolVar(&cfg.LifecycleMetric)
+
+	a.Flag("stackdriver.tracer-interval", "If non-zero, periodically write a known tracer series and read it back through the Monitoring API at this interval, exporting the measured ingestion latency and probe success rate as sidecar metrics. 0 disables the tracer.").
+		Default("0").DurationVar(&cfg.TracerInterval)
+
+	a.Flag("web.status-window", "Size of the sliding window over which the /api/v1/status endpoint aggregates export statistics.").
+		Default("10m").DurationVar(&cfg.StatusWindow)
+
+	a.Flag("memory.budget-bytes", "If non-zero, bound the estimated memory held across shard queues by limiting queue capacity and shard count.").
+		Default("0").Int64Var(&cfg.MemoryBudgetBytes)
+
 	a.Flag("monitoring.backend", "Monitoring backend(s) for internal metrics").Default("prometheus").
 		EnumsVar(&cfg.MonitoringBackends, "prometheus", "stackdriver")
 
@@ -252,15 +681,31 @@ func main() {
 	a.Flag("web.enable-statusz", "If true, then enables a /statusz endpoint on the web server with diagnostic information.").
 		Default("true").BoolVar(&cfg.EnableStatusz)
 
-	a.Flag("include", "PromQL metric and label matcher which must pass for a series to be forwarded to Stackdriver. If repeated, the series must pass any of the filter sets to be forwarded.").
+	a.Flag("include", "PromQL metric and label matcher which must pass for a series to be forwarded to Stackdriver. If repeated, the series must pass any of the filter sets to be forwarded. Matchers on double-underscore labels other than __name__, e.g. __meta_kubernetes_namespace, are resolved against the labels of the series' target, including its discovered labels.").
 		StringsVar(&cfg.Filtersets)
 
 	a.Flag("filter", "PromQL-style matcher for a single label which must pass for a series to be forwarded to Stackdriver. If repeated, the series must pass all filters to be forwarded. Deprecated, please use --include instead.").
 		StringsVar(&cfg.Filters)
 
+	a.Flag("include.max-sample-age", "If non-zero, drop samples older than this duration instead of forwarding them to Stackdriver. The Monitoring API rejects points older than 24 hours.").
+		Default("0").DurationVar(&cfg.MaxSampleAge)
+
+	a.Flag("stackdriver.min-cumulative-interval", "If non-zero, coalesce cumulative points whose interval is narrower than this duration into the next point instead of sending them. The Monitoring API rejects cumulative points below its minimum interval width.").
+		Default("0").DurationVar(&cfg.MinCumulativeInterval)
+
 	promlogflag.AddFlags(a, &cfg.PromlogConfig)
 
-	_, err := a.Parse(os.Args[1:])
+	// Every flag can also be set through an environment variable, e.g.
+	// SIDECAR_STACKDRIVER_PROJECT_ID for --stackdriver.project-id. Values
+	// passed on the command line take precedence over the environment, which
+	// in turn takes precedence over flag defaults and the config file.
+	for _, flag := range a.Model().Flags {
+		if flag.Envar == "" {
+			a.GetFlag(flag.Name).Envar(flagEnvarName(flag.Name))
+		}
+	}
+
+	command, err := a.Parse(os.Args[1:])
 	if err != nil {
 		fmt.Fprintln(os.Stderr, errors.Wrapf(err, "Error parsing commandline arguments"))
 		a.Usage(os.Args[1:])
@@ -269,15 +714,32 @@ func main() {
 
 	logger := promlog.New(&cfg.PromlogConfig)
 	if cfg.ConfigFilename != "" {
-		cfg.MetricRenames, cfg.StaticMetadata, cfg.Aggregations, err = parseConfigFile(cfg.ConfigFilename)
+		parsed, err := parseConfigFile(cfg.ConfigFilename)
 		if err != nil {
 			msg := fmt.Sprintf("Parse config file %s", cfg.ConfigFilename)
 			level.Error(logger).Log("msg", msg, "err", err)
 			os.Exit(2)
 		}
-
-		// Enable Stackdriver monitoring backend if counter aggregator configuration is present.
-		if len(cfg.Aggregations) > 0 {
+		cfg.MetricRenames = parsed.metricRenames
+		cfg.StaticMetadata = parsed.staticMetadata
+		cfg.Aggregations = parsed.aggregations
+		cfg.GaugeAggregations = parsed.gaugeAggregations
+		cfg.JobPrefixes = parsed.jobPrefixes
+		cfg.NamespaceProjects = parsed.namespaceProjects
+		cfg.BucketFilters = parsed.bucketFilters
+		cfg.LabelJoins = parsed.labelJoins
+		cfg.QueryJoins = parsed.queryJoins
+		cfg.LabelSplits = parsed.labelSplits
+		cfg.DeltaCounters = parsed.deltaCounters
+		cfg.ValueTransforms = parsed.valueTransforms
+		cfg.GaugeIntervals = parsed.gaugeIntervals
+		cfg.ExternalLabels = parsed.externalLabels
+		cfg.StaticMetricLabels = parsed.staticLabels
+		cfg.QoSClasses = parsed.qosClasses
+		cfg.HAMerges = parsed.haMerges
+
+		// Enable Stackdriver monitoring backend if aggregator configuration is present.
+		if len(cfg.Aggregations) > 0 || len(cfg.GaugeAggregations) > 0 {
 			sdEnabled := false
 			for _, backend := range cfg.MonitoringBackends {
 				if backend == "stackdriver" {
@@ -290,6 +752,34 @@ func main() {
 		}
 	}
 
+	// Merge static metric labels given as flags over those from the
+	// configuration file.
+	for _, pair := range cfg.MetricLabels {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			level.Error(logger).Log("msg", "Invalid metric label, expected key=value", "flag", pair)
+			os.Exit(2)
+		}
+		if cfg.StaticMetricLabels == nil {
+			cfg.StaticMetricLabels = map[string]string{}
+		}
+		cfg.StaticMetricLabels[parts[0]] = parts[1]
+	}
+
+	// Extra gRPC metadata, e.g. routing headers, attached to every
+	// Monitoring API call.
+	for _, pair := range cfg.MetadataHeaders {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			level.Error(logger).Log("msg", "Invalid gRPC metadata, expected key=value", "flag", pair)
+			os.Exit(2)
+		}
+		if cfg.GRPCMetadata == nil {
+			cfg.GRPCMetadata = map[string]string{}
+		}
+		cfg.GRPCMetadata[parts[0]] = parts[1]
+	}
+
 	level.Info(logger).Log("msg", "Starting Stackdriver Prometheus sidecar", "version", version.Info())
 	level.Info(logger).Log("build_context", version.BuildContext())
 	level.Info(logger).Log("host_details", Uname())
@@ -366,6 +856,55 @@ func main() {
 		retrieval.GenericNamespaceLabel:      cfg.GenericLabels.Namespace,
 	}
 	fillMetadata(&staticLabels)
+	// When the generic resource labels weren't given explicitly, probe the
+	// cloud provider metadata services for defaults so running outside GKE
+	// doesn't require extra flags.
+	if cfg.ResourceAutodetect && staticLabels[retrieval.GenericLocationLabel] == "" {
+		if r := detectResource(); r != nil {
+			level.Info(logger).Log("msg", "Detected runtime environment", "platform", r.platform, "location", r.location)
+			staticLabels[retrieval.GenericLocationLabel] = r.location
+			if staticLabels[retrieval.ProjectIDLabel] == "" && r.projectID != "" {
+				staticLabels[retrieval.ProjectIDLabel] = r.projectID
+			}
+		}
+	}
+	// Anthos and other on-prem clusters have no GCE metadata server to supply
+	// the Kubernetes location and cluster name. Fall back to the generic
+	// resource overrides so hybrid fleets still get complete k8s_* and
+	// aws_ec2_instance monitored resources.
+	if staticLabels[retrieval.KubernetesLocationLabel] == "" {
+		staticLabels[retrieval.KubernetesLocationLabel] = cfg.GenericLabels.Location
+	}
+	if staticLabels[retrieval.KubernetesClusterNameLabel] == "" {
+		staticLabels[retrieval.KubernetesClusterNameLabel] = cfg.GenericLabels.Namespace
+	}
+	// Read external labels and scrape job names directly from the Prometheus
+	// configuration file if one was provided. The runtime APIs remain
+	// authoritative once Prometheus is up; the file makes the external labels
+	// available before the first API call succeeds and allows validating the
+	// job configuration offline.
+	if cfg.PromConfigFilename != "" {
+		externalLabels, jobs, err := readPrometheusConfig(cfg.PromConfigFilename)
+		if err != nil {
+			level.Error(logger).Log("msg", "Reading Prometheus configuration file failed", "err", err)
+			os.Exit(2)
+		}
+		for _, l := range externalLabels {
+			for _, target := range externalLabelTargets[l.Name] {
+				if staticLabels[target] == "" {
+					staticLabels[target] = l.Value
+				}
+			}
+		}
+		if cfg.SelfJobName != "" && !jobs[cfg.SelfJobName] {
+			level.Warn(logger).Log("msg", "The self job is not present in the Prometheus configuration; the sidecar's own metrics are not excluded from export", "job", cfg.SelfJobName)
+		}
+		for job := range cfg.JobPrefixes {
+			if !jobs[job] {
+				level.Warn(logger).Log("msg", "Metric prefix configured for a job that is not present in the Prometheus configuration", "job", job)
+			}
+		}
+	}
 	for k, v := range staticLabels {
 		if v == "" {
 			delete(staticLabels, k)
@@ -379,7 +918,13 @@ func main() {
 	}
 
 	cfg.ProjectIDResource = fmt.Sprintf("projects/%v", *projectID)
+	// The primary API address is used for the connection parameters (scheme,
+	// auth); any further addresses only add dial targets below.
+	cfg.StackdriverAddress = cfg.StackdriverAddresses[0]
 	if cfg.UseRestrictedIPs {
+		if len(cfg.StackdriverAddresses) > 1 {
+			level.Warn(logger).Log("msg", "--stackdriver.use-restricted-ips overrides additional --stackdriver.api-address endpoints")
+		}
 		// manual.GenerateAndRegisterManualResolver generates a Resolver and a random scheme.
 		// It also registers the resolver. rb.InitialAddrs adds the addresses we are using
 		// to resolve GCP API calls to the resolver.
@@ -393,23 +938,101 @@ func main() {
 				{Addr: "199.36.153.7:443"},
 			},
 		})
+	} else if len(cfg.StackdriverAddresses) > 1 {
+		// The round-robin balancer of the client spreads requests across all
+		// endpoints and keeps sending to the healthy ones if some degrade.
+		cfg.manualResolver, _ = manual.GenerateAndRegisterManualResolver()
+		var addresses []resolver.Address
+		for _, u := range cfg.StackdriverAddresses {
+			addresses = append(addresses, resolver.Address{Addr: apiAddress(u)})
+		}
+		cfg.manualResolver.InitialState(resolver.State{Addresses: addresses})
 	}
-	targetsURL, err := cfg.PrometheusURL.Parse(targets.DefaultAPIEndpoint)
-	if err != nil {
-		panic(err)
+	var targetGetter retrieval.TargetGetter
+	var targetCaches []*targets.Cache
+	if cfg.TargetsSource != "" {
+		targetGetter, err = retrieval.NewRegisteredTargetGetter(cfg.TargetsSource, log.With(logger, "component", "targets"))
+		if err != nil {
+			level.Error(logger).Log("msg", "Creating target source failed", "err", err)
+			os.Exit(2)
+		}
+	} else {
+		targetsAddresses := cfg.TargetsAPIAddresses
+		if len(targetsAddresses) == 0 {
+			targetsAddresses = []*url.URL{cfg.PrometheusURL}
+		}
+		for _, addr := range targetsAddresses {
+			targetsURL, err := addr.Parse(targets.DefaultAPIEndpoint)
+			if err != nil {
+				panic(err)
+			}
+			targetCaches = append(targetCaches, targets.NewCache(logger, httpClient, targetsURL))
+		}
+		targetGetter = targetCaches[0]
+		if len(targetCaches) > 1 {
+			getters := make([]retrieval.TargetGetter, 0, len(targetCaches))
+			for _, c := range targetCaches {
+				getters = append(getters, c)
+			}
+			targetGetter = &failoverTargetGetter{logger: logger, getters: getters}
+		}
 	}
-	targetCache := targets.NewCache(logger, httpClient, targetsURL)
 
-	metadataURL, err := cfg.PrometheusURL.Parse(metadata.DefaultEndpointPath)
-	if err != nil {
-		panic(err)
+	var metadataGetter retrieval.MetadataGetter
+	var metadataCaches []*metadata.Cache
+	if cfg.MetadataSource != "" {
+		metadataGetter, err = retrieval.NewRegisteredMetadataGetter(cfg.MetadataSource, log.With(logger, "component", "metadata"))
+		if err != nil {
+			level.Error(logger).Log("msg", "Creating metadata source failed", "err", err)
+			os.Exit(2)
+		}
+	} else {
+		metadataAddresses := cfg.MetadataAPIAddresses
+		if len(metadataAddresses) == 0 {
+			metadataAddresses = []*url.URL{cfg.PrometheusURL}
+		}
+		for _, addr := range metadataAddresses {
+			metadataURL, err := addr.Parse(metadata.DefaultEndpointPath)
+			if err != nil {
+				panic(err)
+			}
+			metadataCaches = append(metadataCaches, metadata.NewCache(httpClient, metadataURL, cfg.StaticMetadata, cfg.MetadataRetryInterval))
+		}
+		metadataGetter = metadataCaches[0]
+		if len(metadataCaches) > 1 {
+			getters := make([]retrieval.MetadataGetter, 0, len(metadataCaches))
+			for _, c := range metadataCaches {
+				getters = append(getters, c)
+			}
+			metadataGetter = &failoverMetadataGetter{logger: logger, getters: getters}
+		}
 	}
-	metadataCache := metadata.NewCache(httpClient, metadataURL, cfg.StaticMetadata)
 
-	tailer, err := tail.Tail(ctx, cfg.WALDirectory)
-	if err != nil {
-		level.Error(logger).Log("msg", "Tailing WAL failed", "err", err)
-		os.Exit(1)
+	var externalLabelsCache *retrieval.ExternalLabelsCache
+	if len(cfg.ExternalLabels) > 0 {
+		statusURL, err := cfg.PrometheusURL.Parse(retrieval.StatusConfigEndpoint)
+		if err != nil {
+			panic(err)
+		}
+		externalLabelsCache = retrieval.NewExternalLabelsCache(
+			log.With(logger, "component", "external_labels"), httpClient, statusURL, time.Minute)
+		targetGetter = retrieval.TargetsWithExternalLabels(targetGetter, externalLabelsCache, cfg.ExternalLabels)
+	}
+
+	if cfg.SnapshotFilename != "" {
+		if err := loadCacheSnapshot(cfg.SnapshotFilename, targetCaches, metadataCaches); err != nil {
+			level.Warn(logger).Log("msg", "Loading cache snapshot failed", "err", err)
+		}
+	}
+
+	// In federation mode there is no WAL to tail.
+	var tailer *tail.Tailer
+	if cfg.FederateInterval == 0 {
+		tailer, err = tail.Tail(ctx, cfg.WALDirectory)
+		if err != nil {
+			level.Error(logger).Log("msg", "Tailing WAL failed", "err", err)
+			os.Exit(1)
+		}
 	}
 	// TODO(jkohen): Remove once we have proper translation of all metric
 	// types. Currently Stackdriver fails the entire request if you attempt
@@ -422,10 +1045,87 @@ func main() {
 	// Testing with different latencies and shard numbers have shown that 3x of the batch size
 	// works well.
 	config.DefaultQueueConfig.Capacity = 3 * stackdriver.MaxTimeseriesesPerRequest
+	config.DefaultQueueConfig.MinBackoff = model.Duration(cfg.APIMinBackoff)
+	config.DefaultQueueConfig.MaxBackoff = model.Duration(cfg.APIMaxBackoff)
+
+	retryableCodes, err := parseRetryStatuses(cfg.APIRetryStatuses)
+	if err != nil {
+		level.Error(logger).Log("msg", "Invalid retry status", "err", err)
+		os.Exit(2)
+	}
+
+	if cfg.MemoryBudgetBytes > 0 {
+		// Bound the total estimated bytes across shard queues. Half the budget
+		// is reserved for queued samples; the remainder covers the series cache
+		// and transient allocations on the write path.
+		perShardBytes := int64(config.DefaultQueueConfig.Capacity) * stackdriver.ApproxTimeSeriesBytes
+		maxShards := int(cfg.MemoryBudgetBytes / 2 / perShardBytes)
+		if maxShards < 1 {
+			maxShards = 1
+		}
+		if maxShards < config.DefaultQueueConfig.MaxShards {
+			config.DefaultQueueConfig.MaxShards = maxShards
+		}
+		level.Info(logger).Log("msg", "Applying memory budget",
+			"budget_bytes", cfg.MemoryBudgetBytes, "max_shards", config.DefaultQueueConfig.MaxShards)
+	}
+
+	var debugDumper *stackdriver.DebugDumper
+	if cfg.DebugDumpDirectory != "" {
+		var err error
+		debugDumper, err = stackdriver.NewDebugDumper(
+			log.With(logger, "component", "debug_dump"),
+			cfg.DebugDumpDirectory, cfg.DebugDumpMaxBytes, cfg.DebugDumpRedact)
+		if err != nil {
+			level.Error(logger).Log("msg", "Creating debug dumper failed", "err", err)
+			os.Exit(1)
+		}
+		defer debugDumper.Close()
+	}
 
 	var scf stackdriver.StorageClientFactory
 
-	if len(cfg.StoreInFilesDirectory) > 0 {
+	errorSummary := stackdriver.NewErrorSummary(log.With(logger, "component", "storage"), time.Minute)
+	defer errorSummary.Close()
+
+	var eventReporter *stackdriver.EventReporter
+	if cfg.KubernetesEvents {
+		var err error
+		eventReporter, err = stackdriver.NewEventReporter(log.With(logger, "component", "events"), 15*time.Minute)
+		if err != nil {
+			level.Error(logger).Log("msg", "Creating Kubernetes event reporter failed", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	if cfg.Sink == "bigquery" {
+		parts := strings.SplitN(cfg.BigQueryTable, ".", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			level.Error(logger).Log(
+				"msg", "--sink=bigquery requires --sink.bigquery-table in 'project.dataset.table' form",
+				"table", cfg.BigQueryTable)
+			os.Exit(2)
+		}
+		scf = &bigQueryClientFactory{
+			logger:  log.With(logger, "component", "storage"),
+			project: parts[0],
+			dataset: parts[1],
+			table:   parts[2],
+			timeout: cfg.APIAttemptDeadline,
+		}
+	} else if cfg.Sink == "pubsub" {
+		if !pubSubTopicPattern.MatchString(cfg.PubSubTopic) {
+			level.Error(logger).Log(
+				"msg", "--sink=pubsub requires --sink.pubsub-topic in 'projects/<project>/topics/<topic>' form",
+				"topic", cfg.PubSubTopic)
+			os.Exit(2)
+		}
+		scf = &pubSubClientFactory{
+			logger:  log.With(logger, "component", "storage"),
+			topic:   cfg.PubSubTopic,
+			timeout: cfg.APIAttemptDeadline,
+		}
+	} else if len(cfg.StoreInFilesDirectory) > 0 {
 		err := os.MkdirAll(cfg.StoreInFilesDirectory, 0700)
 		if err != nil {
 			level.Error(logger).Log(
@@ -438,83 +1138,692 @@ func main() {
 			logger: log.With(logger, "component", "storage"),
 		}
 	} else {
+		// Namespace routes are explicit configuration, so their destination
+		// projects are always permitted.
+		projectAllowlist := cfg.ProjectAllowlist
+		if len(projectAllowlist) > 0 {
+			for _, project := range cfg.NamespaceProjects {
+				projectAllowlist = append(projectAllowlist, project)
+			}
+		}
 		scf = &stackdriverClientFactory{
 			logger:            log.With(logger, "component", "storage"),
 			projectIDResource: cfg.ProjectIDResource,
 			url:               cfg.StackdriverAddress,
-			timeout:           10 * time.Second,
+			timeout:           cfg.APIAttemptDeadline,
 			manualResolver:    cfg.manualResolver,
+			retryableCodes:    retryableCodes,
+			labelMismatch:     cfg.LabelMismatchAction,
+			hedgingDelay:      cfg.HedgingDelay,
+			disableAuth:       cfg.APIDisableAuth,
+			tls:               cfg.APITLS,
+			debugDumper:       debugDumper,
+			errorSummary:      errorSummary,
+			eventReporter:     eventReporter,
+			projectAllowlist:  projectAllowlist,
+			quotaProject:      cfg.QuotaProject,
+			metadata:          cfg.GRPCMetadata,
 		}
 	}
 
-	queueManager, err := stackdriver.NewQueueManager(
-		log.With(logger, "component", "queue_manager"),
-		config.DefaultQueueConfig,
-		scf,
-		tailer,
-	)
-	if err != nil {
-		level.Error(logger).Log("msg", "Creating queue manager failed", "err", err)
-		os.Exit(1)
+	if cfg.ChaosErrorRate < 0 || cfg.ChaosErrorRate > 1 {
+		level.Error(logger).Log("msg", "--stackdriver.chaos.error-rate must be between 0 and 1", "rate", cfg.ChaosErrorRate)
+		os.Exit(2)
 	}
-
-	counterAggregator, err := retrieval.NewCounterAggregator(
-		log.With(logger, "component", "counter_aggregator"),
-		&cfg.Aggregations)
-	if err != nil {
-		level.Error(logger).Log("msg", "Creating counter aggregator failed", "err", err)
-		os.Exit(1)
+	if cfg.ChaosErrorRate > 0 || cfg.ChaosLatency > 0 || cfg.ChaosLatencyJitter > 0 {
+		level.Warn(logger).Log("msg", "Artificial write path fault injection is enabled; never use this in production",
+			"error_rate", cfg.ChaosErrorRate, "latency", cfg.ChaosLatency, "latency_jitter", cfg.ChaosLatencyJitter)
+		scf = &chaosClientFactory{scf, log.With(logger, "component", "chaos"), stackdriver.ChaosConfig{
+			ErrorRate:     cfg.ChaosErrorRate,
+			ErrorCode:     codes.Code(cfg.ChaosErrorCode),
+			Latency:       cfg.ChaosLatency,
+			LatencyJitter: cfg.ChaosLatencyJitter,
+		}}
 	}
-	defer counterAggregator.Close()
 
-	prometheusReader := retrieval.NewPrometheusReader(
-		log.With(logger, "component", "Prometheus reader"),
-		cfg.WALDirectory,
-		tailer,
-		filtersets,
-		cfg.MetricRenames,
-		retrieval.TargetsWithDiscoveredLabels(targetCache, labels.FromMap(staticLabels)),
-		metadataCache,
-		queueManager,
-		cfg.MetricsPrefix,
-		cfg.UseGKEResource,
-		counterAggregator,
-	)
-
-	// Exclude kingpin default flags to expose only Prometheus ones.
-	boilerplateFlags := kingpin.New("", "").Version("")
-	for _, f := range a.Model().Flags {
-		if boilerplateFlags.GetFlag(f.Name) != nil {
-			continue
+	if cfg.CheckPermissions || command == checkCommand.FullCommand() {
+		client := stackdriver.NewClient(&stackdriver.ClientConfig{
+			Logger:       log.With(logger, "component", "permission_check"),
+			ProjectID:    cfg.ProjectIDResource,
+			URL:          cfg.StackdriverAddress,
+			Timeout:      time.Minute,
+			Resolver:     cfg.manualResolver,
+			DisableAuth:  cfg.APIDisableAuth,
+			TLS:          cfg.APITLS,
+			QuotaProject: cfg.QuotaProject,
+			Metadata:     cfg.GRPCMetadata,
+		})
+		cctx, ccancel := context.WithTimeout(ctx, time.Minute)
+		err := client.CheckPermissions(cctx)
+		ccancel()
+		client.Close()
+		if err != nil {
+			level.Error(logger).Log("msg", "Stackdriver permission check failed", "err", err)
+			os.Exit(1)
+		}
+		level.Info(logger).Log("msg", "Stackdriver permission check succeeded", "project", cfg.ProjectIDResource)
+		if command == checkCommand.FullCommand() {
+			os.Exit(0)
 		}
-
 	}
 
-	// Monitor outgoing connections on default transport with conntrack.
-	http.DefaultTransport.(*http.Transport).DialContext = conntrack.NewDialContextFunc(
-		conntrack.DialWithTracing(),
-	)
-
-	http.Handle("/metrics", promhttp.Handler())
-
-	if cfg.EnableStatusz {
-		http.Handle("/statusz", &statuszHandler{
-			logger:    logger,
-			projectID: *projectID,
-			cfg:       &cfg,
+	if command == migrateCommand.FullCommand() {
+		client := stackdriver.NewClient(&stackdriver.ClientConfig{
+			Logger:       log.With(logger, "component", "migrate"),
+			ProjectID:    cfg.ProjectIDResource,
+			URL:          cfg.StackdriverAddress,
+			Timeout:      time.Minute,
+			Resolver:     cfg.manualResolver,
+			DisableAuth:  cfg.APIDisableAuth,
+			TLS:          cfg.APITLS,
+			QuotaProject: cfg.QuotaProject,
+			Metadata:     cfg.GRPCMetadata,
 		})
+		mctx, mcancel := context.WithTimeout(ctx, 5*time.Minute)
+		err := runPrefixMigration(mctx, os.Stdout, client, *migrateOldPrefix, *migrateNewPrefix, *migrateCreate)
+		mcancel()
+		client.Close()
+		if err != nil {
+			level.Error(logger).Log("msg", "Prefix migration failed", "err", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
 	}
 
-	var g group.Group
-	{
-		ctx, cancel := context.WithCancel(context.Background())
-		g.Add(func() error {
-			targetCache.Run(ctx)
-			return nil
-		}, func(error) {
-			cancel()
+	if command == installCommand.FullCommand() {
+		client := stackdriver.NewClient(&stackdriver.ClientConfig{
+			Logger:       log.With(logger, "component", "install"),
+			ProjectID:    cfg.ProjectIDResource,
+			URL:          cfg.StackdriverAddress,
+			Timeout:      time.Minute,
+			Resolver:     cfg.manualResolver,
+			DisableAuth:  cfg.APIDisableAuth,
+			TLS:          cfg.APITLS,
+			QuotaProject: cfg.QuotaProject,
+			Metadata:     cfg.GRPCMetadata,
 		})
-	}
+		prefix := cfg.MetricsPrefix
+		if prefix == "" {
+			prefix = "external.googleapis.com/prometheus"
+		}
+		ictx, icancel := context.WithTimeout(ctx, time.Minute)
+		err := runHealthSetup(ictx, os.Stdout, client, prefix, *installDashboardFile, *installCreate)
+		icancel()
+		client.Close()
+		if err != nil {
+			level.Error(logger).Log("msg", "Installing health monitoring failed", "err", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if command == convertCommand.FullCommand() {
+		staticTargets, err := parseTargetsFile(*convertTargetsFile)
+		if err != nil {
+			level.Error(logger).Log("msg", "Parse targets file", "file", *convertTargetsFile, "err", err)
+			os.Exit(2)
+		}
+		staticMetadata := cfg.StaticMetadata
+		if *convertMetadataFile != "" {
+			parsed, err := parseConfigFile(*convertMetadataFile)
+			if err != nil {
+				level.Error(logger).Log("msg", "Parse metadata file", "file", *convertMetadataFile, "err", err)
+				os.Exit(2)
+			}
+			staticMetadata = parsed.staticMetadata
+		}
+		if err := runConvert(ctx, log.With(logger, "component", "convert"), os.Stdout, staticTargets, staticMetadata, filtersets, &cfg); err != nil {
+			level.Error(logger).Log("msg", "Conversion failed", "err", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if command == benchCommand.FullCommand() {
+		if err := runBench(ctx, log.With(logger, "component", "bench"), os.Stdout, *benchSeries, *benchCycles, *benchChurn, *benchHistogramRatio, &cfg); err != nil {
+			level.Error(logger).Log("msg", "Benchmark failed", "err", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if cfg.DescriptorsFilename != "" {
+		prefix := cfg.MetricsPrefix
+		if prefix == "" {
+			prefix = "external.googleapis.com/prometheus"
+		}
+		descriptors, err := parseDescriptorsFile(cfg.DescriptorsFilename, prefix)
+		if err != nil {
+			level.Error(logger).Log("msg", "Parse descriptors file", "file", cfg.DescriptorsFilename, "err", err)
+			os.Exit(2)
+		}
+		client := stackdriver.NewClient(&stackdriver.ClientConfig{
+			Logger:       log.With(logger, "component", "descriptors"),
+			ProjectID:    cfg.ProjectIDResource,
+			URL:          cfg.StackdriverAddress,
+			Timeout:      time.Minute,
+			Resolver:     cfg.manualResolver,
+			DisableAuth:  cfg.APIDisableAuth,
+			TLS:          cfg.APITLS,
+			QuotaProject: cfg.QuotaProject,
+			Metadata:     cfg.GRPCMetadata,
+		})
+		dctx, dcancel := context.WithTimeout(ctx, time.Minute)
+		err = client.CreateMetricDescriptors(dctx, descriptors)
+		dcancel()
+		client.Close()
+		if err != nil {
+			level.Error(logger).Log("msg", "Creating metric descriptors failed", "err", err)
+			os.Exit(1)
+		}
+		level.Info(logger).Log("msg", "Registered metric descriptors", "count", len(descriptors))
+	}
+
+	var deadLetter stackdriver.DeadLetterSink
+	if cfg.DeadLetterFilename != "" {
+		f, err := os.OpenFile(cfg.DeadLetterFilename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			level.Error(logger).Log("msg", "Opening dead-letter file failed", "err", err)
+			os.Exit(1)
+		}
+		sink := stackdriver.NewFileDeadLetterSink(log.With(logger, "component", "dead_letter"), f)
+		defer sink.Close()
+		deadLetter = sink
+	}
+
+	var interceptor stackdriver.WriteInterceptor
+	if cfg.InterceptorPlugin != "" {
+		interceptor, err = stackdriver.NewPluginInterceptor(cfg.InterceptorPlugin)
+		if err != nil {
+			level.Error(logger).Log("msg", "Loading interceptor plugin failed", "err", err)
+			os.Exit(1)
+		}
+	}
+	// Descriptor lookups and writes go through a dedicated connection with
+	// its own rate limit and retry policy so descriptor churn cannot contend
+	// with point writes.
+	var metadataClient *stackdriver.MetadataClient
+	if cfg.EnforceSchema || cfg.ExportHelpText {
+		client := stackdriver.NewClient(&stackdriver.ClientConfig{
+			Logger:       log.With(logger, "component", "metadata_api"),
+			ProjectID:    cfg.ProjectIDResource,
+			URL:          cfg.StackdriverAddress,
+			Timeout:      time.Minute,
+			Resolver:     cfg.manualResolver,
+			DisableAuth:  cfg.APIDisableAuth,
+			TLS:          cfg.APITLS,
+			QuotaProject: cfg.QuotaProject,
+			Metadata:     cfg.GRPCMetadata,
+		})
+		metadataClient = stackdriver.NewMetadataClient(
+			log.With(logger, "component", "metadata_api"),
+			client, cfg.MetadataAPIMaxRate, cfg.MetadataAPIMaxRetries)
+		defer metadataClient.Close()
+	}
+	if cfg.EnforceSchema {
+		interceptor = stackdriver.NewSchemaEnforcer(
+			log.With(logger, "component", "schema_enforcer"), metadataClient, interceptor)
+	}
+
+	if cfg.LifecycleMetric {
+		prefix := cfg.MetricsPrefix
+		if prefix == "" {
+			prefix = "external.googleapis.com/prometheus"
+		}
+		client := stackdriver.NewClient(&stackdriver.ClientConfig{
+			Logger:       log.With(logger, "component", "lifecycle"),
+			ProjectID:    cfg.ProjectIDResource,
+			URL:          cfg.StackdriverAddress,
+			Timeout:      time.Minute,
+			Resolver:     cfg.manualResolver,
+			DisableAuth:  cfg.APIDisableAuth,
+			TLS:          cfg.APITLS,
+			QuotaProject: cfg.QuotaProject,
+			Metadata:     cfg.GRPCMetadata,
+		})
+		reporter := stackdriver.NewLifecycleReporter(
+			client, cfg.ProjectIDResource, prefix, version.Version, configHash(os.Args[1:], cfg.ConfigFilename))
+		if err := reporter.ReportStartup(); err != nil {
+			level.Warn(logger).Log("msg", "Writing startup event failed", "err", err)
+		}
+		defer func() {
+			if err := reporter.ReportShutdown(); err != nil {
+				level.Warn(logger).Log("msg", "Writing shutdown event failed", "err", err)
+			}
+			client.Close()
+		}()
+	}
+
+	if cfg.TracerInterval > 0 {
+		prefix := cfg.MetricsPrefix
+		if prefix == "" {
+			prefix = "external.googleapis.com/prometheus"
+		}
+		client := stackdriver.NewClient(&stackdriver.ClientConfig{
+			Logger:       log.With(logger, "component", "tracer"),
+			ProjectID:    cfg.ProjectIDResource,
+			URL:          cfg.StackdriverAddress,
+			Timeout:      time.Minute,
+			Resolver:     cfg.manualResolver,
+			DisableAuth:  cfg.APIDisableAuth,
+			TLS:          cfg.APITLS,
+			QuotaProject: cfg.QuotaProject,
+			Metadata:     cfg.GRPCMetadata,
+		})
+		defer client.Close()
+		tracer := stackdriver.NewTracer(
+			log.With(logger, "component", "tracer"),
+			client, cfg.ProjectIDResource, prefix, cfg.TracerInterval)
+		go tracer.Run(ctx)
+	}
+
+	queueManager, err := stackdriver.NewQueueManager(
+		log.With(logger, "component", "queue_manager"),
+		config.DefaultQueueConfig,
+		scf,
+		tailer,
+		cfg.ReplayRate,
+		cfg.APIMaxRetries,
+		deadLetter,
+		interceptor,
+		cfg.NumShards,
+	)
+	if err != nil {
+		level.Error(logger).Log("msg", "Creating queue manager failed", "err", err)
+		os.Exit(1)
+	}
+
+	// Each QoS class gets its own queue manager and thus its own shard pool,
+	// so a flood of samples in one class cannot starve the others. The class
+	// name is appended to the queue name to keep the per-queue metrics apart.
+	queueManagers := []*stackdriver.QueueManager{queueManager}
+	var qosManagers []*stackdriver.QueueManager
+	for _, qc := range cfg.QoSClasses {
+		shards := qc.Shards
+		if shards == 0 {
+			shards = cfg.NumShards
+		}
+		m, err := stackdriver.NewQueueManager(
+			log.With(logger, "component", "queue_manager", "qos", qc.Class.Name),
+			config.DefaultQueueConfig,
+			&namedClientFactory{scf, scf.Name() + "-" + qc.Class.Name},
+			tailer,
+			cfg.ReplayRate,
+			cfg.APIMaxRetries,
+			deadLetter,
+			interceptor,
+			shards,
+		)
+		if err != nil {
+			level.Error(logger).Log("msg", "Creating queue manager failed", "qos", qc.Class.Name, "err", err)
+			os.Exit(1)
+		}
+		queueManagers = append(queueManagers, m)
+		qosManagers = append(qosManagers, m)
+	}
+
+	counterAggregator, err := retrieval.NewCounterAggregator(
+		log.With(logger, "component", "counter_aggregator"),
+		&cfg.Aggregations)
+	if err != nil {
+		level.Error(logger).Log("msg", "Creating counter aggregator failed", "err", err)
+		os.Exit(1)
+	}
+	defer counterAggregator.Close()
+
+	if cfg.AggregationsStateDir != "" {
+		if err := counterAggregator.RestoreState(cfg.AggregationsStateDir); err != nil {
+			level.Warn(logger).Log("msg", "Restoring counter aggregator state failed", "err", err)
+		}
+	}
+
+	var exportAppender retrieval.Appender = queueManager
+	if len(cfg.QoSClasses) > 0 {
+		router := retrieval.NewQoSRouter(queueManager)
+		for i, qc := range cfg.QoSClasses {
+			router.AddClass(qc.Class, qosManagers[i])
+		}
+		exportAppender = router
+	}
+
+	statusReporter := retrieval.NewStatusReporter(cfg.StatusWindow, exportAppender)
+	effectiveConfigHash := configHash(os.Args[1:], cfg.ConfigFilename)
+	configHashMetric.WithLabelValues(effectiveConfigHash).Set(1)
+	statusReporter.SetBuildInfo(version.Version, effectiveConfigHash)
+	http.Handle("/api/v1/status", statusReporter)
+
+	// Runtime-changeable include/exclude rules, e.g. to stop exporting a
+	// noisy metric during an incident without a rollout.
+	dynamicFilters := retrieval.NewDynamicFilters()
+	http.Handle("/api/v1/filters", dynamicFilters)
+
+	// Admin hook to drop cached metadata lookup state, e.g. right after
+	// deploying a new metric. An optional job parameter restricts the flush
+	// to a single scrape job.
+	http.HandleFunc("/api/v1/metadata/flush", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		for _, c := range metadataCaches {
+			c.Flush(req.FormValue("job"))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	var appender retrieval.Appender = statusReporter
+	if cfg.GaugeDedupWindow > 0 {
+		appender = retrieval.NewDedupAppender(cfg.GaugeDedupWindow, appender)
+	}
+	if cfg.AuditLogFilename != "" {
+		var auditWriter io.Writer
+		if cfg.AuditLogFilename != "stderr" {
+			f, err := os.OpenFile(cfg.AuditLogFilename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				level.Error(logger).Log("msg", "Opening audit log file failed", "err", err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			auditWriter = f
+		}
+		auditLog := retrieval.NewAuditLog(log.With(logger, "component", "audit"), auditWriter, appender)
+		defer auditLog.Close()
+		appender = auditLog
+	}
+	if len(cfg.LabelAllowlist) > 0 {
+		appender = retrieval.NewCollapsingAppender(cfg.LabelAllowlist, appender)
+	}
+	if externalLabelsCache != nil {
+		appender = retrieval.NewExternalLabelsAppender(externalLabelsCache, cfg.ExternalLabels, appender)
+	}
+	if len(cfg.StaticMetricLabels) > 0 {
+		appender, err = retrieval.NewStaticLabelsAppender(log.With(logger, "component", "static labels"), cfg.StaticMetricLabels, appender)
+		if err != nil {
+			level.Error(logger).Log("msg", "Invalid static metric labels", "err", err)
+			os.Exit(2)
+		}
+	}
+
+	// A candidate configuration can be run as a shadow conversion pipeline
+	// whose output is only compared against the active one, never written.
+	// The comparator records the active pipeline's output before any label
+	// decoration so that both sides are observed at the same stage.
+	var (
+		shadowComparator *retrieval.ShadowComparator
+		shadowConfig     *parsedConfig
+	)
+	if cfg.ShadowConfigFilename != "" {
+		if cfg.FederateInterval > 0 {
+			level.Error(logger).Log("msg", "A shadow configuration is not supported in federation mode")
+			os.Exit(2)
+		}
+		shadowConfig, err = parseConfigFile(cfg.ShadowConfigFilename)
+		if err != nil {
+			msg := fmt.Sprintf("Parse shadow config file %s", cfg.ShadowConfigFilename)
+			level.Error(logger).Log("msg", msg, "err", err)
+			os.Exit(2)
+		}
+		shadowComparator = retrieval.NewShadowComparator()
+		prometheus.MustRegister(shadowComparator)
+		http.Handle("/api/v1/shadow", shadowComparator)
+		appender = shadowComparator.Active(appender)
+	}
+
+	if cfg.JobAvailabilityMetric != "" {
+		// The availability ratio is the average of the up series per job,
+		// expressed as a regular aggregated gauge.
+		if _, ok := cfg.GaugeAggregations[cfg.JobAvailabilityMetric]; ok {
+			level.Error(logger).Log("msg", "Job availability metric collides with a configured aggregated gauge", "metric", cfg.JobAvailabilityMetric)
+			os.Exit(2)
+		}
+		matchers, err := promql.ParseMetricSelector("up")
+		if err != nil {
+			panic(err)
+		}
+		if cfg.GaugeAggregations == nil {
+			cfg.GaugeAggregations = retrieval.GaugeAggregatorConfig{}
+		}
+		cfg.GaugeAggregations[cfg.JobAvailabilityMetric] = &retrieval.GaugeAggregatorMetricConfig{
+			Matchers: [][]*labels.Matcher{matchers},
+			Help:     "Ratio of up scrape targets per job.",
+			Op:       retrieval.GaugeAggregationAvg,
+			By:       []string{"job"},
+		}
+	}
+
+	gaugeAggregator, err := retrieval.NewGaugeAggregator(
+		log.With(logger, "component", "gauge_aggregator"),
+		&cfg.GaugeAggregations)
+	if err != nil {
+		level.Error(logger).Log("msg", "Creating gauge aggregator failed", "err", err)
+		os.Exit(1)
+	}
+	defer gaugeAggregator.Close()
+
+	var (
+		prometheusReader *retrieval.PrometheusReader
+		federateReader   *retrieval.FederateReader
+	)
+	var deltaConfig *retrieval.DeltaConfig
+	if cfg.UseDeltaCounters || len(cfg.DeltaCounters) > 0 {
+		deltaConfig = &retrieval.DeltaConfig{All: cfg.UseDeltaCounters, Metrics: cfg.DeltaCounters}
+	}
+	var dropTracker *retrieval.DroppedSeriesTracker
+	if cfg.DroppedSeriesLimit > 0 {
+		dropTracker = retrieval.NewDroppedSeriesTracker(cfg.DroppedSeriesLimit)
+		prometheus.MustRegister(dropTracker)
+	}
+	// Per-metric series churn counts identify runaway cardinality sources.
+	churnTracker := retrieval.NewSeriesChurnTracker(0)
+	prometheus.MustRegister(churnTracker)
+	statusReporter.SetChurnTracker(churnTracker)
+	var descriptorUpdater retrieval.DescriptorUpdater
+	var sdDescriptorUpdater *stackdriver.DescriptorUpdater
+	if cfg.ExportHelpText {
+		sdDescriptorUpdater = stackdriver.NewDescriptorUpdater(
+			log.With(logger, "component", "descriptor_updater"), metadataClient)
+		descriptorUpdater = sdDescriptorUpdater
+	}
+	var queryJoiner *retrieval.QueryJoiner
+	if len(cfg.QueryJoins) > 0 {
+		queryJoiner = retrieval.NewQueryJoiner(
+			log.With(logger, "component", "query_join"), cfg.PrometheusURL, cfg.QueryJoins)
+		go queryJoiner.Run(ctx)
+	}
+	if cfg.FederateInterval > 0 {
+		// Reuse the filter configuration as federation match[] selectors.
+		matchers := make([]string, 0, len(cfg.Filters)+len(cfg.Filtersets))
+		for _, f := range cfg.Filters {
+			matchers = append(matchers, fmt.Sprintf("{%s}", f))
+		}
+		matchers = append(matchers, cfg.Filtersets...)
+		federateURL := *cfg.PrometheusURL
+		federateURL.Path = path.Join(federateURL.Path, "/federate")
+		federateReader = retrieval.NewFederateReader(
+			log.With(logger, "component", "federate reader"),
+			&federateURL,
+			cfg.FederateInterval,
+			matchers,
+			filtersets,
+			cfg.MetricRenames,
+			retrieval.TargetsWithDiscoveredLabels(targetGetter, labels.FromMap(staticLabels)),
+			metadataGetter,
+			appender,
+			cfg.MetricsPrefix,
+			cfg.JobPrefixes,
+			cfg.NamespaceProjects,
+			cfg.SelfJobName,
+			cfg.UseGKEResource,
+			cfg.ExportScrapeHealth,
+			counterAggregator,
+			gaugeAggregator,
+			cfg.BucketFilters,
+			cfg.LabelJoins,
+			deltaConfig,
+			descriptorUpdater,
+			cfg.ValueTransforms,
+			cfg.GaugeIntervals,
+			retrieval.EscapingScheme(cfg.MetricNameEscaping),
+			dynamicFilters,
+			cfg.LabelSplits,
+			cfg.HAMerges,
+			cfg.MinCumulativeInterval,
+			churnTracker,
+			retrieval.LongNameAction(cfg.LongMetricNameAction),
+		)
+	} else {
+		prometheusReader = retrieval.NewPrometheusReader(
+			log.With(logger, "component", "Prometheus reader"),
+			cfg.WALDirectory,
+			tailer,
+			filtersets,
+			cfg.MetricRenames,
+			retrieval.TargetsWithDiscoveredLabels(targetGetter, labels.FromMap(staticLabels)),
+			metadataGetter,
+			appender,
+			cfg.MetricsPrefix,
+			cfg.JobPrefixes,
+			cfg.NamespaceProjects,
+			cfg.SelfJobName,
+			cfg.UseGKEResource,
+			cfg.ExportScrapeHealth,
+			counterAggregator,
+			gaugeAggregator,
+			cfg.BucketFilters,
+			cfg.MaxBacklogAge,
+			cfg.MaxBackfillAge,
+			cfg.MaxSampleAge,
+			cfg.LabelJoins,
+			deltaConfig,
+			descriptorUpdater,
+			cfg.SeriesCacheGCInterval,
+			cfg.InactiveSeriesTTL,
+			cfg.ValueTransforms,
+			dropTracker,
+			cfg.GaugeIntervals,
+			retrieval.EscapingScheme(cfg.MetricNameEscaping),
+			dynamicFilters,
+			cfg.LabelSplits,
+			cfg.HAMerges,
+			cfg.MinCumulativeInterval,
+			churnTracker,
+			queryJoiner,
+			retrieval.LongNameAction(cfg.LongMetricNameAction),
+		)
+	}
+
+	var shadowReader *retrieval.PrometheusReader
+	if shadowComparator != nil {
+		shadowTailer, err := tail.Tail(ctx, cfg.WALDirectory)
+		if err != nil {
+			level.Error(logger).Log("msg", "Tailing WAL for the shadow pipeline failed", "err", err)
+			os.Exit(1)
+		}
+		// Aggregated counters and gauges export through their own path and
+		// are therefore left out of the comparison.
+		shadowCounterAggregator, err := retrieval.NewCounterAggregator(
+			log.With(logger, "component", "shadow counter_aggregator"),
+			&retrieval.CounterAggregatorConfig{})
+		if err != nil {
+			panic(err)
+		}
+		defer shadowCounterAggregator.Close()
+		shadowGaugeAggregator, err := retrieval.NewGaugeAggregator(
+			log.With(logger, "component", "shadow gauge_aggregator"),
+			&retrieval.GaugeAggregatorConfig{})
+		if err != nil {
+			panic(err)
+		}
+		defer shadowGaugeAggregator.Close()
+		var shadowDelta *retrieval.DeltaConfig
+		if cfg.UseDeltaCounters || len(shadowConfig.deltaCounters) > 0 {
+			shadowDelta = &retrieval.DeltaConfig{All: cfg.UseDeltaCounters, Metrics: shadowConfig.deltaCounters}
+		}
+		// Target and metadata lookups are shared with the active pipeline;
+		// the comparison covers the conversion configuration.
+		shadowReader = retrieval.NewPrometheusReader(
+			log.With(logger, "component", "shadow reader"),
+			cfg.WALDirectory,
+			shadowTailer,
+			filtersets,
+			shadowConfig.metricRenames,
+			retrieval.TargetsWithDiscoveredLabels(targetGetter, labels.FromMap(staticLabels)),
+			metadataGetter,
+			shadowComparator.Shadow(),
+			cfg.MetricsPrefix,
+			shadowConfig.jobPrefixes,
+			shadowConfig.namespaceProjects,
+			cfg.SelfJobName,
+			cfg.UseGKEResource,
+			cfg.ExportScrapeHealth,
+			shadowCounterAggregator,
+			shadowGaugeAggregator,
+			shadowConfig.bucketFilters,
+			cfg.MaxBacklogAge,
+			cfg.MaxBackfillAge,
+			cfg.MaxSampleAge,
+			shadowConfig.labelJoins,
+			shadowDelta,
+			nil,
+			cfg.SeriesCacheGCInterval,
+			cfg.InactiveSeriesTTL,
+			shadowConfig.valueTransforms,
+			nil,
+			shadowConfig.gaugeIntervals,
+			retrieval.EscapingScheme(cfg.MetricNameEscaping),
+			nil,
+			shadowConfig.labelSplits,
+			shadowConfig.haMerges,
+			cfg.MinCumulativeInterval,
+			nil,
+			// Cached query results are runtime state shared with the active
+			// pipeline, like the target and metadata lookups above.
+			queryJoiner,
+			retrieval.LongNameAction(cfg.LongMetricNameAction),
+		)
+		// The active reader owns progress persistence over the shared WAL.
+		shadowReader.DisableProgressSaving()
+	}
+
+	// Exclude kingpin default flags to expose only Prometheus ones.
+	boilerplateFlags := kingpin.New("", "").Version("")
+	for _, f := range a.Model().Flags {
+		if boilerplateFlags.GetFlag(f.Name) != nil {
+			continue
+		}
+
+	}
+
+	// Monitor outgoing connections on default transport with conntrack.
+	http.DefaultTransport.(*http.Transport).DialContext = conntrack.NewDialContextFunc(
+		conntrack.DialWithTracing(),
+	)
+
+	http.Handle("/metrics", promhttp.Handler())
+
+	if cfg.EnableStatusz {
+		http.Handle("/statusz", &statuszHandler{
+			logger:    logger,
+			projectID: *projectID,
+			cfg:       &cfg,
+			errors:    errorSummary,
+		})
+	}
+
+	var g group.Group
+	// A registered targets source has no caches to run.
+	if len(targetCaches) > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			for _, c := range targetCaches[1:] {
+				go c.Run(ctx)
+			}
+			targetCaches[0].Run(ctx)
+			return nil
+		}, func(error) {
+			cancel()
+		})
+	}
 	{
 		term := make(chan os.Signal)
 		signal.Notify(term, os.Interrupt, syscall.SIGTERM)
@@ -541,11 +1850,28 @@ func main() {
 		// depends on to exit properly.
 		g.Add(
 			func() error {
+				if federateReader != nil {
+					waitForPrometheus(ctx, logger, cfg.PrometheusURL)
+					err := federateReader.Run(ctx)
+					level.Info(logger).Log("msg", "Federate reader stopped")
+					return err
+				}
 				startOffset, err := retrieval.ReadProgressFile(cfg.WALDirectory)
 				if err != nil {
 					level.Warn(logger).Log("msg", "reading progress file failed", "err", err)
 					startOffset = 0
 				}
+				if cfg.Handover {
+					state, err := retrieval.ReadHandoverFile(cfg.WALDirectory)
+					if err != nil {
+						level.Warn(logger).Log("msg", "reading handover file failed", "err", err)
+					} else if state != nil {
+						level.Info(logger).Log("msg", "Resuming from handover file",
+							"offset", state.Offset, "reset_points", len(state.ResetPoints))
+						startOffset = state.Offset
+						prometheusReader.SetHandoverState(state)
+					}
+				}
 				// Write the file again once to ensure we have write permission on startup.
 				if err := retrieval.SaveProgressFile(cfg.WALDirectory, startOffset); err != nil {
 					return err
@@ -559,6 +1885,16 @@ func main() {
 				}
 				err = prometheusReader.Run(ctx, startOffset)
 				level.Info(logger).Log("msg", "Prometheus reader stopped")
+				if cfg.Handover {
+					if state := prometheusReader.HandoverState(); state != nil {
+						if werr := retrieval.WriteHandoverFile(cfg.WALDirectory, state); werr != nil {
+							level.Warn(logger).Log("msg", "writing handover file failed", "err", werr)
+						} else {
+							level.Info(logger).Log("msg", "Wrote handover file",
+								"offset", state.Offset, "reset_points", len(state.ResetPoints))
+						}
+					}
+				}
 				return err
 			},
 			func(err error) {
@@ -569,20 +1905,86 @@ func main() {
 			},
 		)
 	}
+	if shadowReader != nil {
+		// The shadow reader shares the tailer context with the reader above
+		// and starts from the same offset, but never saves progress itself.
+		g.Add(
+			func() error {
+				startOffset, err := retrieval.ReadProgressFile(cfg.WALDirectory)
+				if err != nil {
+					level.Warn(logger).Log("msg", "reading progress file failed", "err", err)
+					startOffset = 0
+				}
+				waitForPrometheus(ctx, logger, cfg.PrometheusURL)
+				select {
+				case <-time.After(time.Minute):
+				case <-ctx.Done():
+					return nil
+				}
+				err = shadowReader.Run(ctx, startOffset)
+				level.Info(logger).Log("msg", "Shadow reader stopped")
+				return err
+			},
+			func(err error) {
+				level.Info(logger).Log("msg", "Stopping shadow reader...")
+				cancel()
+			},
+		)
+	}
+	if sdDescriptorUpdater != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(
+			func() error {
+				sdDescriptorUpdater.Run(ctx)
+				return nil
+			},
+			func(err error) {
+				cancel()
+			},
+		)
+	}
+	if cfg.AggregationsStateDir != "" {
+		cancel := make(chan struct{})
+		g.Add(
+			func() error {
+				tick := time.NewTicker(time.Minute)
+				defer tick.Stop()
+				for {
+					select {
+					case <-cancel:
+						// Save once more on shutdown so no accumulated
+						// deltas are lost.
+						return counterAggregator.SaveState(cfg.AggregationsStateDir)
+					case <-tick.C:
+						if err := counterAggregator.SaveState(cfg.AggregationsStateDir); err != nil {
+							level.Warn(logger).Log("msg", "Saving counter aggregator state failed", "err", err)
+						}
+					}
+				}
+			},
+			func(err error) {
+				close(cancel)
+			},
+		)
+	}
 	{
 		cancel := make(chan struct{})
 		g.Add(
 			func() error {
-				if err := queueManager.Start(); err != nil {
-					return err
+				for _, m := range queueManagers {
+					if err := m.Start(); err != nil {
+						return err
+					}
 				}
 				level.Info(logger).Log("msg", "Stackdriver client started")
 				<-cancel
 				return nil
 			},
 			func(err error) {
-				if err := queueManager.Stop(); err != nil {
-					level.Error(logger).Log("msg", "Error stopping Stackdriver writer", "err", err)
+				for _, m := range queueManagers {
+					if err := m.Stop(); err != nil {
+						level.Error(logger).Log("msg", "Error stopping Stackdriver writer", "err", err)
+					}
 				}
 				close(cancel)
 			},
@@ -614,24 +2016,131 @@ func main() {
 	if err := g.Run(); err != nil {
 		level.Error(logger).Log("err", err)
 	}
+	if cfg.SnapshotFilename != "" {
+		if err := writeCacheSnapshot(cfg.SnapshotFilename, targetCaches, metadataCaches); err != nil {
+			level.Warn(logger).Log("msg", "Writing cache snapshot failed", "err", err)
+		}
+	}
 	level.Info(logger).Log("msg", "See you next time!")
 }
 
+// cacheSnapshot is the on-disk format of the targets and metadata cache
+// snapshot written on shutdown and loaded on startup.
+type cacheSnapshot struct {
+	Targets  json.RawMessage `json:"targets"`
+	Metadata json.RawMessage `json:"metadata"`
+}
+
+// loadCacheSnapshot primes all target and metadata caches from the snapshot
+// file if it exists.
+func loadCacheSnapshot(filename string, targetCaches []*targets.Cache, metadataCaches []*metadata.Cache) error {
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var snapshot cacheSnapshot
+	if err := json.Unmarshal(b, &snapshot); err != nil {
+		return errors.Wrap(err, "decode cache snapshot")
+	}
+	for _, c := range targetCaches {
+		if err := c.LoadSnapshot(snapshot.Targets); err != nil {
+			return err
+		}
+	}
+	for _, c := range metadataCaches {
+		if err := c.LoadSnapshot(snapshot.Metadata); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeCacheSnapshot dumps the contents of the first target and metadata
+// cache to the snapshot file. Registered sources maintain no caches; their
+// part of the snapshot stays empty.
+func writeCacheSnapshot(filename string, targetCaches []*targets.Cache, metadataCaches []*metadata.Cache) error {
+	var snapshot cacheSnapshot
+	var err error
+	if len(targetCaches) > 0 {
+		if snapshot.Targets, err = targetCaches[0].Snapshot(); err != nil {
+			return err
+		}
+	}
+	if len(metadataCaches) > 0 {
+		if snapshot.Metadata, err = metadataCaches[0].Snapshot(); err != nil {
+			return err
+		}
+	}
+	b, err := json.Marshal(&snapshot)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, b, 0644)
+}
+
+// namedClientFactory overrides the queue name of a client factory so that
+// per-class queue managers report their metrics under separate queue labels.
+type namedClientFactory struct {
+	stackdriver.StorageClientFactory
+	name string
+}
+
+func (f *namedClientFactory) Name() string {
+	return f.name
+}
+
+// chaosClientFactory wraps the clients of another factory with artificial
+// fault injection for staging validation of retry and shedding behavior.
+type chaosClientFactory struct {
+	stackdriver.StorageClientFactory
+	logger log.Logger
+	cfg    stackdriver.ChaosConfig
+}
+
+func (f *chaosClientFactory) New() stackdriver.StorageClient {
+	return stackdriver.NewChaosClient(f.logger, f.cfg, f.StorageClientFactory.New())
+}
+
 type stackdriverClientFactory struct {
 	logger            log.Logger
 	projectIDResource string
 	url               *url.URL
 	timeout           time.Duration
 	manualResolver    *manual.Resolver
+	retryableCodes    []codes.Code
+	labelMismatch     string
+	hedgingDelay      time.Duration
+	disableAuth       bool
+	tls               bool
+	debugDumper       *stackdriver.DebugDumper
+	errorSummary      *stackdriver.ErrorSummary
+	eventReporter     *stackdriver.EventReporter
+	projectAllowlist  []string
+	quotaProject      string
+	metadata          map[string]string
 }
 
 func (s *stackdriverClientFactory) New() stackdriver.StorageClient {
 	return stackdriver.NewClient(&stackdriver.ClientConfig{
-		Logger:    s.logger,
-		ProjectID: s.projectIDResource,
-		URL:       s.url,
-		Timeout:   s.timeout,
-		Resolver:  s.manualResolver,
+		Logger:           s.logger,
+		ProjectID:        s.projectIDResource,
+		URL:              s.url,
+		Timeout:          s.timeout,
+		Resolver:         s.manualResolver,
+		RetryableCodes:   s.retryableCodes,
+		LabelMismatch:    s.labelMismatch,
+		HedgingDelay:     s.hedgingDelay,
+		DisableAuth:      s.disableAuth,
+		TLS:              s.tls,
+		DebugDumper:      s.debugDumper,
+		ErrorSummary:     s.errorSummary,
+		EventReporter:    s.eventReporter,
+		ProjectAllowlist: s.projectAllowlist,
+		QuotaProject:     s.quotaProject,
+		Metadata:         s.metadata,
 	})
 }
 
@@ -663,6 +2172,98 @@ func (fcf *fileClientFactory) Name() string {
 	return "fileClientFactory"
 }
 
+// bigQueryClientFactory generates StorageClients streaming converted points
+// into a single BigQuery table.
+type bigQueryClientFactory struct {
+	logger  log.Logger
+	project string
+	dataset string
+	table   string
+	timeout time.Duration
+}
+
+func (f *bigQueryClientFactory) New() stackdriver.StorageClient {
+	return stackdriver.NewBigQueryClient(&stackdriver.BigQueryClientConfig{
+		Logger:  f.logger,
+		Project: f.project,
+		Dataset: f.dataset,
+		Table:   f.table,
+		Timeout: f.timeout,
+	})
+}
+
+func (f *bigQueryClientFactory) Name() string {
+	return "bigQueryClientFactory"
+}
+
+var pubSubTopicPattern = regexp.MustCompile(`^projects/[^/]+/topics/[^/]+$`)
+
+// pubSubClientFactory generates StorageClients publishing converted series
+// to a single Pub/Sub topic.
+type pubSubClientFactory struct {
+	logger  log.Logger
+	topic   string
+	timeout time.Duration
+}
+
+func (f *pubSubClientFactory) New() stackdriver.StorageClient {
+	return stackdriver.NewPubSubClient(&stackdriver.PubSubClientConfig{
+		Logger:  f.logger,
+		Topic:   f.topic,
+		Timeout: f.timeout,
+	})
+}
+
+func (f *pubSubClientFactory) Name() string {
+	return "pubSubClientFactory"
+}
+
+// failoverTargetGetter tries a list of target API clients in order until one
+// returns a result.
+type failoverTargetGetter struct {
+	logger  log.Logger
+	getters []retrieval.TargetGetter
+}
+
+func (f *failoverTargetGetter) Get(ctx context.Context, lset labels.Labels) (*targets.Target, error) {
+	var lastErr error
+	for _, g := range f.getters {
+		target, err := g.Get(ctx, lset)
+		if err != nil {
+			level.Debug(f.logger).Log("msg", "targets API endpoint failed, trying next", "err", err)
+			lastErr = err
+			continue
+		}
+		if target != nil {
+			return target, nil
+		}
+	}
+	return nil, lastErr
+}
+
+// failoverMetadataGetter tries a list of metadata API clients in order until
+// one returns a result.
+type failoverMetadataGetter struct {
+	logger  log.Logger
+	getters []retrieval.MetadataGetter
+}
+
+func (f *failoverMetadataGetter) Get(ctx context.Context, job, instance, metric string) (*metadata.Entry, error) {
+	var lastErr error
+	for _, g := range f.getters {
+		entry, err := g.Get(ctx, job, instance, metric)
+		if err != nil {
+			level.Debug(f.logger).Log("msg", "metadata API endpoint failed, trying next", "err", err)
+			lastErr = err
+			continue
+		}
+		if entry != nil {
+			return entry, nil
+		}
+	}
+	return nil, lastErr
+}
+
 func waitForPrometheus(ctx context.Context, logger log.Logger, promURL *url.URL) {
 	tick := time.NewTicker(3 * time.Second)
 	defer tick.Stop()
@@ -721,7 +2322,46 @@ func getGCEProjectID() string {
 	return ""
 }
 
+// externalLabelTargets maps well-known Prometheus external label names onto
+// the static resource labels they can supply when neither flags nor the
+// metadata server provided a value.
+var externalLabelTargets = map[string][]string{
+	"project_id":   {retrieval.ProjectIDLabel},
+	"location":     {retrieval.KubernetesLocationLabel, retrieval.GenericLocationLabel},
+	"cluster":      {retrieval.KubernetesClusterNameLabel},
+	"cluster_name": {retrieval.KubernetesClusterNameLabel},
+	"namespace":    {retrieval.GenericNamespaceLabel},
+}
+
+// readPrometheusConfig loads the Prometheus configuration file and returns
+// its external labels and the set of configured scrape job names.
+func readPrometheusConfig(filename string) (labels.Labels, map[string]bool, error) {
+	promcfg, err := config.LoadFile(filename)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "load Prometheus configuration file %q", filename)
+	}
+	jobs := make(map[string]bool, len(promcfg.ScrapeConfigs))
+	for _, sc := range promcfg.ScrapeConfigs {
+		jobs[sc.JobName] = true
+	}
+	return promcfg.GlobalConfig.ExternalLabels, jobs, nil
+}
+
+// fillMetadata fills in any missing Kubernetes resource labels, first from
+// environment variables, e.g. set through the Downward API, and then from the
+// GKE metadata server.
 func fillMetadata(staticConfig *map[string]string) {
+	for label, env := range map[string]string{
+		retrieval.ProjectIDLabel:             "GCP_PROJECT",
+		retrieval.KubernetesLocationLabel:    "GCP_REGION",
+		retrieval.KubernetesClusterNameLabel: "KUBE_CLUSTER",
+	} {
+		if (*staticConfig)[label] == "" {
+			if v := strings.TrimSpace(os.Getenv(env)); v != "" {
+				(*staticConfig)[label] = v
+			}
+		}
+	}
 	if !md.OnGCE() {
 		return
 	}
@@ -745,19 +2385,122 @@ func fillMetadata(staticConfig *map[string]string) {
 	}
 }
 
-func parseConfigFile(filename string) (map[string]string, []*metadata.Entry, retrieval.CounterAggregatorConfig, error) {
+type descriptorsFileConfig struct {
+	Descriptors []stackdriver.DescriptorConfig `json:"descriptors"`
+}
+
+// parseDescriptorsFile reads a declarative descriptors file and translates it
+// into Monitoring API metric descriptors under the given metric prefix.
+func parseDescriptorsFile(filename, prefix string) ([]*metric_pb.MetricDescriptor, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading file")
+	}
+	var fc descriptorsFileConfig
+	if err := yaml.Unmarshal(b, &fc); err != nil {
+		return nil, errors.Wrap(err, "invalid YAML")
+	}
+	var ds []*metric_pb.MetricDescriptor
+	seen := map[string]struct{}{}
+	for _, dc := range fc.Descriptors {
+		if _, ok := seen[dc.Metric]; ok {
+			return nil, errors.Errorf("duplicate descriptor for metric %s", dc.Metric)
+		}
+		seen[dc.Metric] = struct{}{}
+		d, err := stackdriver.BuildMetricDescriptor(prefix, dc)
+		if err != nil {
+			return nil, err
+		}
+		ds = append(ds, d)
+	}
+	return ds, nil
+}
+
+// parseRetryStatuses maps gRPC status code names like "UNAVAILABLE" to their
+// numeric codes.
+func parseRetryStatuses(names []string) ([]codes.Code, error) {
+	var parsed []codes.Code
+	for _, name := range names {
+		var code codes.Code
+		if err := code.UnmarshalJSON([]byte(`"` + strings.ToUpper(name) + `"`)); err != nil {
+			return nil, errors.Wrapf(err, "invalid gRPC status code %q", name)
+		}
+		parsed = append(parsed, code)
+	}
+	return parsed, nil
+}
+
+// parsedConfig holds the validated contents of the configuration file.
+type parsedConfig struct {
+	metricRenames     map[string]string
+	staticMetadata    []*metadata.Entry
+	aggregations      retrieval.CounterAggregatorConfig
+	gaugeAggregations retrieval.GaugeAggregatorConfig
+	jobPrefixes       map[string]string
+	namespaceProjects map[string]string
+	bucketFilters     map[string]*retrieval.BucketFilter
+	labelJoins        []*retrieval.LabelJoin
+	queryJoins        []*retrieval.QueryJoin
+	labelSplits       []*retrieval.LabelSplit
+	deltaCounters     map[string]bool
+	valueTransforms   map[string]*retrieval.ValueTransform
+	gaugeIntervals    map[string]*retrieval.GaugeInterval
+	externalLabels    []retrieval.ExternalLabelMapping
+	staticLabels      map[string]string
+	qosClasses        []qosClassSpec
+	haMerges          map[string]retrieval.HAMergeStrategy
+}
+
+// apiAddress returns the host:port an API URL dials to.
+func apiAddress(u *url.URL) string {
+	if u.Port() != "" {
+		return net.JoinHostPort(u.Hostname(), u.Port())
+	}
+	return u.Hostname()
+}
+
+// flagEnvarNameInvalid matches characters of a flag name that cannot appear
+// in an environment variable name.
+var flagEnvarNameInvalid = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+// flagEnvarName returns the environment variable through which a flag can be
+// set, e.g. SIDECAR_STACKDRIVER_PROJECT_ID for stackdriver.project-id.
+func flagEnvarName(flag string) string {
+	return "SIDECAR_" + strings.ToUpper(flagEnvarNameInvalid.ReplaceAllString(flag, "_"))
+}
+
+// configHash returns a short hex digest over the command line and, if given,
+// the config file contents, identifying the effective sidecar configuration
+// in the lifecycle metric.
+func configHash(args []string, configFilename string) string {
+	h := sha256.New()
+	for _, arg := range args {
+		h.Write([]byte(arg))
+		h.Write([]byte{0})
+	}
+	if configFilename != "" {
+		// The file was already parsed successfully at this point, so a read
+		// error cannot realistically occur and leaves the file out of the hash.
+		if b, err := ioutil.ReadFile(configFilename); err == nil {
+			h.Write(b)
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))[:16]
+}
+
+func parseConfigFile(filename string) (*parsedConfig, error) {
 	b, err := ioutil.ReadFile(filename)
 	if err != nil {
-		return nil, nil, nil, errors.Wrap(err, "reading file")
+		return nil, errors.Wrap(err, "reading file")
 	}
 	var fc fileConfig
 	if err := yaml.Unmarshal(b, &fc); err != nil {
-		return nil, nil, nil, errors.Wrap(err, "invalid YAML")
+		return nil, errors.Wrap(err, "invalid YAML")
 	}
 	return processFileConfig(fc)
 }
 
-func processFileConfig(fc fileConfig) (map[string]string, []*metadata.Entry, retrieval.CounterAggregatorConfig, error) {
+func processFileConfig(fc fileConfig) (*parsedConfig, error) {
 	renameMapping := map[string]string{}
 	for _, r := range fc.MetricRenames {
 		renameMapping[r.From] = r.To
@@ -769,9 +2512,10 @@ func processFileConfig(fc fileConfig) (map[string]string, []*metadata.Entry, ret
 			// Convert "untyped" to the "unknown" type used internally as of Prometheus 2.5.
 			sm.Type = textparse.MetricTypeUnknown
 		case textparse.MetricTypeCounter, textparse.MetricTypeGauge, textparse.MetricTypeHistogram,
+			textparse.MetricTypeGaugeHistogram, textparse.MetricTypeStateset, textparse.MetricTypeInfo,
 			textparse.MetricTypeSummary, textparse.MetricTypeUnknown:
 		default:
-			return nil, nil, nil, errors.Errorf("invalid metric type %q", sm.Type)
+			return nil, errors.Errorf("invalid metric type %q", sm.Type)
 		}
 		var valueType metric_pb.MetricDescriptor_ValueType
 		switch sm.ValueType {
@@ -779,29 +2523,291 @@ func processFileConfig(fc fileConfig) (map[string]string, []*metadata.Entry, ret
 			valueType = metric_pb.MetricDescriptor_DOUBLE
 		case "int64":
 			valueType = metric_pb.MetricDescriptor_INT64
+		case "bool":
+			valueType = metric_pb.MetricDescriptor_BOOL
 		case "":
 			valueType = metric_pb.MetricDescriptor_VALUE_TYPE_UNSPECIFIED
 		default:
-			return nil, nil, nil, errors.Errorf("invalid value type %q", sm.ValueType)
+			return nil, errors.Errorf("invalid value type %q", sm.ValueType)
 		}
 		staticMetadata = append(staticMetadata,
-			&metadata.Entry{Metric: sm.Metric, MetricType: textparse.MetricType(sm.Type), ValueType: valueType, Help: sm.Help})
+			&metadata.Entry{Metric: sm.Metric, MetricType: textparse.MetricType(sm.Type), ValueType: valueType, Help: sm.Help, Unit: sm.Unit})
 	}
 
 	aggregations := make(retrieval.CounterAggregatorConfig)
 	for _, c := range fc.AggregatedCounters {
 		if _, ok := aggregations[c.Metric]; ok {
-			return nil, nil, nil, errors.Errorf("duplicate counter aggregator metric %s", c.Metric)
+			return nil, errors.Errorf("duplicate counter aggregator metric %s", c.Metric)
 		}
-		a := &retrieval.CounterAggregatorMetricConfig{Help: c.Help}
+		a := &retrieval.CounterAggregatorMetricConfig{Help: c.Help, Kind: c.Kind}
 		for _, f := range c.Filters {
 			matcher, err := promql.ParseMetricSelector(f)
 			if err != nil {
-				return nil, nil, nil, errors.Errorf("cannot parse metric selector '%s': %q", f, err)
+				return nil, errors.Errorf("cannot parse metric selector '%s': %q", f, err)
 			}
 			a.Matchers = append(a.Matchers, matcher)
 		}
 		aggregations[c.Metric] = a
 	}
-	return renameMapping, staticMetadata, aggregations, nil
+	jobPrefixes := map[string]string{}
+	for _, p := range fc.MetricPrefixes {
+		if p.Job == "" || p.Prefix == "" {
+			return nil, errors.Errorf("metric prefix override must set both job and prefix")
+		}
+		if _, ok := jobPrefixes[p.Job]; ok {
+			return nil, errors.Errorf("duplicate metric prefix override for job %s", p.Job)
+		}
+		jobPrefixes[p.Job] = strings.TrimSuffix(p.Prefix, "/")
+	}
+	namespaceProjects := map[string]string{}
+	for _, np := range fc.NamespaceProjects {
+		if np.Namespace == "" || np.ProjectID == "" {
+			return nil, errors.Errorf("namespace project route must set both namespace and project_id")
+		}
+		if _, ok := namespaceProjects[np.Namespace]; ok {
+			return nil, errors.Errorf("duplicate project route for namespace %s", np.Namespace)
+		}
+		namespaceProjects[np.Namespace] = np.ProjectID
+	}
+	bucketFilters := map[string]*retrieval.BucketFilter{}
+	for _, f := range fc.HistogramBucketFilters {
+		if f.Metric == "" {
+			return nil, errors.Errorf("histogram bucket filter must set a metric")
+		}
+		if _, ok := bucketFilters[f.Metric]; ok {
+			return nil, errors.Errorf("duplicate histogram bucket filter for metric %s", f.Metric)
+		}
+		bucketFilters[f.Metric] = &retrieval.BucketFilter{DropBounds: f.DropBounds, KeepEvery: f.KeepEvery, CollapseEmpty: f.CollapseEmpty, RebucketOnChange: f.RebucketOnChange}
+	}
+	var labelJoins []*retrieval.LabelJoin
+	for _, j := range fc.LabelJoins {
+		if j.InfoMetric == "" {
+			return nil, errors.Errorf("label join must set an info metric")
+		}
+		if len(j.Keys) == 0 {
+			return nil, errors.Errorf("label join for %s must set at least one key", j.InfoMetric)
+		}
+		labelJoins = append(labelJoins, &retrieval.LabelJoin{InfoMetric: j.InfoMetric, Keys: j.Keys, Labels: j.Labels})
+	}
+	var queryJoins []*retrieval.QueryJoin
+	for _, j := range fc.QueryJoins {
+		if j.Query == "" {
+			return nil, errors.Errorf("query join must set a query")
+		}
+		if len(j.Keys) == 0 {
+			return nil, errors.Errorf("query join for %q must set at least one key", j.Query)
+		}
+		var interval time.Duration
+		if j.Interval != "" {
+			var err error
+			if interval, err = time.ParseDuration(j.Interval); err != nil {
+				return nil, errors.Errorf("cannot parse interval '%s' for query join on %q: %q", j.Interval, j.Query, err)
+			}
+			if interval <= 0 {
+				return nil, errors.Errorf("query join for %q must have a positive interval", j.Query)
+			}
+		}
+		queryJoins = append(queryJoins, &retrieval.QueryJoin{Query: j.Query, Keys: j.Keys, Labels: j.Labels, Interval: interval})
+	}
+	var labelSplits []*retrieval.LabelSplit
+	for _, s := range fc.LabelSplits {
+		if s.Label == "" {
+			return nil, errors.Errorf("label split must set a label")
+		}
+		if len(s.Labels) == 0 {
+			return nil, errors.Errorf("label split for %s must set at least one target label", s.Label)
+		}
+		re, err := regexp.Compile(s.Regex)
+		if err != nil {
+			return nil, errors.Errorf("cannot compile regex '%s' for label split on %s: %q", s.Regex, s.Label, err)
+		}
+		if re.NumSubexp() != len(s.Labels) {
+			return nil, errors.Errorf("label split on %s has %d capture groups but %d target labels", s.Label, re.NumSubexp(), len(s.Labels))
+		}
+		labelSplits = append(labelSplits, &retrieval.LabelSplit{
+			Metric: s.Metric,
+			Label:  s.Label,
+			Regex:  re,
+			Labels: s.Labels,
+			Keep:   s.Keep,
+		})
+	}
+	deltaCounters := map[string]bool{}
+	for _, d := range fc.DeltaCounters {
+		if d.Metric == "" {
+			return nil, errors.Errorf("delta counter must set a metric")
+		}
+		if deltaCounters[d.Metric] {
+			return nil, errors.Errorf("duplicate delta counter for metric %s", d.Metric)
+		}
+		deltaCounters[d.Metric] = true
+	}
+	valueTransforms := map[string]*retrieval.ValueTransform{}
+	for _, t := range fc.ValueTransforms {
+		if t.Metric == "" {
+			return nil, errors.Errorf("value transform must set a metric")
+		}
+		if _, ok := valueTransforms[t.Metric]; ok {
+			return nil, errors.Errorf("duplicate value transform for metric %s", t.Metric)
+		}
+		if t.Factor == 0 && t.ClampMin == nil && t.ClampMax == nil && !t.InvertBool {
+			return nil, errors.Errorf("value transform for metric %s must set a factor, clamp, or invert_bool", t.Metric)
+		}
+		if t.ClampMin != nil && t.ClampMax != nil && *t.ClampMin > *t.ClampMax {
+			return nil, errors.Errorf("value transform for metric %s has clamp_min greater than clamp_max", t.Metric)
+		}
+		valueTransforms[t.Metric] = &retrieval.ValueTransform{
+			Factor:     t.Factor,
+			ClampMin:   t.ClampMin,
+			ClampMax:   t.ClampMax,
+			InvertBool: t.InvertBool,
+		}
+	}
+	gaugeIntervals := map[string]*retrieval.GaugeInterval{}
+	for _, g := range fc.GaugeIntervals {
+		if g.Metric == "" {
+			return nil, errors.Errorf("gauge interval must set a metric")
+		}
+		if _, ok := gaugeIntervals[g.Metric]; ok {
+			return nil, errors.Errorf("duplicate gauge interval for metric %s", g.Metric)
+		}
+		d, err := time.ParseDuration(g.MinInterval)
+		if err != nil {
+			return nil, errors.Errorf("cannot parse min_interval '%s' for metric %s: %q", g.MinInterval, g.Metric, err)
+		}
+		if d <= 0 {
+			return nil, errors.Errorf("gauge interval for metric %s must have a positive min_interval", g.Metric)
+		}
+		switch retrieval.GaugeIntervalOp(g.Op) {
+		case "", retrieval.GaugeIntervalLast, retrieval.GaugeIntervalMean, retrieval.GaugeIntervalMax:
+		default:
+			return nil, errors.Errorf("unknown gauge interval op %q for metric %s", g.Op, g.Metric)
+		}
+		gaugeIntervals[g.Metric] = &retrieval.GaugeInterval{
+			MinInterval: d,
+			Op:          retrieval.GaugeIntervalOp(g.Op),
+		}
+	}
+	var externalLabels []retrieval.ExternalLabelMapping
+	seenExternalLabels := map[string]bool{}
+	for _, e := range fc.ExternalLabels {
+		if e.Name == "" {
+			return nil, errors.Errorf("external label mapping must set a name")
+		}
+		if seenExternalLabels[e.Name] {
+			return nil, errors.Errorf("duplicate mapping for external label %s", e.Name)
+		}
+		seenExternalLabels[e.Name] = true
+		if e.ResourceLabel == "" && e.MetricLabel == "" {
+			return nil, errors.Errorf("external label mapping for %s must set a resource_label or metric_label", e.Name)
+		}
+		externalLabels = append(externalLabels, retrieval.ExternalLabelMapping{
+			Name:          e.Name,
+			ResourceLabel: e.ResourceLabel,
+			MetricLabel:   e.MetricLabel,
+		})
+	}
+	staticLabels := map[string]string{}
+	for _, l := range fc.StaticMetricLabels {
+		if l.Name == "" {
+			return nil, errors.Errorf("static metric label must set a name")
+		}
+		if _, ok := staticLabels[l.Name]; ok {
+			return nil, errors.Errorf("duplicate static metric label %s", l.Name)
+		}
+		staticLabels[l.Name] = l.Value
+	}
+	gaugeAggregations := make(retrieval.GaugeAggregatorConfig)
+	for _, g := range fc.AggregatedGauges {
+		if _, ok := gaugeAggregations[g.Metric]; ok {
+			return nil, errors.Errorf("duplicate gauge aggregator metric %s", g.Metric)
+		}
+		a := &retrieval.GaugeAggregatorMetricConfig{Help: g.Help, Op: g.Op, By: g.By}
+		if g.Window != "" {
+			window, err := time.ParseDuration(g.Window)
+			if err != nil {
+				return nil, errors.Errorf("invalid window %q for aggregated gauge %s", g.Window, g.Metric)
+			}
+			a.Window = window
+		}
+		for _, f := range g.Filters {
+			matcher, err := promql.ParseMetricSelector(f)
+			if err != nil {
+				return nil, errors.Errorf("cannot parse metric selector '%s': %q", f, err)
+			}
+			a.Matchers = append(a.Matchers, matcher)
+		}
+		gaugeAggregations[g.Metric] = a
+	}
+	var haMerges map[string]retrieval.HAMergeStrategy
+	for _, m := range fc.HAMerges {
+		if m.Metric == "" {
+			return nil, errors.Errorf("HA merge must set a metric")
+		}
+		if _, ok := haMerges[m.Metric]; ok {
+			return nil, errors.Errorf("duplicate HA merge for metric %s", m.Metric)
+		}
+		switch retrieval.HAMergeStrategy(m.Strategy) {
+		case retrieval.HAMergeDefault, retrieval.HAMergeMax, retrieval.HAMergeLast:
+		default:
+			return nil, errors.Errorf("invalid strategy %q for HA merge of metric %s, expected max or last", m.Strategy, m.Metric)
+		}
+		if haMerges == nil {
+			haMerges = map[string]retrieval.HAMergeStrategy{}
+		}
+		haMerges[m.Metric] = retrieval.HAMergeStrategy(m.Strategy)
+	}
+	var qosClasses []qosClassSpec
+	seenQoSClasses := map[string]bool{}
+	for _, q := range fc.QoSClasses {
+		if q.Name == "" {
+			return nil, errors.Errorf("QoS class must set a name")
+		}
+		if seenQoSClasses[q.Name] {
+			return nil, errors.Errorf("duplicate QoS class %s", q.Name)
+		}
+		seenQoSClasses[q.Name] = true
+		if len(q.Patterns) == 0 {
+			return nil, errors.Errorf("QoS class %s must set at least one pattern", q.Name)
+		}
+		class := &retrieval.QoSClass{Name: q.Name, MaxRate: q.MaxRate, DropPolicy: q.DropPolicy}
+		for _, p := range q.Patterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return nil, errors.Errorf("cannot compile pattern '%s' for QoS class %s: %q", p, q.Name, err)
+			}
+			class.Patterns = append(class.Patterns, re)
+		}
+		if q.MaxRate < 0 {
+			return nil, errors.Errorf("QoS class %s has a negative max_rate", q.Name)
+		}
+		if q.Shards < 0 {
+			return nil, errors.Errorf("QoS class %s has a negative shard count", q.Name)
+		}
+		switch q.DropPolicy {
+		case "", "drop", "block":
+		default:
+			return nil, errors.Errorf("invalid drop_policy %q for QoS class %s, expected drop or block", q.DropPolicy, q.Name)
+		}
+		qosClasses = append(qosClasses, qosClassSpec{Class: class, Shards: q.Shards})
+	}
+	return &parsedConfig{
+		metricRenames:     renameMapping,
+		staticMetadata:    staticMetadata,
+		aggregations:      aggregations,
+		gaugeAggregations: gaugeAggregations,
+		jobPrefixes:       jobPrefixes,
+		namespaceProjects: namespaceProjects,
+		bucketFilters:     bucketFilters,
+		labelJoins:        labelJoins,
+		queryJoins:        queryJoins,
+		labelSplits:       labelSplits,
+		deltaCounters:     deltaCounters,
+		valueTransforms:   valueTransforms,
+		gaugeIntervals:    gaugeIntervals,
+		externalLabels:    externalLabels,
+		staticLabels:      staticLabels,
+		qosClasses:        qosClasses,
+		haMerges:          haMerges,
+	}, nil
 }
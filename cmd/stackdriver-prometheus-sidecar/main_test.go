@@ -16,14 +16,16 @@ package main
 import (
 	"bytes"
 	"errors"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"testing"
 	"time"
 
-	"github.com/Stackdriver/stackdriver-prometheus-sidecar/metadata"
-	"github.com/Stackdriver/stackdriver-prometheus-sidecar/retrieval"
+	"github.com/bjbloemker-google/stackdriver-prometheus-sidecar/metadata"
+	"github.com/bjbloemker-google/stackdriver-prometheus-sidecar/retrieval"
 	"github.com/go-kit/kit/log"
 	"github.com/google/go-cmp/cmp"
 	"github.com/prometheus/prometheus/pkg/labels"
@@ -47,13 +49,29 @@ func TestStartupInterrupt(t *testing.T) {
 		t.Skip("skipping test in short mode.")
 	}
 
-	cmd := exec.Command(os.Args[0], "--stackdriver.project-id=1234", "--prometheus.wal-directory=testdata/wal")
+	// Copy the WAL fixture into a temporary directory so the sidecar's
+	// progress files don't get written into the tracked testdata.
+	walDir := t.TempDir()
+	files, err := ioutil.ReadDir("testdata/wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(filepath.Join("testdata/wal", f.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(walDir, f.Name()), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmd := exec.Command(os.Args[0], "--stackdriver.project-id=1234", "--prometheus.wal-directory="+walDir)
 	cmd.Env = append(os.Environ(), "RUN_MAIN=1")
 	var bout, berr bytes.Buffer
 	cmd.Stdout = &bout
 	cmd.Stderr = &berr
-	err := cmd.Start()
-	if err != nil {
+	if err := cmd.Start(); err != nil {
 		t.Errorf("execution error: %v", err)
 		return
 	}
@@ -166,12 +184,15 @@ func TestProcessFileConfig(t *testing.T) {
 		return m
 	}
 	for _, tt := range []struct {
-		name           string
-		config         fileConfig
-		renameMappings map[string]string
-		staticMetadata []*metadata.Entry
-		aggregations   retrieval.CounterAggregatorConfig
-		err            error
+		name              string
+		config            fileConfig
+		renameMappings    map[string]string
+		staticMetadata    []*metadata.Entry
+		aggregations      retrieval.CounterAggregatorConfig
+		gaugeAggregations retrieval.GaugeAggregatorConfig
+		jobPrefixes       map[string]string
+		namespaceProjects map[string]string
+		err               error
 	}{
 		{
 			"empty",
@@ -179,6 +200,9 @@ func TestProcessFileConfig(t *testing.T) {
 			map[string]string{},
 			[]*metadata.Entry{},
 			retrieval.CounterAggregatorConfig{},
+			retrieval.GaugeAggregatorConfig{},
+			map[string]string{},
+			map[string]string{},
 			nil,
 		},
 		{
@@ -199,6 +223,22 @@ func TestProcessFileConfig(t *testing.T) {
 						Filters: []string{"filter1", "filter2"},
 					},
 				},
+				AggregatedGauges: []aggregatedGaugesConfig{
+					{
+						Metric:  "memory_usage_bytes_by_job",
+						Help:    "per-job memory usage",
+						Op:      "max",
+						By:      []string{"job"},
+						Window:  "30s",
+						Filters: []string{"filter1"},
+					},
+				},
+				MetricPrefixes: []metricPrefixConfig{
+					{Job: "team-a", Prefix: "external.googleapis.com/team-a/"},
+				},
+				NamespaceProjects: []namespaceProjectConfig{
+					{Namespace: "team-a", ProjectID: "team-a-prod"},
+				},
 			},
 			map[string]string{"from": "to"},
 			[]*metadata.Entry{
@@ -215,6 +255,19 @@ func TestProcessFileConfig(t *testing.T) {
 					Help: "total number of bytes sent over eth0",
 				},
 			},
+			retrieval.GaugeAggregatorConfig{
+				"memory_usage_bytes_by_job": &retrieval.GaugeAggregatorMetricConfig{
+					Matchers: [][]*labels.Matcher{
+						mustParseMetricSelector("filter1"),
+					},
+					Help:   "per-job memory usage",
+					Op:     "max",
+					By:     []string{"job"},
+					Window: 30 * time.Second,
+				},
+			},
+			map[string]string{"team-a": "external.googleapis.com/team-a"},
+			map[string]string{"team-a": "team-a-prod"},
 			nil,
 		},
 		{
@@ -222,21 +275,33 @@ func TestProcessFileConfig(t *testing.T) {
 			fileConfig{
 				StaticMetadata: []staticMetadataConfig{{Metric: "int64_default", ValueType: "int64"}},
 			},
-			nil, nil, nil,
+			nil, nil, nil, nil, nil, nil,
 			errors.New("invalid metric type \"\""),
 		},
 	} {
 		t.Run(tt.name, func(t *testing.T) {
-			renameMappings, staticMetadata, aggregations, err := processFileConfig(tt.config)
-			if diff := cmp.Diff(tt.renameMappings, renameMappings); diff != "" {
+			parsed, err := processFileConfig(tt.config)
+			if parsed == nil {
+				parsed = &parsedConfig{}
+			}
+			if diff := cmp.Diff(tt.renameMappings, parsed.metricRenames); diff != "" {
 				t.Errorf("renameMappings mismatch: %v", diff)
 			}
-			if diff := cmp.Diff(tt.staticMetadata, staticMetadata); diff != "" {
+			if diff := cmp.Diff(tt.staticMetadata, parsed.staticMetadata); diff != "" {
 				t.Errorf("staticMetadata mismatch: %v", diff)
 			}
-			if diff := cmp.Diff(tt.aggregations, aggregations); diff != "" {
+			if diff := cmp.Diff(tt.aggregations, parsed.aggregations); diff != "" {
 				t.Errorf("aggregations mismatch: %v", diff)
 			}
+			if diff := cmp.Diff(tt.gaugeAggregations, parsed.gaugeAggregations); diff != "" {
+				t.Errorf("gaugeAggregations mismatch: %v", diff)
+			}
+			if diff := cmp.Diff(tt.jobPrefixes, parsed.jobPrefixes); diff != "" {
+				t.Errorf("jobPrefixes mismatch: %v", diff)
+			}
+			if diff := cmp.Diff(tt.namespaceProjects, parsed.namespaceProjects); diff != "" {
+				t.Errorf("namespaceProjects mismatch: %v", diff)
+			}
 			if (tt.err != nil && err != nil && tt.err.Error() != err.Error()) ||
 				(tt.err == nil && err != nil) || (tt.err != nil && err == nil) {
 				t.Errorf("error mismatch: got %v, expected %v", err, tt.err)
@@ -244,3 +309,83 @@ func TestProcessFileConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestFillMetadataFromEnv(t *testing.T) {
+	for k, v := range map[string]string{
+		"GCP_PROJECT":  "env-project",
+		"GCP_REGION":   "env-location",
+		"KUBE_CLUSTER": "env-cluster",
+	} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+	staticLabels := map[string]string{
+		retrieval.ProjectIDLabel:             "flag-project",
+		retrieval.KubernetesLocationLabel:    "",
+		retrieval.KubernetesClusterNameLabel: "",
+	}
+	fillMetadata(&staticLabels)
+	expected := map[string]string{
+		// Explicit configuration takes precedence over the environment.
+		retrieval.ProjectIDLabel:             "flag-project",
+		retrieval.KubernetesLocationLabel:    "env-location",
+		retrieval.KubernetesClusterNameLabel: "env-cluster",
+	}
+	if diff := cmp.Diff(expected, staticLabels); len(diff) > 0 {
+		t.Errorf("unexpected static labels:\n%v", diff)
+	}
+}
+
+func TestReadPrometheusConfig(t *testing.T) {
+	externalLabels, jobs, err := readPrometheusConfig("testdata/prometheus.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedLabels := map[string]string{
+		"project_id": "test-project",
+		"location":   "us-central1-b",
+		"cluster":    "test-cluster",
+	}
+	if diff := cmp.Diff(expectedLabels, externalLabels.Map()); len(diff) > 0 {
+		t.Errorf("unexpected external labels:\n%v", diff)
+	}
+	expectedJobs := map[string]bool{
+		"kubernetes-pods":                true,
+		"stackdriver-prometheus-sidecar": true,
+	}
+	if diff := cmp.Diff(expectedJobs, jobs); len(diff) > 0 {
+		t.Errorf("unexpected jobs:\n%v", diff)
+	}
+	if _, _, err := readPrometheusConfig("testdata/does-not-exist.yml"); err == nil {
+		t.Errorf("expected error for missing configuration file")
+	}
+}
+
+func TestConfigHash(t *testing.T) {
+	h1 := configHash([]string{"--stackdriver.project-id=p1"}, "")
+	if len(h1) != 16 {
+		t.Fatalf("unexpected hash length %d", len(h1))
+	}
+	if h2 := configHash([]string{"--stackdriver.project-id=p1"}, ""); h2 != h1 {
+		t.Errorf("hash not deterministic: %s != %s", h2, h1)
+	}
+	if h2 := configHash([]string{"--stackdriver.project-id=p2"}, ""); h2 == h1 {
+		t.Errorf("expected different hash for different arguments")
+	}
+	if h2 := configHash([]string{"--stackdriver.project-id=p1"}, "testdata/prometheus.yml"); h2 == h1 {
+		t.Errorf("expected different hash with config file contents")
+	}
+}
+
+func TestFlagEnvarName(t *testing.T) {
+	cases := map[string]string{
+		"stackdriver.project-id":    "SIDECAR_STACKDRIVER_PROJECT_ID",
+		"include":                   "SIDECAR_INCLUDE",
+		"export.gauge-dedup-window": "SIDECAR_EXPORT_GAUGE_DEDUP_WINDOW",
+	}
+	for flag, want := range cases {
+		if got := flagEnvarName(flag); got != want {
+			t.Errorf("expected envar %s for flag %s, got %s", want, flag, got)
+		}
+	}
+}
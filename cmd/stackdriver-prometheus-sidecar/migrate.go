@@ -0,0 +1,70 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/bjbloemker-google/stackdriver-prometheus-sidecar/stackdriver"
+	"github.com/pkg/errors"
+)
+
+// runPrefixMigration implements the migrate-prefix subcommand. It lists the
+// metric descriptors under oldPrefix, optionally registers matching
+// descriptors under newPrefix, and prints a dual-write configuration so the
+// prefix can be switched without dashboards breaking overnight.
+func runPrefixMigration(ctx context.Context, w io.Writer, client *stackdriver.Client, oldPrefix, newPrefix string, create bool) error {
+	oldPrefix = strings.TrimSuffix(oldPrefix, "/")
+	newPrefix = strings.TrimSuffix(newPrefix, "/")
+
+	descriptors, err := client.ListMetricDescriptors(ctx, oldPrefix)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Found %d metric descriptors under %s:\n", len(descriptors), oldPrefix)
+	for _, d := range descriptors {
+		fmt.Fprintf(w, "  %s (%s, %s)\n", d.Type, d.MetricKind, d.ValueType)
+	}
+
+	rewritten := stackdriver.RewriteDescriptorPrefix(descriptors, oldPrefix, newPrefix)
+	if create {
+		if err := client.CreateMetricDescriptors(ctx, rewritten); err != nil {
+			return errors.Wrap(err, "create descriptors under new prefix")
+		}
+		fmt.Fprintf(w, "\nCreated %d metric descriptors under %s.\n", len(rewritten), newPrefix)
+	} else {
+		fmt.Fprintf(w, "\nWould create %d metric descriptors under %s (pass --create-descriptors to create them).\n", len(rewritten), newPrefix)
+	}
+
+	fmt.Fprintf(w, `
+Dual-write configuration:
+
+  Run a second sidecar instance against the same Prometheus server with
+
+    --stackdriver.metrics-prefix=%s
+
+  while the existing instance keeps writing with
+
+    --stackdriver.metrics-prefix=%s
+
+  Both prefixes then receive all samples. Once dashboards and alerts
+  reference the new metric types, remove the old-prefix instance and
+  delete the descriptors under %s.
+`, newPrefix, oldPrefix, oldPrefix)
+	return nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	md "cloud.google.com/go/compute/metadata"
+)
+
+// detectedResource holds resource labels discovered from a cloud provider's
+// metadata service. It supplies defaults for the generic monitored resource
+// when no explicit flags are given.
+type detectedResource struct {
+	platform  string
+	projectID string
+	location  string
+}
+
+// detectTimeout bounds each metadata service probe. The link-local metadata
+// addresses either answer quickly or not at all, so a short timeout keeps
+// startup fast outside any cloud.
+const detectTimeout = 2 * time.Second
+
+// Metadata service endpoints, variables so tests can point them at a fake.
+var (
+	ec2MetadataEndpoint   = "http://169.254.169.254/latest/meta-data/placement/availability-zone"
+	azureMetadataEndpoint = "http://169.254.169.254/metadata/instance/compute?api-version=2019-08-15&format=json"
+)
+
+// detectResource probes the metadata services of the supported cloud
+// providers in turn and returns the first match, or nil if none responds.
+func detectResource() *detectedResource {
+	if r := detectGCE(); r != nil {
+		return r
+	}
+	if r := detectEC2(); r != nil {
+		return r
+	}
+	if r := detectAzure(); r != nil {
+		return r
+	}
+	return nil
+}
+
+// detectGCE queries the GCE metadata server, which also serves GKE nodes.
+func detectGCE() *detectedResource {
+	if !md.OnGCE() {
+		return nil
+	}
+	r := &detectedResource{platform: "gce"}
+	if id, err := md.ProjectID(); err == nil {
+		r.projectID = strings.TrimSpace(id)
+	}
+	if zone, err := md.Zone(); err == nil {
+		r.location = strings.TrimSpace(zone)
+	}
+	return r
+}
+
+// detectEC2 queries the EC2 instance metadata service for the availability
+// zone of the instance.
+func detectEC2() *detectedResource {
+	client := &http.Client{Timeout: detectTimeout}
+	resp, err := client.Get(ec2MetadataEndpoint)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil
+	}
+	az := strings.TrimSpace(string(b))
+	if az == "" {
+		return nil
+	}
+	return &detectedResource{platform: "ec2", location: az}
+}
+
+// detectAzure queries the Azure Instance Metadata Service for the region of
+// the virtual machine.
+func detectAzure() *detectedResource {
+	req, err := http.NewRequest("GET", azureMetadataEndpoint, nil)
+	if err != nil {
+		return nil
+	}
+	// Azure rejects requests without this header to defend against SSRF.
+	req.Header.Set("Metadata", "true")
+	client := &http.Client{Timeout: detectTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	var compute struct {
+		Location string `json:"location"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&compute); err != nil {
+		return nil
+	}
+	if compute.Location == "" {
+		return nil
+	}
+	return &detectedResource{platform: "azure", location: compute.Location}
+}
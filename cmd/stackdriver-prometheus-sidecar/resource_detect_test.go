@@ -0,0 +1,64 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDetectEC2(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "us-east-1b")
+	}))
+	defer server.Close()
+
+	oldEndpoint := ec2MetadataEndpoint
+	ec2MetadataEndpoint = server.URL
+	defer func() { ec2MetadataEndpoint = oldEndpoint }()
+
+	r := detectEC2()
+	if r == nil {
+		t.Fatal("expected a detected resource")
+	}
+	if r.platform != "ec2" || r.location != "us-east-1b" {
+		t.Errorf("unexpected detection result %+v", r)
+	}
+}
+
+func TestDetectAzure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "true" {
+			http.Error(w, "missing Metadata header", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintln(w, `{"location": "westeurope", "vmId": "1"}`)
+	}))
+	defer server.Close()
+
+	oldEndpoint := azureMetadataEndpoint
+	azureMetadataEndpoint = server.URL
+	defer func() { azureMetadataEndpoint = oldEndpoint }()
+
+	r := detectAzure()
+	if r == nil {
+		t.Fatal("expected a detected resource")
+	}
+	if r.platform != "azure" || r.location != "westeurope" {
+		t.Errorf("unexpected detection result %+v", r)
+	}
+}
@@ -7,6 +7,6 @@ import (
 )
 
 func init() {
-	data := "PK\x03\x04\x14\x00\x08\x00\x08\x00\xb6^BP\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x11\x00	\x00statusz-tmpl.htmlUT\x05\x00\x01H\xb86^\xb4Xoo\xdb\xb6\x13~\xdfOq\xbf\xfc:\xa0\x05\x12+	0`p\x15\x0fi\xfe-\x88\xdb\x19I\xddb/i\xf1$q\x95H\x83<\xa7\xcd\x04}\xf7\x81\x7f,\xc9\xb2\xecf\xc1\x06\x040\xc9\xe7\xee!\xef\xb9\xe3\xd1N\xfc\xbf\xcb\xdf/>\xfd1\xbb\x82\x9c\xcab\xf2*\xf6\x1f\x00q\x8e\x8c\xdb\x01@L\x82\n\x9c<\x10\xa3\x95\x81Ti\xa8\xaa\xd1\x03\xeaG\xd4\x1fY\x89u\x1dG\xde\xc2[\x1bzZ\x8f\x01\x16\x8a?A\x15&\x00\xa9\x92t\x94\xb2R\x14Oc0L\x9a#\x83Z\xa4\xef\x82A\x1d>\xf3\x93\x8eOR \xd3cX(\xca\xdf5\x8b\xdf\x04\xa7|\x0c'\xc7\xc7?\xb5\x8b\x84\xdf\xe9\x88\x15\"\x93cHP\x12\xeaw\x9b;\x1b\xf1\x17\x8e\xe1\xe4\xb4\xeb\xb4`\xc9\xd7L\xab\x95\xe4c\xf8?\xe2\xf6YN\xfb\xe7\x0f,'-\xcb\xdavT`J9\x93\xbc\xebR(Fc\xb0\xc8\xd6\xf1\x7f\x19\xa0\xd0\"\xcb\xfb\x1c\xdd\xc0\x1c\xde\xf7\"~\x08\x94w<\xda\xa8\x8e\x12U(=\x06\x9d-\xd8\x9b\xe3C\x08\x7f\xa3\xe3\x9f\xdfn\xb1\xe4;\xf6\xec\x1e\xde\x1b\xc7Q\x93\xe68\xf2\xa5b\x876\xdd\xa1\x0c\xf2\x93\xbd\x15\x93\x9f8\x0f\x80\x98\x8b\xc7u\xb5\xd81$\x053\xe6\xec`-\xe5\xc1\xa49\xd2\x031M\xc8\xc7\x8e\xcd\x8e?	G\xb6\xd0\xad\xcd|i\xd1\xf9\x92\xb6\xa1\xcf\xa8\x8dP\xd2\xb9\x87\xf1\xadLU\xcf\xea\xfdJ\x14\x1c\x12%\xad\x00\xce\xd6\xad\\\xf8\x85\x9e\xf1o\xca\x10p$&\n\xe3l\xe7\x92m\xed{}	\x85(\x05y\x8bk>u\x93\x9eQU\x89\x14\xde\xd8\xb4\x8fn\xee\xae\xec\xb9F3\xad\xfe\xc4\x84n/\xdb\xa5\x8bbe\x08\xf5T%\x8c\x84\x92[\x80U\x17F3\xc5\xfd\xe0\xa3\xe2\x18F\xacD\xb3d\x89\x9b\xbe\xad\xebf\xdfx\xd9\x9e\x01`\xa68\xc4\x0cr\x8d\xe9\xd9AN\xb44\xe3(J\x944\xaa\xc0QR\xa8\x15\x1feJev\xa2\xca\xe8\xebj\x81Z\"\xa1\x89\x96\x8aGU\xb5\xeb\x9cu=\x00\xfaJ\x88\\\xe0\x9b\xe7\xab\xeb\xaa\xda^\xc1\xc2`]sL\xd9\xaa\xa0\xaaB\xc9=m\x88\xb6\xae\x7f]z\xc1\xce:{5\x1a\xd6\xf5\xc1\xa4k\x1cGl\xb2\x91\x00\x00\xab\xd6\xcb\xa2\x97\x8a\xe3\x8b\xc3o\xb2\xf4\xbc\x08Z\xeb\x81\x10\x02\xf7\xcb\xa2H\xbc\xb3\x89BA\xbf,\xa2\xe7\xc40\xe8h\xc3i\xcb2Zv\xef\x86K\xf6\xbaID;:F\xd39;-\xe3\xb3\xc0o\xad\x1aQ\x89\xa4Eb\x0e&a\xd0\x93\xb0C\x1d\x86M/\x9b1m\xd0\xf5\x85Td+\xedT\xe8t\xb1\xaa\xfa&(\x87\xd1\x85\xc3\xeb:8\x12[\xb4oaLz\x12S>\xf16\x90\x8a\x02m\xb7\x88#\xca'1q+\x8c\x87\xae\x03\xe2^V>\x89#\xd2}\x8ekQ\xd8Tu}\xc3\xd2\x0f\x9d\xc0 \x0d9\"\xed\xf3\xbdA\x89Z$P\xb0\x05\xda^W\x84J\xe8\x12\x05\x9b\xa93\x19\xb5\xb5\xf2lR\xb9\xbe\xf3\xbbY\x9b\xb6\xb0\x87\xf6\xae\xa9\xe9\x869\xd46\xf4\x05oM\x03\x7f\xaf$\x9f\xbf\xc3\x90 [\xec\xcf\xd0d*\x0c\xa1\x04\xc6\xb9F\xb3\x91'\x8f\x9c{`\x1f\x83\xca\xa0\xc0G,\xba\xce3\xad\xcaBe\xbe\xc0FS\x0b\xff\x80\"U\xbad\xb4\x9b\xe3\xda\xe1{H>\xf8;\x06K\x8d\xa9\xf8\xde%\n\xc8\xcc\x01\xfb\x18\x94\x14\xa4\xb4\x90\x99\xfbB\x83\x92o\x08\xd2\xc2\xef\x03\xba\x87+\xf4 \xb8\xbd\x04\x8dF\xad\xf4f\x955-\xea>\x80\xfb\xa9J\xa4\x1cW\x06\xe6\xf7\xd3\xbeB\x1e\x99\xdfO\xf70<\x10K\xber-\x1eQ\x0fe\xba\x03\xff8\xdd\x0f\xa44\x82\x90\xae\xa1\x18\xe0BcBJ?m\x12*\x8d\xb7\xd26\x16s\xb96\xd8\xc397\x087wW\x83J\xcd\x0d\xde\xdc]=C&K\xa2\xd1\xd8T\x13r\xb8\x9d\x99\x1e\xcd}\x03\xde\xce\xf6E\xf8\xe5|:\x1c\xd6\x97\xf3\xe9\xeeh\xe2(t\xdf\xd0\xc3O'\xe7Y\xa61s\x17\xd0\xc4Q~:	\xad\xdb~\x01\xe9b\xe1\xa9\x19\xee\xde\xfe\xe5\x08\xa7\xc8'%\xa3$o:q\xe7\xf0U\xa5\x99\xcc\x10^{\x87\xc3\xf5 t\xff\xf1\xd9\xe0\x9e\xeb}lx\xc1a\x1dXw-\\\xc1\x0fa\xf3\x01\xed\xbaof\xa3D\x00\xdc\x17)7\x91J\xe2\xab\xaey\xa3\x95\xbf\xa2\xa0\xddC\xb4\xa5\x96G\xef=\xb8W\xaeT\xab\xb2\x11\x8b\xd4n\x99\xac\xe1!\xbc&\xe5\xa4\x19\xda`C\x1bk\xbe\xa9\x0c\xa9\xff@\x06\xfb\x13F$P\"1\xce\x88\xf5u\xf0\xf0\x87\x80\xfe\x93\xba\xa1\xa7%6\x93\x95\x14\xb4S\x99\xe1M\xbab\x04\xb56\xe4\x08k\x9f\x9e\x96\xb8\xb9\xfe\x99\x15+\xec.\xffKju&q\xe4\x7f\x07\xc6\x91\xffo\xc2\xdf\x01\x00\x00\xff\xffPK\x07\x08Tmx%\xa7\x04\x00\x00e\x10\x00\x00PK\x01\x02\x14\x03\x14\x00\x08\x00\x08\x00\xb6^BPTmx%\xa7\x04\x00\x00e\x10\x00\x00\x11\x00	\x00\x00\x00\x00\x00\x00\x00\x00\x00\xa4\x81\x00\x00\x00\x00statusz-tmpl.htmlUT\x05\x00\x01H\xb86^PK\x05\x06\x00\x00\x00\x00\x01\x00\x01\x00H\x00\x00\x00\xef\x04\x00\x00\x00\x00"
+	data := "PK\x03\x04\x14\x00\b\x00\b\x00\x00\x00BP\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x11\x00\t\x00statusz-tmpl.htmlUT\x05\x00\x01\x00\x116^\xb4Xko\x1b\xb7\x12\xfd\x9e_1\xd77\x17H\x00[k\x1b\xb8@\xa1\xacU8~հ\x92\xaa~$\xe8Gj9\xdae\xbd\"\x05r\xe4\xc4]\xec\x7f/\xf8о\xb4ڸF\v\x040\xc93s\x86s8\x1c\xae\x12\xff\xe7\xfc׳\xfb\xdfg\x17\x90\xd12\x9f\xbc\x89\xfd\x1f\x808C\xc6\xed\x00 &A9N\xee\x88\xd1\xda\xc0Bi(\x8a\xd1\x1d\xea'ԟ\xd9\x12\xcb2\x8e\xbc\x85\xb76\xf4\xbc\x19\x03\xcc\x15\x7f\x86\"L\x00\x16J\xd2\xc1\x82-E\xfe<\x06ä90\xa8\xc5\xe2C0(\xc3\xdf\xec\xa8\xe1\x93\xe4\xc8\xf4\x18抲\x0f\xd5\xe27\xc1)\x1b\xc3\xd1\xe1\xe1\xff\xeaE\xc2\xeft\xc0r\x91\xca1$(\t\xf5\x87vd#\xfe\xc41\x1c\x1d7\x9d\xe6,yL\xb5ZK>\x86\xff\"n\xef帻\xff\xc0rT\xb3llG9.(c\x927]r\xc5h\f\x16\xd9\xda\xfeO=\x14Z\xa4Y\x97\xa3\x99\x98û^\xc4\xf7\x81\xb2\x86G\x9d\xd5A\xa2r\xa5Ǡ\xd39{w\xb8\x0f\xe1\xdf\xe8\xf0\xff\xef\xb7X\xb2\x1d1\x9b\x9b\xf7\xc6qT\x1ds\x1c\xf9R\xb1C{ܡ\f\xb2\xa3\xc1\x8aɎ\x9c\a@\xcc\xc5ӦZ\xec\x18\x92\x9c\x19s\xb2\xb7\x91roRm鎘&\xe4c\xc7f\xc7\xf7\u0091\xcdum\xf3\xb0\xb2\xe8Ê\xb6\xa1/\xa8\x8dPҹ\x87\xf1\xb5\\\xa8\x8e\xd5ǵ\xc89$JZ\x01\x9c\xad[9\xf3\v\x1d\xe3_\x94!\xe0HL\xe4\xc6\xd9>H\xb6\x15\xf7\xf2\x1cr\xb1\x14\xe4-.\xf9\xd4M:FE!\x16\xf0\xce\x1e\xfb\xe8\xea\xe6\xc2\xeek4\xd3\xea\x0fL\xe8\xfa\xbc^:\xcb׆POU\xc2H(\xb9\x05Xua4S\xdc\x0f>+\x8eaĖhV,q\xd3\xf7eYōW\xf5\x1e\x00f\x8aC\xcc Ӹ8\xd9ˈVf\x1cE\x89\x92F\xe58Jr\xb5\xe6\xa3T\xa9\xd4N\xd42z\\\xcfQK$4\xd1J\xf1\xa8(v\xed\xb3,{@_\t\x91K\xbc\xbd\xbf\xb2,\x8a\xed\x15\xcc\r\x96%\xc7\x05[\xe7T\x14(\xb9\xa7\rٖ\xe5\xcf+/\xd8I#V\xa5aY\xeeM\x9a\xc6q\xc4&\xad\x03\x00\xb0j\xbd.{\xa98\xbe:\xfd\xea\x94^\x96AmݓB\xe0~]\x16\x89w6Q(\xe8\xd7e\xf4\x92\x1cz\x1dm:uYF\xab\xe6\xddp\x87\xbdi\x12ю\x8eQu\xceF\xcb\xf8\"\xf0[\xadF\xb4D\xd2\"1{\x930\xe8Hؠ\x0eê\x97͘6\xe8\xfa\xc2B\xa4k\xedTht\xb1\xa2\xf8&(\x83љ\xc3\xcb28\x12\x9b\xd7oaLz\x12S6\xf16\xb0\x109\xdan\x11G\x94Mb\xe2V\x18\x0f]\x06Ľ\xac|\x12G\xa4\xbb\x1c\x97\"\xb7G\xd5\xf4\rK?t\x02\x83\xd4\xe7\x884\xe4{\x85\x12\xb5H gs\xb4\xbd.\x0f\x95\xd0$\n6Sg2\xaak\xe5Ťrs\xe7w\xb3Vma\x80\xf6\xa6\xaa\xe9\x8a9\xd46t\x05\xafM\x03\x7f\xa7$_\x1e\xa1O\x90-\xf6\x17h2\x15\x86P\x02\xe3\\\xa3i\x9d\x93GN=0ĠR\xc8\xf1\t\xf3\xa6\xf3L\xabe\xaeR_`\xa3\xa9\x85\x7f@\xb1Pz\xc9h7ǥ\xc3\aH>\xf9;\x06+\x8d\v\xf1\xbdI\x14\x90\x99\x03\x86\x18\x94\x14\xa4\xb4\x90\xa9\xfb\xa0A\xc9[\x82\xd4\xf0ǀ\x0ep\x85\x1e\x04\xd7\xe7\xa0Ѩ\xb5nWYբn\x038L\xb5D\xcapm\xe0\xe1v\xdaU\xc8#\x0f\xb7\xd3\x01\x86;!\x1f\x9b~v>`\xfeQ\xa4\xbf\xadQ?\x83\xeb'M\xc7\rro\x81\xa1\x80ĒG\xae\xc5\x13\xea\xbe\xd2j\xc0?\xae\xaf;R\x1aAH\xd7\xc1\fp\xa11!\xa5\x9fۄJ㵴\x9d̜o\f\x068\x1f\f\xc2\xd5\xcdE\xef\xd1<\x18\xbc\xba\xb9x\xc1\xb9X\x12\x8d\xc6\xd6\x16!\x87\xeb\x99\xe9\xd0\xdcV\xe0\xf5l(ï\xa7\xd3\xfe\xb4\xbe\x9eNwg\x13G\xa1݇G\xe3xr\x9a\xa6\x1aSw\xe3M\x1ceǓ\xf0V\xd8/\x9e&\x16\u07b6\xfe\xe7\xc2?Ua\x17\xd9d\xc9(ɪ\xd6\xdf\xd8|Qh&S\x84\xb7\xdea\x7f3\b\xcf\xcd\xf8\xa47\xe6&\x8eM/8l\x12k\xae\x85;\xff)\x04\xefѮ\xf9HWJ\x04\xc0}\xb9\xb9\x89T\x12\xdf4\xcd+\xad|O\x00\xed^\xbe-\xb5<z\xeb\xc1A\xb9\x16Z-+\xb1H\xed\x96\xc9\x1a\xee\xc3[RN\x9a\xbe\x00-m\xacy[\x19R\xff\x82\f\xf67\x93H`\x89\xc48#\xd6\xd5\xc1ß\x02\xfawꆞWXM\xd6R\xd0Ne\xfa\x834\xc5\bj\xb5\xe4\bk\xf7\xcf+l\xaf\x7fa\xf9\x1a\x9b\xcb\xff\x90Z\x1d\xe9\x8e&\x17\xdfWJ\x13\xa0\xd6\xca^\x0f\xfbmV\v\xe7\xc1\v\x87\rʖ(^\xeb\xe45\x84\x96v\x89ZK\xaaf93\x04\x06Q\ue5b3'tK\xcc3\xc5\xf1eR\x9e\xd9\xd0\xed\xa5)3t\x87\xd8\xf7E\xf1zq\xe3\xc8\xff\x90\x8f#\xff\xdfA\x7f\x05\x00\x00\xff\xffPK\a\b\x1d\x8a\x8fc\x06\x05\x00\x00&\x12\x00\x00PK\x01\x02\x14\x00\x14\x00\b\x00\b\x00\x00\x00BP\x1d\x8a\x8fc\x06\x05\x00\x00&\x12\x00\x00\x11\x00\t\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00statusz-tmpl.htmlUT\x05\x00\x01\x00\x116^PK\x05\x06\x00\x00\x00\x00\x01\x00\x01\x00H\x00\x00\x00N\x05\x00\x00\x00\x00"
 	fs.Register(data)
 }
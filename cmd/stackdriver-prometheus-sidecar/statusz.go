@@ -24,6 +24,7 @@ import (
 	"time"
 
 	_ "github.com/bjbloemker-google/stackdriver-prometheus-sidecar/cmd/stackdriver-prometheus-sidecar/statik"
+	"github.com/bjbloemker-google/stackdriver-prometheus-sidecar/stackdriver"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/prometheus/common/version"
@@ -39,6 +40,7 @@ type statuszHandler struct {
 	logger    log.Logger
 	projectID string
 	cfg       *mainConfig
+	errors    *stackdriver.ErrorSummary
 }
 
 func init() {
@@ -77,7 +79,8 @@ func (h *statuszHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			ClusterLocation string
 			ClusterName     string
 		}
-		Config *mainConfig
+		Config       *mainConfig
+		ExportErrors []stackdriver.ErrorClassCount
 	}
 	data.ServerName = filepath.Base(os.Args[0])
 
@@ -103,6 +106,9 @@ func (h *statuszHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	data.GKEInfo.ClusterName = h.cfg.KubernetesLabels.ClusterName
 
 	data.Config = h.cfg
+	if h.errors != nil {
+		data.ExportErrors = h.errors.Summary()
+	}
 
 	if err := statuszTmpl.Execute(w, data); err != nil {
 		level.Error(h.logger).Log("msg", "couldn't execute template", "err", err)
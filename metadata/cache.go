@@ -23,6 +23,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -32,11 +33,13 @@ import (
 
 // Cache populates and maintains a cache of metric metadata it retrieves
 // from a given Prometheus server.
-// Its methods are not safe for concurrent use.
+// Its methods are safe for concurrent use.
 type Cache struct {
-	promURL *url.URL
-	client  *http.Client
+	promURL       *url.URL
+	client        *http.Client
+	retryInterval time.Duration
 
+	mtx            sync.Mutex
 	metadata       map[string]*cacheEntry
 	seenJobs       map[string]struct{}
 	staticMetadata map[string]*Entry
@@ -55,29 +58,64 @@ type Entry struct {
 	MetricType textparse.MetricType
 	ValueType  metric_pb.MetricDescriptor_ValueType
 	Help       string
+	Unit       string
+}
+
+// unitSuffixes maps conventional Prometheus metric name suffixes to the
+// corresponding UCUM units used in Stackdriver metric descriptors.
+var unitSuffixes = map[string]string{
+	"_seconds": "s",
+	"_bytes":   "By",
+	"_ratio":   "1",
+}
+
+// InferUnit returns the metric descriptor unit implied by conventional metric
+// name suffixes, or an empty string if the name implies no particular unit.
+// Suffixes of complex types (e.g. _seconds_sum for a summary) are understood.
+func InferUnit(metric string) string {
+	for suffix, unit := range unitSuffixes {
+		if strings.HasSuffix(metric, suffix) {
+			return unit
+		}
+		for _, complexSuffix := range []string{"_sum", "_count", "_bucket", "_total"} {
+			if strings.HasSuffix(metric, suffix+complexSuffix) {
+				return unit
+			}
+		}
+	}
+	return ""
 }
 
 // NewCache returns a new cache that gets populated by the metadata endpoint
 // at the given URL.
 // It uses the default endpoint path if no specific path is provided.
-func NewCache(client *http.Client, promURL *url.URL, staticMetadata []*Entry) *Cache {
+// retryInterval determines how long a failed metadata lookup for a metric is
+// cached before it is retried; zero uses a default of 30 seconds.
+func NewCache(client *http.Client, promURL *url.URL, staticMetadata []*Entry, retryInterval time.Duration) *Cache {
 	if client == nil {
 		client = http.DefaultClient
 	}
+	if retryInterval <= 0 {
+		retryInterval = defaultRetryInterval
+	}
 	c := &Cache{
 		promURL:        promURL,
 		client:         client,
+		retryInterval:  retryInterval,
 		staticMetadata: map[string]*Entry{},
 		metadata:       map[string]*cacheEntry{},
 		seenJobs:       map[string]struct{}{},
 	}
 	for _, m := range staticMetadata {
+		if m.Unit == "" {
+			m.Unit = InferUnit(m.Metric)
+		}
 		c.staticMetadata[m.Metric] = m
 	}
 	return c
 }
 
-const retryInterval = 30 * time.Second
+const defaultRetryInterval = 30 * time.Second
 
 type cacheEntry struct {
 	*Entry
@@ -85,7 +123,7 @@ type cacheEntry struct {
 	lastFetch time.Time
 }
 
-func (e *cacheEntry) shouldRefetch() bool {
+func (e *cacheEntry) shouldRefetch(retryInterval time.Duration) bool {
 	// TODO(fabxc): how often does this happen? Do we need an exponential backoff?
 	return !e.found && time.Since(e.lastFetch) > retryInterval
 }
@@ -98,8 +136,16 @@ func (c *Cache) Get(ctx context.Context, job, instance, metric string) (*Entry,
 	if md, ok := c.staticMetadata[metric]; ok {
 		return md, nil
 	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	// Metadata for synthetic scrape health series is well-known and may not be
+	// retrievable through the API at all times. Always resolve it locally so
+	// those series can be exported reliably.
+	if md, ok := internalMetrics[metric]; ok {
+		return md, nil
+	}
 	md, ok := c.metadata[metric]
-	if !ok || md.shouldRefetch() {
+	if !ok || md.shouldRefetch(c.retryInterval) {
 		// If we are seeing the job for the first time, preemptively get a full
 		// list of all metadata for the instance.
 		if _, ok := c.seenJobs[job]; !ok {
@@ -138,6 +184,63 @@ func (c *Cache) Get(ctx context.Context, job, instance, metric string) (*Entry,
 	return nil, nil
 }
 
+// Snapshot returns a JSON-encoded copy of all metadata retrieved through the
+// API so far, which can be passed to LoadSnapshot to prime the cache of a
+// restarting sidecar. Static metadata is not included since it is always
+// available.
+func (c *Cache) Snapshot() ([]byte, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	entries := make([]*Entry, 0, len(c.metadata))
+	for _, md := range c.metadata {
+		if md.found && md.Entry != nil {
+			entries = append(entries, md.Entry)
+		}
+	}
+	return json.Marshal(entries)
+}
+
+// LoadSnapshot primes the cache with metadata produced by Snapshot. Loaded
+// entries are treated like API results, so series can be resolved before the
+// Prometheus server is reachable.
+func (c *Cache) LoadSnapshot(b []byte) error {
+	var entries []*Entry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return errors.Wrap(err, "decode metadata snapshot")
+	}
+	now := time.Now()
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, e := range entries {
+		if _, ok := c.metadata[e.Metric]; !ok {
+			c.metadata[e.Metric] = &cacheEntry{Entry: e, lastFetch: now, found: true}
+		}
+	}
+	return nil
+}
+
+// Flush drops the cached lookup state for the given job so the next lookup
+// for one of its series retrieves fresh metadata, and removes all negative
+// entries so newly added metrics resolve immediately. An empty job flushes
+// the state of all jobs.
+func (c *Cache) Flush(job string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if job == "" {
+		c.seenJobs = map[string]struct{}{}
+	} else {
+		delete(c.seenJobs, job)
+	}
+	// Metadata entries are not tracked per job, so negative entries are
+	// dropped across the board. Positive entries are kept; metadata changes
+	// for existing metrics need special handling in Stackdriver anyway.
+	for metric, md := range c.metadata {
+		if !md.found {
+			delete(c.metadata, metric)
+		}
+	}
+}
+
 func (c *Cache) fetch(ctx context.Context, typ string, q url.Values) (*apiResponse, error) {
 	u := *c.promURL
 	u.RawQuery = q.Encode()
@@ -190,7 +293,7 @@ func (c *Cache) fetchMetric(ctx context.Context, job, instance, metric string) (
 		d.Type = textparse.MetricTypeUnknown
 	}
 	return &cacheEntry{
-		Entry:     &Entry{Metric: metric, MetricType: d.Type, Help: d.Help},
+		Entry:     &Entry{Metric: metric, MetricType: d.Type, Help: d.Help, Unit: InferUnit(metric)},
 		lastFetch: now,
 		found:     true,
 	}, nil
@@ -226,7 +329,7 @@ func (c *Cache) fetchBatch(ctx context.Context, job, instance string) (map[strin
 			md.Type = textparse.MetricTypeUnknown
 		}
 		result[md.Metric] = &cacheEntry{
-			Entry:     &Entry{Metric: md.Metric, MetricType: md.Type, Help: md.Help},
+			Entry:     &Entry{Metric: md.Metric, MetricType: md.Type, Help: md.Help, Unit: InferUnit(md.Metric)},
 			lastFetch: now,
 			found:     true,
 		}
@@ -254,7 +357,8 @@ var internalMetrics = map[string]*Entry{
 		Metric:     "scrape_duration_seconds",
 		MetricType: textparse.MetricTypeGauge,
 		ValueType:  metric_pb.MetricDescriptor_DOUBLE,
-		Help:       "Duration of the last scrape"},
+		Help:       "Duration of the last scrape",
+		Unit:       "s"},
 	"scrape_samples_post_metric_relabeling": &Entry{
 		Metric:     "scrape_samples_post_metric_relabeling",
 		MetricType: textparse.MetricTypeGauge,
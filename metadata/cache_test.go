@@ -72,7 +72,7 @@ func TestCache_Get(t *testing.T) {
 		&Entry{Metric: "static_metric2", MetricType: textparse.MetricTypeCounter, ValueType: metric_pb.MetricDescriptor_DOUBLE, Help: "help_static2"},
 		&Entry{Metric: "metric_with_override", MetricType: textparse.MetricTypeCounter, ValueType: metric_pb.MetricDescriptor_INT64, Help: "help_metric_override"},
 	}
-	c := NewCache(nil, u, staticMetadata)
+	c := NewCache(nil, u, staticMetadata, 0)
 
 	// First get for the job, we expect an initial batch request.
 	handler = func(qMetric, qMatch string) *apiResponse {
@@ -243,12 +243,75 @@ func TestCache_Get(t *testing.T) {
 	}
 }
 
+func TestCache_Flush(t *testing.T) {
+	var handler func(qMetric, qMatch string) *apiResponse
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := json.NewEncoder(w).Encode(handler(
+			r.FormValue("metric"),
+			r.FormValue("match_target"),
+		))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCache(nil, u, nil, 0)
+
+	// The initial batch fetch does not know the metric yet.
+	handler = func(qMetric, qMatch string) *apiResponse {
+		return &apiResponse{Status: "success"}
+	}
+	md, err := c.Get(ctx, "prometheus", "localhost:9090", "new_metric")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md != nil {
+		t.Fatalf("expected nil metadata but got %v", md)
+	}
+	// The single-metric lookup fails as well; the result is cached negatively.
+	handler = func(qMetric, qMatch string) *apiResponse {
+		return &apiResponse{Status: "error", ErrorType: apiErrorNotFound, Error: "does not exist"}
+	}
+	if _, err := c.Get(ctx, "prometheus", "localhost:9090", "new_metric"); err != nil {
+		t.Fatal(err)
+	}
+	handler = func(qMetric, qMatch string) *apiResponse {
+		t.Error("unexpected request")
+		return nil
+	}
+	if _, err := c.Get(ctx, "prometheus", "localhost:9090", "new_metric"); err != nil {
+		t.Fatal(err)
+	}
+
+	// After a flush, the lookup is retried immediately and succeeds.
+	c.Flush("prometheus")
+	handler = func(qMetric, qMatch string) *apiResponse {
+		return &apiResponse{Status: "success", Data: []apiMetadata{
+			{Metric: "new_metric", Type: textparse.MetricTypeCounter, Help: "help_new"},
+		}}
+	}
+	md, err = c.Get(ctx, "prometheus", "localhost:9090", "new_metric")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md == nil || md.MetricType != textparse.MetricTypeCounter {
+		t.Fatalf("expected counter metadata after flush, got %v", md)
+	}
+}
+
 func TestNewCache(t *testing.T) {
 	static := []*Entry{
 		&Entry{Metric: "a", Help: "a"},
 		&Entry{Metric: "b", Help: "b"},
 	}
-	c := NewCache(nil, nil, static)
+	c := NewCache(nil, nil, static, 0)
 
 	want := map[string]*Entry{
 		"a": &Entry{Metric: "a", Help: "a"},
@@ -258,3 +321,53 @@ func TestNewCache(t *testing.T) {
 		t.Errorf("expected metadata %v but got %v", want, c.staticMetadata)
 	}
 }
+
+func TestInferUnit(t *testing.T) {
+	for _, tt := range []struct {
+		metric string
+		want   string
+	}{
+		{"http_request_duration_seconds", "s"},
+		{"http_request_duration_seconds_sum", "s"},
+		{"http_request_duration_seconds_bucket", "s"},
+		{"process_resident_memory_bytes", "By"},
+		{"cache_hit_ratio", "1"},
+		{"http_requests_total", ""},
+		{"up", ""},
+	} {
+		if got := InferUnit(tt.metric); got != tt.want {
+			t.Errorf("InferUnit(%q) = %q, want %q", tt.metric, got, tt.want)
+		}
+	}
+}
+
+func TestCache_Snapshot(t *testing.T) {
+	c := NewCache(nil, nil, nil, 0)
+	c.metadata = map[string]*cacheEntry{
+		"metric1": {
+			Entry: &Entry{Metric: "metric1", MetricType: textparse.MetricTypeGauge, Help: "help", Unit: "s"},
+			found: true,
+		},
+		// Negative lookups are not part of the snapshot.
+		"metric2": {},
+	}
+	b, err := c.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewCache(nil, nil, nil, 0)
+	if err := loaded.LoadSnapshot(b); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loaded.metadata["metric2"]; ok {
+		t.Fatalf("negative lookup was included in the snapshot")
+	}
+	md, ok := loaded.metadata["metric1"]
+	if !ok || !md.found {
+		t.Fatalf("expected found entry for metric1, got %v", md)
+	}
+	if !reflect.DeepEqual(md.Entry, c.metadata["metric1"].Entry) {
+		t.Fatalf("unexpected entry %v", md.Entry)
+	}
+}
@@ -16,17 +16,36 @@ package retrieval
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
 	promlabels "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/tsdb/fileutil"
 	"github.com/prometheus/tsdb/labels"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/stats/view"
 )
 
+// Supported values for the 'kind' option of an aggregated counter.
+const (
+	AggregationKindCumulative = "cumulative"
+	AggregationKindDelta      = "delta"
+)
+
+// deltaExportInterval determines how often views of delta aggregated counters
+// are restarted. It should match the reporting interval of the exporter so
+// that each exported point covers roughly one interval.
+const deltaExportInterval = 60 * time.Second
+
 // CounterAggregator provides the 'aggregated counters' feature of the sidecar.
 // It can be used to export a sum of multiple counters from Prometheus to
 // Stackdriver as a single cumulative metric.
@@ -37,16 +56,28 @@ import (
 type CounterAggregator struct {
 	logger      log.Logger
 	counters    []*aggregatedCounter
+	quit        chan struct{}
 	statsRecord func(context.Context, ...stats.Measurement) // used in testing.
+
+	// mtx guards the running totals of the counters.
+	mtx sync.Mutex
 }
 
 // aggregatedCounter is where CounterAggregator keeps internal state about each
 // exported metric: OpenCensus measure and view as well as a list of Matchers that
 // define which Prometheus metrics will get aggregated.
 type aggregatedCounter struct {
+	name     string
 	measure  *stats.Float64Measure
 	view     *view.View
 	matchers [][]*promlabels.Matcher
+	kind     string
+
+	// Running total and start time of the counter, guarded by the
+	// aggregator's mutex. They are persisted to the state file so restarts
+	// do not reset the exported value to zero.
+	value     float64
+	startTime time.Time
 }
 
 // CounterAggregatorConfig contains configuration for CounterAggregator. Keys of the map
@@ -55,14 +86,17 @@ type CounterAggregatorConfig map[string]*CounterAggregatorMetricConfig
 
 // CounterAggregatorMetricConfig provides configuration of a single aggregated counter.
 // Matchers specify what Prometheus metrics (which are expected to be counter metrics) will
-// be re-aggregated. Help provides a description for the exported metric.
+// be re-aggregated. Help provides a description for the exported metric. Kind determines
+// whether the exported metric behaves as a CUMULATIVE counter (default) or emits
+// per-interval DELTA points.
 type CounterAggregatorMetricConfig struct {
 	Matchers [][]*promlabels.Matcher
 	Help     string
+	Kind     string
 }
 
 func (a CounterAggregatorMetricConfig) Equal(b CounterAggregatorMetricConfig) bool {
-	return a.Help == b.Help &&
+	return a.Help == b.Help && a.Kind == b.Kind &&
 		fmt.Sprintf("%v", a.Matchers) == fmt.Sprintf("%v", b.Matchers)
 }
 
@@ -73,14 +107,25 @@ func (a CounterAggregatorMetricConfig) Equal(b CounterAggregatorMetricConfig) bo
 type counterTracker struct {
 	lastTimestamp int64
 	lastValue     float64
-	measures      []*stats.Float64Measure
+	counters      []*aggregatedCounter
 	ca            *CounterAggregator
 }
 
 // NewCounterAggregator creates a counter aggregator.
 func NewCounterAggregator(logger log.Logger, config *CounterAggregatorConfig) (*CounterAggregator, error) {
-	aggregator := &CounterAggregator{logger: logger, statsRecord: stats.Record}
+	aggregator := &CounterAggregator{logger: logger, quit: make(chan struct{}), statsRecord: stats.Record}
+	hasDelta := false
 	for metric, cfg := range *config {
+		kind := cfg.Kind
+		switch kind {
+		case "":
+			kind = AggregationKindCumulative
+		case AggregationKindCumulative:
+		case AggregationKindDelta:
+			hasDelta = true
+		default:
+			return nil, errors.Errorf("invalid kind %q for aggregated counter %s", cfg.Kind, metric)
+		}
 		measure := stats.Float64(metric, cfg.Help, stats.UnitDimensionless)
 		v := &view.View{
 			Name:        metric,
@@ -92,16 +137,48 @@ func NewCounterAggregator(logger log.Logger, config *CounterAggregatorConfig) (*
 			return nil, err
 		}
 		aggregator.counters = append(aggregator.counters, &aggregatedCounter{
-			measure:  measure,
-			view:     v,
-			matchers: cfg.Matchers,
+			name:      metric,
+			measure:   measure,
+			view:      v,
+			matchers:  cfg.Matchers,
+			kind:      kind,
+			startTime: time.Now(),
 		})
 	}
+	if hasDelta {
+		go aggregator.resetDeltaViews()
+	}
 	return aggregator, nil
 }
 
+// resetDeltaViews restarts the views of delta aggregated counters once per
+// export interval. Restarting a view resets its aggregation state and start
+// time, so each exported point only covers the preceding interval, which is
+// the closest representation of DELTA kind available through OpenCensus.
+func (c *CounterAggregator) resetDeltaViews() {
+	tick := time.NewTicker(deltaExportInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-c.quit:
+			return
+		case <-tick.C:
+			for _, counter := range c.counters {
+				if counter.kind != AggregationKindDelta {
+					continue
+				}
+				view.Unregister(counter.view)
+				if err := view.Register(counter.view); err != nil {
+					level.Error(c.logger).Log("msg", "re-registering delta view failed", "metric", counter.view.Name, "err", err)
+				}
+			}
+		}
+	}
+}
+
 // Close must be called when CounterAggregator is no longer needed.
 func (c *CounterAggregator) Close() {
+	close(c.quit)
 	for _, counter := range c.counters {
 		view.Unregister(counter.view)
 	}
@@ -111,16 +188,16 @@ func (c *CounterAggregator) Close() {
 // If `nil` is returned, it means that there are no aggregated counters that need to
 // be incremented for this time series.
 func (c *CounterAggregator) getTracker(lset labels.Labels) *counterTracker {
-	var measures []*stats.Float64Measure
+	var counters []*aggregatedCounter
 	for _, counter := range c.counters {
 		if matchFiltersets(lset, counter.matchers) {
-			measures = append(measures, counter.measure)
+			counters = append(counters, counter)
 		}
 	}
-	if len(measures) == 0 {
+	if len(counters) == 0 {
 		return nil
 	}
-	return &counterTracker{measures: measures, ca: c}
+	return &counterTracker{counters: counters, ca: c}
 }
 
 // newPoint gets called on each new sample (timestamp, value) for time series that need to feed
@@ -157,9 +234,85 @@ func (t *counterTracker) newPoint(ctx context.Context, lset labels.Labels, ts in
 	if delta == 0 {
 		return
 	}
-	ms := make([]stats.Measurement, len(t.measures))
-	for i, measure := range t.measures {
-		ms[i] = measure.M(delta)
+	ms := make([]stats.Measurement, len(t.counters))
+	t.ca.mtx.Lock()
+	for i, counter := range t.counters {
+		counter.value += delta
+		ms[i] = counter.measure.M(delta)
 	}
+	t.ca.mtx.Unlock()
 	t.ca.statsRecord(ctx, ms...)
 }
+
+// counterStateFilename is the name of the file in the state directory that
+// aggregated counter values are persisted to.
+const counterStateFilename = "counter_aggregator.json"
+
+// counterState is the persisted state of a single aggregated counter.
+type counterState struct {
+	Value     float64   `json:"value"`
+	StartTime time.Time `json:"start_time"`
+}
+
+// RestoreState loads persisted counter values from the state directory and
+// resumes the exported counters from them, so that a restart of the sidecar
+// does not appear as a counter reset to zero downstream. It must be called
+// before any samples are processed. A missing state file is not an error.
+func (c *CounterAggregator) RestoreState(dir string) error {
+	b, err := ioutil.ReadFile(filepath.Join(dir, counterStateFilename))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	state := map[string]counterState{}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return errors.Wrap(err, "corrupt counter state file")
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, counter := range c.counters {
+		// Delta counters cover single export intervals and are not restored.
+		if counter.kind != AggregationKindCumulative {
+			continue
+		}
+		s, ok := state[counter.name]
+		if !ok || s.Value <= 0 {
+			continue
+		}
+		counter.value = s.Value
+		counter.startTime = s.StartTime
+		// Seed the view with the persisted total so the exported value
+		// continues where the previous process left off.
+		c.statsRecord(context.Background(), counter.measure.M(s.Value))
+	}
+	return nil
+}
+
+// SaveState persists the current values of all cumulative aggregated counters
+// to the state directory, from where RestoreState picks them up after a
+// restart.
+func (c *CounterAggregator) SaveState(dir string) error {
+	state := map[string]counterState{}
+	c.mtx.Lock()
+	for _, counter := range c.counters {
+		if counter.kind != AggregationKindCumulative {
+			continue
+		}
+		state[counter.name] = counterState{Value: counter.value, StartTime: counter.startTime}
+	}
+	c.mtx.Unlock()
+	if len(state) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, counterStateFilename+".tmp")
+	if err := ioutil.WriteFile(tmp, b, 0666); err != nil {
+		return err
+	}
+	return fileutil.Rename(tmp, filepath.Join(dir, counterStateFilename))
+}
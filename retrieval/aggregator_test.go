@@ -17,7 +17,11 @@ package retrieval
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"io/ioutil"
 	"math"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 
@@ -27,6 +31,101 @@ import (
 	"go.opencensus.io/stats"
 )
 
+func TestCounterAggregatorKind(t *testing.T) {
+	for _, tt := range []struct {
+		kind    string
+		wantErr bool
+	}{
+		{"", false},
+		{AggregationKindCumulative, false},
+		{AggregationKindDelta, false},
+		{"bogus", true},
+	} {
+		aggr, err := NewCounterAggregator(log.NewNopLogger(), &CounterAggregatorConfig{
+			"counter_kind_test": &CounterAggregatorMetricConfig{Kind: tt.kind},
+		})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("kind %q: unexpected error %v", tt.kind, err)
+		}
+		if aggr != nil {
+			aggr.Close()
+		}
+	}
+}
+
+func TestCounterAggregatorPersistence(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "counter_aggregator_state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := &CounterAggregatorConfig{
+		"persistent_counter1": &CounterAggregatorMetricConfig{Matchers: [][]*promlabels.Matcher{
+			{&promlabels.Matcher{Type: promlabels.MatchEqual, Name: "a", Value: "a1"}},
+		}},
+	}
+	lset := labels.FromStrings("__name__", "metric1", "job", "job1", "instance", "inst1", "a", "a1")
+
+	aggr, err := NewCounterAggregator(log.NewNopLogger(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aggr.statsRecord = func(ctx context.Context, ms ...stats.Measurement) {}
+
+	tracker := aggr.getTracker(lset)
+	tracker.newPoint(ctx, lset, 1, 15)
+	tracker.newPoint(ctx, lset, 2, 25)
+
+	if err := aggr.SaveState(dir); err != nil {
+		t.Fatal(err)
+	}
+	aggr.Close()
+
+	// A new aggregator must resume from the persisted total of 10 rather
+	// than starting over from zero.
+	aggr, err = NewCounterAggregator(log.NewNopLogger(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aggr.Close()
+
+	var got []float64
+	aggr.statsRecord = func(ctx context.Context, ms ...stats.Measurement) {
+		for _, m := range ms {
+			got = append(got, m.Value())
+		}
+	}
+	if err := aggr.RestoreState(dir); err != nil {
+		t.Fatal(err)
+	}
+	tracker = aggr.getTracker(lset)
+	tracker.newPoint(ctx, lset, 3, 100)
+	tracker.newPoint(ctx, lset, 4, 105)
+
+	if want := []float64{10, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected values %v; want %v", got, want)
+	}
+	// Saving again must include the restored value plus new deltas.
+	if err := aggr.SaveState(dir); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, counterStateFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := map[string]counterState{}
+	if err := json.Unmarshal(b, &state); err != nil {
+		t.Fatal(err)
+	}
+	if v := state["persistent_counter1"].Value; v != 15 {
+		t.Errorf("unexpected persisted value %v; want 15", v)
+	}
+}
+
 func TestCounterAggregator(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
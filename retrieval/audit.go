@@ -0,0 +1,177 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// auditInterval determines how often the audit log emits a digest of the
+// exported data.
+const auditInterval = time.Minute
+
+// AuditLog wraps an Appender and records a per-interval digest of exported
+// point counts and value checksums per metric. The digests can later be
+// reconciled against what Stackdriver has stored when users claim data is
+// missing. The checksum of an interval is the XOR of a hash over each point's
+// end timestamp and value, so it does not depend on export order.
+type AuditLog struct {
+	logger log.Logger
+	next   Appender
+	w      io.Writer
+	quit   chan struct{}
+
+	mtx     sync.Mutex
+	records map[string]*auditRecord
+}
+
+// auditRecord accumulates the digest of a single metric type within the
+// current interval.
+type auditRecord struct {
+	points   int64
+	checksum uint64
+}
+
+// auditDigest is the wire format of one audit log line.
+type auditDigest struct {
+	Time     string `json:"time"`
+	Metric   string `json:"metric"`
+	Points   int64  `json:"points"`
+	Checksum string `json:"checksum"`
+}
+
+// NewAuditLog creates an audit log that passes all samples through to next.
+// Digests are written to w as JSON lines, or logged if w is nil.
+func NewAuditLog(logger log.Logger, w io.Writer, next Appender) *AuditLog {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	l := &AuditLog{
+		logger:  logger,
+		next:    next,
+		w:       w,
+		quit:    make(chan struct{}),
+		records: map[string]*auditRecord{},
+	}
+	go l.run()
+	return l
+}
+
+// Append implements Appender.
+func (l *AuditLog) Append(hash uint64, s *monitoring_pb.TimeSeries) error {
+	var points int64
+	var checksum uint64
+	for _, p := range s.Points {
+		h := fnv.New64a()
+		var buf [8]byte
+		if end := p.Interval.GetEndTime(); end != nil {
+			binary.BigEndian.PutUint64(buf[:], uint64(end.Seconds))
+			h.Write(buf[:])
+		}
+		switch v := p.Value.Value.(type) {
+		case *monitoring_pb.TypedValue_DoubleValue:
+			binary.BigEndian.PutUint64(buf[:], math.Float64bits(v.DoubleValue))
+		case *monitoring_pb.TypedValue_Int64Value:
+			binary.BigEndian.PutUint64(buf[:], uint64(v.Int64Value))
+		case *monitoring_pb.TypedValue_DistributionValue:
+			binary.BigEndian.PutUint64(buf[:], uint64(v.DistributionValue.Count))
+		}
+		h.Write(buf[:])
+		checksum ^= h.Sum64()
+		points++
+	}
+	metric := s.Metric.GetType()
+
+	l.mtx.Lock()
+	r, ok := l.records[metric]
+	if !ok {
+		r = &auditRecord{}
+		l.records[metric] = r
+	}
+	r.points += points
+	r.checksum ^= checksum
+	l.mtx.Unlock()
+
+	return l.next.Append(hash, s)
+}
+
+func (l *AuditLog) run() {
+	tick := time.NewTicker(auditInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-l.quit:
+			return
+		case <-tick.C:
+			l.flush(time.Now())
+		}
+	}
+}
+
+// flush writes the digest of the past interval and starts a new one.
+func (l *AuditLog) flush(now time.Time) {
+	l.mtx.Lock()
+	records := l.records
+	l.records = map[string]*auditRecord{}
+	l.mtx.Unlock()
+
+	metrics := make([]string, 0, len(records))
+	for metric := range records {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+
+	for _, metric := range metrics {
+		r := records[metric]
+		digest := auditDigest{
+			Time:     now.UTC().Format(time.RFC3339),
+			Metric:   metric,
+			Points:   r.points,
+			Checksum: fmt.Sprintf("%016x", r.checksum),
+		}
+		if l.w == nil {
+			level.Info(l.logger).Log("msg", "audit digest",
+				"metric", digest.Metric, "points", digest.Points, "checksum", digest.Checksum)
+			continue
+		}
+		b, err := json.Marshal(digest)
+		if err != nil {
+			level.Error(l.logger).Log("msg", "marshalling audit digest failed", "err", err)
+			continue
+		}
+		if _, err := l.w.Write(append(b, '\n')); err != nil {
+			level.Error(l.logger).Log("msg", "writing audit digest failed", "err", err)
+		}
+	}
+}
+
+// Close stops the audit log and writes the digest of the current partial
+// interval.
+func (l *AuditLog) Close() {
+	close(l.quit)
+	l.flush(time.Now())
+}
@@ -0,0 +1,98 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	timestamp_pb "github.com/golang/protobuf/ptypes/timestamp"
+	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+func auditTestSeries(metric string, ts int64, value float64) *monitoring_pb.TimeSeries {
+	return &monitoring_pb.TimeSeries{
+		Metric: &metric_pb.Metric{Type: metric},
+		Points: []*monitoring_pb.Point{{
+			Interval: &monitoring_pb.TimeInterval{
+				EndTime: &timestamp_pb.Timestamp{Seconds: ts},
+			},
+			Value: &monitoring_pb.TypedValue{
+				Value: &monitoring_pb.TypedValue_DoubleValue{DoubleValue: value},
+			},
+		}},
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	digests := func(input []*monitoring_pb.TimeSeries) []auditDigest {
+		var buf bytes.Buffer
+		next := &nopAppender{}
+		l := NewAuditLog(log.NewNopLogger(), &buf, next)
+		for _, s := range input {
+			if err := l.Append(1, s); err != nil {
+				t.Fatal(err)
+			}
+		}
+		l.Close()
+		if len(next.samples) != len(input) {
+			t.Fatalf("expected %d samples passed through, got %d", len(input), len(next.samples))
+		}
+		var out []auditDigest
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			var d auditDigest
+			if err := json.Unmarshal([]byte(line), &d); err != nil {
+				t.Fatalf("invalid digest line %q: %v", line, err)
+			}
+			out = append(out, d)
+		}
+		return out
+	}
+
+	input := []*monitoring_pb.TimeSeries{
+		auditTestSeries("metric1", 1, 2.5),
+		auditTestSeries("metric1", 2, 3.5),
+		auditTestSeries("metric2", 1, 2.5),
+	}
+	got := digests(input)
+	if len(got) != 2 {
+		t.Fatalf("expected 2 digests, got %v", got)
+	}
+	if got[0].Metric != "metric1" || got[0].Points != 2 {
+		t.Errorf("unexpected digest %v", got[0])
+	}
+	if got[1].Metric != "metric2" || got[1].Points != 1 {
+		t.Errorf("unexpected digest %v", got[1])
+	}
+	if _, err := time.Parse(time.RFC3339, got[0].Time); err != nil {
+		t.Errorf("invalid digest time %q: %v", got[0].Time, err)
+	}
+
+	// The checksum does not depend on export order.
+	reordered := digests([]*monitoring_pb.TimeSeries{input[1], input[0], input[2]})
+	if reordered[0].Checksum != got[0].Checksum {
+		t.Errorf("checksum depends on order: %q != %q", reordered[0].Checksum, got[0].Checksum)
+	}
+	// Different values produce a different checksum.
+	changed := digests([]*monitoring_pb.TimeSeries{input[0], auditTestSeries("metric1", 2, 4.5), input[2]})
+	if changed[0].Checksum == got[0].Checksum {
+		t.Errorf("checksum did not change with values")
+	}
+}
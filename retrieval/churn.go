@@ -0,0 +1,151 @@
+/*
+Copyright 2020 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retrieval
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultChurnMetricLimit bounds how many metric names the churn tracker
+// keeps individual counts for.
+const defaultChurnMetricLimit = 1000
+
+var (
+	seriesChurnDesc = prometheus.NewDesc(
+		"prometheus_sidecar_series_churn_total",
+		"Number of series created in or evicted from the series cache, by metric name and event.",
+		[]string{"metric", "event"}, nil)
+	seriesChurnOverflowDesc = prometheus.NewDesc(
+		"prometheus_sidecar_series_churn_overflow_total",
+		"Number of churn events that were not tracked individually because the metric limit was reached.",
+		nil, nil)
+)
+
+// SeriesChurnTracker counts how often series are created in and evicted from
+// the series cache per metric name. High churn indicates a runaway cardinality
+// source: many short-lived series that inflate the quota footprint without
+// providing continuous data. The counts are exposed as metrics on the
+// sidecar's own /metrics endpoint and as a top-N list on the status endpoint.
+// Cardinality is bounded by a metric name limit beyond which events are only
+// counted in an overflow series.
+// Implements prometheus.Collector.
+type SeriesChurnTracker struct {
+	limit int
+
+	mtx      sync.Mutex
+	metrics  map[string]*churnEntry
+	overflow float64
+}
+
+type churnEntry struct {
+	created float64
+	evicted float64
+}
+
+// MetricChurn is the per-metric churn summary served by the status endpoint.
+type MetricChurn struct {
+	Metric  string `json:"metric"`
+	Created int64  `json:"created"`
+	Evicted int64  `json:"evicted"`
+}
+
+// NewSeriesChurnTracker returns a tracker holding individual counts for at
+// most limit metric names. A non-positive limit selects the default.
+func NewSeriesChurnTracker(limit int) *SeriesChurnTracker {
+	if limit <= 0 {
+		limit = defaultChurnMetricLimit
+	}
+	return &SeriesChurnTracker{
+		limit:   limit,
+		metrics: map[string]*churnEntry{},
+	}
+}
+
+// ObserveCreated records that a series of the given metric was added to the
+// series cache.
+func (t *SeriesChurnTracker) ObserveCreated(metric string) {
+	t.observe(metric, func(e *churnEntry) { e.created++ })
+}
+
+// ObserveEvicted records that a series of the given metric was garbage
+// collected from the series cache.
+func (t *SeriesChurnTracker) ObserveEvicted(metric string) {
+	t.observe(metric, func(e *churnEntry) { e.evicted++ })
+}
+
+func (t *SeriesChurnTracker) observe(metric string, record func(*churnEntry)) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	entry, ok := t.metrics[metric]
+	if !ok {
+		if len(t.metrics) >= t.limit {
+			t.overflow++
+			return
+		}
+		entry = &churnEntry{}
+		t.metrics[metric] = entry
+	}
+	record(entry)
+}
+
+// TopChurners returns the n metrics with the highest combined creation and
+// eviction counts, in descending order.
+func (t *SeriesChurnTracker) TopChurners(n int) []MetricChurn {
+	t.mtx.Lock()
+	churners := make([]MetricChurn, 0, len(t.metrics))
+	for metric, entry := range t.metrics {
+		churners = append(churners, MetricChurn{
+			Metric:  metric,
+			Created: int64(entry.created),
+			Evicted: int64(entry.evicted),
+		})
+	}
+	t.mtx.Unlock()
+
+	sort.Slice(churners, func(i, j int) bool {
+		ci, cj := churners[i], churners[j]
+		if ti, tj := ci.Created+ci.Evicted, cj.Created+cj.Evicted; ti != tj {
+			return ti > tj
+		}
+		return ci.Metric < cj.Metric
+	})
+	if len(churners) > n {
+		churners = churners[:n]
+	}
+	return churners
+}
+
+// Describe implements prometheus.Collector.
+func (t *SeriesChurnTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- seriesChurnDesc
+	ch <- seriesChurnOverflowDesc
+}
+
+// Collect implements prometheus.Collector.
+func (t *SeriesChurnTracker) Collect(ch chan<- prometheus.Metric) {
+	t.mtx.Lock()
+	for metric, entry := range t.metrics {
+		ch <- prometheus.MustNewConstMetric(seriesChurnDesc,
+			prometheus.CounterValue, entry.created, metric, "created")
+		ch <- prometheus.MustNewConstMetric(seriesChurnDesc,
+			prometheus.CounterValue, entry.evicted, metric, "evicted")
+	}
+	overflow := t.overflow
+	t.mtx.Unlock()
+	ch <- prometheus.MustNewConstMetric(seriesChurnOverflowDesc,
+		prometheus.CounterValue, overflow)
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2020 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retrieval
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSeriesChurnTracker(t *testing.T) {
+	tracker := NewSeriesChurnTracker(3)
+
+	tracker.ObserveCreated("metric1")
+	tracker.ObserveCreated("metric1")
+	tracker.ObserveEvicted("metric1")
+	tracker.ObserveCreated("metric2")
+	tracker.ObserveCreated("metric3")
+	tracker.ObserveEvicted("metric3")
+	// The limit is reached, so further metrics only count as overflow.
+	tracker.ObserveCreated("metric4")
+
+	want := []MetricChurn{
+		{Metric: "metric1", Created: 2, Evicted: 1},
+		{Metric: "metric3", Created: 1, Evicted: 1},
+	}
+	if got := tracker.TopChurners(2); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected top churners %v, got %v", want, got)
+	}
+	if got := tracker.TopChurners(10); len(got) != 3 {
+		t.Errorf("expected 3 tracked metrics, got %v", got)
+	}
+	if tracker.overflow != 1 {
+		t.Errorf("expected overflow 1, got %v", tracker.overflow)
+	}
+
+	ch := make(chan prometheus.Metric, 8)
+	tracker.Collect(ch)
+	close(ch)
+	var collected int
+	for range ch {
+		collected++
+	}
+	// A created and an evicted series per tracked metric plus the overflow
+	// counter.
+	if collected != 7 {
+		t.Errorf("expected 7 metrics, got %d", collected)
+	}
+}
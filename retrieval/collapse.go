@@ -0,0 +1,167 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"sync"
+
+	timestamp_pb "github.com/golang/protobuf/ptypes/timestamp"
+	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// CollapsingAppender wraps an Appender and implements the low-cardinality
+// mode of the sidecar. Across all metrics, only an allowlisted set of metric
+// labels is kept. Series that become identical after stripping are collapsed
+// into one: cumulative counters are summed, everything else keeps the last
+// written value. Points that would go backwards in time on the collapsed
+// series are dropped.
+type CollapsingAppender struct {
+	next  Appender
+	allow map[string]bool
+
+	mtx    sync.Mutex
+	series map[uint64]*collapsedSeries
+	// Stripped metric proto and output hash for each input series, so they
+	// are computed once per series instead of once per sample.
+	mapped map[uint64]*collapsedTarget
+}
+
+// collapsedTarget is the precomputed output identity of an input series.
+type collapsedTarget struct {
+	metric *metric_pb.Metric
+	hash   uint64
+}
+
+// collapsedSeries tracks the state of one output series that one or more
+// input series collapse into.
+type collapsedSeries struct {
+	lastTimestamp int64
+	// Start time of the first collapsed cumulative point. All further points
+	// reuse it so the collapsed counter has a consistent reset timestamp.
+	start *timestamp_pb.Timestamp
+	// Last value of each input series, so the collapsed counter can be
+	// recomputed as their sum on every new point.
+	values map[uint64]float64
+}
+
+// NewCollapsingAppender returns an appender that keeps only the given metric
+// labels and collapses the resulting duplicate series before passing them on
+// to next.
+func NewCollapsingAppender(allowedLabels []string, next Appender) *CollapsingAppender {
+	allow := map[string]bool{}
+	for _, l := range allowedLabels {
+		allow[l] = true
+	}
+	return &CollapsingAppender{
+		next:   next,
+		allow:  allow,
+		series: map[uint64]*collapsedSeries{},
+		mapped: map[uint64]*collapsedTarget{},
+	}
+}
+
+// Append implements Appender.
+func (c *CollapsingAppender) Append(hash uint64, s *monitoring_pb.TimeSeries) error {
+	stripped := false
+	for name := range s.Metric.Labels {
+		if !c.allow[name] {
+			stripped = true
+			break
+		}
+	}
+	if !stripped {
+		return c.next.Append(hash, s)
+	}
+	// The input hash identifies the full series, so the stripped metric and
+	// the resulting output hash are stable per series and cached. This keeps
+	// per-sample hashing and label map rebuilding out of the hot path.
+	c.mtx.Lock()
+	target, ok := c.mapped[hash]
+	if !ok {
+		// The metric proto is shared with the series cache, so replace it
+		// rather than mutating it in place.
+		labels := make(map[string]string, len(s.Metric.Labels))
+		for name, value := range s.Metric.Labels {
+			if c.allow[name] {
+				labels[name] = value
+			}
+		}
+		metric := &metric_pb.Metric{Type: s.Metric.Type, Labels: labels}
+		target = &collapsedTarget{
+			metric: metric,
+			hash:   hashSeriesKey(s.Resource, metric),
+		}
+		c.mapped[hash] = target
+	}
+	c.mtx.Unlock()
+
+	out := *s
+	out.Metric = target.metric
+	outHash := target.hash
+
+	if len(out.Points) != 1 {
+		return c.next.Append(outHash, &out)
+	}
+	point := *out.Points[0]
+	out.Points = []*monitoring_pb.Point{&point}
+	timestamp := point.Interval.GetEndTime().GetSeconds()
+
+	c.mtx.Lock()
+	cs, ok := c.series[outHash]
+	if !ok {
+		cs = &collapsedSeries{values: map[uint64]float64{}}
+		c.series[outHash] = cs
+	}
+	if timestamp < cs.lastTimestamp {
+		// A collapsed input series lags behind the others. Its value is
+		// already accounted for, so drop the point.
+		c.mtx.Unlock()
+		return nil
+	}
+	cs.lastTimestamp = timestamp
+
+	if out.MetricKind == metric_pb.MetricDescriptor_CUMULATIVE {
+		interval := *point.Interval
+		if cs.start == nil {
+			cs.start = interval.StartTime
+		}
+		interval.StartTime = cs.start
+		point.Interval = &interval
+		switch v := point.Value.Value.(type) {
+		case *monitoring_pb.TypedValue_DoubleValue:
+			cs.values[hash] = v.DoubleValue
+			var sum float64
+			for _, value := range cs.values {
+				sum += value
+			}
+			point.Value = &monitoring_pb.TypedValue{
+				Value: &monitoring_pb.TypedValue_DoubleValue{DoubleValue: sum},
+			}
+		case *monitoring_pb.TypedValue_Int64Value:
+			cs.values[hash] = float64(v.Int64Value)
+			var sum float64
+			for _, value := range cs.values {
+				sum += value
+			}
+			point.Value = &monitoring_pb.TypedValue{
+				Value: &monitoring_pb.TypedValue_Int64Value{Int64Value: int64(sum)},
+			}
+		}
+	}
+	c.mtx.Unlock()
+
+	return c.next.Append(outHash, &out)
+}
@@ -0,0 +1,96 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"sync"
+	"time"
+
+	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// DedupAppender wraps an Appender and drops gauge points whose value is
+// identical to the last exported point of the same series. Slow-changing
+// gauges, e.g. config info metrics that are constant 1, then only cost one
+// write per suppression window instead of one per scrape. A series with an
+// unchanged value is re-exported once the window since its last exported
+// point has passed, so it does not appear stale in Stackdriver. Cumulative
+// and distribution-valued points are always passed through.
+type DedupAppender struct {
+	next   Appender
+	window time.Duration
+
+	mtx    sync.Mutex
+	series map[uint64]*dedupSeries
+}
+
+// dedupSeries is the last exported state of one series.
+type dedupSeries struct {
+	value interface{}
+	// End timestamp of the last exported point in Unix seconds. The window
+	// is measured on sample timestamps rather than wall clock so replayed
+	// backlog behaves the same as live data.
+	lastExport int64
+}
+
+// NewDedupAppender returns an appender that suppresses consecutive identical
+// gauge points for at most the given window before passing them on to next.
+func NewDedupAppender(window time.Duration, next Appender) *DedupAppender {
+	return &DedupAppender{
+		next:   next,
+		window: window,
+		series: map[uint64]*dedupSeries{},
+	}
+}
+
+// Append implements Appender.
+func (d *DedupAppender) Append(hash uint64, s *monitoring_pb.TimeSeries) error {
+	if s.MetricKind != metric_pb.MetricDescriptor_GAUGE || len(s.Points) != 1 {
+		return d.next.Append(hash, s)
+	}
+	// Only scalar values are compared. Distributions change on practically
+	// every scrape, so suppression would not pay for the comparison cost.
+	var value interface{}
+	switch v := s.Points[0].Value.Value.(type) {
+	case *monitoring_pb.TypedValue_DoubleValue:
+		value = v.DoubleValue
+	case *monitoring_pb.TypedValue_Int64Value:
+		value = v.Int64Value
+	case *monitoring_pb.TypedValue_BoolValue:
+		value = v.BoolValue
+	case *monitoring_pb.TypedValue_StringValue:
+		value = v.StringValue
+	default:
+		return d.next.Append(hash, s)
+	}
+	timestamp := s.Points[0].Interval.GetEndTime().GetSeconds()
+
+	d.mtx.Lock()
+	ds, ok := d.series[hash]
+	if ok && ds.value == value && timestamp-ds.lastExport < int64(d.window/time.Second) {
+		d.mtx.Unlock()
+		return nil
+	}
+	if !ok {
+		ds = &dedupSeries{}
+		d.series[hash] = ds
+	}
+	ds.value = value
+	ds.lastExport = timestamp
+	d.mtx.Unlock()
+
+	return d.next.Append(hash, s)
+}
@@ -0,0 +1,56 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"testing"
+	"time"
+
+	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+)
+
+func TestDedupAppenderGauges(t *testing.T) {
+	next := &nopAppender{}
+	d := NewDedupAppender(time.Minute, next)
+
+	labels := map[string]string{"job": "job1"}
+
+	d.Append(1, collapseTestSeries(metric_pb.MetricDescriptor_GAUGE, labels, 10, 1))
+	// Unchanged within the window; suppressed.
+	d.Append(1, collapseTestSeries(metric_pb.MetricDescriptor_GAUGE, labels, 20, 1))
+	// Changed value; exported.
+	d.Append(1, collapseTestSeries(metric_pb.MetricDescriptor_GAUGE, labels, 30, 2))
+	// Unchanged but the window since the last export has passed; exported.
+	d.Append(1, collapseTestSeries(metric_pb.MetricDescriptor_GAUGE, labels, 95, 2))
+	// A different series with the same value is tracked separately.
+	d.Append(2, collapseTestSeries(metric_pb.MetricDescriptor_GAUGE, labels, 96, 2))
+	// Cumulative points pass through untouched.
+	d.Append(3, collapseTestSeries(metric_pb.MetricDescriptor_CUMULATIVE, labels, 97, 5))
+	d.Append(3, collapseTestSeries(metric_pb.MetricDescriptor_CUMULATIVE, labels, 98, 5))
+
+	var got []int64
+	for _, s := range next.samples {
+		got = append(got, s.Points[0].Interval.EndTime.Seconds)
+	}
+	want := []int64{10, 30, 95, 96, 97, 98}
+	if len(got) != len(want) {
+		t.Fatalf("unexpected exported timestamps %v; want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("unexpected exported timestamps %v; want %v", got, want)
+		}
+	}
+}
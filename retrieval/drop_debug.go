@@ -0,0 +1,123 @@
+/*
+Copyright 2020 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retrieval
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// droppedSeriesTTL determines how long a dropped series stays on the debug
+// endpoint after it was last seen.
+const droppedSeriesTTL = 10 * time.Minute
+
+var (
+	droppedSeriesInfoDesc = prometheus.NewDesc(
+		"prometheus_sidecar_dropped_series_info",
+		"Number of times a recently dropped series was dropped, by series and drop reason.",
+		[]string{"reason", "series"}, nil)
+	droppedSeriesOverflowDesc = prometheus.NewDesc(
+		"prometheus_sidecar_dropped_series_overflow_total",
+		"Number of drops that were not tracked individually because the dropped series limit was reached.",
+		nil, nil)
+)
+
+// DroppedSeriesTracker records which series were recently dropped instead of
+// being exported and for what reason, and exposes them as metrics on the
+// sidecar's own /metrics endpoint. Cardinality is bounded by a series limit
+// beyond which drops are only counted in an overflow series, and entries
+// expire once they have not been dropped for a while.
+// Implements prometheus.Collector.
+type DroppedSeriesTracker struct {
+	limit int
+
+	mtx      sync.Mutex
+	series   map[droppedSeriesKey]*droppedSeriesEntry
+	overflow float64
+}
+
+type droppedSeriesKey struct {
+	reason string
+	series string
+}
+
+type droppedSeriesEntry struct {
+	count    float64
+	lastSeen time.Time
+}
+
+// NewDroppedSeriesTracker returns a tracker holding at most limit dropped
+// series.
+func NewDroppedSeriesTracker(limit int) *DroppedSeriesTracker {
+	return &DroppedSeriesTracker{
+		limit:  limit,
+		series: map[droppedSeriesKey]*droppedSeriesEntry{},
+	}
+}
+
+// Observe records that the series with the given label set was dropped.
+func (t *DroppedSeriesTracker) Observe(reason string, lset labels.Labels) {
+	key := droppedSeriesKey{reason: reason, series: lset.String()}
+	now := time.Now()
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	entry, ok := t.series[key]
+	if !ok {
+		if len(t.series) >= t.limit {
+			t.expireLocked(now)
+		}
+		if len(t.series) >= t.limit {
+			t.overflow++
+			return
+		}
+		entry = &droppedSeriesEntry{}
+		t.series[key] = entry
+	}
+	entry.count++
+	entry.lastSeen = now
+}
+
+// expireLocked removes entries that have not been dropped recently. The
+// caller must hold the mutex.
+func (t *DroppedSeriesTracker) expireLocked(now time.Time) {
+	for key, entry := range t.series {
+		if now.Sub(entry.lastSeen) > droppedSeriesTTL {
+			delete(t.series, key)
+		}
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (t *DroppedSeriesTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- droppedSeriesInfoDesc
+	ch <- droppedSeriesOverflowDesc
+}
+
+// Collect implements prometheus.Collector.
+func (t *DroppedSeriesTracker) Collect(ch chan<- prometheus.Metric) {
+	t.mtx.Lock()
+	t.expireLocked(time.Now())
+	for key, entry := range t.series {
+		ch <- prometheus.MustNewConstMetric(droppedSeriesInfoDesc,
+			prometheus.GaugeValue, entry.count, key.reason, key.series)
+	}
+	overflow := t.overflow
+	t.mtx.Unlock()
+	ch <- prometheus.MustNewConstMetric(droppedSeriesOverflowDesc,
+		prometheus.CounterValue, overflow)
+}
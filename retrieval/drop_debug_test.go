@@ -0,0 +1,69 @@
+/*
+Copyright 2020 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retrieval
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/tsdb/labels"
+)
+
+func TestDroppedSeriesTracker(t *testing.T) {
+	tracker := NewDroppedSeriesTracker(2)
+
+	lset1 := labels.FromStrings("__name__", "metric1", "job", "job1")
+	lset2 := labels.FromStrings("__name__", "metric2", "job", "job1")
+	lset3 := labels.FromStrings("__name__", "metric3", "job", "job1")
+
+	tracker.Observe("filtered", lset1)
+	tracker.Observe("filtered", lset1)
+	tracker.Observe("target_not_found", lset2)
+	// The limit is reached, so the third series only counts as overflow.
+	tracker.Observe("filtered", lset3)
+
+	if len(tracker.series) != 2 {
+		t.Fatalf("expected 2 tracked series, got %d", len(tracker.series))
+	}
+	key := droppedSeriesKey{reason: "filtered", series: lset1.String()}
+	if entry := tracker.series[key]; entry == nil || entry.count != 2 {
+		t.Errorf("unexpected entry for %v: %+v", key, entry)
+	}
+	if tracker.overflow != 1 {
+		t.Errorf("expected overflow 1, got %v", tracker.overflow)
+	}
+
+	ch := make(chan prometheus.Metric, 4)
+	tracker.Collect(ch)
+	close(ch)
+	var collected int
+	for range ch {
+		collected++
+	}
+	// Two tracked series plus the overflow counter.
+	if collected != 3 {
+		t.Errorf("expected 3 metrics, got %d", collected)
+	}
+
+	// Expiring an old entry makes room for new series again.
+	tracker.series[key].lastSeen = time.Now().Add(-2 * droppedSeriesTTL)
+	tracker.Observe("filtered", lset3)
+	if entry := tracker.series[droppedSeriesKey{reason: "filtered", series: lset3.String()}]; entry == nil || entry.count != 1 {
+		t.Errorf("expected series 3 to be tracked after expiry, got %+v", entry)
+	}
+	if _, ok := tracker.series[key]; ok {
+		t.Errorf("expected expired entry to be removed")
+	}
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2020 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retrieval
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	promlabels "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+	tsdblabels "github.com/prometheus/tsdb/labels"
+)
+
+// DynamicFilters holds include/exclude rules that can be changed at runtime
+// through an admin endpoint. They are applied on top of the static filter
+// decision cached with each series, so excluding a noisy metric takes effect
+// immediately without a restart. Rules may carry a TTL for temporary changes
+// during an incident.
+type DynamicFilters struct {
+	mtx   sync.Mutex
+	rules []*dynamicFilterRule
+}
+
+// dynamicFilterRule is one runtime rule and its wire format.
+type dynamicFilterRule struct {
+	// Selector is a PromQL metric selector the series must match.
+	Selector string `json:"selector"`
+	// Action is either "include" or "exclude".
+	Action string `json:"action"`
+	// TTL, if set on submission, expires the rule automatically.
+	TTL string `json:"ttl,omitempty"`
+	// Expires is the absolute expiry time derived from TTL, if any.
+	Expires *time.Time `json:"expires,omitempty"`
+
+	matchers []*promlabels.Matcher
+}
+
+// NewDynamicFilters returns an empty rule set.
+func NewDynamicFilters() *DynamicFilters {
+	return &DynamicFilters{}
+}
+
+// Exported returns the export decision for the label set: the decision of the
+// last matching rule, or defaultExported when no active rule matches.
+func (f *DynamicFilters) Exported(lset tsdblabels.Labels, defaultExported bool) bool {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if len(f.rules) == 0 {
+		return defaultExported
+	}
+	now := time.Now()
+	exported := defaultExported
+	for _, r := range f.rules {
+		if r.Expires != nil && now.After(*r.Expires) {
+			continue
+		}
+		if matchesRule(lset, r.matchers) {
+			exported = r.Action == "include"
+		}
+	}
+	return exported
+}
+
+// matchesRule checks whether all matchers of a rule match the label set.
+func matchesRule(lset tsdblabels.Labels, matchers []*promlabels.Matcher) bool {
+	for _, m := range matchers {
+		if !m.Matches(lset.Get(m.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// ServeHTTP implements the admin endpoint. POST adds a rule, GET lists the
+// active rules, and DELETE removes all rules.
+func (f *DynamicFilters) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var rule dynamicFilterRule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if rule.Action != "include" && rule.Action != "exclude" {
+			http.Error(w, "action must be 'include' or 'exclude'", http.StatusBadRequest)
+			return
+		}
+		matchers, err := promql.ParseMetricSelector(rule.Selector)
+		if err != nil {
+			http.Error(w, "invalid selector: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		rule.matchers = matchers
+		if rule.TTL != "" {
+			d, err := time.ParseDuration(rule.TTL)
+			if err != nil || d <= 0 {
+				http.Error(w, "invalid ttl", http.StatusBadRequest)
+				return
+			}
+			expires := time.Now().Add(d)
+			rule.Expires = &expires
+		}
+		f.mtx.Lock()
+		f.expireLocked()
+		f.rules = append(f.rules, &rule)
+		f.mtx.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&rule)
+	case http.MethodGet:
+		f.mtx.Lock()
+		f.expireLocked()
+		rules := append([]*dynamicFilterRule{}, f.rules...)
+		f.mtx.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rules)
+	case http.MethodDelete:
+		f.mtx.Lock()
+		f.rules = nil
+		f.mtx.Unlock()
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// expireLocked drops rules whose TTL has passed. Callers must hold the mutex.
+func (f *DynamicFilters) expireLocked() {
+	now := time.Now()
+	active := f.rules[:0]
+	for _, r := range f.rules {
+		if r.Expires == nil || now.Before(*r.Expires) {
+			active = append(active, r)
+		}
+	}
+	f.rules = active
+}
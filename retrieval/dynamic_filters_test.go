@@ -0,0 +1,100 @@
+/*
+Copyright 2020 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retrieval
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/tsdb/labels"
+)
+
+func postFilterRule(t *testing.T, f *DynamicFilters, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/api/v1/filters", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	return w
+}
+
+func TestDynamicFilters(t *testing.T) {
+	f := NewDynamicFilters()
+
+	noisy := labels.FromStrings("__name__", "noisy_metric", "job", "job1")
+	other := labels.FromStrings("__name__", "other_metric", "job", "job1")
+
+	// Without rules, the cached decision stands.
+	if !f.Exported(noisy, true) || f.Exported(noisy, false) {
+		t.Fatal("expected default decision without rules")
+	}
+
+	if w := postFilterRule(t, f, `{"action": "exclude", "selector": "{__name__=\"noisy_metric\"}"}`); w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body)
+	}
+	if f.Exported(noisy, true) {
+		t.Error("expected noisy metric to be excluded")
+	}
+	if !f.Exported(other, true) {
+		t.Error("expected other metric to be unaffected")
+	}
+
+	// An include rule overrides a static exclusion.
+	if w := postFilterRule(t, f, `{"action": "include", "selector": "{__name__=\"other_metric\"}"}`); w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body)
+	}
+	if !f.Exported(other, false) {
+		t.Error("expected other metric to be force-included")
+	}
+
+	// Invalid submissions are rejected.
+	for _, body := range []string{
+		`{"action": "bogus", "selector": "{__name__=\"x\"}"}`,
+		`{"action": "exclude", "selector": "{"}`,
+		`{"action": "exclude", "selector": "{__name__=\"x\"}", "ttl": "-1m"}`,
+	} {
+		if w := postFilterRule(t, f, body); w.Code != http.StatusBadRequest {
+			t.Errorf("expected rejection of %s, got %d", body, w.Code)
+		}
+	}
+
+	// DELETE removes all rules.
+	req := httptest.NewRequest("DELETE", "/api/v1/filters", nil)
+	f.ServeHTTP(httptest.NewRecorder(), req)
+	if f.Exported(noisy, true) != true {
+		t.Error("expected rules to be cleared")
+	}
+}
+
+func TestDynamicFiltersTTL(t *testing.T) {
+	f := NewDynamicFilters()
+	lset := labels.FromStrings("__name__", "noisy_metric")
+
+	if w := postFilterRule(t, f, `{"action": "exclude", "selector": "{__name__=\"noisy_metric\"}", "ttl": "1ms"}`); w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if !f.Exported(lset, true) {
+		t.Error("expected expired rule to be ignored")
+	}
+	// Listing prunes expired rules.
+	req := httptest.NewRequest("GET", "/api/v1/filters", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	if got := strings.TrimSpace(w.Body.String()); got != "[]" {
+		t.Errorf("expected empty rule list, got %s", got)
+	}
+}
@@ -0,0 +1,269 @@
+/*
+Copyright 2020 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retrieval
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bjbloemker-google/stackdriver-prometheus-sidecar/targets"
+	"github.com/ghodss/yaml"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// StatusConfigEndpoint is the default HTTP path of the Prometheus status API
+// endpoint serving the loaded configuration.
+const StatusConfigEndpoint = "api/v1/status/config"
+
+// ExternalLabelMapping maps one Prometheus external label into the exported
+// data. A label can feed the monitored resource by exposing it as a
+// discovered target label consumed by the resource maps, become a metric
+// label on every exported series, or both.
+type ExternalLabelMapping struct {
+	// Name of the external label in the Prometheus configuration.
+	Name string
+	// ResourceLabel is the discovered-label name the value is exposed as.
+	ResourceLabel string
+	// MetricLabel is the metric label the value is added as.
+	MetricLabel string
+}
+
+// ExternalLabelsCache fetches the external labels from the Prometheus status
+// API and caches them for a refresh interval, so configuration reloads are
+// picked up without restarting the sidecar.
+type ExternalLabelsCache struct {
+	logger   log.Logger
+	client   *http.Client
+	url      *url.URL
+	interval time.Duration
+
+	mtx         sync.Mutex
+	labels      labels.Labels
+	gen         uint64
+	lastRefresh time.Time
+}
+
+// NewExternalLabelsCache returns a cache reading from the status config
+// endpoint at the given URL, refetching at most once per interval.
+func NewExternalLabelsCache(logger log.Logger, client *http.Client, statusURL *url.URL, interval time.Duration) *ExternalLabelsCache {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	return &ExternalLabelsCache{
+		logger:   logger,
+		client:   client,
+		url:      statusURL,
+		interval: interval,
+	}
+}
+
+// Labels returns the current external labels along with a generation counter
+// that increments whenever the labels change. A failed refresh keeps serving
+// the last successfully fetched labels.
+func (c *ExternalLabelsCache) Labels(ctx context.Context) (labels.Labels, uint64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if time.Since(c.lastRefresh) < c.interval {
+		return c.labels, c.gen
+	}
+	c.lastRefresh = time.Now()
+	lset, err := c.fetch(ctx)
+	if err != nil {
+		level.Warn(c.logger).Log("msg", "Fetching external labels failed", "err", err)
+		return c.labels, c.gen
+	}
+	if !labels.Equal(lset, c.labels) {
+		c.labels = lset
+		c.gen++
+	}
+	return c.labels, c.gen
+}
+
+// fetch retrieves the loaded Prometheus configuration and extracts the
+// external labels from it.
+func (c *ExternalLabelsCache) fetch(ctx context.Context) (labels.Labels, error) {
+	req, err := http.NewRequest("GET", c.url.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected response status %s", resp.Status)
+	}
+	var apiResponse struct {
+		Status string `json:"status"`
+		Data   struct {
+			YAML string `json:"yaml"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&apiResponse); err != nil {
+		return nil, errors.Wrap(err, "decode response")
+	}
+	if apiResponse.Status != "success" {
+		return nil, errors.Errorf("unexpected response status %q", apiResponse.Status)
+	}
+	var config struct {
+		Global struct {
+			ExternalLabels map[string]string `json:"external_labels"`
+		} `json:"global"`
+	}
+	if err := yaml.Unmarshal([]byte(apiResponse.Data.YAML), &config); err != nil {
+		return nil, errors.Wrap(err, "decode config")
+	}
+	return labels.FromMap(config.Global.ExternalLabels), nil
+}
+
+type targetsWithExternalLabels struct {
+	TargetGetter
+	cache *ExternalLabelsCache
+	// External label name to discovered-label name.
+	resourceLabels map[string]string
+}
+
+// TargetsWithExternalLabels wraps a TargetGetter and adds the mapped external
+// labels to the discovered labels of all targets retrieved from it, where the
+// resource maps pick them up. Labels already discovered on a target are not
+// overridden.
+func TargetsWithExternalLabels(tg TargetGetter, cache *ExternalLabelsCache, mappings []ExternalLabelMapping) TargetGetter {
+	resourceLabels := map[string]string{}
+	for _, m := range mappings {
+		if m.ResourceLabel != "" {
+			resourceLabels[m.Name] = m.ResourceLabel
+		}
+	}
+	if len(resourceLabels) == 0 {
+		return tg
+	}
+	return &targetsWithExternalLabels{TargetGetter: tg, cache: cache, resourceLabels: resourceLabels}
+}
+
+func (tg *targetsWithExternalLabels) Get(ctx context.Context, lset labels.Labels) (*targets.Target, error) {
+	t, err := tg.TargetGetter.Get(ctx, lset)
+	if err != nil || t == nil {
+		return t, err
+	}
+	external, _ := tg.cache.Labels(ctx)
+	var add labels.Labels
+	for name, dst := range tg.resourceLabels {
+		if v := external.Get(name); v != "" && t.DiscoveredLabels.Get(dst) == "" {
+			add = append(add, labels.Label{Name: dst, Value: v})
+		}
+	}
+	if len(add) == 0 {
+		return t, nil
+	}
+	repl := *t
+	repl.DiscoveredLabels = append(append(labels.Labels{}, t.DiscoveredLabels...), add...)
+	sort.Sort(repl.DiscoveredLabels)
+	return &repl, nil
+}
+
+// ExternalLabelsAppender wraps an Appender and adds the mapped external
+// labels as metric labels on every exported series.
+type ExternalLabelsAppender struct {
+	next  Appender
+	cache *ExternalLabelsCache
+	// External label name to metric label name.
+	metricLabels map[string]string
+
+	mtx sync.Mutex
+	gen uint64
+	// Extended metric proto and output hash per input series, recomputed
+	// when the external labels change generation.
+	mapped map[uint64]*externalTarget
+}
+
+// externalTarget is the precomputed output identity of an input series.
+type externalTarget struct {
+	metric *metric_pb.Metric
+	hash   uint64
+}
+
+// NewExternalLabelsAppender returns an appender adding the mapped external
+// labels before passing series on to next. It returns next unchanged if no
+// mapping targets a metric label.
+func NewExternalLabelsAppender(cache *ExternalLabelsCache, mappings []ExternalLabelMapping, next Appender) Appender {
+	metricLabels := map[string]string{}
+	for _, m := range mappings {
+		if m.MetricLabel != "" {
+			metricLabels[m.Name] = m.MetricLabel
+		}
+	}
+	if len(metricLabels) == 0 {
+		return next
+	}
+	return &ExternalLabelsAppender{
+		next:         next,
+		cache:        cache,
+		metricLabels: metricLabels,
+		mapped:       map[uint64]*externalTarget{},
+	}
+}
+
+// Append implements Appender.
+func (a *ExternalLabelsAppender) Append(hash uint64, s *monitoring_pb.TimeSeries) error {
+	external, gen := a.cache.Labels(context.Background())
+
+	a.mtx.Lock()
+	if gen != a.gen {
+		a.gen = gen
+		a.mapped = map[uint64]*externalTarget{}
+	}
+	target, ok := a.mapped[hash]
+	if !ok {
+		// The metric proto is shared with the series cache, so replace it
+		// rather than mutating it in place. Labels already set on the series
+		// win over external labels.
+		extended := make(map[string]string, len(s.Metric.Labels)+len(a.metricLabels))
+		for name, value := range s.Metric.Labels {
+			extended[name] = value
+		}
+		added := false
+		for name, dst := range a.metricLabels {
+			if v := external.Get(name); v != "" && extended[dst] == "" {
+				extended[dst] = v
+				added = true
+			}
+		}
+		if added {
+			metric := &metric_pb.Metric{Type: s.Metric.Type, Labels: extended}
+			target = &externalTarget{metric: metric, hash: hashSeriesKey(s.Resource, metric)}
+		} else {
+			target = &externalTarget{metric: s.Metric, hash: hash}
+		}
+		a.mapped[hash] = target
+	}
+	a.mtx.Unlock()
+
+	if target.metric == s.Metric {
+		return a.next.Append(hash, s)
+	}
+	out := *s
+	out.Metric = target.metric
+	return a.next.Append(target.hash, &out)
+}
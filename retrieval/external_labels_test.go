@@ -0,0 +1,125 @@
+/*
+Copyright 2020 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retrieval
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/bjbloemker-google/stackdriver-prometheus-sidecar/targets"
+	"github.com/prometheus/prometheus/pkg/labels"
+	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+)
+
+// externalLabelsServer serves a mutable Prometheus status config response.
+func externalLabelsServer(t *testing.T, config *string) *ExternalLabelsCache {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data":   map[string]string{"yaml": *config},
+		})
+	}))
+	t.Cleanup(server.Close)
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewExternalLabelsCache(nil, http.DefaultClient, u, 0)
+}
+
+func TestExternalLabelsCache(t *testing.T) {
+	config := "global:\n  external_labels:\n    cluster: test-cluster\n"
+	c := externalLabelsServer(t, &config)
+	ctx := context.Background()
+
+	lset, gen := c.Labels(ctx)
+	if got := lset.Get("cluster"); got != "test-cluster" {
+		t.Fatalf("unexpected cluster label %q", got)
+	}
+	// Unchanged labels keep the generation.
+	if _, gen2 := c.Labels(ctx); gen2 != gen {
+		t.Fatalf("generation changed without a label change")
+	}
+	// A config reload must be picked up and bump the generation.
+	config = "global:\n  external_labels:\n    cluster: other-cluster\n"
+	lset, gen2 := c.Labels(ctx)
+	if got := lset.Get("cluster"); got != "other-cluster" {
+		t.Fatalf("unexpected cluster label %q after reload", got)
+	}
+	if gen2 == gen {
+		t.Fatalf("expected new generation after label change")
+	}
+}
+
+func TestTargetsWithExternalLabels(t *testing.T) {
+	config := "global:\n  external_labels:\n    cluster: test-cluster\n"
+	c := externalLabelsServer(t, &config)
+
+	base := targetMap{
+		"job1/inst1": &targets.Target{
+			Labels:           labels.FromStrings("job", "job1", "instance", "inst1"),
+			DiscoveredLabels: labels.FromStrings("__resource_a", "resource2_a"),
+		},
+	}
+	tg := TargetsWithExternalLabels(base, c, []ExternalLabelMapping{
+		{Name: "cluster", ResourceLabel: "__meta_cluster"},
+	})
+	target, err := tg.Get(context.Background(), labels.FromStrings("job", "job1", "instance", "inst1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := target.DiscoveredLabels.Get("__meta_cluster"); got != "test-cluster" {
+		t.Fatalf("unexpected discovered label %q", got)
+	}
+	// The original target must not be mutated.
+	if got := base["job1/inst1"].DiscoveredLabels.Get("__meta_cluster"); got != "" {
+		t.Fatalf("original target was mutated: %q", got)
+	}
+}
+
+func TestExternalLabelsAppender(t *testing.T) {
+	config := "global:\n  external_labels:\n    cluster: test-cluster\n"
+	c := externalLabelsServer(t, &config)
+
+	next := &nopAppender{}
+	a := NewExternalLabelsAppender(c, []ExternalLabelMapping{
+		{Name: "cluster", MetricLabel: "cluster"},
+	}, next)
+
+	in := collapseTestSeries(metric_pb.MetricDescriptor_GAUGE, map[string]string{"job": "job1"}, 10, 1)
+	if err := a.Append(1, in); err != nil {
+		t.Fatal(err)
+	}
+	if len(next.samples) != 1 {
+		t.Fatalf("expected 1 sample, got %d", len(next.samples))
+	}
+	out := next.samples[0]
+	if got := out.Metric.Labels["cluster"]; got != "test-cluster" {
+		t.Fatalf("unexpected metric label %q", got)
+	}
+	// The input series proto must not be mutated.
+	if got := in.Metric.Labels["cluster"]; got != "" {
+		t.Fatalf("input series was mutated: %q", got)
+	}
+	// Without metric label mappings the appender is elided.
+	if got := NewExternalLabelsAppender(c, []ExternalLabelMapping{
+		{Name: "cluster", ResourceLabel: "__meta_cluster"},
+	}, next); got != Appender(next) {
+		t.Fatalf("expected next appender to be returned unchanged")
+	}
+}
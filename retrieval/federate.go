@@ -0,0 +1,270 @@
+/*
+Copyright 2019 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retrieval
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	promlabels "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/textparse"
+	"github.com/prometheus/tsdb"
+	tsdblabels "github.com/prometheus/tsdb/labels"
+	"go.opencensus.io/stats"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// FederateReader periodically scrapes a Prometheus federation endpoint and
+// pushes the returned snapshots through the same series cache and sample
+// builder as the WAL-based reader. It serves environments where the WAL is
+// not accessible, e.g. managed Prometheus offerings or Windows deployments.
+type FederateReader struct {
+	logger      log.Logger
+	url         *url.URL
+	interval    time.Duration
+	matchers    []string
+	seriesCache *SeriesCache
+	builder     *SampleBuilder
+	appender    Appender
+	client      *http.Client
+
+	// Synthetic series references handed to the series cache, keyed by the
+	// label set of the scraped series.
+	refs    map[string]uint64
+	nextRef uint64
+}
+
+// NewFederateReader is the FederateReader constructor. The matchers are
+// passed to the federation endpoint as match[] selectors; if empty, all
+// series are requested.
+func NewFederateReader(
+	logger log.Logger,
+	promURL *url.URL,
+	interval time.Duration,
+	matchers []string,
+	filtersets [][]*promlabels.Matcher,
+	metricRenames map[string]string,
+	targetGetter TargetGetter,
+	metadataGetter MetadataGetter,
+	appender Appender,
+	metricsPrefix string,
+	jobPrefixes map[string]string,
+	namespaceProjects map[string]string,
+	selfJob string,
+	useGkeResource bool,
+	exportScrapeHealth bool,
+	counterAggregator *CounterAggregator,
+	gaugeAggregator *GaugeAggregator,
+	bucketFilters map[string]*BucketFilter,
+	labelJoins []*LabelJoin,
+	deltas *DeltaConfig,
+	descriptors DescriptorUpdater,
+	valueTransforms map[string]*ValueTransform,
+	gaugeIntervals map[string]*GaugeInterval,
+	escaping EscapingScheme,
+	dynamicFilters *DynamicFilters,
+	labelSplits []*LabelSplit,
+	haMerges map[string]HAMergeStrategy,
+	minCumulativeInterval time.Duration,
+	churnTracker *SeriesChurnTracker,
+	longNames LongNameAction,
+) *FederateReader {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	if len(matchers) == 0 {
+		matchers = []string{`{__name__=~".+"}`}
+	}
+	seriesCache := NewSeriesCache(
+		logger,
+		"",
+		filtersets,
+		metricRenames,
+		targetGetter,
+		metadataGetter,
+		ResourceMappings,
+		metricsPrefix,
+		jobPrefixes,
+		namespaceProjects,
+		selfJob,
+		useGkeResource,
+		exportScrapeHealth,
+		counterAggregator,
+		gaugeAggregator,
+		labelJoins,
+		deltas,
+		descriptors,
+		// The federate reader never runs the cache's garbage collection.
+		0,
+		0,
+		nil,
+		escaping,
+		labelSplits,
+		churnTracker,
+		nil,
+		longNames,
+	)
+	return &FederateReader{
+		logger:      logger,
+		url:         promURL,
+		interval:    interval,
+		matchers:    matchers,
+		seriesCache: seriesCache,
+		builder:     NewSampleBuilder(seriesCache, bucketFilters, 0, valueTransforms, gaugeIntervals, dynamicFilters, haMerges, minCumulativeInterval),
+		appender:    appender,
+		client:      &http.Client{Timeout: interval},
+		refs:        map[string]uint64{},
+	}
+}
+
+// Run scrapes the federation endpoint on every interval until the context is
+// canceled. Scrape failures are logged and retried on the next interval.
+func (r *FederateReader) Run(ctx context.Context) error {
+	level.Info(r.logger).Log("msg", "Starting federate reader...")
+
+	tick := time.NewTicker(r.interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			level.Info(r.logger).Log("msg", "Done scraping federation endpoint.")
+			return nil
+		case <-tick.C:
+			if err := r.scrape(ctx); err != nil {
+				level.Warn(r.logger).Log("msg", "Scraping federation endpoint failed", "err", err)
+			}
+		}
+	}
+}
+
+// scrape fetches a single snapshot and converts it through the sample builder.
+func (r *FederateReader) scrape(ctx context.Context) error {
+	u := *r.url
+	q := u.Query()
+	for _, m := range r.matchers {
+		q.Add("match[]", m)
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := r.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("unexpected response status %s", resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	samples, err := r.parse(ctx, b, resp.Header.Get("Content-Type"))
+	if err != nil {
+		return err
+	}
+
+	var produced int
+	processed := len(samples)
+
+	for len(samples) > 0 {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+		var outputSample *monitoring_pb.TimeSeries
+		var hash uint64
+		outputSample, hash, samples, err = r.builder.Next(ctx, samples)
+		if err != nil {
+			// Drop the remainder of the snapshot; the next scrape starts over.
+			level.Warn(r.logger).Log("msg", "Failed to build sample", "err", err)
+			break
+		}
+		if outputSample == nil {
+			continue
+		}
+		r.appender.Append(hash, outputSample)
+		produced++
+	}
+	stats.Record(ctx, samplesProcessed.M(int64(processed)), samplesProduced.M(int64(produced)))
+	return nil
+}
+
+// parse decodes the federation response body into TSDB samples, registering
+// any new series with the series cache under a synthetic reference.
+func (r *FederateReader) parse(ctx context.Context, b []byte, contentType string) ([]tsdb.RefSample, error) {
+	var (
+		samples []tsdb.RefSample
+		lset    promlabels.Labels
+		now     = time.Now().UnixNano() / int64(time.Millisecond)
+		p       = textparse.New(b, contentType)
+	)
+	for {
+		et, err := p.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "parse federation response")
+		}
+		if et != textparse.EntrySeries {
+			continue
+		}
+		_, tp, v := p.Series()
+		lset = lset[:0]
+		key := p.Metric(&lset)
+
+		ref, ok := r.refs[key]
+		if !ok {
+			r.nextRef++
+			ref = r.nextRef
+			r.refs[key] = ref
+			if err := r.seriesCache.Set(ctx, ref, toTSDBLabels(lset), 0); err != nil {
+				level.Warn(r.logger).Log("msg", "update series cache", "err", err)
+			}
+		}
+		// Federation includes the original sample timestamps. Fall back to
+		// the scrape time if a series has none.
+		t := now
+		if tp != nil {
+			t = *tp
+		}
+		samples = append(samples, tsdb.RefSample{Ref: ref, T: t, V: v})
+	}
+	return samples, nil
+}
+
+// toTSDBLabels converts parsed Prometheus labels into TSDB labels.
+func toTSDBLabels(input promlabels.Labels) tsdblabels.Labels {
+	output := make(tsdblabels.Labels, 0, len(input))
+	for _, l := range input {
+		output = append(output, tsdblabels.Label{Name: l.Name, Value: l.Value})
+	}
+	sort.Sort(output)
+	return output
+}
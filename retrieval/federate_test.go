@@ -0,0 +1,104 @@
+/*
+Copyright 2019 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retrieval
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bjbloemker-google/stackdriver-prometheus-sidecar/metadata"
+	"github.com/bjbloemker-google/stackdriver-prometheus-sidecar/targets"
+	"github.com/go-kit/kit/log"
+	promlabels "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/textparse"
+)
+
+func TestFederateReader(t *testing.T) {
+	var gotMatchers []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMatchers = r.URL.Query()["match[]"]
+		fmt.Fprintln(w, `metric1{job="job1",instance="instance1"} 5.5 2000`)
+		fmt.Fprintln(w, `metric1{job="job1",instance="instance1"} 6.5 3000`)
+	}))
+	defer srv.Close()
+
+	serverURL, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targetMap := targetMap{
+		"job1/instance1": &targets.Target{
+			Labels:           promlabels.FromStrings("job", "job1", "instance", "instance1"),
+			DiscoveredLabels: promlabels.FromStrings("__resource_a", "resource2_a"),
+		},
+	}
+	metadataMap := metadataMap{
+		"job1/instance1/metric1": &metadata.Entry{Metric: "metric1", MetricType: textparse.MetricTypeGauge},
+	}
+	resourceMaps := []ResourceMap{
+		{
+			Type: "resource2",
+			LabelMap: map[string]labelTranslation{
+				"__resource_a": constValue("resource_a"),
+			},
+		},
+	}
+	aggr, _ := NewCounterAggregator(log.NewNopLogger(), new(CounterAggregatorConfig))
+	gaugeAggr, _ := NewGaugeAggregator(log.NewNopLogger(), new(GaugeAggregatorConfig))
+	appender := &nopAppender{}
+
+	r := NewFederateReader(nil, serverURL, time.Minute, []string{`{job="job1"}`}, nil, nil,
+		targetMap, metadataMap, appender, "", nil, nil, "", false, false, aggr, gaugeAggr, nil, nil, nil, nil, nil, nil, "", nil, nil, nil, 0, nil, "")
+	// The federate reader resolves resources through the global mappings;
+	// restrict them to the test mapping for a predictable result.
+	r.seriesCache.resourceMaps = resourceMaps
+
+	if err := r.scrape(context.Background()); err != nil {
+		t.Fatalf("scrape failed: %s", err)
+	}
+	if !reflect.DeepEqual(gotMatchers, []string{`{job="job1"}`}) {
+		t.Errorf("unexpected match[] parameters %v", gotMatchers)
+	}
+	if len(appender.samples) != 2 {
+		t.Fatalf("expected 2 samples, got %d", len(appender.samples))
+	}
+	s := appender.samples[0]
+	if got := s.Metric.GetType(); got != "external.googleapis.com/prometheus/metric1" {
+		t.Errorf("unexpected metric type %q", got)
+	}
+	if got := s.Resource.GetType(); got != "resource2" {
+		t.Errorf("unexpected resource type %q", got)
+	}
+	if got := s.Points[0].Value.GetDoubleValue(); got != 5.5 {
+		t.Errorf("unexpected value %v", got)
+	}
+	if got := s.Points[0].Interval.EndTime.Seconds; got != 2 {
+		t.Errorf("unexpected end time %d", got)
+	}
+
+	// A second scrape of the same snapshot must not produce duplicates.
+	if err := r.scrape(context.Background()); err != nil {
+		t.Fatalf("scrape failed: %s", err)
+	}
+	if len(appender.samples) != 2 {
+		t.Fatalf("expected still 2 samples after duplicate scrape, got %d", len(appender.samples))
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	promlabels "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/tsdb/labels"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// Supported values for the 'op' option of an aggregated gauge.
+const (
+	GaugeAggregationSum = "sum"
+	GaugeAggregationAvg = "avg"
+	GaugeAggregationMin = "min"
+	GaugeAggregationMax = "max"
+)
+
+// GaugeAggregator provides the 'aggregated gauges' feature of the sidecar.
+// It reduces cardinality of incoming samples by recomputing them as
+// sum/avg/min/max grouped by a configured label set over a fixed window.
+// Once per window a single derived gauge point is emitted per label group
+// through OpenCensus, so users without Prometheus recording rules can still
+// aggregate at the sidecar.
+type GaugeAggregator struct {
+	logger      log.Logger
+	gauges      []*aggregatedGauge
+	quit        chan struct{}
+	statsRecord func(context.Context, []tag.Mutator, ...stats.Measurement) error // used in testing.
+}
+
+// aggregatedGauge is where GaugeAggregator keeps internal state about each
+// derived gauge: OpenCensus measure and view, the matchers that select input
+// series, and the per-window aggregation state keyed by group label values.
+type aggregatedGauge struct {
+	measure  *stats.Float64Measure
+	view     *view.View
+	matchers [][]*promlabels.Matcher
+	op       string
+	by       []string
+	tagKeys  []tag.Key
+	window   time.Duration
+
+	mtx    sync.Mutex
+	groups map[string]*gaugeGroup
+}
+
+// gaugeGroup accumulates samples for a single combination of group label
+// values within the current window.
+type gaugeGroup struct {
+	tags  []tag.Mutator
+	sum   float64
+	count int64
+	min   float64
+	max   float64
+}
+
+// GaugeAggregatorConfig contains configuration for GaugeAggregator. Keys of
+// the map are metric names that will be exported by the aggregator.
+type GaugeAggregatorConfig map[string]*GaugeAggregatorMetricConfig
+
+// GaugeAggregatorMetricConfig provides configuration of a single aggregated
+// gauge. Matchers select the input series, Op is one of sum/avg/min/max, By
+// lists the labels to group by and Window determines how often a derived point
+// is emitted.
+type GaugeAggregatorMetricConfig struct {
+	Matchers [][]*promlabels.Matcher
+	Help     string
+	Op       string
+	By       []string
+	Window   time.Duration
+}
+
+func (a GaugeAggregatorMetricConfig) Equal(b GaugeAggregatorMetricConfig) bool {
+	return a.Help == b.Help && a.Op == b.Op && a.Window == b.Window &&
+		fmt.Sprintf("%v", a.By) == fmt.Sprintf("%v", b.By) &&
+		fmt.Sprintf("%v", a.Matchers) == fmt.Sprintf("%v", b.Matchers)
+}
+
+// gaugeTracker feeds samples of a single input time series into all aggregated
+// gauges whose matchers cover it.
+type gaugeTracker struct {
+	gauges []*aggregatedGauge
+	ga     *GaugeAggregator
+}
+
+// NewGaugeAggregator creates a gauge aggregator.
+func NewGaugeAggregator(logger log.Logger, config *GaugeAggregatorConfig) (*GaugeAggregator, error) {
+	aggregator := &GaugeAggregator{logger: logger, quit: make(chan struct{}), statsRecord: stats.RecordWithTags}
+	for metric, cfg := range *config {
+		switch cfg.Op {
+		case GaugeAggregationSum, GaugeAggregationAvg, GaugeAggregationMin, GaugeAggregationMax:
+		default:
+			return nil, errors.Errorf("invalid op %q for aggregated gauge %s", cfg.Op, metric)
+		}
+		window := cfg.Window
+		if window == 0 {
+			window = deltaExportInterval
+		}
+		var tagKeys []tag.Key
+		for _, l := range cfg.By {
+			key, err := tag.NewKey(l)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid group-by label %q for aggregated gauge %s", l, metric)
+			}
+			tagKeys = append(tagKeys, key)
+		}
+		measure := stats.Float64(metric, cfg.Help, stats.UnitDimensionless)
+		v := &view.View{
+			Name:        metric,
+			Description: cfg.Help,
+			Measure:     measure,
+			TagKeys:     tagKeys,
+			Aggregation: view.LastValue(),
+		}
+		if err := view.Register(v); err != nil {
+			return nil, err
+		}
+		g := &aggregatedGauge{
+			measure:  measure,
+			view:     v,
+			matchers: cfg.Matchers,
+			op:       cfg.Op,
+			by:       cfg.By,
+			tagKeys:  tagKeys,
+			window:   window,
+			groups:   map[string]*gaugeGroup{},
+		}
+		aggregator.gauges = append(aggregator.gauges, g)
+		go aggregator.flushLoop(g)
+	}
+	return aggregator, nil
+}
+
+// flushLoop emits the aggregated value of each group once per window and
+// starts a fresh window.
+func (a *GaugeAggregator) flushLoop(g *aggregatedGauge) {
+	tick := time.NewTicker(g.window)
+	defer tick.Stop()
+	for {
+		select {
+		case <-a.quit:
+			return
+		case <-tick.C:
+			a.flush(g)
+		}
+	}
+}
+
+// flush computes the derived value for every group accumulated in the current
+// window, records it and resets the window state.
+func (a *GaugeAggregator) flush(g *aggregatedGauge) {
+	g.mtx.Lock()
+	groups := g.groups
+	g.groups = map[string]*gaugeGroup{}
+	g.mtx.Unlock()
+
+	for _, group := range groups {
+		var value float64
+		switch g.op {
+		case GaugeAggregationSum:
+			value = group.sum
+		case GaugeAggregationAvg:
+			value = group.sum / float64(group.count)
+		case GaugeAggregationMin:
+			value = group.min
+		case GaugeAggregationMax:
+			value = group.max
+		}
+		if err := a.statsRecord(context.Background(), group.tags, g.measure.M(value)); err != nil {
+			level.Error(a.logger).Log("msg", "recording aggregated gauge failed", "metric", g.view.Name, "err", err)
+		}
+	}
+}
+
+// Close must be called when GaugeAggregator is no longer needed.
+func (a *GaugeAggregator) Close() {
+	close(a.quit)
+	for _, g := range a.gauges {
+		view.Unregister(g.view)
+	}
+}
+
+// getTracker returns a gaugeTracker for a specific time series defined by
+// labelset. If `nil` is returned, no aggregated gauge takes input from this
+// time series.
+func (a *GaugeAggregator) getTracker(lset labels.Labels) *gaugeTracker {
+	var gauges []*aggregatedGauge
+	for _, g := range a.gauges {
+		if matchFiltersets(lset, g.matchers) {
+			gauges = append(gauges, g)
+		}
+	}
+	if len(gauges) == 0 {
+		return nil
+	}
+	return &gaugeTracker{gauges: gauges, ga: a}
+}
+
+// newPoint gets called on each new sample of time series that feed values
+// into aggregated gauges.
+func (t *gaugeTracker) newPoint(lset labels.Labels, v float64) {
+	if math.IsNaN(v) {
+		return
+	}
+	for _, g := range t.gauges {
+		g.observe(lset, v)
+	}
+}
+
+// observe folds a sample into the group state of the current window.
+func (g *aggregatedGauge) observe(lset labels.Labels, v float64) {
+	var key strings.Builder
+	tags := make([]tag.Mutator, 0, len(g.by))
+	for i, l := range g.by {
+		value := lset.Get(l)
+		key.WriteString(value)
+		key.WriteByte('\xff')
+		tags = append(tags, tag.Upsert(g.tagKeys[i], value))
+	}
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	group, ok := g.groups[key.String()]
+	if !ok {
+		group = &gaugeGroup{tags: tags, min: v, max: v}
+		g.groups[key.String()] = group
+	}
+	group.sum += v
+	group.count++
+	if v < group.min {
+		group.min = v
+	}
+	if v > group.max {
+		group.max = v
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	promlabels "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/tsdb/labels"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+func TestGaugeAggregatorOp(t *testing.T) {
+	for _, tt := range []struct {
+		op      string
+		wantErr bool
+	}{
+		{GaugeAggregationSum, false},
+		{GaugeAggregationAvg, false},
+		{GaugeAggregationMin, false},
+		{GaugeAggregationMax, false},
+		{"", true},
+		{"bogus", true},
+	} {
+		aggr, err := NewGaugeAggregator(log.NewNopLogger(), &GaugeAggregatorConfig{
+			"gauge_op_test": &GaugeAggregatorMetricConfig{Op: tt.op},
+		})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("op %q: unexpected error %v", tt.op, err)
+		}
+		if aggr != nil {
+			aggr.Close()
+		}
+	}
+}
+
+func TestGaugeAggregator(t *testing.T) {
+	for _, tt := range []struct {
+		op    string
+		input []float64
+		want  []float64
+	}{
+		{GaugeAggregationSum, []float64{3, 4, 5}, []float64{12}},
+		{GaugeAggregationAvg, []float64{3, 4, 5}, []float64{4}},
+		{GaugeAggregationMin, []float64{4, 3, 5}, []float64{3}},
+		{GaugeAggregationMax, []float64{4, 5, 3}, []float64{5}},
+		{GaugeAggregationSum, []float64{3, math.NaN(), 4}, []float64{7}},
+	} {
+		t.Run(tt.op, func(t *testing.T) {
+			aggr, err := NewGaugeAggregator(log.NewNopLogger(), &GaugeAggregatorConfig{
+				"gauge1": &GaugeAggregatorMetricConfig{
+					Op: tt.op,
+					By: []string{"job"},
+					Matchers: [][]*promlabels.Matcher{
+						{&promlabels.Matcher{Type: promlabels.MatchEqual, Name: "a", Value: "a1"}},
+					},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer aggr.Close()
+
+			var got []float64
+			aggr.statsRecord = func(ctx context.Context, mutators []tag.Mutator, ms ...stats.Measurement) error {
+				for _, m := range ms {
+					got = append(got, m.Value())
+				}
+				return nil
+			}
+
+			lset := labels.FromStrings("__name__", "metric1", "job", "job1", "instance", "inst1", "a", "a1")
+			tracker := aggr.getTracker(lset)
+			if tracker == nil {
+				t.Fatal("expected tracker for matching series")
+			}
+			if aggr.getTracker(labels.FromStrings("__name__", "metric1", "a", "a2")) != nil {
+				t.Fatal("unexpected tracker for non-matching series")
+			}
+
+			for _, v := range tt.input {
+				tracker.newPoint(lset, v)
+			}
+			aggr.flush(aggr.gauges[0])
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unexpected values %v; want %v", got, tt.want)
+			}
+
+			// A flushed window leaves no residual state behind.
+			got = nil
+			aggr.flush(aggr.gauges[0])
+			if got != nil {
+				t.Errorf("unexpected values after empty window: %v", got)
+			}
+		})
+	}
+}
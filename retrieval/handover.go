@@ -0,0 +1,120 @@
+/*
+Copyright 2020 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retrieval
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+const handoverFilename = "stackdriver_sidecar_handover.json"
+
+// HandoverResetPoint carries the counter reset tracking of a single series,
+// keyed by the hash of its WAL label set so it can be matched up across
+// instances.
+type HandoverResetPoint struct {
+	Hash              uint64  `json:"hash"`
+	ResetValue        float64 `json:"reset_value"`
+	ResetTimestamp    int64   `json:"reset_timestamp"`
+	PreviousValue     float64 `json:"previous_value"`
+	PreviousTimestamp int64   `json:"previous_timestamp"`
+}
+
+// HandoverState is the JSON object of the handover file a stopping sidecar
+// writes for its replacement. It carries the exact WAL position and the
+// counter reset state, so the new instance neither re-reads flushed samples
+// nor skips the first sample of every cumulative series to seed a new reset
+// timestamp.
+type HandoverState struct {
+	// Offset is the WAL read position when the old instance stopped. Unlike
+	// the periodic progress file it carries no safety margin, since the old
+	// instance stopped cleanly.
+	Offset int `json:"offset"`
+	// ResetPoints is the reset tracking of every initialized cumulative
+	// series.
+	ResetPoints []HandoverResetPoint `json:"reset_points"`
+}
+
+// WriteHandoverFile writes the handover state into the given directory. Like
+// the progress file it is gzip-compressed, written to a temporary name,
+// synced, and atomically renamed into place.
+func WriteHandoverFile(dir string, state *HandoverState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, handoverFilename+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, handoverFilename))
+}
+
+// ReadHandoverFile reads and removes the handover file in the given
+// directory. The removal ensures a later cold restart does not resume from
+// state that has long gone stale. It returns a nil state and no error if the
+// directory has no handover file.
+func ReadHandoverFile(dir string) (*HandoverState, error) {
+	filename := filepath.Join(dir, handoverFilename)
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Decompressing verifies the checksum in the gzip footer and detects
+	// files truncated by a crash.
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, errors.Wrap(err, "corrupt handover file")
+	}
+	if b, err = ioutil.ReadAll(zr); err != nil {
+		return nil, errors.Wrap(err, "corrupt handover file")
+	}
+	var state HandoverState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, errors.Wrap(err, "corrupt handover file")
+	}
+	if err := os.Remove(filename); err != nil {
+		return nil, errors.Wrap(err, "consume handover file")
+	}
+	return &state, nil
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2020 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retrieval
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/bjbloemker-google/stackdriver-prometheus-sidecar/metadata"
+	"github.com/bjbloemker-google/stackdriver-prometheus-sidecar/targets"
+	"github.com/go-kit/kit/log"
+	promlabels "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/textparse"
+	"github.com/prometheus/tsdb/labels"
+	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+)
+
+func TestHandoverFile(t *testing.T) {
+	dir := t.TempDir()
+
+	// A directory without a handover file yields no state and no error.
+	if state, err := ReadHandoverFile(dir); state != nil || err != nil {
+		t.Fatalf("unexpected state %v, error %v", state, err)
+	}
+
+	want := &HandoverState{
+		Offset: 12345,
+		ResetPoints: []HandoverResetPoint{
+			{Hash: 77, ResetValue: 5, ResetTimestamp: 1000, PreviousValue: 8, PreviousTimestamp: 16000},
+		},
+	}
+	if err := WriteHandoverFile(dir, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadHandoverFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected state %+v, want %+v", got, want)
+	}
+	// The file is consumed by the read and gone on the next one.
+	if state, err := ReadHandoverFile(dir); state != nil || err != nil {
+		t.Fatalf("expected handover file to be consumed, got %v, error %v", state, err)
+	}
+}
+
+func TestSeriesCache_RestoreResetPoints(t *testing.T) {
+	resourceMaps := []ResourceMap{
+		{
+			Type:     "resource2",
+			LabelMap: map[string]labelTranslation{"__resource_a": constValue("resource_a")},
+		},
+	}
+	targetMap := targetMap{
+		"job1/inst1": &targets.Target{
+			Labels:           promlabels.FromStrings("job", "job1", "instance", "inst1"),
+			DiscoveredLabels: promlabels.FromStrings("__resource_a", "resource2_a"),
+		},
+	}
+	metadataMap := metadataMap{
+		"job1/inst1/metric1": &metadata.Entry{Metric: "metric1", MetricType: textparse.MetricTypeCounter, ValueType: metric_pb.MetricDescriptor_DOUBLE},
+	}
+	aggr, _ := NewCounterAggregator(log.NewNopLogger(), new(CounterAggregatorConfig))
+	gaugeAggr, _ := NewGaugeAggregator(log.NewNopLogger(), new(GaugeAggregatorConfig))
+	c := NewSeriesCache(nil, "", nil, nil, targetMap, metadataMap, resourceMaps, "", nil, nil, "", false, false, aggr, gaugeAggr, nil, nil, nil, 0, 0, nil, "", nil, nil, nil, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lset := labels.FromStrings("__name__", "metric1", "job", "job1", "instance", "inst1")
+	c.RestoreResetPoints([]HandoverResetPoint{
+		{Hash: lset.Hash(), ResetValue: 5, ResetTimestamp: 1000, PreviousValue: 8, PreviousTimestamp: 16000},
+	})
+
+	const refID = 1
+	if err := c.Set(ctx, refID, lset, 5); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, ok, err := c.Get(ctx, refID); !ok || err != nil {
+		t.Fatalf("expected cache entry but got none, error: %s", err)
+	}
+	// The first sample continues the restored interval instead of being
+	// skipped to seed a new reset timestamp.
+	rt, v, ok := c.GetResetAdjusted(refID, 31000, 9)
+	if !ok || rt != 1000 || v != 4 {
+		t.Errorf("unexpected adjusted sample (%d, %v, %v)", rt, v, ok)
+	}
+	// A reset since the handover is still detected against the restored
+	// previous value.
+	lset2 := labels.FromStrings("__name__", "metric1", "job", "job1", "instance", "inst1", "case", "reset")
+	c.RestoreResetPoints([]HandoverResetPoint{
+		{Hash: lset2.Hash(), ResetValue: 5, ResetTimestamp: 1000, PreviousValue: 8, PreviousTimestamp: 16000},
+	})
+	const refID2 = 2
+	if err := c.Set(ctx, refID2, lset2, 5); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, ok, err := c.Get(ctx, refID2); !ok || err != nil {
+		t.Fatalf("expected cache entry but got none, error: %s", err)
+	}
+	rt, v, ok = c.GetResetAdjusted(refID2, 31000, 2)
+	if !ok || rt != 30999 || v != 2 {
+		t.Errorf("unexpected adjusted sample (%d, %v, %v)", rt, v, ok)
+	}
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2020 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retrieval
+
+import (
+	"sync"
+
+	"github.com/prometheus/tsdb/labels"
+)
+
+// internPool deduplicates strings so cached series protos sharing label
+// names, values, and metric types reference a single backing copy instead of
+// each retaining their own WAL-decoded allocation. The pool grows with label
+// cardinality, which the label count and length limits keep bounded.
+type internPool struct {
+	mtx     sync.Mutex
+	strings map[string]string
+}
+
+func newInternPool() *internPool {
+	return &internPool{strings: map[string]string{}}
+}
+
+// intern returns the pooled copy of s, adding it on first use.
+func (p *internPool) intern(s string) string {
+	p.mtx.Lock()
+	pooled, ok := p.strings[s]
+	if !ok {
+		pooled = s
+		p.strings[s] = s
+	}
+	p.mtx.Unlock()
+	return pooled
+}
+
+// internValues replaces all values of m with their pooled copies in place.
+func (p *internPool) internValues(m map[string]string) {
+	for k, v := range m {
+		m[k] = p.intern(v)
+	}
+}
+
+// internedLabels pools the label strings of all cached series.
+var internedLabels = newInternPool()
+
+// symbolTable interns the label sets cached for WAL series. Label strings
+// repeat heavily across series — every series of a metric carries the same
+// name and most of the same label pairs — so sharing one copy of each
+// distinct string cuts resident memory substantially for caches holding
+// millions of series.
+//
+// Unlike internPool, whose entries live as long as the process, the symbol
+// table reference counts its strings so churned-away series do not
+// accumulate: every internLabels call must be paired with a releaseLabels
+// call when the label set is dropped from the cache.
+type symbolTable struct {
+	mtx     sync.Mutex
+	symbols map[string]*symbol
+}
+
+type symbol struct {
+	s    string
+	refs int
+}
+
+func newSymbolTable() *symbolTable {
+	return &symbolTable{symbols: map[string]*symbol{}}
+}
+
+// internLabels returns a label set equal to lset whose name and value strings
+// are shared with all other interned label sets.
+func (t *symbolTable) internLabels(lset labels.Labels) labels.Labels {
+	interned := make(labels.Labels, len(lset))
+	t.mtx.Lock()
+	for i, l := range lset {
+		interned[i].Name = t.internLocked(l.Name)
+		interned[i].Value = t.internLocked(l.Value)
+	}
+	t.mtx.Unlock()
+	return interned
+}
+
+func (t *symbolTable) internLocked(s string) string {
+	sym, ok := t.symbols[s]
+	if !ok {
+		sym = &symbol{s: s}
+		t.symbols[s] = sym
+	}
+	sym.refs++
+	return sym.s
+}
+
+// releaseLabels decrements the reference counts of the strings in a label set
+// previously returned by internLabels and drops strings no longer referenced
+// by any label set.
+func (t *symbolTable) releaseLabels(lset labels.Labels) {
+	t.mtx.Lock()
+	for _, l := range lset {
+		t.releaseLocked(l.Name)
+		t.releaseLocked(l.Value)
+	}
+	t.mtx.Unlock()
+}
+
+func (t *symbolTable) releaseLocked(s string) {
+	sym, ok := t.symbols[s]
+	if !ok {
+		return
+	}
+	if sym.refs--; sym.refs <= 0 {
+		delete(t.symbols, s)
+	}
+}
+
+// size returns the number of distinct interned strings.
+func (t *symbolTable) size() int {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return len(t.symbols)
+}
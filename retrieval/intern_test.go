@@ -0,0 +1,91 @@
+/*
+Copyright 2020 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retrieval
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+
+	"github.com/prometheus/tsdb/labels"
+)
+
+func TestSymbolTable(t *testing.T) {
+	table := newSymbolTable()
+
+	lset1 := table.internLabels(labels.FromStrings("__name__", "metric1", "job", "job1"))
+	lset2 := table.internLabels(labels.FromStrings("__name__", "metric1", "job", "job2"))
+
+	// 5 distinct strings: __name__, metric1, job, job1, job2.
+	if got := table.size(); got != 5 {
+		t.Fatalf("expected 5 interned strings, got %d", got)
+	}
+	if !lset1.Equals(labels.FromStrings("__name__", "metric1", "job", "job1")) {
+		t.Fatalf("unexpected interned labels %s", lset1)
+	}
+
+	// Releasing one label set only drops the strings it referenced
+	// exclusively.
+	table.releaseLabels(lset1)
+	if got := table.size(); got != 4 {
+		t.Fatalf("expected 4 interned strings after release, got %d", got)
+	}
+	table.releaseLabels(lset2)
+	if got := table.size(); got != 0 {
+		t.Fatalf("expected empty table after releasing all label sets, got %d", got)
+	}
+}
+
+// benchmarkLabelMemory reports the retained heap bytes per label set for a
+// population of series shaped like a typical scrape: many series per metric
+// sharing label names and most label values.
+func benchmarkLabelMemory(b *testing.B, intern bool) {
+	// Copy strings so equal strings are distinct allocations, as they are
+	// when decoded from the WAL.
+	cp := func(s string) string { return string(append([]byte(nil), s...)) }
+	makeLabels := func(i int) labels.Labels {
+		return labels.FromStrings(
+			cp("__name__"), cp(fmt.Sprintf("http_requests_total_%d", i%100)),
+			cp("job"), cp("default/prometheus"),
+			cp("instance"), cp(fmt.Sprintf("instance-%d:9090", i%1000)),
+			cp("handler"), cp(fmt.Sprintf("/api/v1/handler_%d", i%50)),
+			cp("code"), cp(fmt.Sprintf("%d", 200+i%5)),
+		)
+	}
+	table := newSymbolTable()
+	retained := make([]labels.Labels, b.N)
+
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	for i := 0; i < b.N; i++ {
+		lset := makeLabels(i)
+		if intern {
+			lset = table.internLabels(lset)
+		}
+		retained[i] = lset
+	}
+
+	runtime.GC()
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/float64(b.N), "heap-bytes/series")
+
+	runtime.KeepAlive(retained)
+	runtime.KeepAlive(table)
+}
+
+func BenchmarkLabelMemoryRaw(b *testing.B)      { benchmarkLabelMemory(b, false) }
+func BenchmarkLabelMemoryInterned(b *testing.B) { benchmarkLabelMemory(b, true) }
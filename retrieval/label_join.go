@@ -0,0 +1,151 @@
+/*
+Copyright 2020 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retrieval
+
+import (
+	"sort"
+
+	promlabels "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// LabelJoin configures copying labels from an info metric, e.g.
+// kube_pod_labels, onto other series that share the join key labels.
+// It replaces the recording rules that are commonly used for this kind of
+// enrichment.
+type LabelJoin struct {
+	// InfoMetric is the name of the info metric whose labels are copied.
+	InfoMetric string
+	// Keys are the labels the info metric and the receiving series are
+	// joined on, e.g. namespace and pod.
+	Keys []string
+	// Labels are the info metric labels copied to matching series. If empty,
+	// all labels except the join keys are copied.
+	Labels []string
+}
+
+// joinKey returns the key under which the joined labels of an info metric
+// instance are stored. It identifies the instance through the info metric
+// name and the values of the join key labels. The second return value is
+// false if any key label is missing from the label set.
+func joinKey(infoMetric string, keys []string, lset labels.Labels) (uint64, bool) {
+	key := make(labels.Labels, 0, len(keys)+1)
+	for _, k := range keys {
+		v := lset.Get(k)
+		if v == "" {
+			return 0, false
+		}
+		key = append(key, labels.Label{Name: k, Value: v})
+	}
+	key = append(key, labels.Label{Name: "__name__", Value: infoMetric})
+	sort.Sort(key)
+	return key.Hash(), true
+}
+
+// joinedLabels selects the labels of an info metric series that are copied
+// to matching series.
+func (j *LabelJoin) joinedLabels(lset labels.Labels) promlabels.Labels {
+	var out promlabels.Labels
+	if len(j.Labels) > 0 {
+		for _, n := range j.Labels {
+			if v := lset.Get(n); v != "" {
+				out = append(out, promlabels.Label{Name: n, Value: v})
+			}
+		}
+		sort.Sort(out)
+		return out
+	}
+	for _, l := range lset {
+		if l.Name == "__name__" || l.Name == "job" || l.Name == "instance" {
+			continue
+		}
+		if j.isKey(l.Name) {
+			continue
+		}
+		out = append(out, promlabels.Label{Name: l.Name, Value: l.Value})
+	}
+	return out
+}
+
+func (j *LabelJoin) isKey(name string) bool {
+	for _, k := range j.Keys {
+		if k == name {
+			return true
+		}
+	}
+	return false
+}
+
+// observeInfoMetric records the labels an info metric series provides for its
+// join key. Series that were already populated with stale or missing joined
+// labels are invalidated so their next refresh picks up the new values.
+// Must be called without c.mtx held.
+func (c *SeriesCache) observeInfoMetric(lset labels.Labels) {
+	name := lset.Get("__name__")
+	for _, j := range c.labelJoins {
+		if j.InfoMetric != name {
+			continue
+		}
+		key, ok := joinKey(j.InfoMetric, j.Keys, lset)
+		if !ok {
+			continue
+		}
+		joined := j.joinedLabels(lset)
+
+		c.mtx.Lock()
+		if promlabels.Compare(c.joinedLabels[key], joined) == 0 {
+			c.mtx.Unlock()
+			continue
+		}
+		c.joinedLabels[key] = joined
+		for _, entry := range c.entries {
+			if !entry.populated() || entry.lset.Get("__name__") == j.InfoMetric {
+				continue
+			}
+			if k, ok := joinKey(j.InfoMetric, j.Keys, entry.lset); ok && k == key {
+				entry.proto = nil
+			}
+		}
+		c.mtx.Unlock()
+	}
+}
+
+// attachJoinedLabels extends the final label set of a series with the labels
+// joined from info metrics. The join keys are looked up on the full input
+// label set since they may have been dropped as target labels. Labels already
+// present on the series are never overwritten.
+func (c *SeriesCache) attachJoinedLabels(finalLabels promlabels.Labels, lset labels.Labels) promlabels.Labels {
+	name := lset.Get("__name__")
+	for _, j := range c.labelJoins {
+		// Never join an info metric onto itself.
+		if j.InfoMetric == name {
+			continue
+		}
+		key, ok := joinKey(j.InfoMetric, j.Keys, lset)
+		if !ok {
+			continue
+		}
+		c.mtx.Lock()
+		joined := c.joinedLabels[key]
+		c.mtx.Unlock()
+
+		for _, l := range joined {
+			if finalLabels.Get(l.Name) == "" {
+				finalLabels = append(finalLabels, l)
+			}
+		}
+	}
+	sort.Sort(finalLabels)
+	return finalLabels
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2020 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retrieval
+
+import (
+	"regexp"
+	"sort"
+
+	promlabels "github.com/prometheus/prometheus/pkg/labels"
+)
+
+// LabelSplit decomposes a composite label value into several labels through
+// a regular expression, e.g. version="appA-1.2.3-linux-amd64" into separate
+// app, version, and platform labels. Splits are applied during series
+// translation, before the label count limit is enforced.
+type LabelSplit struct {
+	// Metric restricts the split to one metric name. Empty applies it to
+	// every series carrying the source label.
+	Metric string
+	// Label is the source label whose value is split.
+	Label string
+	// Regex matches the source value. Each capture group populates the
+	// corresponding entry of Labels.
+	Regex *regexp.Regexp
+	// Labels are the target label names, one per capture group.
+	Labels []string
+	// Keep retains the source label alongside the split results.
+	Keep bool
+}
+
+// apply returns the label set with the split applied. If the source label is
+// missing or its value does not match the expression, the set is returned
+// unchanged.
+func (s *LabelSplit) apply(lset promlabels.Labels) promlabels.Labels {
+	v := lset.Get(s.Label)
+	if v == "" {
+		return lset
+	}
+	m := s.Regex.FindStringSubmatch(v)
+	if m == nil {
+		return lset
+	}
+	out := make(promlabels.Labels, 0, len(lset)+len(s.Labels))
+	for _, l := range lset {
+		if l.Name != s.Label || s.Keep {
+			out = append(out, l)
+		}
+	}
+	for i, name := range s.Labels {
+		if i+1 < len(m) && m[i+1] != "" {
+			out = append(out, promlabels.Label{Name: name, Value: m[i+1]})
+		}
+	}
+	sort.Sort(out)
+	return out
+}
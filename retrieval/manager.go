@@ -14,12 +14,16 @@ limitations under the License.
 package retrieval
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/bjbloemker-google/stackdriver-prometheus-sidecar/metadata"
@@ -27,6 +31,8 @@ import (
 	"github.com/bjbloemker-google/stackdriver-prometheus-sidecar/targets"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/tsdb"
 	"github.com/prometheus/tsdb/fileutil"
@@ -34,6 +40,8 @@ import (
 	"github.com/prometheus/tsdb/wal"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/stats/view"
+	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+	monitoredres_pb "google.golang.org/genproto/googleapis/api/monitoredres"
 	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
 )
 
@@ -86,25 +94,101 @@ func NewPrometheusReader(
 	metadataGetter MetadataGetter,
 	appender Appender,
 	metricsPrefix string,
+	jobPrefixes map[string]string,
+	namespaceProjects map[string]string,
+	selfJob string,
 	useGkeResource bool,
+	exportScrapeHealth bool,
 	counterAggregator *CounterAggregator,
+	gaugeAggregator *GaugeAggregator,
+	bucketFilters map[string]*BucketFilter,
+	maxBacklogAge time.Duration,
+	maxBackfillAge time.Duration,
+	maxSampleAge time.Duration,
+	labelJoins []*LabelJoin,
+	deltas *DeltaConfig,
+	descriptors DescriptorUpdater,
+	cacheGCInterval time.Duration,
+	inactiveSeriesTTL time.Duration,
+	valueTransforms map[string]*ValueTransform,
+	dropTracker *DroppedSeriesTracker,
+	gaugeIntervals map[string]*GaugeInterval,
+	escaping EscapingScheme,
+	dynamicFilters *DynamicFilters,
+	labelSplits []*LabelSplit,
+	haMerges map[string]HAMergeStrategy,
+	minCumulativeInterval time.Duration,
+	churnTracker *SeriesChurnTracker,
+	queryJoiner *QueryJoiner,
+	longNames LongNameAction,
 ) *PrometheusReader {
 	if logger == nil {
 		logger = log.NewNopLogger()
 	}
 	return &PrometheusReader{
-		appender:             appender,
-		logger:               logger,
-		tailer:               tailer,
-		filtersets:           filtersets,
-		walDirectory:         walDirectory,
-		targetGetter:         targetGetter,
-		metadataGetter:       metadataGetter,
-		progressSaveInterval: time.Minute,
-		metricRenames:        metricRenames,
-		metricsPrefix:        metricsPrefix,
-		useGkeResource:       useGkeResource,
-		counterAggregator:    counterAggregator,
+		appender:              appender,
+		logger:                logger,
+		tailer:                tailer,
+		filtersets:            filtersets,
+		walDirectory:          walDirectory,
+		targetGetter:          targetGetter,
+		metadataGetter:        metadataGetter,
+		progressSaveInterval:  time.Minute,
+		metricRenames:         metricRenames,
+		metricsPrefix:         metricsPrefix,
+		jobPrefixes:           jobPrefixes,
+		namespaceProjects:     namespaceProjects,
+		selfJob:               selfJob,
+		useGkeResource:        useGkeResource,
+		exportScrapeHealth:    exportScrapeHealth,
+		counterAggregator:     counterAggregator,
+		gaugeAggregator:       gaugeAggregator,
+		bucketFilters:         bucketFilters,
+		maxBacklogAge:         maxBacklogAge,
+		maxBackfillAge:        maxBackfillAge,
+		maxSampleAge:          maxSampleAge,
+		labelJoins:            labelJoins,
+		deltas:                deltas,
+		descriptors:           descriptors,
+		cacheGCInterval:       cacheGCInterval,
+		inactiveSeriesTTL:     inactiveSeriesTTL,
+		valueTransforms:       valueTransforms,
+		dropTracker:           dropTracker,
+		gaugeIntervals:        gaugeIntervals,
+		escaping:              escaping,
+		dynamicFilters:        dynamicFilters,
+		labelSplits:           labelSplits,
+		haMerges:              haMerges,
+		minCumulativeInterval: minCumulativeInterval,
+		churnTracker:          churnTracker,
+		queryJoiner:           queryJoiner,
+		longNames:             longNames,
+	}
+}
+
+// DisableProgressSaving stops the reader from writing progress files into the
+// WAL directory, keeping reads strictly side-effect free. Offline consumers
+// like the convert subcommand use this to process WALs they do not own.
+func (r *PrometheusReader) DisableProgressSaving() {
+	r.progressSaveInterval = 0
+}
+
+// SetHandoverState seeds the reader with the state a stopping instance wrote
+// for its replacement, continuing its counter reset tracking. Must be called
+// before Run.
+func (r *PrometheusReader) SetHandoverState(state *HandoverState) {
+	r.handover = state
+}
+
+// HandoverState captures the current WAL position and counter reset state for
+// a handover file. It returns nil if Run was never started.
+func (r *PrometheusReader) HandoverState() *HandoverState {
+	if r.seriesCache == nil {
+		return nil
+	}
+	return &HandoverState{
+		Offset:      r.tailer.Offset(),
+		ResetPoints: r.seriesCache.ResetPoints(),
 	}
 }
 
@@ -119,13 +203,72 @@ type PrometheusReader struct {
 	appender             Appender
 	progressSaveInterval time.Duration
 	metricsPrefix        string
+	jobPrefixes          map[string]string
+	namespaceProjects    map[string]string
+	selfJob              string
 	useGkeResource       bool
+	exportScrapeHealth   bool
 	counterAggregator    *CounterAggregator
+	gaugeAggregator      *GaugeAggregator
+	bucketFilters        map[string]*BucketFilter
+	// maxBacklogAge bounds how old samples read from the WAL may be before
+	// the reader sheds them to catch up to the WAL head. Zero disables shedding.
+	maxBacklogAge time.Duration
+	// maxBackfillAge bounds how much history is replayed on startup. Samples
+	// older than this are skipped without being exported. Zero replays all.
+	maxBackfillAge time.Duration
+	// maxSampleAge drops individual samples older than the limit at the
+	// transform stage. Zero disables the filter.
+	maxSampleAge time.Duration
+	// labelJoins configures labels copied from info metrics onto other series.
+	labelJoins []*LabelJoin
+	// deltas selects counters exported with the DELTA metric kind.
+	deltas *DeltaConfig
+	// descriptors optionally receives series metadata for descriptor updates.
+	descriptors DescriptorUpdater
+	// cacheGCInterval is how often the series cache garbage collects. Zero
+	// uses the default interval.
+	cacheGCInterval time.Duration
+	// inactiveSeriesTTL expires cached series without recent samples. Zero
+	// keeps series until their WAL references are checkpointed away.
+	inactiveSeriesTTL time.Duration
+	// valueTransforms rewrites sample values per metric name.
+	valueTransforms map[string]*ValueTransform
+	// dropTracker optionally records dropped series for the debug exporter.
+	dropTracker *DroppedSeriesTracker
+	// gaugeIntervals enforces minimum export intervals per gauge metric.
+	gaugeIntervals map[string]*GaugeInterval
+	// escaping selects how UTF-8 metric and label names are translated.
+	escaping EscapingScheme
+	// dynamicFilters optionally overrides filter decisions at runtime.
+	dynamicFilters *DynamicFilters
+	// labelSplits decomposes composite label values during translation.
+	labelSplits []*LabelSplit
+	// haMerges merges overlapping samples from redundant HA targets per metric.
+	haMerges map[string]HAMergeStrategy
+	// minCumulativeInterval coalesces cumulative points below the minimum
+	// interval width the Monitoring API permits. Zero disables it.
+	minCumulativeInterval time.Duration
+	// churnTracker optionally counts series creations and evictions per metric.
+	churnTracker *SeriesChurnTracker
+	// queryJoiner optionally attaches labels cached from periodic PromQL
+	// query results.
+	queryJoiner *QueryJoiner
+	// longNames selects how metric types exceeding the API length limit are
+	// handled.
+	longNames LongNameAction
+	// handover, if non-nil, is the state inherited from a previous instance.
+	handover *HandoverState
+	// seriesCache is set once Run starts and exposes the reset state for a
+	// handover on shutdown.
+	seriesCache *SeriesCache
 }
 
 var (
-	samplesProcessed = stats.Int64("prometheus_sidecar/samples_processed", "Number of WAL samples processed", stats.UnitDimensionless)
-	samplesProduced  = stats.Int64("prometheus_sidecar/samples_produced", "Number of Stackdriver samples produced", stats.UnitDimensionless)
+	samplesProcessed       = stats.Int64("prometheus_sidecar/samples_processed", "Number of WAL samples processed", stats.UnitDimensionless)
+	samplesProduced        = stats.Int64("prometheus_sidecar/samples_produced", "Number of Stackdriver samples produced", stats.UnitDimensionless)
+	samplesShed            = stats.Int64("prometheus_sidecar/samples_shed", "Number of WAL samples discarded because they exceeded the backlog age limit", stats.UnitDimensionless)
+	samplesSkippedBackfill = stats.Int64("prometheus_sidecar/samples_skipped_backfill", "Number of WAL samples skipped on startup because they exceeded the backfill age limit", stats.UnitDimensionless)
 )
 
 func init() {
@@ -147,12 +290,24 @@ func init() {
 		Measure:     samplesProduced,
 		Aggregation: view.Sum(),
 	})
+	view.Register(&view.View{
+		Name:        "prometheus_sidecar/samples_shed",
+		Description: "Number of WAL samples discarded because they exceeded the backlog age limit",
+		Measure:     samplesShed,
+		Aggregation: view.Sum(),
+	})
+	view.Register(&view.View{
+		Name:        "prometheus_sidecar/samples_skipped_backfill",
+		Description: "Number of WAL samples skipped on startup because they exceeded the backfill age limit",
+		Measure:     samplesSkippedBackfill,
+		Aggregation: view.Sum(),
+	})
 }
 
 func (r *PrometheusReader) Run(ctx context.Context, startOffset int) error {
 	level.Info(r.logger).Log("msg", "Starting Prometheus reader...")
 
-	seriesCache := newSeriesCache(
+	seriesCache := NewSeriesCache(
 		r.logger,
 		r.walDirectory,
 		r.filtersets,
@@ -161,12 +316,32 @@ func (r *PrometheusReader) Run(ctx context.Context, startOffset int) error {
 		r.metadataGetter,
 		ResourceMappings,
 		r.metricsPrefix,
+		r.jobPrefixes,
+		r.namespaceProjects,
+		r.selfJob,
 		r.useGkeResource,
+		r.exportScrapeHealth,
 		r.counterAggregator,
+		r.gaugeAggregator,
+		r.labelJoins,
+		r.deltas,
+		r.descriptors,
+		r.cacheGCInterval,
+		r.inactiveSeriesTTL,
+		r.dropTracker,
+		r.escaping,
+		r.labelSplits,
+		r.churnTracker,
+		r.queryJoiner,
+		r.longNames,
 	)
-	go seriesCache.run(ctx)
+	r.seriesCache = seriesCache
+	if r.handover != nil {
+		seriesCache.RestoreResetPoints(r.handover.ResetPoints)
+	}
+	go seriesCache.Run(ctx)
 
-	builder := &sampleBuilder{series: seriesCache}
+	builder := NewSampleBuilder(seriesCache, r.bucketFilters, r.maxSampleAge, r.valueTransforms, r.gaugeIntervals, r.dynamicFilters, r.haMerges, r.minCumulativeInterval)
 
 	// NOTE(fabxc): wrap the tailer into a buffered reader once we become concerned
 	// with performance. The WAL reader will do a lot of tiny reads otherwise.
@@ -180,13 +355,17 @@ func (r *PrometheusReader) Run(ctx context.Context, startOffset int) error {
 		lastSave time.Time
 		samples  []tsdb.RefSample
 		series   []tsdb.RefSeries
+		// State about the currently shed backlog range, if any.
+		shedding           bool
+		shedCount          int64
+		shedMinT, shedMaxT int64
 	)
 Outer:
 	for reader.Next() {
 		offset := r.tailer.Offset()
 		record := reader.Record()
 
-		if offset > startOffset && time.Since(lastSave) > r.progressSaveInterval {
+		if r.progressSaveInterval > 0 && offset > startOffset && time.Since(lastSave) > r.progressSaveInterval {
 			if err := SaveProgressFile(r.walDirectory, offset); err != nil {
 				level.Error(r.logger).Log("msg", "saving progress failed", "err", err)
 			} else {
@@ -203,7 +382,7 @@ Outer:
 				continue
 			}
 			for _, s := range series {
-				seriesCache.set(ctx, s.Ref, s.Labels, r.tailer.CurrentSegment())
+				seriesCache.Set(ctx, s.Ref, s.Labels, r.tailer.CurrentSegment())
 			}
 		case tsdb.RecordSamples:
 			// Skip sample records before the the boundary offset.
@@ -221,6 +400,37 @@ Outer:
 				level.Error(r.logger).Log("error", err)
 				continue
 			}
+			// Skip samples beyond the backfill age limit on startup. Unlike
+			// backlog shedding below, this applies regardless of whether we
+			// are falling behind.
+			if r.maxBackfillAge > 0 && len(samples) > 0 {
+				if time.Since(timestampTime(samples[len(samples)-1].T)) > r.maxBackfillAge {
+					stats.Record(ctx, samplesSkippedBackfill.M(int64(len(samples))))
+					continue
+				}
+			}
+			// If the backlog exceeds the configured age limit, shed sample
+			// records until we are close to the WAL head again. Exporting
+			// fresh data matters more than slowly draining a large backlog.
+			if r.maxBacklogAge > 0 && len(samples) > 0 {
+				lastT := samples[len(samples)-1].T
+				if time.Since(timestampTime(lastT)) > r.maxBacklogAge {
+					if !shedding {
+						shedding = true
+						shedMinT = samples[0].T
+					}
+					shedCount += int64(len(samples))
+					shedMaxT = lastT
+					continue
+				}
+				if shedding {
+					level.Warn(r.logger).Log("msg", "shed backlog samples exceeding age limit",
+						"samples", shedCount, "min_time", timestampTime(shedMinT), "max_time", timestampTime(shedMaxT),
+						"max_backlog_age", r.maxBacklogAge)
+					stats.Record(ctx, samplesShed.M(shedCount))
+					shedding, shedCount = false, 0
+				}
+			}
 			backoff := time.Duration(0)
 			// Do not increment the metric for produced samples each time but rather
 			// once at the end.
@@ -242,7 +452,7 @@ Outer:
 
 				var outputSample *monitoring_pb.TimeSeries
 				var hash uint64
-				outputSample, hash, samples, err = builder.next(ctx, samples)
+				outputSample, hash, samples, err = builder.Next(ctx, samples)
 				if err != nil {
 					level.Warn(r.logger).Log("msg", "Failed to build sample", "err", err)
 					backoff = exponential(backoff)
@@ -257,6 +467,13 @@ Outer:
 			stats.Record(ctx, samplesProcessed.M(int64(processed)), samplesProduced.M(int64(produced)))
 
 		case tsdb.RecordTombstones:
+		default:
+			// Newer Prometheus servers may write record types this TSDB
+			// version doesn't know, e.g. exemplar records. They carry no data
+			// we can export; ignoring them keeps tailing such WALs working.
+			// Propagating exemplar trace IDs into write logs requires a TSDB
+			// version that can decode these records.
+			level.Debug(r.logger).Log("msg", "skipping unknown WAL record type")
 		}
 	}
 	level.Info(r.logger).Log("msg", "Done processing WAL.")
@@ -268,6 +485,25 @@ const (
 	progressBufferMargin = 512 * 1024
 )
 
+var progressFileAge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+	Name: "prometheus_sidecar_progress_file_age_seconds",
+	Help: "Time in seconds since the WAL read position was last persisted. Zero until the first save.",
+}, func() float64 {
+	t := atomic.LoadInt64(&progressLastSave)
+	if t == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, t)).Seconds()
+})
+
+// progressLastSave is the time of the last successful progress file save in
+// nanoseconds since the epoch, or zero if no save happened yet.
+var progressLastSave int64
+
+func init() {
+	prometheus.MustRegister(progressFileAge)
+}
+
 // progress defines the JSON object of the progress file.
 type progress struct {
 	// Approximate WAL offset of last synchronized records in bytes.
@@ -276,22 +512,53 @@ type progress struct {
 
 // ReadPRogressFile reads the progress file in the given directory and returns
 // the saved offset.
+// The file is validated on read. If it is corrupt or truncated, e.g. left
+// behind by a crash, the backup of the previous save is tried before giving
+// up, so a single bad file costs one save interval of progress rather than a
+// full WAL replay. An error is only returned if neither file is usable.
 func ReadProgressFile(dir string) (offset int, err error) {
-	b, err := ioutil.ReadFile(filepath.Join(dir, progressFilename))
+	offset, err = readProgressFile(filepath.Join(dir, progressFilename))
+	if err == nil {
+		return offset, nil
+	}
+	if offset, berr := readProgressFile(filepath.Join(dir, progressFilename+".bak")); berr == nil {
+		return offset, nil
+	}
 	if os.IsNotExist(err) {
 		return 0, nil
 	}
+	return 0, err
+}
+
+// readProgressFile reads and validates a single progress file.
+func readProgressFile(filename string) (offset int, err error) {
+	b, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return 0, err
 	}
+	// Progress files are gzip-compressed. Decompressing verifies the checksum
+	// in the gzip footer and detects files truncated by a crash.
+	// Fall back to plain JSON for files written by older versions.
+	if bytes.HasPrefix(b, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return 0, errors.Wrap(err, "corrupt progress file")
+		}
+		if b, err = ioutil.ReadAll(zr); err != nil {
+			return 0, errors.Wrap(err, "corrupt progress file")
+		}
+	}
 	var p progress
 	if err := json.Unmarshal(b, &p); err != nil {
-		return 0, err
+		return 0, errors.Wrap(err, "corrupt progress file")
 	}
 	return p.Offset, nil
 }
 
 // SaveProgressFile saves a progress file with the given offset in directory.
+// The file is written to a temporary name, synced to disk, and atomically
+// renamed into place; the previous file is kept as a backup. A crash at any
+// point leaves either the old or the new file intact.
 func SaveProgressFile(dir string, offset int) error {
 	// Adjust offset to account for buffered records that possibly haven't been
 	// written yet.
@@ -299,16 +566,48 @@ func SaveProgressFile(dir string, offset int) error {
 	if err != nil {
 		return err
 	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
 	tmp := filepath.Join(dir, progressFilename+".tmp")
-	if err := ioutil.WriteFile(tmp, b, 0666); err != nil {
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	// Sync the contents so the rename below cannot be persisted ahead of
+	// them, which is how crashes produce empty progress files.
+	if err := f.Sync(); err != nil {
+		f.Close()
 		return err
 	}
-	if err := fileutil.Rename(tmp, filepath.Join(dir, progressFilename)); err != nil {
+	if err := f.Close(); err != nil {
 		return err
 	}
+	name := filepath.Join(dir, progressFilename)
+	if err := os.Rename(name, name+".bak"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := fileutil.Rename(tmp, name); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&progressLastSave, time.Now().UnixNano())
 	return nil
 }
 
+// timestampTime converts a millisecond sample timestamp into a time.Time.
+func timestampTime(t int64) time.Time {
+	return time.Unix(t/1000, (t%1000)*int64(time.Millisecond))
+}
+
 // TODO(jkohen): We should be able to avoid this conversion.
 func pkgLabels(input tsdblabels.Labels) labels.Labels {
 	output := make(labels.Labels, 0, len(input))
@@ -319,23 +618,29 @@ func pkgLabels(input tsdblabels.Labels) labels.Labels {
 }
 
 func hashSeries(s *monitoring_pb.TimeSeries) uint64 {
+	return hashSeriesKey(s.Resource, s.Metric)
+}
+
+// hashSeriesKey computes the stable series key over the resource and metric
+// identity, independently of any sample data in a TimeSeries proto.
+func hashSeriesKey(resource *monitoredres_pb.MonitoredResource, metric *metric_pb.Metric) uint64 {
 	const sep = '\xff'
 	h := hashNew()
 
-	h = hashAdd(h, s.Resource.Type)
+	h = hashAdd(h, resource.Type)
 	h = hashAddByte(h, sep)
-	h = hashAdd(h, s.Metric.Type)
+	h = hashAdd(h, metric.Type)
 
 	// Map iteration is randomized. We thus convert the labels to sorted slices
 	// with labels.FromMap before hashing.
-	for _, l := range labels.FromMap(s.Resource.Labels) {
+	for _, l := range labels.FromMap(resource.Labels) {
 		h = hashAddByte(h, sep)
 		h = hashAdd(h, l.Name)
 		h = hashAddByte(h, sep)
 		h = hashAdd(h, l.Value)
 	}
 	h = hashAddByte(h, sep)
-	for _, l := range labels.FromMap(s.Metric.Labels) {
+	for _, l := range labels.FromMap(metric.Labels) {
 		h = hashAddByte(h, sep)
 		h = hashAdd(h, l.Name)
 		h = hashAddByte(h, sep)
@@ -344,6 +649,32 @@ func hashSeries(s *monitoring_pb.TimeSeries) uint64 {
 	return h
 }
 
+// seriesKey builds the canonical byte sequence that hashSeriesKey digests.
+// The series cache stores it alongside the hash to detect collisions.
+func seriesKey(resource *monitoredres_pb.MonitoredResource, metric *metric_pb.Metric) string {
+	const sep = '\xff'
+	var b strings.Builder
+
+	b.WriteString(resource.Type)
+	b.WriteByte(sep)
+	b.WriteString(metric.Type)
+
+	for _, l := range labels.FromMap(resource.Labels) {
+		b.WriteByte(sep)
+		b.WriteString(l.Name)
+		b.WriteByte(sep)
+		b.WriteString(l.Value)
+	}
+	b.WriteByte(sep)
+	for _, l := range labels.FromMap(metric.Labels) {
+		b.WriteByte(sep)
+		b.WriteString(l.Name)
+		b.WriteByte(sep)
+		b.WriteString(l.Value)
+	}
+	return b.String()
+}
+
 func exponential(d time.Duration) time.Duration {
 	const (
 		min = 10 * time.Millisecond
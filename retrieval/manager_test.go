@@ -17,6 +17,7 @@ import (
 	"context"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
@@ -86,7 +87,8 @@ func TestReader_Progress(t *testing.T) {
 	}
 
 	aggr, _ := NewCounterAggregator(log.NewNopLogger(), new(CounterAggregatorConfig))
-	r := NewPrometheusReader(nil, dir, tailer, nil, nil, targetMap, metadataMap, &nopAppender{}, "", false, aggr)
+	gaugeAggr, _ := NewGaugeAggregator(log.NewNopLogger(), new(GaugeAggregatorConfig))
+	r := NewPrometheusReader(nil, dir, tailer, nil, nil, targetMap, metadataMap, &nopAppender{}, "", nil, nil, "", false, false, aggr, gaugeAggr, nil, 0, 0, 0, nil, nil, nil, 0, 0, nil, nil, nil, "", nil, nil, nil, 0, nil, nil, "")
 	r.progressSaveInterval = 200 * time.Millisecond
 
 	// Populate sample data
@@ -143,7 +145,7 @@ func TestReader_Progress(t *testing.T) {
 	}
 
 	recorder := &nopAppender{}
-	r = NewPrometheusReader(nil, dir, tailer, nil, nil, targetMap, metadataMap, recorder, "", false, aggr)
+	r = NewPrometheusReader(nil, dir, tailer, nil, nil, targetMap, metadataMap, recorder, "", nil, nil, "", false, false, aggr, gaugeAggr, nil, 0, 0, 0, nil, nil, nil, 0, 0, nil, nil, nil, "", nil, nil, nil, 0, nil, nil, "")
 	go r.Run(ctx, progressOffset)
 
 	// Wait for reader to process until the end.
@@ -194,6 +196,69 @@ func TestReader_ProgressFile(t *testing.T) {
 	if offset != 12345 {
 		t.Fatalf("expected progress offset %d but got %d", 12345, offset)
 	}
+
+	// Files written by older versions are plain JSON and must still be readable.
+	filename := filepath.Join(dir, progressFilename)
+	if err := ioutil.WriteFile(filename, []byte(`{"offset": 54321}`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	offset, err = ReadProgressFile(dir)
+	if err != nil {
+		t.Fatalf("read progress: %s", err)
+	}
+	if offset != 54321 {
+		t.Fatalf("expected progress offset %d but got %d", 54321, offset)
+	}
+
+	// A truncated file, e.g. left behind by a crash, must not return a bogus
+	// offset. Saving keeps the previous file as a backup, so the offset of
+	// the preceding save is recovered instead.
+	if err := SaveProgressFile(dir, progressBufferMargin+12345); err != nil {
+		t.Fatalf("save progress: %s", err)
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, b[:len(b)-4], 0666); err != nil {
+		t.Fatal(err)
+	}
+	offset, err = ReadProgressFile(dir)
+	if err != nil {
+		t.Fatalf("read progress: %s", err)
+	}
+	if offset != 54321 {
+		t.Fatalf("expected backup progress offset %d but got %d", 54321, offset)
+	}
+	// Without a usable backup, corruption must be reported as an error.
+	if err := os.Remove(filename + ".bak"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadProgressFile(dir); err == nil {
+		t.Fatalf("expected error for truncated progress file")
+	}
+	// Garbage content must be detected as well.
+	if err := ioutil.WriteFile(filename, []byte("garbage"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadProgressFile(dir); err == nil {
+		t.Fatalf("expected error for corrupt progress file")
+	}
+	// A missing file after a crash between backup rotation and rename falls
+	// back to the backup as well.
+	if err := os.Rename(filename, filename+".bak"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename+".bak", []byte(`{"offset": 777}`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	offset, err = ReadProgressFile(dir)
+	if err != nil {
+		t.Fatalf("read progress: %s", err)
+	}
+	if offset != 777 {
+		t.Fatalf("expected backup progress offset %d but got %d", 777, offset)
+	}
 }
 
 func TestTargetsWithDiscoveredLabels(t *testing.T) {
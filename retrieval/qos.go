@@ -0,0 +1,119 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+var qosDroppedSamples = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "prometheus_sidecar_qos_dropped_samples_total",
+	Help: "Number of samples dropped because their QoS class exceeded its rate limit.",
+}, []string{"class"})
+
+func init() {
+	prometheus.MustRegister(qosDroppedSamples)
+}
+
+// QoSClass describes one quality-of-service class, e.g. critical, normal, or
+// best-effort. Samples whose metric name matches one of the patterns are
+// routed to the class's own export queue so a flood in one class cannot
+// starve the others.
+type QoSClass struct {
+	// Name identifies the class in configuration and metrics.
+	Name string
+	// Patterns match against the metric name of a sample.
+	Patterns []*regexp.Regexp
+	// MaxRate bounds the class to this many samples per second. Zero means
+	// unlimited.
+	MaxRate float64
+	// DropPolicy determines what happens to samples exceeding MaxRate:
+	// "drop" (the default) discards them, "block" waits for the limiter.
+	DropPolicy string
+}
+
+// QoSRouter is an Appender that routes each sample to the appender of the
+// first QoS class matching its metric name. Samples matching no class go to
+// the fallback appender. Classes are consulted in the order they were added.
+type QoSRouter struct {
+	routes   []qosRoute
+	fallback Appender
+}
+
+type qosRoute struct {
+	class    *QoSClass
+	appender Appender
+	limiter  *rate.Limiter
+}
+
+// NewQoSRouter returns a router sending unmatched samples to the fallback
+// appender. Classes are added with AddClass.
+func NewQoSRouter(fallback Appender) *QoSRouter {
+	return &QoSRouter{fallback: fallback}
+}
+
+// AddClass appends a class and its appender to the routing table.
+func (r *QoSRouter) AddClass(class *QoSClass, appender Appender) {
+	route := qosRoute{class: class, appender: appender}
+	if class.MaxRate > 0 {
+		burst := int(class.MaxRate)
+		if burst < 1 {
+			burst = 1
+		}
+		route.limiter = rate.NewLimiter(rate.Limit(class.MaxRate), burst)
+	}
+	qosDroppedSamples.WithLabelValues(class.Name)
+	r.routes = append(r.routes, route)
+}
+
+// Append implements Appender.
+func (r *QoSRouter) Append(hash uint64, s *monitoring_pb.TimeSeries) error {
+	// The metric name is the last path element of the metric type, e.g.
+	// external.googleapis.com/prometheus/up.
+	name := s.Metric.Type
+	if i := strings.LastIndexByte(name, '/'); i >= 0 {
+		name = name[i+1:]
+	}
+	for _, route := range r.routes {
+		if !route.class.matches(name) {
+			continue
+		}
+		if route.limiter != nil && !route.limiter.Allow() {
+			if route.class.DropPolicy == "block" {
+				route.limiter.Wait(context.Background())
+			} else {
+				qosDroppedSamples.WithLabelValues(route.class.Name).Inc()
+				return nil
+			}
+		}
+		return route.appender.Append(hash, s)
+	}
+	return r.fallback.Append(hash, s)
+}
+
+func (c *QoSClass) matches(name string) bool {
+	for _, p := range c.Patterns {
+		if p.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
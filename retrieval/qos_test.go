@@ -0,0 +1,76 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"regexp"
+	"testing"
+
+	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+func qosSample(name string) *monitoring_pb.TimeSeries {
+	return &monitoring_pb.TimeSeries{
+		Metric: &metric_pb.Metric{Type: "external.googleapis.com/prometheus/" + name},
+	}
+}
+
+func TestQoSRouter(t *testing.T) {
+	critical := &nopAppender{}
+	bestEffort := &nopAppender{}
+	fallback := &nopAppender{}
+
+	r := NewQoSRouter(fallback)
+	r.AddClass(&QoSClass{
+		Name:     "critical",
+		Patterns: []*regexp.Regexp{regexp.MustCompile("^slo_")},
+	}, critical)
+	r.AddClass(&QoSClass{
+		Name:     "best-effort",
+		Patterns: []*regexp.Regexp{regexp.MustCompile("^debug_"), regexp.MustCompile("^test_")},
+	}, bestEffort)
+
+	for _, name := range []string{"slo_latency", "debug_foo", "test_bar", "http_requests_total"} {
+		if err := r.Append(1, qosSample(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(critical.samples) != 1 || len(bestEffort.samples) != 2 || len(fallback.samples) != 1 {
+		t.Fatalf("unexpected routing: critical=%d best-effort=%d fallback=%d",
+			len(critical.samples), len(bestEffort.samples), len(fallback.samples))
+	}
+}
+
+func TestQoSRouterRateLimit(t *testing.T) {
+	bestEffort := &nopAppender{}
+	r := NewQoSRouter(&nopAppender{})
+	r.AddClass(&QoSClass{
+		Name:     "best-effort",
+		Patterns: []*regexp.Regexp{regexp.MustCompile("^debug_")},
+		MaxRate:  1,
+	}, bestEffort)
+
+	// The limiter's burst of one admits the first sample; subsequent
+	// samples within the same second are dropped.
+	for i := 0; i < 5; i++ {
+		if err := r.Append(1, qosSample("debug_foo")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(bestEffort.samples) != 1 {
+		t.Fatalf("expected 1 admitted sample, got %d", len(bestEffort.samples))
+	}
+}
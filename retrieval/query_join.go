@@ -0,0 +1,224 @@
+/*
+Copyright 2020 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retrieval
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	promlabels "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// defaultQueryJoinInterval is how often a query join is refreshed when the
+// configuration does not set an interval.
+const defaultQueryJoinInterval = 5 * time.Minute
+
+// QueryJoin configures copying labels from the result of a PromQL query onto
+// series that share the join key labels. It serves slow-changing enrichment
+// labels that no info metric provides directly, e.g. a machine role or team
+// ownership derived from an expression.
+type QueryJoin struct {
+	// Query is the PromQL expression evaluated against the Prometheus API.
+	Query string
+	// Keys are the labels the query results and the receiving series are
+	// joined on.
+	Keys []string
+	// Labels are the result labels copied to matching series. If empty, all
+	// labels except the join keys, __name__, job, and instance are copied.
+	Labels []string
+	// Interval is how often the query is re-evaluated. Zero uses the default.
+	Interval time.Duration
+}
+
+// joinedLabels selects the labels of a query result that are copied to
+// matching series.
+func (j *QueryJoin) joinedLabels(lset labels.Labels) promlabels.Labels {
+	var out promlabels.Labels
+	if len(j.Labels) > 0 {
+		for _, n := range j.Labels {
+			if v := lset.Get(n); v != "" {
+				out = append(out, promlabels.Label{Name: n, Value: v})
+			}
+		}
+		sort.Sort(out)
+		return out
+	}
+	for _, l := range lset {
+		if l.Name == "__name__" || l.Name == "job" || l.Name == "instance" {
+			continue
+		}
+		if isJoinKey(j.Keys, l.Name) {
+			continue
+		}
+		out = append(out, promlabels.Label{Name: l.Name, Value: l.Value})
+	}
+	return out
+}
+
+func isJoinKey(keys []string, name string) bool {
+	for _, k := range keys {
+		if k == name {
+			return true
+		}
+	}
+	return false
+}
+
+// QueryJoiner periodically evaluates PromQL queries against the Prometheus
+// API and caches the labels of their results keyed by the configured join
+// keys. The series cache attaches the cached labels to matching series when
+// it populates an entry, so changed results propagate within the regular
+// entry refresh interval.
+type QueryJoiner struct {
+	logger log.Logger
+	url    *url.URL
+	joins  []*QueryJoin
+	client *http.Client
+
+	mtx sync.Mutex
+	// Map from join key to the labels the most recent query evaluation
+	// provides for matching series.
+	results map[uint64]promlabels.Labels
+}
+
+// NewQueryJoiner returns a joiner evaluating the given queries against the
+// Prometheus base URL.
+func NewQueryJoiner(logger log.Logger, promURL *url.URL, joins []*QueryJoin) *QueryJoiner {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	return &QueryJoiner{
+		logger:  logger,
+		url:     promURL,
+		joins:   joins,
+		client:  &http.Client{Timeout: time.Minute},
+		results: map[uint64]promlabels.Labels{},
+	}
+}
+
+// Run evaluates every query at its configured interval until the context is
+// canceled. Each query is also evaluated once on startup.
+func (q *QueryJoiner) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, j := range q.joins {
+		wg.Add(1)
+		go func(j *QueryJoin) {
+			defer wg.Done()
+			interval := j.Interval
+			if interval == 0 {
+				interval = defaultQueryJoinInterval
+			}
+			tick := time.NewTicker(interval)
+			defer tick.Stop()
+			for {
+				if err := q.evaluate(ctx, j); err != nil {
+					level.Warn(q.logger).Log("msg", "Evaluating join query failed", "query", j.Query, "err", err)
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-tick.C:
+				}
+			}
+		}(j)
+	}
+	wg.Wait()
+}
+
+// queryResponse is the shape of an instant query result of the Prometheus
+// HTTP API. Sample values are not needed and left out.
+type queryResponse struct {
+	Status string `json:"status"`
+	Data   struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Metric map[string]string `json:"metric"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+// evaluate runs a single query and caches the labels of its results.
+func (q *QueryJoiner) evaluate(ctx context.Context, j *QueryJoin) error {
+	u := *q.url
+	u.Path = path.Join(u.Path, "/api/v1/query")
+	params := url.Values{"query": []string{j.Query}}
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := q.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("unexpected response status %s", resp.Status)
+	}
+	var qr queryResponse
+	if err := json.NewDecoder(resp.Body).Decode(&qr); err != nil {
+		return errors.Wrap(err, "decode query response")
+	}
+	if qr.Status != "success" {
+		return errors.Errorf("query returned status %q", qr.Status)
+	}
+	for _, result := range qr.Data.Result {
+		lset := labels.FromMap(result.Metric)
+		key, ok := joinKey(j.Query, j.Keys, lset)
+		if !ok {
+			continue
+		}
+		joined := j.joinedLabels(lset)
+		q.mtx.Lock()
+		q.results[key] = joined
+		q.mtx.Unlock()
+	}
+	return nil
+}
+
+// attach extends the final label set of a series with the labels joined from
+// query results. The join keys are looked up on the full input label set
+// since they may have been dropped as target labels. Labels already present
+// on the series are never overwritten.
+func (q *QueryJoiner) attach(finalLabels promlabels.Labels, lset labels.Labels) promlabels.Labels {
+	for _, j := range q.joins {
+		key, ok := joinKey(j.Query, j.Keys, lset)
+		if !ok {
+			continue
+		}
+		q.mtx.Lock()
+		joined := q.results[key]
+		q.mtx.Unlock()
+
+		for _, l := range joined {
+			if finalLabels.Get(l.Name) == "" {
+				finalLabels = append(finalLabels, l)
+			}
+		}
+	}
+	sort.Sort(finalLabels)
+	return finalLabels
+}
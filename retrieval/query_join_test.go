@@ -0,0 +1,106 @@
+/*
+Copyright 2020 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retrieval
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	promlabels "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// queryJoinServer serves a fixed instant query response for every query.
+func queryJoinServer(t *testing.T, results []map[string]string) *url.URL {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/query" {
+			t.Errorf("unexpected path %q", r.URL.Path)
+		}
+		var rs []map[string]interface{}
+		for _, metric := range results {
+			rs = append(rs, map[string]interface{}{"metric": metric})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data":   map[string]interface{}{"resultType": "vector", "result": rs},
+		})
+	}))
+	t.Cleanup(server.Close)
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestQueryJoiner(t *testing.T) {
+	u := queryJoinServer(t, []map[string]string{
+		{"__name__": "node_role", "node": "node-a", "role": "ingest", "team": "infra"},
+		{"__name__": "node_role", "node": "node-b", "role": "storage", "team": "infra"},
+	})
+	join := &QueryJoin{
+		Query: `max by (node, role, team) (node_role)`,
+		Keys:  []string{"node"},
+	}
+	q := NewQueryJoiner(nil, u, []*QueryJoin{join})
+	if err := q.evaluate(context.Background(), join); err != nil {
+		t.Fatal(err)
+	}
+
+	// A matching series receives the result labels without its own labels
+	// being overwritten.
+	got := q.attach(
+		promlabels.FromStrings("job", "job1", "role", "own-role"),
+		labels.FromStrings("__name__", "metric1", "job", "job1", "node", "node-a", "role", "own-role"),
+	)
+	want := promlabels.FromStrings("job", "job1", "role", "own-role", "team", "infra")
+	if !promlabels.Equal(got, want) {
+		t.Fatalf("unexpected labels %s, want %s", got, want)
+	}
+
+	// Series without a cached join key pass through unchanged.
+	got = q.attach(
+		promlabels.FromStrings("job", "job1"),
+		labels.FromStrings("__name__", "metric1", "job", "job1", "node", "node-c"),
+	)
+	want = promlabels.FromStrings("job", "job1")
+	if !promlabels.Equal(got, want) {
+		t.Fatalf("unexpected labels %s, want %s", got, want)
+	}
+}
+
+func TestQueryJoin_JoinedLabels(t *testing.T) {
+	join := &QueryJoin{
+		Query:  `node_role`,
+		Keys:   []string{"node"},
+		Labels: []string{"role"},
+	}
+	lset := labels.FromStrings("__name__", "node_role", "instance", "inst1", "node", "node-a", "role", "ingest", "team", "infra")
+	got := join.joinedLabels(lset)
+	want := promlabels.FromStrings("role", "ingest")
+	if !promlabels.Equal(got, want) {
+		t.Fatalf("unexpected labels %s, want %s", got, want)
+	}
+	// Without an explicit list, join keys and identifying labels are excluded.
+	join.Labels = nil
+	got = join.joinedLabels(lset)
+	want = promlabels.FromStrings("role", "ingest", "team", "infra")
+	if !promlabels.Equal(got, want) {
+		t.Fatalf("unexpected labels %s, want %s", got, want)
+	}
+}
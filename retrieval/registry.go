@@ -0,0 +1,91 @@
+/*
+Copyright 2020 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retrieval
+
+import (
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// TargetGetterFactory constructs a TargetGetter for a registered target
+// source. Factories that need configuration should capture it at
+// registration time.
+type TargetGetterFactory func(logger log.Logger) (TargetGetter, error)
+
+// MetadataGetterFactory constructs a MetadataGetter for a registered
+// metadata source.
+type MetadataGetterFactory func(logger log.Logger) (MetadataGetter, error)
+
+var (
+	registryMtx             sync.Mutex
+	targetGetterFactories   = map[string]TargetGetterFactory{}
+	metadataGetterFactories = map[string]MetadataGetterFactory{}
+)
+
+// RegisterTargetGetter makes a target source available under the given name,
+// e.g. to serve targets from a service discovery system the Prometheus
+// targets API cannot reach. It is intended to be called from an init function
+// by programs embedding the sidecar and panics if the name is empty, the
+// factory is nil, or the name is already taken.
+func RegisterTargetGetter(name string, factory TargetGetterFactory) {
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+	if name == "" || factory == nil {
+		panic("retrieval: RegisterTargetGetter requires a name and a factory")
+	}
+	if _, ok := targetGetterFactories[name]; ok {
+		panic("retrieval: target source already registered: " + name)
+	}
+	targetGetterFactories[name] = factory
+}
+
+// RegisterMetadataGetter makes a metadata source available under the given
+// name. It follows the same rules as RegisterTargetGetter.
+func RegisterMetadataGetter(name string, factory MetadataGetterFactory) {
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+	if name == "" || factory == nil {
+		panic("retrieval: RegisterMetadataGetter requires a name and a factory")
+	}
+	if _, ok := metadataGetterFactories[name]; ok {
+		panic("retrieval: metadata source already registered: " + name)
+	}
+	metadataGetterFactories[name] = factory
+}
+
+// NewRegisteredTargetGetter instantiates the target source registered under
+// the given name.
+func NewRegisteredTargetGetter(name string, logger log.Logger) (TargetGetter, error) {
+	registryMtx.Lock()
+	factory, ok := targetGetterFactories[name]
+	registryMtx.Unlock()
+	if !ok {
+		return nil, errors.Errorf("unknown target source %q", name)
+	}
+	return factory(logger)
+}
+
+// NewRegisteredMetadataGetter instantiates the metadata source registered
+// under the given name.
+func NewRegisteredMetadataGetter(name string, logger log.Logger) (MetadataGetter, error) {
+	registryMtx.Lock()
+	factory, ok := metadataGetterFactories[name]
+	registryMtx.Unlock()
+	if !ok {
+		return nil, errors.Errorf("unknown metadata source %q", name)
+	}
+	return factory(logger)
+}
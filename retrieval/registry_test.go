@@ -0,0 +1,71 @@
+/*
+Copyright 2020 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retrieval
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bjbloemker-google/stackdriver-prometheus-sidecar/targets"
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+type registryTargetGetter struct{}
+
+func (registryTargetGetter) Get(ctx context.Context, lset labels.Labels) (*targets.Target, error) {
+	return nil, nil
+}
+
+func TestTargetGetterRegistry(t *testing.T) {
+	if _, err := NewRegisteredTargetGetter("missing", nil); err == nil {
+		t.Fatal("expected error for unknown target source")
+	}
+	RegisterTargetGetter("test", func(logger log.Logger) (TargetGetter, error) {
+		return registryTargetGetter{}, nil
+	})
+	g, err := NewRegisteredTargetGetter("test", log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := g.(registryTargetGetter); !ok {
+		t.Fatalf("unexpected target getter %T", g)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected panic on duplicate registration")
+			}
+		}()
+		RegisterTargetGetter("test", func(logger log.Logger) (TargetGetter, error) {
+			return registryTargetGetter{}, nil
+		})
+	}()
+}
+
+func TestMetadataGetterRegistry(t *testing.T) {
+	if _, err := NewRegisteredMetadataGetter("missing", nil); err == nil {
+		t.Fatal("expected error for unknown metadata source")
+	}
+	RegisterMetadataGetter("test", func(logger log.Logger) (MetadataGetter, error) {
+		return metadataMap{}, nil
+	})
+	g, err := NewRegisteredMetadataGetter("test", log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := g.(metadataMap); !ok {
+		t.Fatalf("unexpected metadata getter %T", g)
+	}
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2020 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retrieval
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// EscapingScheme selects how metric and label names using the extended UTF-8
+// charset permitted by newer Prometheus versions are translated into names
+// the Monitoring API accepts. Names that are valid under the legacy charset
+// always pass through unchanged.
+type EscapingScheme string
+
+const (
+	// EscapeNone passes names through untouched. Series with invalid names
+	// are rejected by the Monitoring API.
+	EscapeNone EscapingScheme = "none"
+	// EscapeUnderscores replaces every invalid character with an underscore.
+	// The translation is not reversible and distinct names may collide.
+	EscapeUnderscores EscapingScheme = "underscores"
+	// EscapeValues prefixes escaped names with "U__" and encodes invalid
+	// characters as "_<hex code point>_", doubling literal underscores. The
+	// original name can be recovered with UnescapeName.
+	EscapeValues EscapingScheme = "values"
+)
+
+// maxMetricTypeLength is the maximum length of a metric type accepted by the
+// Monitoring API. Longer types, typically from generated recording-rule
+// names, are rejected at write time.
+const maxMetricTypeLength = 200
+
+// LongNameAction selects how metric types exceeding the Monitoring API length
+// limit are handled.
+type LongNameAction string
+
+const (
+	// LongNameDrop rejects series with an over-long metric type during
+	// conversion, surfacing the failure before it reaches the API. This is
+	// the default and the zero value.
+	LongNameDrop LongNameAction = "drop"
+	// LongNameTruncate shortens over-long metric types, replacing the tail
+	// with a hash of the full type. The same input always yields the same
+	// output and distinct inputs stay distinct, so the truncated series
+	// export stably.
+	LongNameTruncate LongNameAction = "truncate"
+)
+
+// truncateMetricType deterministically shortens a metric type to the API
+// length limit. Types within the limit pass through unchanged.
+func truncateMetricType(metricType string) string {
+	if len(metricType) <= maxMetricTypeLength {
+		return metricType
+	}
+	h := fnv.New64a()
+	h.Write([]byte(metricType))
+	suffix := fmt.Sprintf("_%016x", h.Sum64())
+	return metricType[:maxMetricTypeLength-len(suffix)] + suffix
+}
+
+// isValidNameRune reports whether the rune is permitted at byte position i of
+// a legacy Prometheus metric name, or label name if isLabel is set.
+func isValidNameRune(r rune, i int, isLabel bool) bool {
+	if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '_' {
+		return true
+	}
+	if r >= '0' && r <= '9' {
+		return i > 0
+	}
+	return !isLabel && r == ':'
+}
+
+// isValidName reports whether the name only uses the legacy charset.
+func isValidName(name string, isLabel bool) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		if !isValidNameRune(r, i, isLabel) {
+			return false
+		}
+	}
+	return true
+}
+
+// escapeName translates a metric or label name according to the scheme.
+func escapeName(name string, scheme EscapingScheme, isLabel bool) string {
+	if scheme == EscapeNone || isValidName(name, isLabel) {
+		return name
+	}
+	var b strings.Builder
+	if scheme == EscapeValues {
+		b.WriteString("U__")
+		for _, r := range name {
+			switch {
+			case r == '_':
+				b.WriteString("__")
+			// The "U__" prefix guarantees a valid first character, so a
+			// leading digit needs no special treatment.
+			case isValidNameRune(r, 1, isLabel):
+				b.WriteRune(r)
+			default:
+				fmt.Fprintf(&b, "_%x_", r)
+			}
+		}
+		return b.String()
+	}
+	// Default scheme, including the zero value: replace with underscores.
+	for i, r := range name {
+		if isValidNameRune(r, i, isLabel) {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
+
+// UnescapeName recovers the original name from one escaped with the "values"
+// scheme. Names without the escaping prefix are returned unchanged.
+func UnescapeName(name string) string {
+	const prefix = "U__"
+	if !strings.HasPrefix(name, prefix) {
+		return name
+	}
+	escaped := name[len(prefix):]
+	var b strings.Builder
+	for i := 0; i < len(escaped); {
+		if escaped[i] != '_' {
+			b.WriteByte(escaped[i])
+			i++
+			continue
+		}
+		if i+1 < len(escaped) && escaped[i+1] == '_' {
+			b.WriteByte('_')
+			i += 2
+			continue
+		}
+		end := strings.IndexByte(escaped[i+1:], '_')
+		if end < 0 {
+			// Malformed escape; keep the remainder as-is.
+			b.WriteString(escaped[i:])
+			break
+		}
+		code, err := strconv.ParseInt(escaped[i+1:i+1+end], 16, 32)
+		if err != nil {
+			b.WriteString(escaped[i : i+1+end+1])
+		} else {
+			b.WriteRune(rune(code))
+		}
+		i += end + 2
+	}
+	return b.String()
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2020 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retrieval
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEscapeName(t *testing.T) {
+	cases := []struct {
+		name    string
+		isLabel bool
+		scheme  EscapingScheme
+		want    string
+	}{
+		// Legacy-valid names pass through under every scheme.
+		{"http_requests_total", false, EscapeUnderscores, "http_requests_total"},
+		{"http_requests_total", false, EscapeValues, "http_requests_total"},
+		{"foo:bar", false, EscapeValues, "foo:bar"},
+		{"le", true, EscapeUnderscores, "le"},
+		// Colons are only valid in metric names.
+		{"foo:bar", true, EscapeUnderscores, "foo_bar"},
+		// UTF-8 names under the underscores scheme.
+		{"http.requests.total", false, EscapeUnderscores, "http_requests_total"},
+		{"jvm 1 mémoire", false, EscapeUnderscores, "jvm_1_m_moire"},
+		{"0day_count", false, EscapeUnderscores, "_day_count"},
+		// UTF-8 names under the reversible values scheme.
+		{"http.requests.total", false, EscapeValues, "U__http_2e_requests_2e_total"},
+		{"my_label.x", true, EscapeValues, "U__my__label_2e_x"},
+		// The none scheme leaves everything alone.
+		{"http.requests.total", false, EscapeNone, "http.requests.total"},
+	}
+	for _, c := range cases {
+		if got := escapeName(c.name, c.scheme, c.isLabel); got != c.want {
+			t.Errorf("escapeName(%q, %q, %v): got %q, want %q", c.name, c.scheme, c.isLabel, got, c.want)
+		}
+	}
+}
+
+func TestUnescapeName(t *testing.T) {
+	// Every name escaped with the values scheme must round-trip.
+	for _, name := range []string{
+		"http.requests.total",
+		"my_label.x",
+		"jvm 1 mémoire",
+		"0day_count",
+		"日本語",
+	} {
+		escaped := escapeName(name, EscapeValues, false)
+		if got := UnescapeName(escaped); got != name {
+			t.Errorf("round trip of %q via %q: got %q", name, escaped, got)
+		}
+	}
+	// Names without the escaping prefix are returned unchanged.
+	if got := UnescapeName("http_requests_total"); got != "http_requests_total" {
+		t.Errorf("unexpected unescape result %q", got)
+	}
+}
+
+func TestTruncateMetricType(t *testing.T) {
+	short := "external.googleapis.com/prometheus/http_requests_total"
+	if got := truncateMetricType(short); got != short {
+		t.Errorf("short metric type was modified: %q", got)
+	}
+
+	long := "external.googleapis.com/prometheus/" + strings.Repeat("very_long_recording_rule_name:", 10)
+	got := truncateMetricType(long)
+	if len(got) != maxMetricTypeLength {
+		t.Errorf("unexpected truncated length %d, want %d", len(got), maxMetricTypeLength)
+	}
+	// The result must be deterministic and distinct inputs must stay
+	// distinct even when they share the truncated prefix.
+	if again := truncateMetricType(long); again != got {
+		t.Errorf("truncation is not deterministic: %q vs %q", got, again)
+	}
+	if other := truncateMetricType(long + "x"); other == got {
+		t.Errorf("distinct names truncated to the same type %q", got)
+	}
+}
@@ -15,6 +15,8 @@ package retrieval
 
 import (
 	"context"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -39,6 +41,12 @@ import (
 var (
 	droppedSeries = stats.Int64("prometheus_sidecar/dropped_series",
 		"Number of series that were dropped instead of being sent to Stackdriver", stats.UnitDimensionless)
+	cachedSeries = stats.Int64("prometheus_sidecar/series_cache_size",
+		"Number of series held in the series cache", stats.UnitDimensionless)
+	hashCollisions = stats.Int64("prometheus_sidecar/hash_collisions",
+		"Number of times a series hash collided with a different series", stats.UnitDimensionless)
+	metricTypeChanges = stats.Int64("prometheus_sidecar/metric_type_changes",
+		"Number of times the metadata type of a series changed", stats.UnitDimensionless)
 
 	keyReason, _ = tag.NewKey("reason")
 )
@@ -53,47 +61,164 @@ func init() {
 	}); err != nil {
 		panic(err)
 	}
+	if err := view.Register(&view.View{
+		Name:        "prometheus_sidecar/series_cache_size",
+		Description: "Number of series held in the series cache",
+		Measure:     cachedSeries,
+		Aggregation: view.LastValue(),
+	}); err != nil {
+		panic(err)
+	}
+	if err := view.Register(&view.View{
+		Name:        "prometheus_sidecar/hash_collisions",
+		Description: "Number of times a series hash collided with a different series",
+		Measure:     hashCollisions,
+		Aggregation: view.Count(),
+	}); err != nil {
+		panic(err)
+	}
+	if err := view.Register(&view.View{
+		Name:        "prometheus_sidecar/metric_type_changes",
+		Description: "Number of times the metadata type of a series changed",
+		Measure:     metricTypeChanges,
+		Aggregation: view.Count(),
+	}); err != nil {
+		panic(err)
+	}
 }
 
-type seriesGetter interface {
+// SeriesGetter provides the series information a SampleBuilder needs to
+// convert samples into Stackdriver time series.
+type SeriesGetter interface {
 	// Same interface as the standard map getter.
-	get(ctx context.Context, ref uint64) (*seriesCacheEntry, bool, error)
+	Get(ctx context.Context, ref uint64) (*SeriesCacheEntry, bool, error)
 
 	// Get the reset timestamp and adjusted value for the input sample.
 	// If false is returned, the sample should be skipped.
-	getResetAdjusted(ref uint64, t int64, v float64) (int64, float64, bool)
+	GetResetAdjusted(ref uint64, t int64, v float64) (int64, float64, bool)
 
 	// Attempt to set the new most recent time range for the series with given hash.
 	// Returns false if it failed, in which case the sample must be discarded.
-	updateSampleInterval(hash uint64, start, end int64) bool
+	UpdateSampleInterval(hash uint64, start, end int64) bool
+
+	// Record the start time an OpenMetrics _created series reported for the
+	// metric family instance with the given key. t is in milliseconds.
+	SetCreatedTimestamp(key uint64, t int64)
+
+	// Forget the reset tracking of the referenced series so that its next
+	// sample starts a fresh cumulative interval.
+	ResetCumulative(ref uint64)
+}
+
+// DeltaConfig selects which counters are exported with the DELTA metric kind
+// instead of CUMULATIVE. DELTA points cover the range since the previous
+// sample, so consecutive intervals do not overlap. Summaries and histograms
+// are always exported as CUMULATIVE.
+type DeltaConfig struct {
+	// All exports every counter as DELTA.
+	All bool
+	// Metrics lists individual counters, by their Prometheus metric name
+	// without the _total suffix, that are exported as DELTA.
+	Metrics map[string]bool
+}
+
+func (d *DeltaConfig) isDelta(name string) bool {
+	if d == nil {
+		return false
+	}
+	return d.All || d.Metrics[name]
+}
+
+// DescriptorUpdater receives the converted series template and HELP text of
+// exported series so metric descriptors can be kept up to date with
+// human-readable descriptions.
+type DescriptorUpdater interface {
+	UpdateDescriptor(ts *monitoring_pb.TimeSeries, help string)
 }
 
-// seriesCache holds a mapping from series reference to label set.
+// SeriesCache holds a mapping from series reference to label set.
 // It can garbage collect obsolete entries based on the most recent WAL checkpoint.
-// Implements seriesGetter.
-type seriesCache struct {
-	logger            log.Logger
-	dir               string
-	filtersets        [][]*promlabels.Matcher
-	targets           TargetGetter
-	metadata          MetadataGetter
-	counterAggregator *CounterAggregator
-	resourceMaps      []ResourceMap
-	metricsPrefix     string
-	useGkeResource    bool
-	renames           map[string]string
+// Implements SeriesGetter.
+type SeriesCache struct {
+	logger             log.Logger
+	dir                string
+	filtersets         [][]*promlabels.Matcher
+	targets            TargetGetter
+	metadata           MetadataGetter
+	counterAggregator  *CounterAggregator
+	gaugeAggregator    *GaugeAggregator
+	resourceMaps       []ResourceMap
+	metricsPrefix      string
+	jobPrefixes        map[string]string
+	namespaceProjects  map[string]string
+	selfJob            string
+	useGkeResource     bool
+	exportScrapeHealth bool
+	renames            map[string]string
+	labelJoins         []*LabelJoin
+	deltas             *DeltaConfig
+	descriptors        DescriptorUpdater
+	// gcInterval is how often obsolete cache entries are garbage collected.
+	gcInterval time.Duration
+	// seriesTTL, if non-zero, expires entries that have not received a sample
+	// for the given duration, even if their reference is still in the WAL.
+	seriesTTL time.Duration
+	// dropTracker, if non-nil, records dropped series for the debug exporter.
+	dropTracker *DroppedSeriesTracker
+	// escaping selects how UTF-8 metric and label names are translated into
+	// Monitoring-compatible ones. The zero value escapes with underscores.
+	escaping EscapingScheme
+	// labelSplits decomposes composite label values during translation.
+	labelSplits []*LabelSplit
+	// churnTracker, if non-nil, counts series creations and evictions per
+	// metric name so cardinality churn can be attributed to its sources.
+	churnTracker *SeriesChurnTracker
+	// queryJoiner, if non-nil, attaches labels cached from periodic PromQL
+	// query results.
+	queryJoiner *QueryJoiner
+	// longNames selects how metric types exceeding the API length limit are
+	// handled.
+	longNames LongNameAction
 
 	// lastCheckpoint holds the index of the last checkpoint we garbage collected for.
 	// We don't have to redo garbage collection until a higher checkpoint appears.
 	lastCheckpoint int
 	mtx            sync.Mutex
 	// Map from series reference to various cached information about it.
-	entries map[uint64]*seriesCacheEntry
+	entries map[uint64]*SeriesCacheEntry
 	// Map from series hash to most recently written interval.
 	intervals map[uint64]sampleInterval
+	// Map from metric family instance key to the start time in milliseconds
+	// reported by its OpenMetrics _created series.
+	createdTimestamps map[uint64]int64
+	// Map from output series hash to the input series that owns it, used to
+	// detect distinct Prometheus series colliding on the same Stackdriver
+	// series.
+	owners map[uint64]seriesOwner
+	// Map from info metric join key to the labels its most recent series
+	// provides for matching series.
+	joinedLabels map[uint64]promlabels.Labels
+	// Map from WAL label set hash to counter reset state restored from a
+	// handover file. Entries are consumed when the series is first seen.
+	restoredResets map[uint64]HandoverResetPoint
+	// symbols interns the label strings of cached entries so series sharing
+	// label names and values retain a single copy of each string.
+	symbols *symbolTable
 }
 
-type seriesCacheEntry struct {
+// seriesOwner identifies the input series that an output series hash was
+// assigned to.
+type seriesOwner struct {
+	ref  uint64
+	lset labels.Labels
+	// Canonical byte representation of the output series identity the hash
+	// was computed over, to tell genuine hash collisions apart from distinct
+	// input series mapping to the same output series.
+	key string
+}
+
+// SeriesCacheEntry holds the cached conversion state for a single series.
+type SeriesCacheEntry struct {
 	proto    *monitoring_pb.TimeSeries
 	metadata *metadata.Entry
 	lset     labels.Labels
@@ -111,9 +236,29 @@ type seriesCacheEntry struct {
 	resetValue     float64
 	resetTimestamp int64
 
-	// Value of the most recent point seen for the time series. If a new value is
-	// less than the previous, then the series has reset.
-	previousValue float64
+	// Value and timestamp of the most recent point seen for the time series.
+	// If a new value is less than the previous, then the series has reset.
+	previousValue     float64
+	previousTimestamp int64
+
+	// Minimum expected spacing between points in milliseconds, derived from
+	// the target's scrape interval. Zero if the targets API did not report an
+	// interval.
+	pointSpacing int64
+
+	// Adjusted value and timestamp of the previous sample, used to compute
+	// DELTA points. Only maintained for series exported with the DELTA
+	// metric kind.
+	deltaValue     float64
+	deltaTimestamp int64
+
+	// Start timestamp and running aggregates of the current gauge interval
+	// window. Only maintained for gauge metrics with a configured minimum
+	// export interval.
+	gaugeWindowStart int64
+	gaugeWindowSum   float64
+	gaugeWindowCount float64
+	gaugeWindowMax   float64
 
 	// maxSegment indicates the maximum WAL segment index in which
 	// the series was first logged.
@@ -124,9 +269,20 @@ type seriesCacheEntry struct {
 	// it when retrieving records through a buffered reader.
 	maxSegment int
 
+	// Key of the metric family instance this OpenMetrics _created series
+	// carries the start time for. Zero for all other series.
+	createdFor uint64
+	// Key under which a start time from a _created series may be found for
+	// this series. Only set for cumulative series.
+	createdKey uint64
+
 	// Last time we attempted to populate meta information about the series.
 	lastRefresh time.Time
 
+	// Last time a sample for the series was looked up, used to expire
+	// inactive series.
+	lastSeen time.Time
+
 	// Whether the series needs to be exported.
 	exported bool
 
@@ -135,19 +291,27 @@ type seriesCacheEntry struct {
 	// This is nil if there are no aggregated counters that need to be incremented
 	// for this time series.
 	tracker *counterTracker
+	// Gauge tracker that will be called with each new sample if this time
+	// series feeds one of the aggregated gauges.
+	gauges *gaugeTracker
 }
 
 const refreshInterval = 3 * time.Minute
 
-func (e *seriesCacheEntry) populated() bool {
+func (e *SeriesCacheEntry) populated() bool {
 	return e.proto != nil
 }
 
-func (e *seriesCacheEntry) shouldRefresh() bool {
-	return !e.populated() && time.Since(e.lastRefresh) > refreshInterval
+// shouldRefresh determines whether the meta information of a series should be
+// probed again. Populated entries are re-probed as well so that metadata type
+// changes, e.g. from an exporter upgrade, are picked up.
+func (e *SeriesCacheEntry) shouldRefresh() bool {
+	return time.Since(e.lastRefresh) > refreshInterval
 }
 
-func newSeriesCache(
+// NewSeriesCache returns a cache that translates TSDB series references into
+// Stackdriver time series templates using target and metadata lookups.
+func NewSeriesCache(
 	logger log.Logger,
 	dir string,
 	filtersets [][]*promlabels.Matcher,
@@ -156,30 +320,84 @@ func newSeriesCache(
 	metadata MetadataGetter,
 	resourceMaps []ResourceMap,
 	metricsPrefix string,
+	jobPrefixes map[string]string,
+	namespaceProjects map[string]string,
+	selfJob string,
 	useGkeResource bool,
+	exportScrapeHealth bool,
 	counterAggregator *CounterAggregator,
-) *seriesCache {
+	gaugeAggregator *GaugeAggregator,
+	labelJoins []*LabelJoin,
+	deltas *DeltaConfig,
+	descriptors DescriptorUpdater,
+	gcInterval time.Duration,
+	seriesTTL time.Duration,
+	dropTracker *DroppedSeriesTracker,
+	escaping EscapingScheme,
+	labelSplits []*LabelSplit,
+	churnTracker *SeriesChurnTracker,
+	queryJoiner *QueryJoiner,
+	longNames LongNameAction,
+) *SeriesCache {
 	if logger == nil {
 		logger = log.NewNopLogger()
 	}
-	return &seriesCache{
-		logger:            logger,
-		dir:               dir,
-		filtersets:        filtersets,
-		targets:           targets,
-		metadata:          metadata,
-		resourceMaps:      resourceMaps,
-		entries:           map[uint64]*seriesCacheEntry{},
-		intervals:         map[uint64]sampleInterval{},
-		metricsPrefix:     metricsPrefix,
-		useGkeResource:    useGkeResource,
-		renames:           renames,
-		counterAggregator: counterAggregator,
+	return &SeriesCache{
+		logger:             logger,
+		dir:                dir,
+		filtersets:         filtersets,
+		targets:            targets,
+		metadata:           metadata,
+		resourceMaps:       resourceMaps,
+		entries:            map[uint64]*SeriesCacheEntry{},
+		intervals:          map[uint64]sampleInterval{},
+		createdTimestamps:  map[uint64]int64{},
+		owners:             map[uint64]seriesOwner{},
+		joinedLabels:       map[uint64]promlabels.Labels{},
+		restoredResets:     map[uint64]HandoverResetPoint{},
+		symbols:            newSymbolTable(),
+		labelJoins:         labelJoins,
+		deltas:             deltas,
+		descriptors:        descriptors,
+		gcInterval:         gcInterval,
+		seriesTTL:          seriesTTL,
+		dropTracker:        dropTracker,
+		escaping:           escaping,
+		labelSplits:        labelSplits,
+		churnTracker:       churnTracker,
+		queryJoiner:        queryJoiner,
+		longNames:          longNames,
+		metricsPrefix:      metricsPrefix,
+		jobPrefixes:        jobPrefixes,
+		namespaceProjects:  namespaceProjects,
+		selfJob:            selfJob,
+		useGkeResource:     useGkeResource,
+		exportScrapeHealth: exportScrapeHealth,
+		renames:            renames,
+		counterAggregator:  counterAggregator,
+		gaugeAggregator:    gaugeAggregator,
 	}
 }
 
-func (c *seriesCache) run(ctx context.Context) {
-	tick := time.NewTicker(time.Minute)
+// scrapeHealthMetrics are the synthetic series Prometheus writes for each
+// scrape. They are exported regardless of the configured filters when
+// scrape health export is enabled.
+var scrapeHealthMetrics = map[string]struct{}{
+	"up":                                    {},
+	"scrape_duration_seconds":               {},
+	"scrape_samples_scraped":                {},
+	"scrape_samples_post_metric_relabeling": {},
+}
+
+// Run periodically garbage collects cache entries that have become obsolete
+// through WAL checkpoints or inactivity. It blocks until the context is
+// canceled.
+func (c *SeriesCache) Run(ctx context.Context) {
+	interval := c.gcInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	tick := time.NewTicker(interval)
 	defer tick.Stop()
 
 	for {
@@ -194,77 +412,162 @@ func (c *seriesCache) run(ctx context.Context) {
 	}
 }
 
+// gcBatchSize bounds how many cache entries are inspected while holding the
+// cache lock, so garbage collection never pauses the hot path for long.
+const gcBatchSize = 1024
+
 // garbageCollect drops obsolete cache entries based on the contents of the most
-// recent checkpoint.
-func (c *seriesCache) garbageCollect() error {
-	cpDir, cpNum, err := tsdb.LastCheckpoint(c.dir)
-	if errors.Cause(err) == tsdb.ErrNotFound {
-		return nil // Nothing to do.
-	}
-	if err != nil {
+// recent checkpoint and, if a TTL is configured, expires entries that have not
+// seen a sample recently. Entries are deleted in small batches so concurrent
+// sample processing is not blocked for the duration of a full sweep.
+func (c *SeriesCache) garbageCollect() error {
+	// exists stays nil unless a new checkpoint appeared since the last run,
+	// in which case it holds the references it contains.
+	var exists map[uint64]struct{}
+	cpNum := c.lastCheckpoint
+
+	cpDir, num, err := tsdb.LastCheckpoint(c.dir)
+	switch {
+	case errors.Cause(err) == tsdb.ErrNotFound:
+		// No checkpoint yet; only the TTL sweep below applies.
+	case err != nil:
 		return errors.Wrap(err, "find last checkpoint")
-	}
-	if cpNum <= c.lastCheckpoint {
-		return nil
-	}
-	sr, err := wal.NewSegmentsReader(cpDir)
-	if err != nil {
-		return errors.Wrap(err, "open segments")
-	}
-	defer sr.Close()
+	case num > c.lastCheckpoint:
+		// Scan all series records in the checkpoint and build a set of
+		// existing references.
+		sr, err := wal.NewSegmentsReader(cpDir)
+		if err != nil {
+			return errors.Wrap(err, "open segments")
+		}
+		defer sr.Close()
 
-	// Scan all series records in the checkpoint and build a set of existing
-	// references.
-	var (
-		r      = wal.NewReader(sr)
+		var (
+			r      = wal.NewReader(sr)
+			dec    tsdb.RecordDecoder
+			series []tsdb.RefSeries
+		)
 		exists = map[uint64]struct{}{}
-		dec    tsdb.RecordDecoder
-		series []tsdb.RefSeries
-	)
-	for r.Next() {
-		rec := r.Record()
-		if dec.Type(rec) != tsdb.RecordSeries {
-			continue
-		}
-		series, err = dec.Series(rec, series[:0])
-		if err != nil {
-			return errors.Wrap(err, "decode series")
+		for r.Next() {
+			rec := r.Record()
+			if dec.Type(rec) != tsdb.RecordSeries {
+				continue
+			}
+			series, err = dec.Series(rec, series[:0])
+			if err != nil {
+				return errors.Wrap(err, "decode series")
+			}
+			for _, s := range series {
+				exists[s.Ref] = struct{}{}
+			}
 		}
-		for _, s := range series {
-			exists[s.Ref] = struct{}{}
+		if r.Err() != nil {
+			return errors.Wrap(err, "read checkpoint records")
 		}
+		cpNum = num
 	}
-	if r.Err() != nil {
-		return errors.Wrap(err, "read checkpoint records")
+	if exists == nil && c.seriesTTL <= 0 {
+		c.recordCacheSize()
+		return nil
 	}
 
-	// We can cleanup series in our cache that were neither in the current checkpoint nor
-	// defined in WAL segments after the checkpoint.
-	// References are monotonic but may be inserted into the WAL out of order. Thus we
-	// consider the highest possible segment a series was created in.
+	// Snapshot the cached references, then inspect them in batches so the
+	// lock is released between batches and samples keep flowing.
 	c.mtx.Lock()
-	defer c.mtx.Unlock()
+	refs := make([]uint64, 0, len(c.entries))
+	for ref := range c.entries {
+		refs = append(refs, ref)
+	}
+	c.mtx.Unlock()
 
-	for ref, entry := range c.entries {
-		if _, ok := exists[ref]; !ok && entry.maxSegment <= cpNum {
+	now := time.Now()
+	for start := 0; start < len(refs); start += gcBatchSize {
+		end := start + gcBatchSize
+		if end > len(refs) {
+			end = len(refs)
+		}
+		c.mtx.Lock()
+		for _, ref := range refs[start:end] {
+			entry, ok := c.entries[ref]
+			if !ok {
+				continue
+			}
+			// We can cleanup series in our cache that were neither in the
+			// current checkpoint nor defined in WAL segments after the
+			// checkpoint.
+			// References are monotonic but may be inserted into the WAL out of
+			// order. Thus we consider the highest possible segment a series
+			// was created in.
+			obsolete := false
+			if exists != nil {
+				_, live := exists[ref]
+				obsolete = !live && entry.maxSegment <= cpNum
+			}
+			expired := c.seriesTTL > 0 && now.Sub(entry.lastSeen) > c.seriesTTL
+			if !obsolete && !expired {
+				continue
+			}
+			if entry.createdFor != 0 {
+				delete(c.createdTimestamps, entry.createdFor)
+			}
+			if o, ok := c.owners[entry.hash]; ok && o.ref == ref {
+				delete(c.owners, entry.hash)
+			}
+			if c.churnTracker != nil && entry.createdFor == 0 {
+				c.churnTracker.ObserveEvicted(entry.lset.Get("__name__"))
+			}
+			c.symbols.releaseLabels(entry.lset)
 			delete(c.entries, ref)
 		}
+		c.mtx.Unlock()
 	}
 	c.lastCheckpoint = cpNum
+	c.recordCacheSize()
 	return nil
 }
 
-func (c *seriesCache) get(ctx context.Context, ref uint64) (*seriesCacheEntry, bool, error) {
+// releaseEntryLocked releases the interned label strings of the entry
+// currently stored for ref, if any, before the reference is reassigned.
+// The caller must hold the cache mutex.
+func (c *SeriesCache) releaseEntryLocked(ref uint64) {
+	if prev, ok := c.entries[ref]; ok {
+		c.symbols.releaseLabels(prev.lset)
+	}
+}
+
+// recordCacheSize exports the current number of cached entries.
+func (c *SeriesCache) recordCacheSize() {
+	c.mtx.Lock()
+	size := len(c.entries)
+	c.mtx.Unlock()
+	stats.Record(context.Background(), cachedSeries.M(int64(size)))
+}
+
+// Get returns the cached entry for the given series reference. The second
+// return value is false if no populated entry exists for the reference.
+func (c *SeriesCache) Get(ctx context.Context, ref uint64) (*SeriesCacheEntry, bool, error) {
 	c.mtx.Lock()
 	e, ok := c.entries[ref]
+	if ok {
+		e.lastSeen = time.Now()
+	}
 	c.mtx.Unlock()
 
 	if !ok {
 		return nil, false, nil
 	}
+	// _created series have no conversion state of their own but must reach
+	// the sample builder so it can record their start times.
+	if e.createdFor != 0 {
+		return e, true, nil
+	}
 	if e.shouldRefresh() {
 		if err := c.refresh(ctx, ref); err != nil {
-			return nil, false, err
+			// Populated entries keep exporting with their current state on
+			// transient probe failures.
+			if !e.populated() {
+				return nil, false, err
+			}
+			level.Debug(c.logger).Log("msg", "series refresh failed", "labels", e.lset, "err", err)
 		}
 	}
 	if !e.populated() {
@@ -273,9 +576,9 @@ func (c *seriesCache) get(ctx context.Context, ref uint64) (*seriesCacheEntry, b
 	return e, true, nil
 }
 
-// updateSampleInterval attempts to set the new most recent time range for the series with given hash.
+// UpdateSampleInterval attempts to set the new most recent time range for the series with given hash.
 // Returns false if it failed, in which case the sample must be discarded.
-func (c *seriesCache) updateSampleInterval(hash uint64, start, end int64) bool {
+func (c *SeriesCache) UpdateSampleInterval(hash uint64, start, end int64) bool {
 	iv, ok := c.intervals[hash]
 	if !ok || iv.accepts(start, end) {
 		c.intervals[hash] = sampleInterval{start, end}
@@ -292,12 +595,17 @@ func (si *sampleInterval) accepts(start, end int64) bool {
 	return (start == si.start && end > si.end) || (start > si.start && start >= si.end)
 }
 
-// getResetAdjusted takes a sample for a referenced series and returns
+// GetResetAdjusted takes a sample for a referenced series and returns
 // its reset timestamp and adjusted value.
 // If the last return argument is false, the sample should be dropped.
-func (c *seriesCache) getResetAdjusted(ref uint64, t int64, v float64) (int64, float64, bool) {
+func (c *SeriesCache) GetResetAdjusted(ref uint64, t int64, v float64) (int64, float64, bool) {
 	c.mtx.Lock()
 	e, ok := c.entries[ref]
+	var created int64
+	var hasCreated bool
+	if ok && e.createdKey != 0 {
+		created, hasCreated = c.createdTimestamps[e.createdKey]
+	}
 	c.mtx.Unlock()
 	if !ok {
 		return 0, 0, false
@@ -305,9 +613,30 @@ func (c *seriesCache) getResetAdjusted(ref uint64, t int64, v float64) (int64, f
 	hasReset := e.hasReset
 	e.hasReset = true
 	if !hasReset {
+		// A reset point restored from a handover file continues the
+		// cumulative interval of the previous instance; the regular logic
+		// below detects any reset that happened in between.
+		if p, ok := c.takeRestoredReset(e.lset.Hash()); ok {
+			e.resetValue = p.ResetValue
+			e.resetTimestamp = p.ResetTimestamp
+			e.previousValue = p.PreviousValue
+			e.previousTimestamp = p.PreviousTimestamp
+			hasReset = true
+		}
+	}
+	if !hasReset {
+		e.previousValue = v
+		e.previousTimestamp = t
+		// If an OpenMetrics _created series reported the true start time, the
+		// first sample doesn't have to be skipped: we know the value
+		// accumulated from zero since that time.
+		if hasCreated && created < t {
+			e.resetTimestamp = created
+			e.resetValue = 0
+			return e.resetTimestamp, v, true
+		}
 		e.resetTimestamp = t
 		e.resetValue = v
-		e.previousValue = v
 		// If we just initialized the reset timestamp, this sample should be skipped.
 		// We don't know the window over which the current cumulative value was built up over.
 		// The next sample for will be considered from this point onwards.
@@ -315,39 +644,168 @@ func (c *seriesCache) getResetAdjusted(ref uint64, t int64, v float64) (int64, f
 	}
 	if v < e.previousValue {
 		// If the value has dropped, there's been a reset.
-		// If the series was reset, set the reset timestamp to be one millisecond
-		// before the timestamp of the current sample.
-		// We don't know the true reset time but this ensures the range is non-zero
-		// while unlikely to conflict with any previous sample.
+		// Prefer the start time reported by a _created series if it moved
+		// forward. Otherwise estimate it: with the target's scrape interval
+		// known, the reset happened at most one interval before the current
+		// sample. Without it, fall back to one millisecond before the sample;
+		// that doesn't reflect the true reset time but ensures the range is
+		// non-zero while unlikely to conflict with any previous sample.
 		e.resetValue = 0
-		e.resetTimestamp = t - 1
+		switch {
+		case hasCreated && created > e.resetTimestamp && created < t:
+			e.resetTimestamp = created
+		case e.pointSpacing > 0 && t-e.pointSpacing > e.previousTimestamp:
+			e.resetTimestamp = t - e.pointSpacing
+		default:
+			e.resetTimestamp = t - 1
+		}
 	}
 	e.previousValue = v
+	e.previousTimestamp = t
 	return e.resetTimestamp, v - e.resetValue, true
 }
 
-// set the label set for the given reference.
+// RestoreResetPoints seeds counter reset tracking from a handover file, so
+// cumulative series continue the intervals established by the previous
+// instance instead of skipping their first sample to start new ones.
+func (c *SeriesCache) RestoreResetPoints(points []HandoverResetPoint) {
+	c.mtx.Lock()
+	for _, p := range points {
+		c.restoredResets[p.Hash] = p
+	}
+	c.mtx.Unlock()
+}
+
+// takeRestoredReset consumes the restored reset point for the series with the
+// given label set hash, if any.
+func (c *SeriesCache) takeRestoredReset(hash uint64) (HandoverResetPoint, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	p, ok := c.restoredResets[hash]
+	if ok {
+		delete(c.restoredResets, hash)
+	}
+	return p, ok
+}
+
+// ResetPoints exports the counter reset tracking of every initialized series
+// for a handover file.
+func (c *SeriesCache) ResetPoints() []HandoverResetPoint {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	var points []HandoverResetPoint
+	for _, e := range c.entries {
+		if !e.hasReset {
+			continue
+		}
+		points = append(points, HandoverResetPoint{
+			Hash:              e.lset.Hash(),
+			ResetValue:        e.resetValue,
+			ResetTimestamp:    e.resetTimestamp,
+			PreviousValue:     e.previousValue,
+			PreviousTimestamp: e.previousTimestamp,
+		})
+	}
+	return points
+}
+
+// ResetCumulative forgets the reset tracking of the referenced series. The
+// next sample seeds a new reset timestamp and is skipped, starting a fresh
+// cumulative interval. Used when a histogram changes its bucket layout
+// mid-stream.
+func (c *SeriesCache) ResetCumulative(ref uint64) {
+	c.mtx.Lock()
+	if e, ok := c.entries[ref]; ok {
+		e.hasReset = false
+	}
+	c.mtx.Unlock()
+}
+
+// SetCreatedTimestamp records the start time in milliseconds an OpenMetrics
+// _created series reported for the metric family instance with the given key.
+func (c *SeriesCache) SetCreatedTimestamp(key uint64, t int64) {
+	c.mtx.Lock()
+	c.createdTimestamps[key] = t
+	c.mtx.Unlock()
+}
+
+// createdKey returns the key under which the start time from an OpenMetrics
+// _created series is stored. It identifies the metric family instance through
+// the base metric name and the label set without the __name__ and le labels.
+func createdKey(baseName string, lset labels.Labels) uint64 {
+	key := make(labels.Labels, 0, len(lset))
+	for _, l := range lset {
+		if l.Name == "__name__" || l.Name == "le" {
+			continue
+		}
+		key = append(key, l)
+	}
+	key = append(key, labels.Label{Name: "__name__", Value: baseName})
+	sort.Sort(key)
+	return key.Hash()
+}
+
+// Set the label set for the given reference.
 // maxSegment indicates the the highest segment at which the series was possibly defined.
-func (c *seriesCache) set(ctx context.Context, ref uint64, lset labels.Labels, maxSegment int) error {
-	exported := c.filtersets == nil || matchFiltersets(lset, c.filtersets)
+func (c *SeriesCache) Set(ctx context.Context, ref uint64, lset labels.Labels, maxSegment int) error {
+	// Never export the sidecar's own scrape job. If Prometheus scrapes the
+	// sidecar's /metrics endpoint, exporting it would feed the sidecar's
+	// internal metrics back into itself and grow without bound.
+	if c.selfJob != "" && lset.Get("job") == c.selfJob {
+		return nil
+	}
+	// OpenMetrics _created series carry the start time of their metric family.
+	// They are consumed by the sample builder to set precise start times for
+	// cumulative series and are never exported themselves.
+	if name := lset.Get("__name__"); strings.HasSuffix(name, metricSuffixCreated) {
+		c.mtx.Lock()
+		c.releaseEntryLocked(ref)
+		c.entries[ref] = &SeriesCacheEntry{
+			maxSegment: maxSegment,
+			lset:       c.symbols.internLabels(lset),
+			createdFor: createdKey(name[:len(name)-len(metricSuffixCreated)], lset),
+			lastSeen:   time.Now(),
+		}
+		c.mtx.Unlock()
+		return nil
+	}
+	// Record the labels of info metric series even when the series itself is
+	// filtered out; only the joined labels have to reach Stackdriver.
+	if len(c.labelJoins) > 0 {
+		c.observeInfoMetric(lset)
+	}
+	exported := c.filtersets == nil || c.matchFiltersetsWithTarget(ctx, lset)
+	if !exported && c.exportScrapeHealth {
+		_, exported = scrapeHealthMetrics[lset.Get("__name__")]
+	}
 	counterTracker := c.counterAggregator.getTracker(lset)
+	gaugeTracker := c.gaugeAggregator.getTracker(lset)
 
-	if !exported && counterTracker == nil {
+	if !exported && counterTracker == nil && gaugeTracker == nil {
+		if c.dropTracker != nil {
+			c.dropTracker.Observe("filtered", lset)
+		}
 		return nil
 	}
 
 	c.mtx.Lock()
-	c.entries[ref] = &seriesCacheEntry{
+	c.releaseEntryLocked(ref)
+	c.entries[ref] = &SeriesCacheEntry{
 		maxSegment: maxSegment,
-		lset:       lset,
+		lset:       c.symbols.internLabels(lset),
 		exported:   exported,
 		tracker:    counterTracker,
+		gauges:     gaugeTracker,
+		lastSeen:   time.Now(),
 	}
 	c.mtx.Unlock()
+	if c.churnTracker != nil {
+		c.churnTracker.ObserveCreated(lset.Get("__name__"))
+	}
 	return c.refresh(ctx, ref)
 }
 
-func (c *seriesCache) refresh(ctx context.Context, ref uint64) error {
+func (c *SeriesCache) refresh(ctx context.Context, ref uint64) error {
 	c.mtx.Lock()
 	entry := c.entries[ref]
 	c.mtx.Unlock()
@@ -366,6 +824,9 @@ func (c *seriesCache) refresh(ctx context.Context, ref uint64) error {
 	if target == nil {
 		ctx, _ = tag.New(ctx, tag.Insert(keyReason, "target_not_found"))
 		stats.Record(ctx, droppedSeries.M(1))
+		if c.dropTracker != nil {
+			c.dropTracker.Observe("target_not_found", entry.lset)
+		}
 		level.Debug(c.logger).Log("msg", "target not found", "labels", entry.lset)
 		return nil
 	}
@@ -373,6 +834,9 @@ func (c *seriesCache) refresh(ctx context.Context, ref uint64) error {
 	if !ok {
 		ctx, _ = tag.New(ctx, tag.Insert(keyReason, "unknown_resource"))
 		stats.Record(ctx, droppedSeries.M(1))
+		if c.dropTracker != nil {
+			c.dropTracker.Observe("unknown_resource", entry.lset)
+		}
 		level.Debug(c.logger).Log("msg", "unknown resource", "labels", target.Labels, "discovered_labels", target.DiscoveredLabels)
 		return nil
 	}
@@ -388,10 +852,29 @@ func (c *seriesCache) refresh(ctx context.Context, ref uint64) error {
 			break
 		}
 	}
+	// Attach labels joined from info metrics before checking the label count
+	// so oversized series are still dropped.
+	if len(c.labelJoins) > 0 {
+		finalLabels = c.attachJoinedLabels(finalLabels, entry.lset)
+	}
+	if c.queryJoiner != nil {
+		finalLabels = c.queryJoiner.attach(finalLabels, entry.lset)
+	}
+	// Split composite label values. Like joins, this runs before the label
+	// count check since it can add labels.
+	for _, s := range c.labelSplits {
+		if s.Metric != "" && s.Metric != entry.lset.Get("__name__") {
+			continue
+		}
+		finalLabels = s.apply(finalLabels)
+	}
 	// Drop series with too many labels.
 	if len(finalLabels) > maxLabelCount {
 		ctx, _ = tag.New(ctx, tag.Insert(keyReason, "too_many_labels"))
 		stats.Record(ctx, droppedSeries.M(1))
+		if c.dropTracker != nil {
+			c.dropTracker.Observe("too_many_labels", entry.lset)
+		}
 		level.Debug(c.logger).Log("msg", "too many labels", "labels", entry.lset)
 		return nil
 	}
@@ -403,6 +886,10 @@ func (c *seriesCache) refresh(ctx context.Context, ref uint64) error {
 		job            = entry.lset.Get("job")
 		instance       = entry.lset.Get("instance")
 	)
+	prefix := c.metricsPrefix
+	if p, ok := c.jobPrefixes[job]; ok {
+		prefix = p
+	}
 	metadata, err := c.metadata.Get(ctx, job, instance, metricName)
 	if err != nil {
 		return errors.Wrap(err, "get metadata")
@@ -420,13 +907,35 @@ func (c *seriesCache) refresh(ctx context.Context, ref uint64) error {
 		if metadata == nil {
 			ctx, _ = tag.New(ctx, tag.Insert(keyReason, "metadata_not_found"))
 			stats.Record(ctx, droppedSeries.M(1))
+			if c.dropTracker != nil {
+				c.dropTracker.Observe("metadata_not_found", entry.lset)
+			}
 			level.Debug(c.logger).Log("msg", "metadata not found", "metric_name", metricName)
 			return nil
 		}
 	}
+	if entry.metadata != nil && (entry.metadata.MetricType != metadata.MetricType || entry.metadata.ValueType != metadata.ValueType) {
+		// The metric's type changed, e.g. through an exporter upgrade. Restart
+		// conversion from scratch so the series continues under the new kind
+		// instead of carrying over reset state that no longer applies.
+		stats.Record(ctx, metricTypeChanges.M(1))
+		level.Info(c.logger).Log("msg", "metric type changed",
+			"metric_name", metricName, "old", entry.metadata.MetricType, "new", metadata.MetricType)
+		entry.hasReset = false
+		entry.resetValue = 0
+		entry.resetTimestamp = 0
+		entry.previousValue = 0
+		entry.previousTimestamp = 0
+		entry.deltaValue = 0
+		entry.deltaTimestamp = 0
+		entry.gaugeWindowStart = 0
+		entry.gaugeWindowSum = 0
+		entry.gaugeWindowCount = 0
+		entry.gaugeWindowMax = 0
+	}
 	// Handle label modifications for histograms early so we don't build the label map twice.
 	// We have to remove the 'le' label which defines the bucket boundary.
-	if metadata.MetricType == textparse.MetricTypeHistogram {
+	if metadata.MetricType == textparse.MetricTypeHistogram || metadata.MetricType == textparse.MetricTypeGaugeHistogram {
 		for i, l := range finalLabels {
 			if l.Name == "le" {
 				finalLabels = append(finalLabels[:i], finalLabels[i+1:]...)
@@ -434,23 +943,35 @@ func (c *seriesCache) refresh(ctx context.Context, ref uint64) error {
 			}
 		}
 	}
+	// Intern the label strings so series sharing names and values reference
+	// one copy instead of each retaining their own WAL-decoded allocation.
+	metricLabels := make(map[string]string, len(finalLabels))
+	for _, l := range finalLabels {
+		metricLabels[internedLabels.intern(escapeName(l.Name, c.escaping, true))] = internedLabels.intern(l.Value)
+	}
 	ts := &monitoring_pb.TimeSeries{
 		Metric: &metric_pb.Metric{
-			Type:   c.getMetricType(c.metricsPrefix, metricName),
-			Labels: finalLabels.Map(),
+			Type:   c.getMetricType(prefix, metricName),
+			Labels: metricLabels,
 		},
 		Resource: resource,
 	}
 
+	if err := checkValueType(metadata.MetricType, metadata.ValueType); err != nil {
+		return err
+	}
 	switch metadata.MetricType {
 	case textparse.MetricTypeCounter:
 		ts.MetricKind = metric_pb.MetricDescriptor_CUMULATIVE
+		if c.deltas.isDelta(metricName) || (baseMetricName != "" && c.deltas.isDelta(baseMetricName)) {
+			ts.MetricKind = metric_pb.MetricDescriptor_DELTA
+		}
 		ts.ValueType = metric_pb.MetricDescriptor_DOUBLE
 		if metadata.ValueType != metric_pb.MetricDescriptor_VALUE_TYPE_UNSPECIFIED {
 			ts.ValueType = metadata.ValueType
 		}
 		if baseMetricName != "" && suffix == metricSuffixTotal {
-			ts.Metric.Type = c.getMetricType(c.metricsPrefix, baseMetricName)
+			ts.Metric.Type = c.getMetricType(prefix, baseMetricName)
 		}
 	case textparse.MetricTypeGauge, textparse.MetricTypeUnknown:
 		ts.MetricKind = metric_pb.MetricDescriptor_GAUGE
@@ -473,33 +994,115 @@ func (c *seriesCache) refresh(ctx context.Context, ref uint64) error {
 			return errors.Errorf("unexpected metric name suffix %q", suffix)
 		}
 	case textparse.MetricTypeHistogram:
-		ts.Metric.Type = c.getMetricType(c.metricsPrefix, baseMetricName)
+		ts.Metric.Type = c.getMetricType(prefix, baseMetricName)
 		ts.MetricKind = metric_pb.MetricDescriptor_CUMULATIVE
 		ts.ValueType = metric_pb.MetricDescriptor_DISTRIBUTION
+	case textparse.MetricTypeGaugeHistogram:
+		ts.Metric.Type = c.getMetricType(prefix, baseMetricName)
+		ts.MetricKind = metric_pb.MetricDescriptor_GAUGE
+		ts.ValueType = metric_pb.MetricDescriptor_DISTRIBUTION
+	case textparse.MetricTypeStateset:
+		ts.MetricKind = metric_pb.MetricDescriptor_GAUGE
+		ts.ValueType = metric_pb.MetricDescriptor_BOOL
+	case textparse.MetricTypeInfo:
+		ts.MetricKind = metric_pb.MetricDescriptor_GAUGE
+		ts.ValueType = metric_pb.MetricDescriptor_INT64
 	default:
 		return errors.Errorf("unexpected metric type %s", metadata.MetricType)
 	}
 
+	if len(ts.Metric.Type) > maxMetricTypeLength {
+		if c.longNames != LongNameTruncate {
+			return errors.Errorf("metric type %s exceeds the maximum length of %d characters", ts.Metric.Type, maxMetricTypeLength)
+		}
+		ts.Metric.Type = internedLabels.intern(truncateMetricType(ts.Metric.Type))
+	}
+
+	// Distinct Prometheus series can map to the same Stackdriver series, e.g.
+	// through renames or dropped labels. Writing both would interleave their
+	// points and fail; keep only the smaller input label set so the winner is
+	// the same regardless of the order in which the series appear.
+	// Distribution series are exempt: all bucket series of a histogram map to
+	// the same output series by design.
+	hash := hashSeries(ts)
+	key := seriesKey(ts.Resource, ts.Metric)
+	if ts.ValueType != metric_pb.MetricDescriptor_DISTRIBUTION {
+		c.mtx.Lock()
+		// The 64 bit hash can collide between distinct output series, which
+		// would silently merge them. Verify the hash against the stored series
+		// key and probe linearly past genuine collisions, so whichever series
+		// registered first keeps the original hash and later ones are
+		// disambiguated the same way on every refresh.
+		for {
+			owner, ok := c.owners[hash]
+			if !ok || owner.key == key {
+				break
+			}
+			stats.Record(ctx, hashCollisions.M(1))
+			level.Warn(c.logger).Log("msg", "series hash collision",
+				"labels", entry.lset, "existing_labels", owner.lset)
+			hash++
+		}
+		owner, collision := c.owners[hash]
+		switch {
+		case !collision || labels.Compare(entry.lset, owner.lset) == 0:
+			c.owners[hash] = seriesOwner{ref: ref, lset: entry.lset, key: key}
+		case labels.Compare(entry.lset, owner.lset) < 0:
+			if prev, ok := c.entries[owner.ref]; ok {
+				prev.proto = nil
+			}
+			c.owners[hash] = seriesOwner{ref: ref, lset: entry.lset, key: key}
+		default:
+			c.mtx.Unlock()
+			ctx, _ = tag.New(ctx, tag.Insert(keyReason, "series_collision"))
+			stats.Record(ctx, droppedSeries.M(1))
+			if c.dropTracker != nil {
+				c.dropTracker.Observe("series_collision", entry.lset)
+			}
+			level.Warn(c.logger).Log("msg", "series collides with an already exported series",
+				"labels", entry.lset, "existing_labels", owner.lset)
+			return nil
+		}
+		c.mtx.Unlock()
+	}
+
 	entry.proto = ts
 	entry.metadata = metadata
 	entry.suffix = suffix
-	entry.hash = hashSeries(ts)
+	entry.hash = hash
+	entry.pointSpacing = int64(target.ScrapeIntervalDuration() / time.Millisecond)
 
+	if c.descriptors != nil && entry.exported {
+		c.descriptors.UpdateDescriptor(ts, metadata.Help)
+	}
+
+	if ts.MetricKind == metric_pb.MetricDescriptor_CUMULATIVE {
+		base := metricName
+		if baseMetricName != "" {
+			base = baseMetricName
+		}
+		entry.createdKey = createdKey(base, entry.lset)
+	}
 	return nil
 }
 
-func (c *seriesCache) getMetricType(prefix, name string) string {
+func (c *SeriesCache) getMetricType(prefix, name string) string {
 	if repl, ok := c.renames[name]; ok {
 		name = repl
 	}
-	return getMetricType(prefix, name)
+	name = escapeName(name, c.escaping, false)
+	// Many series share a metric type; pool the built string.
+	return internedLabels.intern(getMetricType(prefix, name))
 }
 
 // getResource returns the monitored resource, the entry labels, and whether the operation succeeded.
 // The returned entry labels are a subset of `entryLabels` without the labels that were used as resource labels.
-func (c *seriesCache) getResource(discovered, entryLabels promlabels.Labels) (*monitoredres_pb.MonitoredResource, promlabels.Labels, bool) {
+func (c *SeriesCache) getResource(discovered, entryLabels promlabels.Labels) (*monitoredres_pb.MonitoredResource, promlabels.Labels, bool) {
 	if c.useGkeResource {
 		if lset, finalLabels := GKEResourceMap.BestEffortTranslate(discovered, entryLabels); lset != nil {
+			// Resource label names come from the static resource maps; only
+			// the values are per-series allocations worth pooling.
+			internedLabels.internValues(lset)
 			return &monitoredres_pb.MonitoredResource{
 				Type:   GKEResourceMap.Type,
 				Labels: lset,
@@ -508,6 +1111,14 @@ func (c *seriesCache) getResource(discovered, entryLabels promlabels.Labels) (*m
 	}
 	for _, m := range c.resourceMaps {
 		if lset, finalLabels := m.Translate(discovered, entryLabels); lset != nil {
+			// Route containers to the project configured for their namespace,
+			// so tenants can be isolated without one sidecar per namespace.
+			if m.Type == "k8s_container" && len(c.namespaceProjects) > 0 {
+				if project, ok := c.namespaceProjects[lset["namespace_name"]]; ok {
+					lset["project_id"] = project
+				}
+			}
+			internedLabels.internValues(lset)
 			return &monitoredres_pb.MonitoredResource{
 				Type:   m.Type,
 				Labels: lset,
@@ -530,10 +1141,57 @@ func matchFiltersets(lset labels.Labels, filtersets [][]*promlabels.Matcher) boo
 // matchFilterset checks whether labels match a given list of label matchers.
 // All matchers need to match for the function to return true.
 func matchFilterset(lset labels.Labels, filterset []*promlabels.Matcher) bool {
+	return matchFiltersetFunc(lset.Get, filterset)
+}
+
+// matchFiltersetFunc checks whether the label values returned by get match a
+// given list of label matchers. All matchers need to match for the function
+// to return true.
+func matchFiltersetFunc(get func(string) string, filterset []*promlabels.Matcher) bool {
 	for _, matcher := range filterset {
-		if !matcher.Matches(lset.Get(matcher.Name)) {
+		if !matcher.Matches(get(matcher.Name)) {
 			return false
 		}
 	}
 	return true
 }
+
+// matchFiltersetsWithTarget checks whether any of the configured filtersets
+// passes for the series. Matchers on double-underscore labels other than
+// __name__ refer to the labels of the series' target, including its
+// discovered labels, and are resolved through the target cache. This enables
+// export policies scoped by discovery metadata, e.g. a Kubernetes namespace
+// matched as __meta_kubernetes_namespace. The target is only looked up when
+// such a matcher is actually evaluated.
+func (c *SeriesCache) matchFiltersetsWithTarget(ctx context.Context, lset labels.Labels) bool {
+	var (
+		target   *targets.Target
+		resolved bool
+	)
+	get := func(name string) string {
+		if !strings.HasPrefix(name, "__") || name == "__name__" {
+			return lset.Get(name)
+		}
+		if !resolved {
+			resolved = true
+			t, err := c.targets.Get(ctx, pkgLabels(lset))
+			if err != nil {
+				level.Warn(c.logger).Log("msg", "retrieving target failed", "err", err)
+			}
+			target = t
+		}
+		if target == nil {
+			return ""
+		}
+		if v := target.Labels.Get(name); v != "" {
+			return v
+		}
+		return target.DiscoveredLabels.Get(name)
+	}
+	for _, fs := range c.filtersets {
+		if matchFiltersetFunc(get, fs) {
+			return true
+		}
+	}
+	return false
+}
@@ -20,6 +20,8 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
 	"testing"
@@ -56,30 +58,31 @@ func TestScrapeCache_GarbageCollect(t *testing.T) {
 	}()
 	logger := log.NewLogfmtLogger(logBuffer)
 	aggr, _ := NewCounterAggregator(logger, new(CounterAggregatorConfig))
-	c := newSeriesCache(logger, dir, nil, nil,
+	gaugeAggr, _ := NewGaugeAggregator(logger, new(GaugeAggregatorConfig))
+	c := NewSeriesCache(logger, dir, nil, nil,
 		targetMap{"/": &targets.Target{}},
 		metadataMap{"//": &metadata.Entry{MetricType: textparse.MetricTypeGauge, ValueType: metric_pb.MetricDescriptor_DOUBLE}},
 		[]ResourceMap{
 			{Type: "resource1", LabelMap: map[string]labelTranslation{}},
 		},
-		"", false, aggr,
+		"", nil, nil, "", false, false, aggr, gaugeAggr, nil, nil, nil, 0, 0, nil, "", nil, nil, nil, "",
 	)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	// Add the series to the cache. Normally, they would have been inserted during
 	// tailing - either with the checkpoint index or a segment index at or below.
-	c.set(ctx, 1, labels.FromStrings("a", "1"), 0)
-	c.set(ctx, 2, labels.FromStrings("a", "2"), 5)
-	c.set(ctx, 3, labels.FromStrings("a", "3"), 9)
-	c.set(ctx, 4, labels.FromStrings("a", "4"), 10)
-	c.set(ctx, 5, labels.FromStrings("a", "5"), 11)
-	c.set(ctx, 6, labels.FromStrings("a", "6"), 12)
-	c.set(ctx, 7, labels.FromStrings("a", "7"), 13)
+	c.Set(ctx, 1, labels.FromStrings("a", "1"), 0)
+	c.Set(ctx, 2, labels.FromStrings("a", "2"), 5)
+	c.Set(ctx, 3, labels.FromStrings("a", "3"), 9)
+	c.Set(ctx, 4, labels.FromStrings("a", "4"), 10)
+	c.Set(ctx, 5, labels.FromStrings("a", "5"), 11)
+	c.Set(ctx, 6, labels.FromStrings("a", "6"), 12)
+	c.Set(ctx, 7, labels.FromStrings("a", "7"), 13)
 
 	// We should be able to read them all.
 	for i := 1; i <= 7; i++ {
-		entry, ok, err := c.get(ctx, uint64(i))
+		entry, ok, err := c.Get(ctx, uint64(i))
 		if err != nil {
 			t.Fatalf("unexpected error: %s", err)
 		}
@@ -118,7 +121,7 @@ func TestScrapeCache_GarbageCollect(t *testing.T) {
 			t.Fatal(err)
 		}
 		for i := 1; i < 2; i++ {
-			if entry, ok, err := c.get(ctx, uint64(i)); err != nil {
+			if entry, ok, err := c.Get(ctx, uint64(i)); err != nil {
 				t.Fatalf("unexpected error: %s", err)
 			} else if ok {
 				t.Fatalf("unexpected cache entry %d: %s", i, entry.lset)
@@ -126,7 +129,7 @@ func TestScrapeCache_GarbageCollect(t *testing.T) {
 		}
 		// We should be able to read them all.
 		for i := 3; i <= 7; i++ {
-			entry, ok, err := c.get(ctx, uint64(i))
+			entry, ok, err := c.Get(ctx, uint64(i))
 			if err != nil {
 				t.Fatalf("unexpected error: %s", err)
 			}
@@ -166,14 +169,14 @@ func TestScrapeCache_GarbageCollect(t *testing.T) {
 	//  Only series 4 and 7 should be left.
 	for i := 1; i <= 7; i++ {
 		if i != 4 && i != 7 {
-			if entry, ok, err := c.get(ctx, uint64(i)); err != nil {
+			if entry, ok, err := c.Get(ctx, uint64(i)); err != nil {
 				t.Fatalf("unexpected error: %s", err)
 			} else if ok {
 				t.Fatalf("unexpected cache entry %d: %s", i, entry.lset)
 			}
 			continue
 		}
-		entry, ok, err := c.get(ctx, uint64(i))
+		entry, ok, err := c.Get(ctx, uint64(i))
 		if err != nil {
 			t.Fatalf("unexpected error: %s", err)
 		}
@@ -186,6 +189,63 @@ func TestScrapeCache_GarbageCollect(t *testing.T) {
 	}
 }
 
+func TestScrapeCache_InactiveSeriesTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scrape_cache_ttl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger := log.NewNopLogger()
+	aggr, _ := NewCounterAggregator(logger, new(CounterAggregatorConfig))
+	gaugeAggr, _ := NewGaugeAggregator(logger, new(GaugeAggregatorConfig))
+	c := NewSeriesCache(logger, dir, nil, nil,
+		targetMap{"/": &targets.Target{}},
+		metadataMap{"//": &metadata.Entry{MetricType: textparse.MetricTypeGauge, ValueType: metric_pb.MetricDescriptor_DOUBLE}},
+		[]ResourceMap{
+			{Type: "resource1", LabelMap: map[string]labelTranslation{}},
+		},
+		"", nil, nil, "", false, false, aggr, gaugeAggr, nil, nil, nil, 0, time.Minute, nil, "", nil, nil, nil, "",
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c.Set(ctx, 1, labels.FromStrings("a", "1"), 0)
+	c.Set(ctx, 2, labels.FromStrings("a", "2"), 0)
+
+	// Mark the first series as inactive for longer than the TTL. There is no
+	// checkpoint in the directory, so only the TTL sweep applies.
+	c.entries[1].lastSeen = time.Now().Add(-2 * time.Minute)
+	if err := c.garbageCollect(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := c.Get(ctx, 1); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if ok {
+		t.Fatalf("inactive series was not dropped")
+	}
+	entry, ok, err := c.Get(ctx, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !ok {
+		t.Fatalf("active series was dropped")
+	}
+	if !entry.lset.Equals(labels.FromStrings("a", "2")) {
+		t.Fatalf("unexpected label set: %s", entry.lset)
+	}
+	// The lookup above counts as activity, so another collection right after
+	// must keep the series.
+	if err := c.garbageCollect(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := c.Get(ctx, 2); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if !ok {
+		t.Fatalf("active series was dropped")
+	}
+}
+
 func TestSeriesCache_Refresh(t *testing.T) {
 	resourceMaps := []ResourceMap{
 		{
@@ -203,14 +263,15 @@ func TestSeriesCache_Refresh(t *testing.T) {
 	}()
 	logger := log.NewLogfmtLogger(logBuffer)
 	aggr, _ := NewCounterAggregator(logger, new(CounterAggregatorConfig))
-	c := newSeriesCache(logger, "", nil, nil, targetMap, metadataMap, resourceMaps, "", false, aggr)
+	gaugeAggr, _ := NewGaugeAggregator(logger, new(GaugeAggregatorConfig))
+	c := NewSeriesCache(logger, "", nil, nil, targetMap, metadataMap, resourceMaps, "", nil, nil, "", false, false, aggr, gaugeAggr, nil, nil, nil, 0, 0, nil, "", nil, nil, nil, "")
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	// Query unset reference.
 	const refID = 1
-	entry, ok, err := c.get(ctx, refID)
+	entry, ok, err := c.Get(ctx, refID)
 	if err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
@@ -219,14 +280,14 @@ func TestSeriesCache_Refresh(t *testing.T) {
 	}
 
 	// Set a series but the metadata and target getters won't have sufficient information for it.
-	if err := c.set(ctx, refID, labels.FromStrings("__name__", "metric1", "job", "job1", "instance", "inst1"), 5); err != nil {
+	if err := c.Set(ctx, refID, labels.FromStrings("__name__", "metric1", "job", "job1", "instance", "inst1"), 5); err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
 	if !strings.Contains(logBuffer.String(), "target not found") {
 		t.Errorf("expected error \"target not found\", got: %v", logBuffer)
 	}
 	// We should still not receive anything.
-	entry, ok, err = c.get(ctx, refID)
+	entry, ok, err = c.Get(ctx, refID)
 	if err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
@@ -246,7 +307,7 @@ func TestSeriesCache_Refresh(t *testing.T) {
 	c.entries[refID].lastRefresh = time.Now().Add(-2 * refreshInterval)
 
 	// Now another get should trigger a refresh, which now finds data.
-	entry, ok, err = c.get(ctx, refID)
+	entry, ok, err = c.Get(ctx, refID)
 	if entry == nil || !ok || err != nil {
 		t.Errorf("expected metadata but got none, error: %s", err)
 	}
@@ -255,6 +316,118 @@ func TestSeriesCache_Refresh(t *testing.T) {
 	}
 }
 
+func TestSeriesCache_ResetWithScrapeInterval(t *testing.T) {
+	resourceMaps := []ResourceMap{
+		{
+			Type:     "resource2",
+			LabelMap: map[string]labelTranslation{"__resource_a": constValue("resource_a")},
+		},
+	}
+	targetMap := targetMap{
+		"job1/inst1": &targets.Target{
+			Labels:           promlabels.FromStrings("job", "job1", "instance", "inst1"),
+			DiscoveredLabels: promlabels.FromStrings("__resource_a", "resource2_a"),
+			ScrapeInterval:   "15s",
+		},
+	}
+	metadataMap := metadataMap{
+		"job1/inst1/metric1": &metadata.Entry{Metric: "metric1", MetricType: textparse.MetricTypeCounter, ValueType: metric_pb.MetricDescriptor_DOUBLE},
+	}
+	aggr, _ := NewCounterAggregator(log.NewNopLogger(), new(CounterAggregatorConfig))
+	gaugeAggr, _ := NewGaugeAggregator(log.NewNopLogger(), new(GaugeAggregatorConfig))
+	c := NewSeriesCache(nil, "", nil, nil, targetMap, metadataMap, resourceMaps, "", nil, nil, "", false, false, aggr, gaugeAggr, nil, nil, nil, 0, 0, nil, "", nil, nil, nil, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const refID = 1
+	if err := c.Set(ctx, refID, labels.FromStrings("__name__", "metric1", "job", "job1", "instance", "inst1"), 5); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	entry, ok, err := c.Get(ctx, refID)
+	if entry == nil || !ok || err != nil {
+		t.Fatalf("expected cache entry but got none, error: %s", err)
+	}
+	if entry.pointSpacing != 15000 {
+		t.Fatalf("expected point spacing 15000, got %d", entry.pointSpacing)
+	}
+	// The first sample only initializes the reset state.
+	if _, _, ok := c.GetResetAdjusted(refID, 1000, 5); ok {
+		t.Errorf("expected first sample to be dropped")
+	}
+	rt, v, ok := c.GetResetAdjusted(refID, 16000, 8)
+	if !ok || rt != 1000 || v != 3 {
+		t.Errorf("unexpected adjusted sample (%d, %v, %v)", rt, v, ok)
+	}
+	// On a reset, the start time moves to one scrape interval before the
+	// sample rather than one millisecond.
+	rt, v, ok = c.GetResetAdjusted(refID, 40000, 2)
+	if !ok || rt != 25000 || v != 2 {
+		t.Errorf("unexpected adjusted sample (%d, %v, %v)", rt, v, ok)
+	}
+	// If that would collide with the previous sample, fall back to one
+	// millisecond before the current one.
+	rt, v, ok = c.GetResetAdjusted(refID, 50000, 1)
+	if !ok || rt != 49999 || v != 1 {
+		t.Errorf("unexpected adjusted sample (%d, %v, %v)", rt, v, ok)
+	}
+}
+
+func TestSeriesCache_MetadataTypeChange(t *testing.T) {
+	resourceMaps := []ResourceMap{
+		{
+			Type:     "resource2",
+			LabelMap: map[string]labelTranslation{"__resource_a": constValue("resource_a")},
+		},
+	}
+	targetMap := targetMap{
+		"job1/inst1": &targets.Target{
+			Labels:           promlabels.FromStrings("job", "job1", "instance", "inst1"),
+			DiscoveredLabels: promlabels.FromStrings("__resource_a", "resource2_a"),
+		},
+	}
+	metadataMap := metadataMap{
+		"job1/inst1/metric1": &metadata.Entry{Metric: "metric1", MetricType: textparse.MetricTypeCounter, ValueType: metric_pb.MetricDescriptor_DOUBLE},
+	}
+	aggr, _ := NewCounterAggregator(log.NewNopLogger(), new(CounterAggregatorConfig))
+	gaugeAggr, _ := NewGaugeAggregator(log.NewNopLogger(), new(GaugeAggregatorConfig))
+	c := NewSeriesCache(nil, "", nil, nil, targetMap, metadataMap, resourceMaps, "", nil, nil, "", false, false, aggr, gaugeAggr, nil, nil, nil, 0, 0, nil, "", nil, nil, nil, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const refID = 1
+	if err := c.Set(ctx, refID, labels.FromStrings("__name__", "metric1", "job", "job1", "instance", "inst1"), 5); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	entry, ok, err := c.Get(ctx, refID)
+	if entry == nil || !ok || err != nil {
+		t.Fatalf("expected cache entry but got none, error: %s", err)
+	}
+	if entry.proto.MetricKind != metric_pb.MetricDescriptor_CUMULATIVE {
+		t.Fatalf("expected CUMULATIVE kind, got %s", entry.proto.MetricKind)
+	}
+	// Feed two samples so the entry carries reset state.
+	c.GetResetAdjusted(refID, 1000, 5)
+	c.GetResetAdjusted(refID, 2000, 8)
+
+	// The exporter changes the metric's type. The next refresh must pick up
+	// the new kind and restart conversion.
+	metadataMap["job1/inst1/metric1"] = &metadata.Entry{Metric: "metric1", MetricType: textparse.MetricTypeGauge, ValueType: metric_pb.MetricDescriptor_DOUBLE}
+	c.entries[refID].lastRefresh = time.Now().Add(-2 * refreshInterval)
+
+	entry, ok, err = c.Get(ctx, refID)
+	if entry == nil || !ok || err != nil {
+		t.Fatalf("expected cache entry but got none, error: %s", err)
+	}
+	if entry.proto.MetricKind != metric_pb.MetricDescriptor_GAUGE {
+		t.Fatalf("expected GAUGE kind after type change, got %s", entry.proto.MetricKind)
+	}
+	if entry.hasReset {
+		t.Errorf("expected reset state to be cleared")
+	}
+}
+
 func TestSeriesCache_RefreshTooManyLabels(t *testing.T) {
 	resourceMaps := []ResourceMap{
 		{
@@ -279,7 +452,8 @@ func TestSeriesCache_RefreshTooManyLabels(t *testing.T) {
 		"job1/inst1/metric1": &metadata.Entry{Metric: "metric1", MetricType: textparse.MetricTypeGauge, ValueType: metric_pb.MetricDescriptor_DOUBLE},
 	}
 	aggr, _ := NewCounterAggregator(logger, new(CounterAggregatorConfig))
-	c := newSeriesCache(logger, "", nil, nil, targetMap, metadataMap, resourceMaps, "", false, aggr)
+	gaugeAggr, _ := NewGaugeAggregator(logger, new(GaugeAggregatorConfig))
+	c := NewSeriesCache(logger, "", nil, nil, targetMap, metadataMap, resourceMaps, "", nil, nil, "", false, false, aggr, gaugeAggr, nil, nil, nil, 0, 0, nil, "", nil, nil, nil, "")
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -290,7 +464,7 @@ func TestSeriesCache_RefreshTooManyLabels(t *testing.T) {
 		lset = append(lset, labels.Label{fmt.Sprintf("label%d", i), "x"})
 	}
 	// Set will trigger a refresh.
-	if err := c.set(ctx, refID, lset, 5); err != nil {
+	if err := c.Set(ctx, refID, lset, 5); err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
 	if !strings.Contains(logBuffer.String(), "too many labels") {
@@ -298,7 +472,7 @@ func TestSeriesCache_RefreshTooManyLabels(t *testing.T) {
 	}
 
 	// Get shouldn't find data because of the previous error.
-	entry, ok, err := c.get(ctx, refID)
+	entry, ok, err := c.Get(ctx, refID)
 	if err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
@@ -331,14 +505,15 @@ func TestSeriesCache_RefreshUnknownResource(t *testing.T) {
 		"job1/inst1/metric1": &metadata.Entry{Metric: "metric1", MetricType: textparse.MetricTypeGauge, ValueType: metric_pb.MetricDescriptor_DOUBLE},
 	}
 	aggr, _ := NewCounterAggregator(logger, new(CounterAggregatorConfig))
-	c := newSeriesCache(logger, "", nil, nil, targetMap, metadataMap, resourceMaps, "", false, aggr)
+	gaugeAggr, _ := NewGaugeAggregator(logger, new(GaugeAggregatorConfig))
+	c := NewSeriesCache(logger, "", nil, nil, targetMap, metadataMap, resourceMaps, "", nil, nil, "", false, false, aggr, gaugeAggr, nil, nil, nil, 0, 0, nil, "", nil, nil, nil, "")
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	const refID = 1
 	// Set will trigger a refresh.
-	if err := c.set(ctx, refID, labels.FromStrings("__name__", "metric1", "job", "job1", "instance", "inst1"), 5); err != nil {
+	if err := c.Set(ctx, refID, labels.FromStrings("__name__", "metric1", "job", "job1", "instance", "inst1"), 5); err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
 	if !strings.Contains(logBuffer.String(), "unknown resource") {
@@ -346,7 +521,7 @@ func TestSeriesCache_RefreshUnknownResource(t *testing.T) {
 	}
 
 	// Get shouldn't find data because of the previous error.
-	entry, ok, err := c.get(ctx, refID)
+	entry, ok, err := c.Get(ctx, refID)
 	if err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
@@ -377,14 +552,15 @@ func TestSeriesCache_RefreshMetadataNotFound(t *testing.T) {
 	}
 	metadataMap := metadataMap{}
 	aggr, _ := NewCounterAggregator(logger, new(CounterAggregatorConfig))
-	c := newSeriesCache(logger, "", nil, nil, targetMap, metadataMap, resourceMaps, "", false, aggr)
+	gaugeAggr, _ := NewGaugeAggregator(logger, new(GaugeAggregatorConfig))
+	c := NewSeriesCache(logger, "", nil, nil, targetMap, metadataMap, resourceMaps, "", nil, nil, "", false, false, aggr, gaugeAggr, nil, nil, nil, 0, 0, nil, "", nil, nil, nil, "")
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	const refID = 1
 	// Set will trigger a refresh.
-	if err := c.set(ctx, refID, labels.FromStrings("__name__", "metric1", "job", "job1", "instance", "inst1"), 5); err != nil {
+	if err := c.Set(ctx, refID, labels.FromStrings("__name__", "metric1", "job", "job1", "instance", "inst1"), 5); err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
 	if !strings.Contains(logBuffer.String(), "metadata not found") {
@@ -392,7 +568,7 @@ func TestSeriesCache_RefreshMetadataNotFound(t *testing.T) {
 	}
 
 	// Get shouldn't find data because of the previous error.
-	entry, ok, err := c.get(ctx, refID)
+	entry, ok, err := c.Get(ctx, refID)
 	if err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
@@ -426,13 +602,14 @@ func TestSeriesCache_Filter(t *testing.T) {
 	}()
 	logger := log.NewLogfmtLogger(logBuffer)
 	aggr, _ := NewCounterAggregator(logger, new(CounterAggregatorConfig))
-	c := newSeriesCache(logger, "", [][]*promlabels.Matcher{
+	gaugeAggr, _ := NewGaugeAggregator(logger, new(GaugeAggregatorConfig))
+	c := NewSeriesCache(logger, "", [][]*promlabels.Matcher{
 		{
 			&promlabels.Matcher{Type: promlabels.MatchEqual, Name: "a", Value: "a1"},
 			&promlabels.Matcher{Type: promlabels.MatchEqual, Name: "b", Value: "b1"},
 		},
 		{&promlabels.Matcher{Type: promlabels.MatchEqual, Name: "c", Value: "c1"}},
-	}, nil, targetMap, metadataMap, resourceMaps, "", false, aggr)
+	}, nil, targetMap, metadataMap, resourceMaps, "", nil, nil, "", false, false, aggr, gaugeAggr, nil, nil, nil, 0, 0, nil, "", nil, nil, nil, "")
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -443,20 +620,70 @@ func TestSeriesCache_Filter(t *testing.T) {
 		labels.FromStrings("__name__", "metric1", "job", "job1", "instance", "inst1", "c", "c1"),
 	}
 	for idx, lset := range lsets {
-		err := c.set(ctx, uint64(idx), lset, 1)
+		err := c.Set(ctx, uint64(idx), lset, 1)
 		if err != nil {
 			t.Fatal(err)
 		}
-		if _, ok, err := c.get(ctx, uint64(idx)); !ok || err != nil {
+		if _, ok, err := c.Get(ctx, uint64(idx)); !ok || err != nil {
 			t.Fatalf("metric not found: %s", err)
 		}
 	}
 	// Test filtered metric.
-	err := c.set(ctx, 100, labels.FromStrings("__name__", "metric1", "job", "job1", "instance", "inst1", "a", "a1", "b", "b2"), 1)
+	err := c.Set(ctx, 100, labels.FromStrings("__name__", "metric1", "job", "job1", "instance", "inst1", "a", "a1", "b", "b2"), 1)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if _, ok, err := c.get(ctx, 100); err != nil {
+	if _, ok, err := c.Get(ctx, 100); err != nil {
+		t.Fatalf("error retrieving metric: %s", err)
+	} else if ok {
+		t.Fatalf("metric was not filtered")
+	}
+}
+
+func TestSeriesCache_FiltersetsTargetLabels(t *testing.T) {
+	resourceMaps := []ResourceMap{
+		{
+			Type:     "resource2",
+			LabelMap: map[string]labelTranslation{"__resource_a": constValue("resource_a")},
+		},
+	}
+	// Two targets in different namespaces; the namespace is only present in
+	// the discovered labels.
+	targetMap := targetMap{
+		"job1/inst1": &targets.Target{
+			Labels:           promlabels.FromStrings("job", "job1", "instance", "inst1"),
+			DiscoveredLabels: promlabels.FromStrings("__resource_a", "resource2_a", "__meta_kubernetes_namespace", "prod"),
+		},
+		"job1/inst2": &targets.Target{
+			Labels:           promlabels.FromStrings("job", "job1", "instance", "inst2"),
+			DiscoveredLabels: promlabels.FromStrings("__resource_a", "resource2_a", "__meta_kubernetes_namespace", "staging"),
+		},
+	}
+	metadataMap := metadataMap{
+		"job1/inst1/metric1": &metadata.Entry{Metric: "metric1", MetricType: textparse.MetricTypeGauge, ValueType: metric_pb.MetricDescriptor_DOUBLE},
+		"job1/inst2/metric1": &metadata.Entry{Metric: "metric1", MetricType: textparse.MetricTypeGauge, ValueType: metric_pb.MetricDescriptor_DOUBLE},
+	}
+	logger := log.NewNopLogger()
+	aggr, _ := NewCounterAggregator(logger, new(CounterAggregatorConfig))
+	gaugeAggr, _ := NewGaugeAggregator(logger, new(GaugeAggregatorConfig))
+	c := NewSeriesCache(logger, "", [][]*promlabels.Matcher{
+		{&promlabels.Matcher{Type: promlabels.MatchEqual, Name: "__meta_kubernetes_namespace", Value: "prod"}},
+	}, nil, targetMap, metadataMap, resourceMaps, "", nil, nil, "", false, false, aggr, gaugeAggr, nil, nil, nil, 0, 0, nil, "", nil, nil, nil, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The series of the prod target passes, the staging one is filtered.
+	if err := c.Set(ctx, 1, labels.FromStrings("__name__", "metric1", "job", "job1", "instance", "inst1"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := c.Get(ctx, 1); !ok || err != nil {
+		t.Fatalf("metric not found: %s", err)
+	}
+	if err := c.Set(ctx, 2, labels.FromStrings("__name__", "metric1", "job", "job1", "instance", "inst2"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := c.Get(ctx, 2); err != nil {
 		t.Fatalf("error retrieving metric: %s", err)
 	} else if ok {
 		t.Fatalf("metric was not filtered")
@@ -486,9 +713,10 @@ func TestSeriesCache_CounterAggregator(t *testing.T) {
 			{&promlabels.Matcher{Type: promlabels.MatchEqual, Name: "a", Value: "a1"}},
 		}},
 	})
-	c := newSeriesCache(logger, "", [][]*promlabels.Matcher{
+	gaugeAggr, _ := NewGaugeAggregator(logger, new(GaugeAggregatorConfig))
+	c := NewSeriesCache(logger, "", [][]*promlabels.Matcher{
 		{&promlabels.Matcher{Type: promlabels.MatchEqual, Name: "b", Value: "b1"}},
-	}, nil, targetMap, metadataMap, resourceMaps, "", false, aggr)
+	}, nil, targetMap, metadataMap, resourceMaps, "", nil, nil, "", false, false, aggr, gaugeAggr, nil, nil, nil, 0, 0, nil, "", nil, nil, nil, "")
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -505,11 +733,11 @@ func TestSeriesCache_CounterAggregator(t *testing.T) {
 		{"unexported and untracked", labels.FromStrings("__name__", "metric1", "job", "job1", "instance", "inst1", "c", "c1"), false, false},
 	} {
 		t.Run(tt.name, func(t *testing.T) {
-			err := c.set(ctx, uint64(idx), tt.lset, 1)
+			err := c.Set(ctx, uint64(idx), tt.lset, 1)
 			if err != nil {
 				t.Fatal(err)
 			}
-			entry, ok, err := c.get(ctx, uint64(idx))
+			entry, ok, err := c.Get(ctx, uint64(idx))
 			if err != nil {
 				t.Fatalf("unexpected error: %s", err)
 			}
@@ -558,19 +786,20 @@ func TestSeriesCache_RenameMetric(t *testing.T) {
 	}()
 	logger := log.NewLogfmtLogger(logBuffer)
 	aggr, _ := NewCounterAggregator(logger, new(CounterAggregatorConfig))
-	c := newSeriesCache(logger, "", nil,
+	gaugeAggr, _ := NewGaugeAggregator(logger, new(GaugeAggregatorConfig))
+	c := NewSeriesCache(logger, "", nil,
 		map[string]string{"metric2": "metric3"},
-		targetMap, metadataMap, resourceMaps, "", false, aggr)
+		targetMap, metadataMap, resourceMaps, "", nil, nil, "", false, false, aggr, gaugeAggr, nil, nil, nil, 0, 0, nil, "", nil, nil, nil, "")
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	// Test base case of metric that's not renamed.
-	err := c.set(ctx, 1, labels.FromStrings("__name__", "metric1", "job", "job1", "instance", "inst1"), 1)
+	err := c.Set(ctx, 1, labels.FromStrings("__name__", "metric1", "job", "job1", "instance", "inst1"), 1)
 	if err != nil {
 		t.Fatal(err)
 	}
-	entry, ok, err := c.get(ctx, 1)
+	entry, ok, err := c.Get(ctx, 1)
 	if !ok || err != nil {
 		t.Fatalf("metric not found: %s", err)
 	}
@@ -580,11 +809,11 @@ func TestSeriesCache_RenameMetric(t *testing.T) {
 	if want := getMetricType("", "metric1"); entry.proto.Metric.Type != want {
 		t.Fatalf("want proto metric type %q but got %q", want, entry.proto.Metric.Type)
 	}
-	err = c.set(ctx, 2, labels.FromStrings("__name__", "metric2", "job", "job1", "instance", "inst1"), 1)
+	err = c.Set(ctx, 2, labels.FromStrings("__name__", "metric2", "job", "job1", "instance", "inst1"), 1)
 	if err != nil {
 		t.Fatal(err)
 	}
-	entry, ok, err = c.get(ctx, 2)
+	entry, ok, err = c.Get(ctx, 2)
 	if !ok || err != nil {
 		t.Fatalf("metric not found: %s", err)
 	}
@@ -592,3 +821,274 @@ func TestSeriesCache_RenameMetric(t *testing.T) {
 		t.Fatalf("want proto metric type %q but got %q", want, entry.proto.Metric.Type)
 	}
 }
+
+func TestSeriesCache_Collision(t *testing.T) {
+	resourceMaps := []ResourceMap{
+		{
+			Type:     "resource2",
+			LabelMap: map[string]labelTranslation{"__resource_a": constValue("resource_a")},
+		},
+	}
+	targetMap := targetMap{
+		"job1/inst1": &targets.Target{
+			Labels:           promlabels.FromStrings("job", "job1", "instance", "inst1"),
+			DiscoveredLabels: promlabels.FromStrings("__resource_a", "resource2_a"),
+		},
+	}
+	metadataMap := metadataMap{
+		"job1/inst1/metric1": &metadata.Entry{Metric: "metric1", MetricType: textparse.MetricTypeGauge, ValueType: metric_pb.MetricDescriptor_DOUBLE},
+		"job1/inst1/metric2": &metadata.Entry{Metric: "metric2", MetricType: textparse.MetricTypeGauge, ValueType: metric_pb.MetricDescriptor_DOUBLE},
+	}
+	logger := log.NewNopLogger()
+	aggr, _ := NewCounterAggregator(logger, new(CounterAggregatorConfig))
+	gaugeAggr, _ := NewGaugeAggregator(logger, new(GaugeAggregatorConfig))
+	// The rename makes metric1 and metric2 map to the same Stackdriver series.
+	c := NewSeriesCache(logger, "", nil,
+		map[string]string{"metric2": "metric1"},
+		targetMap, metadataMap, resourceMaps, "", nil, nil, "", false, false, aggr, gaugeAggr, nil, nil, nil, 0, 0, nil, "", nil, nil, nil, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The later colliding series loses regardless of insertion order, so the
+	// smaller label set must win even when it appears second.
+	if err := c.Set(ctx, 1, labels.FromStrings("__name__", "metric2", "job", "job1", "instance", "inst1"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := c.Get(ctx, 1); !ok || err != nil {
+		t.Fatalf("metric not found: %s", err)
+	}
+	if err := c.Set(ctx, 2, labels.FromStrings("__name__", "metric1", "job", "job1", "instance", "inst1"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := c.Get(ctx, 2); !ok || err != nil {
+		t.Fatalf("expected winning series to be exported: %s", err)
+	}
+	if _, ok, _ := c.Get(ctx, 1); ok {
+		t.Fatalf("expected colliding series to be dropped")
+	}
+}
+
+func TestSeriesCache_HashCollision(t *testing.T) {
+	resourceMaps := []ResourceMap{
+		{
+			Type:     "resource2",
+			LabelMap: map[string]labelTranslation{"__resource_a": constValue("resource_a")},
+		},
+	}
+	targetMap := targetMap{
+		"job1/inst1": &targets.Target{
+			Labels:           promlabels.FromStrings("job", "job1", "instance", "inst1"),
+			DiscoveredLabels: promlabels.FromStrings("__resource_a", "resource2_a"),
+		},
+	}
+	metadataMap := metadataMap{
+		"job1/inst1/metric1": &metadata.Entry{Metric: "metric1", MetricType: textparse.MetricTypeGauge, ValueType: metric_pb.MetricDescriptor_DOUBLE},
+	}
+	logger := log.NewNopLogger()
+	aggr, _ := NewCounterAggregator(logger, new(CounterAggregatorConfig))
+	gaugeAggr, _ := NewGaugeAggregator(logger, new(GaugeAggregatorConfig))
+	c := NewSeriesCache(logger, "", nil, nil, targetMap, metadataMap, resourceMaps, "", nil, nil, "", false, false, aggr, gaugeAggr, nil, nil, nil, 0, 0, nil, "", nil, nil, nil, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := c.Set(ctx, 1, labels.FromStrings("__name__", "metric1", "job", "job1", "instance", "inst1"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := c.Get(ctx, 1); !ok || err != nil {
+		t.Fatalf("metric not found: %s", err)
+	}
+	hash := c.entries[1].hash
+
+	// Simulate a distinct series whose identity hashes to the same value by
+	// occupying the slot with a different series key.
+	c.owners[hash] = seriesOwner{ref: 99, lset: labels.FromStrings("__name__", "other"), key: "other"}
+
+	if err := c.refresh(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.entries[1].hash; got != hash+1 {
+		t.Fatalf("expected colliding series to probe to hash %d, got %d", hash+1, got)
+	}
+	if owner := c.owners[hash+1]; owner.ref != 1 {
+		t.Fatalf("expected colliding series to own the probed slot, got ref %d", owner.ref)
+	}
+	// The disambiguation must come out the same on every refresh.
+	if err := c.refresh(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.entries[1].hash; got != hash+1 {
+		t.Fatalf("expected stable hash %d after refresh, got %d", hash+1, got)
+	}
+}
+
+func TestSeriesCache_LabelJoin(t *testing.T) {
+	resourceMaps := []ResourceMap{
+		{
+			Type:     "resource2",
+			LabelMap: map[string]labelTranslation{"__resource_a": constValue("resource_a")},
+		},
+	}
+	targetMap := targetMap{
+		"job1/inst1": &targets.Target{
+			Labels:           promlabels.FromStrings("job", "job1", "instance", "inst1"),
+			DiscoveredLabels: promlabels.FromStrings("__resource_a", "resource2_a"),
+		},
+	}
+	metadataMap := metadataMap{
+		"job1/inst1/metric1":         &metadata.Entry{Metric: "metric1", MetricType: textparse.MetricTypeGauge, ValueType: metric_pb.MetricDescriptor_DOUBLE},
+		"job1/inst1/kube_pod_labels": &metadata.Entry{Metric: "kube_pod_labels", MetricType: textparse.MetricTypeGauge, ValueType: metric_pb.MetricDescriptor_DOUBLE},
+	}
+	logger := log.NewNopLogger()
+	aggr, _ := NewCounterAggregator(logger, new(CounterAggregatorConfig))
+	gaugeAggr, _ := NewGaugeAggregator(logger, new(GaugeAggregatorConfig))
+	joins := []*LabelJoin{
+		{InfoMetric: "kube_pod_labels", Keys: []string{"pod"}},
+	}
+	c := NewSeriesCache(logger, "", nil, nil, targetMap, metadataMap, resourceMaps, "", nil, nil, "", false, false, aggr, gaugeAggr, joins, nil, nil, 0, 0, nil, "", nil, nil, nil, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := c.Set(ctx, 1, labels.FromStrings(
+		"__name__", "kube_pod_labels", "job", "job1", "instance", "inst1", "pod", "pod1", "label_app", "frontend"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set(ctx, 2, labels.FromStrings(
+		"__name__", "metric1", "job", "job1", "instance", "inst1", "pod", "pod1"), 1); err != nil {
+		t.Fatal(err)
+	}
+	entry, ok, err := c.Get(ctx, 2)
+	if !ok || err != nil {
+		t.Fatalf("metric not found: %s", err)
+	}
+	if got := entry.proto.Metric.Labels["label_app"]; got != "frontend" {
+		t.Errorf("expected joined label_app \"frontend\", got %q", got)
+	}
+
+	// An updated info series invalidates matching entries so they pick up the
+	// new labels on their next refresh.
+	if err := c.Set(ctx, 3, labels.FromStrings(
+		"__name__", "kube_pod_labels", "job", "job1", "instance", "inst1", "pod", "pod1", "label_app", "backend"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if c.entries[2].populated() {
+		t.Fatalf("expected entry to be invalidated by the updated info series")
+	}
+	c.entries[2].lastRefresh = time.Now().Add(-2 * refreshInterval)
+	entry, ok, err = c.Get(ctx, 2)
+	if !ok || err != nil {
+		t.Fatalf("metric not found: %s", err)
+	}
+	if got := entry.proto.Metric.Labels["label_app"]; got != "backend" {
+		t.Errorf("expected joined label_app \"backend\", got %q", got)
+	}
+}
+
+func TestSeriesCache_LabelSplit(t *testing.T) {
+	resourceMaps := []ResourceMap{
+		{
+			Type:     "resource2",
+			LabelMap: map[string]labelTranslation{"__resource_a": constValue("resource_a")},
+		},
+	}
+	targetMap := targetMap{
+		"job1/inst1": &targets.Target{
+			Labels:           promlabels.FromStrings("job", "job1", "instance", "inst1"),
+			DiscoveredLabels: promlabels.FromStrings("__resource_a", "resource2_a"),
+		},
+	}
+	metadataMap := metadataMap{
+		"job1/inst1/metric1": &metadata.Entry{Metric: "metric1", MetricType: textparse.MetricTypeGauge, ValueType: metric_pb.MetricDescriptor_DOUBLE},
+		"job1/inst1/metric2": &metadata.Entry{Metric: "metric2", MetricType: textparse.MetricTypeGauge, ValueType: metric_pb.MetricDescriptor_DOUBLE},
+	}
+	logger := log.NewNopLogger()
+	aggr, _ := NewCounterAggregator(logger, new(CounterAggregatorConfig))
+	gaugeAggr, _ := NewGaugeAggregator(logger, new(GaugeAggregatorConfig))
+	splits := []*LabelSplit{
+		{
+			Metric: "metric1",
+			Label:  "version",
+			Regex:  regexp.MustCompile(`^([^-]+)-([^-]+)-(.+)$`),
+			Labels: []string{"app", "app_version", "platform"},
+		},
+	}
+	c := NewSeriesCache(logger, "", nil, nil, targetMap, metadataMap, resourceMaps, "", nil, nil, "", false, false, aggr, gaugeAggr, nil, nil, nil, 0, 0, nil, "", splits, nil, nil, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := c.Set(ctx, 1, labels.FromStrings(
+		"__name__", "metric1", "job", "job1", "instance", "inst1", "version", "appA-1.2.3-linux-amd64"), 1); err != nil {
+		t.Fatal(err)
+	}
+	entry, ok, err := c.Get(ctx, 1)
+	if !ok || err != nil {
+		t.Fatalf("metric not found: %s", err)
+	}
+	want := map[string]string{"app": "appA", "app_version": "1.2.3", "platform": "linux-amd64"}
+	if !reflect.DeepEqual(entry.proto.Metric.Labels, want) {
+		t.Errorf("expected split labels %v, got %v", want, entry.proto.Metric.Labels)
+	}
+
+	// The split is restricted to metric1; other metrics keep their labels.
+	if err := c.Set(ctx, 2, labels.FromStrings(
+		"__name__", "metric2", "job", "job1", "instance", "inst1", "version", "appA-1.2.3-linux-amd64"), 1); err != nil {
+		t.Fatal(err)
+	}
+	entry, ok, err = c.Get(ctx, 2)
+	if !ok || err != nil {
+		t.Fatalf("metric not found: %s", err)
+	}
+	if got := entry.proto.Metric.Labels["version"]; got != "appA-1.2.3-linux-amd64" {
+		t.Errorf("expected untouched version label, got %q", got)
+	}
+
+	// A non-matching value leaves the label set unchanged.
+	if err := c.Set(ctx, 3, labels.FromStrings(
+		"__name__", "metric1", "job", "job1", "instance", "inst1", "version", "nodashes"), 1); err != nil {
+		t.Fatal(err)
+	}
+	entry, ok, err = c.Get(ctx, 3)
+	if !ok || err != nil {
+		t.Fatalf("metric not found: %s", err)
+	}
+	if got := entry.proto.Metric.Labels["version"]; got != "nodashes" {
+		t.Errorf("expected untouched version label, got %q", got)
+	}
+}
+
+func TestSeriesCacheSelfJobExclusion(t *testing.T) {
+	resourceMaps := []ResourceMap{
+		{Type: "resource1", LabelMap: map[string]labelTranslation{}},
+	}
+	targetMap := targetMap{
+		"job1/inst1":    &targets.Target{},
+		"sidecar/inst1": &targets.Target{},
+	}
+	metadataMap := metadataMap{
+		"job1/inst1/metric1":    &metadata.Entry{Metric: "metric1", MetricType: textparse.MetricTypeGauge, ValueType: metric_pb.MetricDescriptor_DOUBLE},
+		"sidecar/inst1/metric1": &metadata.Entry{Metric: "metric1", MetricType: textparse.MetricTypeGauge, ValueType: metric_pb.MetricDescriptor_DOUBLE},
+	}
+	logger := log.NewNopLogger()
+	aggr, _ := NewCounterAggregator(logger, new(CounterAggregatorConfig))
+	gaugeAggr, _ := NewGaugeAggregator(logger, new(GaugeAggregatorConfig))
+	c := NewSeriesCache(logger, "", nil, nil, targetMap, metadataMap, resourceMaps, "", nil, nil, "sidecar", false, false, aggr, gaugeAggr, nil, nil, nil, 0, 0, nil, "", nil, nil, nil, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := c.Set(ctx, 1, labels.FromStrings("__name__", "metric1", "job", "sidecar", "instance", "inst1"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := c.Get(ctx, 1); ok {
+		t.Fatalf("expected series of the sidecar's own job to be excluded")
+	}
+	if err := c.Set(ctx, 2, labels.FromStrings("__name__", "metric1", "job", "job1", "instance", "inst1"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := c.Get(ctx, 2); !ok || err != nil {
+		t.Fatalf("expected series of other jobs to be exported: %v", err)
+	}
+}
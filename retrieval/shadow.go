@@ -0,0 +1,242 @@
+/*
+Copyright 2020 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retrieval
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// shadowSeriesLimit bounds how many output series the comparator keeps
+// individual state for.
+const shadowSeriesLimit = 10000
+
+// shadowExampleLimit is how many example series the report lists per
+// disposition.
+const shadowExampleLimit = 50
+
+// Pipelines an output series was seen from.
+const (
+	shadowSeenActive = 1 << iota
+	shadowSeenShadow
+)
+
+var (
+	shadowSamplesDesc = prometheus.NewDesc(
+		"prometheus_sidecar_shadow_samples_total",
+		"Number of samples produced by the conversion pipelines in shadow comparison mode, by pipeline.",
+		[]string{"pipeline"}, nil)
+	shadowSeriesDesc = prometheus.NewDesc(
+		"prometheus_sidecar_shadow_series",
+		"Number of output series in shadow comparison mode, by which pipelines produced them.",
+		[]string{"disposition"}, nil)
+	shadowSeriesOverflowDesc = prometheus.NewDesc(
+		"prometheus_sidecar_shadow_series_overflow_total",
+		"Number of samples whose series were not tracked individually because the series limit was reached.",
+		nil, nil)
+)
+
+// ShadowComparator compares the output of the active conversion pipeline
+// against that of a shadow pipeline running a candidate configuration. Only
+// the active pipeline's samples are written; the shadow side terminates in
+// the comparator. Differences in the produced series and their label sets
+// are exposed as metrics and as a JSON report on /api/v1/shadow, so a filter
+// or rename change can be validated before it is rolled out.
+// Tracked series state is bounded; series beyond the limit are only counted
+// in an overflow series.
+// Implements prometheus.Collector and http.Handler.
+type ShadowComparator struct {
+	mtx           sync.Mutex
+	series        map[uint64]*shadowSeries
+	activeSamples float64
+	shadowSamples float64
+	overflow      float64
+}
+
+// shadowSeries records which pipelines produced an output series.
+type shadowSeries struct {
+	desc string
+	seen uint8
+}
+
+// shadowReport is the wire format of the comparison report.
+type shadowReport struct {
+	Samples struct {
+		Active int64 `json:"active"`
+		Shadow int64 `json:"shadow"`
+	} `json:"samples"`
+	Series struct {
+		Both       int `json:"both"`
+		ActiveOnly int `json:"active_only"`
+		ShadowOnly int `json:"shadow_only"`
+	} `json:"series"`
+	ActiveOnlyExamples []string `json:"active_only_examples,omitempty"`
+	ShadowOnlyExamples []string `json:"shadow_only_examples,omitempty"`
+	UntrackedSamples   int64    `json:"untracked_samples,omitempty"`
+}
+
+// NewShadowComparator returns an empty comparator.
+func NewShadowComparator() *ShadowComparator {
+	return &ShadowComparator{series: map[uint64]*shadowSeries{}}
+}
+
+// Active returns an appender that records the active pipeline's output and
+// passes it on to next unchanged.
+func (c *ShadowComparator) Active(next Appender) Appender {
+	return &shadowAppender{comparator: c, seen: shadowSeenActive, next: next}
+}
+
+// Shadow returns a terminal appender that records the shadow pipeline's
+// output without writing it anywhere.
+func (c *ShadowComparator) Shadow() Appender {
+	return &shadowAppender{comparator: c, seen: shadowSeenShadow}
+}
+
+// shadowAppender records the output of one pipeline in the comparator.
+type shadowAppender struct {
+	comparator *ShadowComparator
+	seen       uint8
+	next       Appender
+}
+
+// Append implements Appender.
+func (a *shadowAppender) Append(hash uint64, s *monitoring_pb.TimeSeries) error {
+	a.comparator.observe(a.seen, hash, s)
+	if a.next != nil {
+		return a.next.Append(hash, s)
+	}
+	return nil
+}
+
+func (c *ShadowComparator) observe(seen uint8, hash uint64, s *monitoring_pb.TimeSeries) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if seen == shadowSeenActive {
+		c.activeSamples += float64(len(s.Points))
+	} else {
+		c.shadowSamples += float64(len(s.Points))
+	}
+	entry, ok := c.series[hash]
+	if !ok {
+		if len(c.series) >= shadowSeriesLimit {
+			c.overflow += float64(len(s.Points))
+			return
+		}
+		entry = &shadowSeries{desc: shadowSeriesString(s)}
+		c.series[hash] = entry
+	}
+	entry.seen |= seen
+}
+
+// shadowSeriesString renders the identity of an output series with its metric
+// labels in stable order, e.g. for the report's example lists.
+func shadowSeriesString(s *monitoring_pb.TimeSeries) string {
+	labels := s.Metric.GetLabels()
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString(s.Metric.GetType())
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%q", name, labels[name])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// dispositions returns the number of series per disposition and sorted
+// example series that only one pipeline produced. The caller must hold the
+// mutex.
+func (c *ShadowComparator) dispositions() (both, activeOnly, shadowOnly int, activeExamples, shadowExamples []string) {
+	for _, entry := range c.series {
+		switch entry.seen {
+		case shadowSeenActive | shadowSeenShadow:
+			both++
+		case shadowSeenActive:
+			activeOnly++
+			activeExamples = append(activeExamples, entry.desc)
+		case shadowSeenShadow:
+			shadowOnly++
+			shadowExamples = append(shadowExamples, entry.desc)
+		}
+	}
+	sort.Strings(activeExamples)
+	sort.Strings(shadowExamples)
+	if len(activeExamples) > shadowExampleLimit {
+		activeExamples = activeExamples[:shadowExampleLimit]
+	}
+	if len(shadowExamples) > shadowExampleLimit {
+		shadowExamples = shadowExamples[:shadowExampleLimit]
+	}
+	return both, activeOnly, shadowOnly, activeExamples, shadowExamples
+}
+
+// Describe implements prometheus.Collector.
+func (c *ShadowComparator) Describe(ch chan<- *prometheus.Desc) {
+	ch <- shadowSamplesDesc
+	ch <- shadowSeriesDesc
+	ch <- shadowSeriesOverflowDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *ShadowComparator) Collect(ch chan<- prometheus.Metric) {
+	c.mtx.Lock()
+	active, shadow, overflow := c.activeSamples, c.shadowSamples, c.overflow
+	both, activeOnly, shadowOnly, _, _ := c.dispositions()
+	c.mtx.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(shadowSamplesDesc,
+		prometheus.CounterValue, active, "active")
+	ch <- prometheus.MustNewConstMetric(shadowSamplesDesc,
+		prometheus.CounterValue, shadow, "shadow")
+	ch <- prometheus.MustNewConstMetric(shadowSeriesDesc,
+		prometheus.GaugeValue, float64(both), "both")
+	ch <- prometheus.MustNewConstMetric(shadowSeriesDesc,
+		prometheus.GaugeValue, float64(activeOnly), "active_only")
+	ch <- prometheus.MustNewConstMetric(shadowSeriesDesc,
+		prometheus.GaugeValue, float64(shadowOnly), "shadow_only")
+	ch <- prometheus.MustNewConstMetric(shadowSeriesOverflowDesc,
+		prometheus.CounterValue, overflow)
+}
+
+// ServeHTTP implements http.Handler.
+func (c *ShadowComparator) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var resp shadowReport
+
+	c.mtx.Lock()
+	resp.Samples.Active = int64(c.activeSamples)
+	resp.Samples.Shadow = int64(c.shadowSamples)
+	resp.UntrackedSamples = int64(c.overflow)
+	resp.Series.Both, resp.Series.ActiveOnly, resp.Series.ShadowOnly,
+		resp.ActiveOnlyExamples, resp.ShadowOnlyExamples = c.dispositions()
+	c.mtx.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
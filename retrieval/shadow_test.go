@@ -0,0 +1,74 @@
+/*
+Copyright 2020 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retrieval
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+)
+
+func TestShadowComparator(t *testing.T) {
+	comparator := NewShadowComparator()
+	next := &nopAppender{}
+	active := comparator.Active(next)
+	shadow := comparator.Shadow()
+
+	// Series 1 is produced by both pipelines, series 2 only by the active
+	// one, series 3 only by the shadow one.
+	series1 := collapseTestSeries(metric_pb.MetricDescriptor_GAUGE, map[string]string{"job": "job1"}, 10, 1)
+	series2 := collapseTestSeries(metric_pb.MetricDescriptor_GAUGE, map[string]string{"job": "job2"}, 10, 1)
+	series3 := collapseTestSeries(metric_pb.MetricDescriptor_GAUGE, map[string]string{"job": "job3"}, 10, 1)
+
+	if err := active.Append(1, series1); err != nil {
+		t.Fatal(err)
+	}
+	if err := shadow.Append(1, series1); err != nil {
+		t.Fatal(err)
+	}
+	if err := active.Append(2, series2); err != nil {
+		t.Fatal(err)
+	}
+	if err := shadow.Append(3, series3); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the active pipeline writes.
+	if len(next.samples) != 2 {
+		t.Fatalf("expected 2 samples, got %d", len(next.samples))
+	}
+
+	rec := httptest.NewRecorder()
+	comparator.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/shadow", nil))
+	var resp shadowReport
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Samples.Active != 2 || resp.Samples.Shadow != 2 {
+		t.Fatalf("unexpected sample counts %+v", resp.Samples)
+	}
+	if resp.Series.Both != 1 || resp.Series.ActiveOnly != 1 || resp.Series.ShadowOnly != 1 {
+		t.Fatalf("unexpected series counts %+v", resp.Series)
+	}
+	wantActive := `external.googleapis.com/prometheus/metric1{job="job2"}`
+	if len(resp.ActiveOnlyExamples) != 1 || resp.ActiveOnlyExamples[0] != wantActive {
+		t.Fatalf("unexpected active-only examples %v", resp.ActiveOnlyExamples)
+	}
+	wantShadow := `external.googleapis.com/prometheus/metric1{job="job3"}`
+	if len(resp.ShadowOnlyExamples) != 1 || resp.ShadowOnlyExamples[0] != wantShadow {
+		t.Fatalf("unexpected shadow-only examples %v", resp.ShadowOnlyExamples)
+	}
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2020 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retrieval
+
+import (
+	"context"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// StaticLabelsAppender wraps an Appender and attaches a fixed set of metric
+// labels to every exported series, e.g. an environment tag configured on the
+// sidecar. Labels already set on a series win over static ones. Series that
+// exceed the metric label limit with the static labels attached are dropped.
+type StaticLabelsAppender struct {
+	logger log.Logger
+	next   Appender
+	labels map[string]string
+
+	mtx sync.Mutex
+	// Extended metric proto and output hash per input series. Series that
+	// exceed the label limit are cached as nil and dropped.
+	mapped map[uint64]*staticTarget
+}
+
+// staticTarget is the precomputed output identity of an input series.
+type staticTarget struct {
+	metric *metric_pb.Metric
+	hash   uint64
+}
+
+// NewStaticLabelsAppender returns an appender attaching the given labels
+// before passing series on to next. It errors if the static labels alone
+// already exceed the metric label limit.
+func NewStaticLabelsAppender(logger log.Logger, staticLabels map[string]string, next Appender) (Appender, error) {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	if len(staticLabels) == 0 {
+		return next, nil
+	}
+	if len(staticLabels) > maxLabelCount {
+		return nil, errors.Errorf("%d static metric labels configured, at most %d metric labels are supported", len(staticLabels), maxLabelCount)
+	}
+	for name := range staticLabels {
+		if name == "" {
+			return nil, errors.New("static metric label with empty name")
+		}
+	}
+	return &StaticLabelsAppender{
+		logger: logger,
+		next:   next,
+		labels: staticLabels,
+		mapped: map[uint64]*staticTarget{},
+	}, nil
+}
+
+// Append implements Appender.
+func (a *StaticLabelsAppender) Append(hash uint64, s *monitoring_pb.TimeSeries) error {
+	a.mtx.Lock()
+	target, ok := a.mapped[hash]
+	if !ok {
+		target = a.extend(s)
+		a.mapped[hash] = target
+	}
+	a.mtx.Unlock()
+
+	if target == nil {
+		// The series exceeded the label limit and was reported when it was
+		// first seen; its samples are silently dropped from here on.
+		return nil
+	}
+	if target.metric == s.Metric {
+		return a.next.Append(hash, s)
+	}
+	// The series' nested messages are shared with the series cache, so
+	// replace the metric rather than mutating it in place.
+	extended := *s
+	extended.Metric = target.metric
+	return a.next.Append(target.hash, &extended)
+}
+
+// extend computes the output identity of a series with the static labels
+// attached, or nil if that would exceed the metric label limit. The caller
+// must hold the mutex.
+func (a *StaticLabelsAppender) extend(s *monitoring_pb.TimeSeries) *staticTarget {
+	extended := make(map[string]string, len(s.Metric.Labels)+len(a.labels))
+	for name, value := range s.Metric.Labels {
+		extended[name] = value
+	}
+	added := false
+	for name, value := range a.labels {
+		if _, ok := extended[name]; !ok {
+			extended[name] = value
+			added = true
+		}
+	}
+	if len(extended) > maxLabelCount {
+		ctx, _ := tag.New(context.Background(), tag.Insert(keyReason, "too_many_labels"))
+		stats.Record(ctx, droppedSeries.M(1))
+		level.Warn(a.logger).Log("msg", "series exceeds the metric label limit with static labels attached",
+			"metric", s.Metric.Type, "labels", len(extended), "limit", maxLabelCount)
+		return nil
+	}
+	if !added {
+		return &staticTarget{metric: s.Metric}
+	}
+	metric := &metric_pb.Metric{Type: s.Metric.Type, Labels: extended}
+	return &staticTarget{metric: metric, hash: hashSeriesKey(s.Resource, metric)}
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2020 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retrieval
+
+import (
+	"fmt"
+	"testing"
+
+	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+)
+
+func TestStaticLabelsAppender(t *testing.T) {
+	next := &nopAppender{}
+	a, err := NewStaticLabelsAppender(nil, map[string]string{
+		"environment": "prod",
+		"job":         "static-job",
+	}, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := collapseTestSeries(metric_pb.MetricDescriptor_GAUGE, map[string]string{"job": "job1"}, 10, 1)
+	if err := a.Append(1, in); err != nil {
+		t.Fatal(err)
+	}
+	if len(next.samples) != 1 {
+		t.Fatalf("expected 1 sample, got %d", len(next.samples))
+	}
+	out := next.samples[0]
+	if got := out.Metric.Labels["environment"]; got != "prod" {
+		t.Fatalf("unexpected metric label %q", got)
+	}
+	// Labels already set on the series win over static ones.
+	if got := out.Metric.Labels["job"]; got != "job1" {
+		t.Fatalf("unexpected metric label %q", got)
+	}
+	// The input series proto must not be mutated.
+	if got := in.Metric.Labels["environment"]; got != "" {
+		t.Fatalf("input series was mutated: %q", got)
+	}
+
+	// Without static labels the appender is elided.
+	if got, err := NewStaticLabelsAppender(nil, nil, next); err != nil || got != Appender(next) {
+		t.Fatalf("expected next appender to be returned unchanged, got %v, %v", got, err)
+	}
+}
+
+func TestStaticLabelsAppenderLabelLimit(t *testing.T) {
+	next := &nopAppender{}
+	a, err := NewStaticLabelsAppender(nil, map[string]string{"environment": "prod"}, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A series at the label limit has no room for the static label and must
+	// be dropped.
+	full := map[string]string{}
+	for i := 0; i < maxLabelCount; i++ {
+		full[fmt.Sprintf("label%d", i)] = "value"
+	}
+	in := collapseTestSeries(metric_pb.MetricDescriptor_GAUGE, full, 10, 1)
+	if err := a.Append(1, in); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Append(1, in); err != nil {
+		t.Fatal(err)
+	}
+	if len(next.samples) != 0 {
+		t.Fatalf("expected no samples, got %d", len(next.samples))
+	}
+
+	// More static labels than the limit permits are rejected outright.
+	tooMany := map[string]string{}
+	for i := 0; i <= maxLabelCount; i++ {
+		tooMany[fmt.Sprintf("label%d", i)] = "value"
+	}
+	if _, err := NewStaticLabelsAppender(nil, tooMany, next); err == nil {
+		t.Fatalf("expected error for %d static labels", len(tooMany))
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// StatusReporter wraps an Appender and aggregates export statistics over a
+// sliding window, serving them as JSON on /api/v1/status so dashboards and
+// support tooling can query sidecar health programmatically.
+type StatusReporter struct {
+	next   Appender
+	window time.Duration
+
+	mtx        sync.Mutex
+	buckets    []*statusBucket
+	lastExport map[string]time.Time
+
+	version    string
+	configHash string
+	churn      *SeriesChurnTracker
+}
+
+// statusChurnTopN is how many of the highest-churn metrics the status
+// response includes.
+const statusChurnTopN = 10
+
+// SetChurnTracker makes the status response include the highest-churn metrics
+// recorded by the given tracker.
+func (r *StatusReporter) SetChurnTracker(churn *SeriesChurnTracker) {
+	r.mtx.Lock()
+	r.churn = churn
+	r.mtx.Unlock()
+}
+
+// SetBuildInfo records the binary version and effective configuration hash
+// for inclusion in the status response.
+func (r *StatusReporter) SetBuildInfo(version, configHash string) {
+	r.mtx.Lock()
+	r.version = version
+	r.configHash = configHash
+	r.mtx.Unlock()
+}
+
+// statusBucket aggregates the exports of a single minute.
+type statusBucket struct {
+	start   time.Time
+	series  map[uint64]struct{}
+	metrics map[string]int64
+}
+
+// statusMetric is the per-metric part of the status response.
+type statusMetric struct {
+	Points     int64  `json:"points"`
+	LastExport string `json:"last_export"`
+}
+
+// statusResponse is the wire format of the status endpoint.
+type statusResponse struct {
+	Version       string                  `json:"version,omitempty"`
+	ConfigHash    string                  `json:"config_hash,omitempty"`
+	Window        string                  `json:"window"`
+	ActiveSeries  int                     `json:"active_series"`
+	Metrics       map[string]statusMetric `json:"metrics"`
+	DropsByReason map[string]int64        `json:"drops_by_reason"`
+	QueueDepths   map[string]int64        `json:"queue_depths"`
+	SeriesChurn   []MetricChurn           `json:"series_churn,omitempty"`
+}
+
+// NewStatusReporter returns a reporter that passes all samples through to
+// next and aggregates statistics over the given window.
+func NewStatusReporter(window time.Duration, next Appender) *StatusReporter {
+	if window <= 0 {
+		window = 10 * time.Minute
+	}
+	return &StatusReporter{
+		next:       next,
+		window:     window,
+		lastExport: map[string]time.Time{},
+	}
+}
+
+// Append implements Appender.
+func (r *StatusReporter) Append(hash uint64, s *monitoring_pb.TimeSeries) error {
+	metric := s.Metric.GetType()
+	now := time.Now()
+
+	r.mtx.Lock()
+	r.prune(now)
+	bucket := r.bucket(now)
+	bucket.metrics[metric] += int64(len(s.Points))
+	bucket.series[hash] = struct{}{}
+	r.lastExport[metric] = now
+	r.mtx.Unlock()
+
+	return r.next.Append(hash, s)
+}
+
+// bucket returns the bucket covering the given time, creating it if needed.
+// The caller must hold the lock.
+func (r *StatusReporter) bucket(now time.Time) *statusBucket {
+	start := now.Truncate(time.Minute)
+	if n := len(r.buckets); n > 0 && r.buckets[n-1].start.Equal(start) {
+		return r.buckets[n-1]
+	}
+	bucket := &statusBucket{
+		start:   start,
+		series:  map[uint64]struct{}{},
+		metrics: map[string]int64{},
+	}
+	r.buckets = append(r.buckets, bucket)
+	return bucket
+}
+
+// prune drops buckets that have fallen out of the window. The caller must
+// hold the lock.
+func (r *StatusReporter) prune(now time.Time) {
+	horizon := now.Add(-r.window)
+	for len(r.buckets) > 0 && r.buckets[0].start.Before(horizon) {
+		r.buckets = r.buckets[1:]
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (r *StatusReporter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	resp := statusResponse{
+		Window:        r.window.String(),
+		Metrics:       map[string]statusMetric{},
+		DropsByReason: map[string]int64{},
+		QueueDepths:   map[string]int64{},
+	}
+
+	r.mtx.Lock()
+	r.prune(time.Now())
+	series := map[uint64]struct{}{}
+	for _, bucket := range r.buckets {
+		for hash := range bucket.series {
+			series[hash] = struct{}{}
+		}
+		for metric, points := range bucket.metrics {
+			m := resp.Metrics[metric]
+			m.Points += points
+			resp.Metrics[metric] = m
+		}
+	}
+	resp.Version = r.version
+	resp.ConfigHash = r.configHash
+	resp.ActiveSeries = len(series)
+	if r.churn != nil {
+		resp.SeriesChurn = r.churn.TopChurners(statusChurnTopN)
+	}
+	for metric, last := range r.lastExport {
+		if m, ok := resp.Metrics[metric]; ok {
+			m.LastExport = last.UTC().Format(time.RFC3339)
+			resp.Metrics[metric] = m
+		}
+	}
+	r.mtx.Unlock()
+
+	// Drop and queue statistics are maintained as regular metrics by other
+	// components; read them back from the default registry.
+	if families, err := prometheus.DefaultGatherer.Gather(); err == nil {
+		for _, family := range families {
+			switch {
+			case strings.HasSuffix(family.GetName(), "dropped_series"):
+				for _, m := range family.Metric {
+					reason := "unknown"
+					for _, l := range m.Label {
+						if l.GetName() == "reason" {
+							reason = l.GetValue()
+						}
+					}
+					resp.DropsByReason[reason] += int64(m.GetCounter().GetValue())
+				}
+			case strings.HasSuffix(family.GetName(), "queue_length"):
+				for _, m := range family.Metric {
+					queue := ""
+					for _, l := range m.Label {
+						if l.GetName() == "queue" {
+							queue = l.GetValue()
+						}
+					}
+					resp.QueueDepths[queue] = int64(m.GetGauge().GetValue())
+				}
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
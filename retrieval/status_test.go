@@ -0,0 +1,88 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStatusReporter(t *testing.T) {
+	next := &nopAppender{}
+	r := NewStatusReporter(10*time.Minute, next)
+	r.SetBuildInfo("0.1.2", "abcd1234")
+
+	r.Append(1, auditTestSeries("metric1", 1, 2.5))
+	r.Append(1, auditTestSeries("metric1", 2, 3.5))
+	r.Append(2, auditTestSeries("metric2", 1, 1))
+
+	if len(next.samples) != 3 {
+		t.Fatalf("expected 3 samples passed through, got %d", len(next.samples))
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/status", nil))
+
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	var resp statusResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response %q: %v", rec.Body.String(), err)
+	}
+	if resp.Window != "10m0s" {
+		t.Errorf("unexpected window %q", resp.Window)
+	}
+	if resp.Version != "0.1.2" || resp.ConfigHash != "abcd1234" {
+		t.Errorf("unexpected build info %q/%q", resp.Version, resp.ConfigHash)
+	}
+	if resp.ActiveSeries != 2 {
+		t.Errorf("unexpected active series count %d", resp.ActiveSeries)
+	}
+	if m := resp.Metrics["metric1"]; m.Points != 2 {
+		t.Errorf("unexpected points for metric1: %v", m)
+	}
+	if m := resp.Metrics["metric2"]; m.Points != 1 {
+		t.Errorf("unexpected points for metric2: %v", m)
+	}
+	if _, err := time.Parse(time.RFC3339, resp.Metrics["metric1"].LastExport); err != nil {
+		t.Errorf("invalid last export time %q: %v", resp.Metrics["metric1"].LastExport, err)
+	}
+}
+
+func TestStatusReporterSeriesChurn(t *testing.T) {
+	r := NewStatusReporter(10*time.Minute, &nopAppender{})
+	churn := NewSeriesChurnTracker(0)
+	churn.ObserveCreated("metric1")
+	churn.ObserveEvicted("metric1")
+	churn.ObserveCreated("metric2")
+	r.SetChurnTracker(churn)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/status", nil))
+
+	var resp statusResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response %q: %v", rec.Body.String(), err)
+	}
+	if len(resp.SeriesChurn) != 2 {
+		t.Fatalf("expected 2 churn entries, got %v", resp.SeriesChurn)
+	}
+	if top := resp.SeriesChurn[0]; top.Metric != "metric1" || top.Created != 1 || top.Evicted != 1 {
+		t.Errorf("unexpected top churner %+v", top)
+	}
+}
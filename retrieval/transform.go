@@ -19,6 +19,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	timestamp_pb "github.com/golang/protobuf/ptypes/timestamp"
@@ -26,26 +27,246 @@ import (
 	"github.com/prometheus/prometheus/pkg/textparse"
 	"github.com/prometheus/tsdb"
 	tsdbLabels "github.com/prometheus/tsdb/labels"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
 	distribution_pb "google.golang.org/genproto/googleapis/api/distribution"
 	metric_pb "google.golang.org/genproto/googleapis/api/metric"
 	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
 )
 
-type sampleBuilder struct {
-	series seriesGetter
+var samplesDroppedMaxAge = stats.Int64("prometheus_sidecar/samples_dropped_max_age",
+	"Number of samples dropped because they exceeded the maximum sample age", stats.UnitDimensionless)
+
+var samplesCoalesced = stats.Int64("prometheus_sidecar/samples_coalesced",
+	"Number of cumulative samples coalesced into the next point because their interval was below the minimum width", stats.UnitDimensionless)
+
+func init() {
+	view.Register(&view.View{
+		Name:        "prometheus_sidecar/samples_dropped_max_age",
+		Description: "Number of samples dropped because they exceeded the maximum sample age",
+		Measure:     samplesDroppedMaxAge,
+		Aggregation: view.Sum(),
+	})
+	view.Register(&view.View{
+		Name:        "prometheus_sidecar/samples_coalesced",
+		Description: "Number of cumulative samples coalesced into the next point because their interval was below the minimum width",
+		Measure:     samplesCoalesced,
+		Aggregation: view.Sum(),
+	})
 }
 
-// next extracts the next sample from the TSDB input sample list and returns
+// SampleBuilder converts TSDB samples into Stackdriver time series, using a
+// SeriesGetter to resolve series references to metadata and cached protos.
+type SampleBuilder struct {
+	series SeriesGetter
+	// bucketFilters optionally drops histogram bucket bounds per metric name
+	// before the Distribution is assembled.
+	bucketFilters map[string]*BucketFilter
+	// maxSampleAge optionally drops samples older than the limit. The
+	// Monitoring API rejects points older than 24 hours, so converting them
+	// only wastes quota. Zero disables the filter.
+	maxSampleAge time.Duration
+	// valueTransforms optionally rewrites sample values per metric name
+	// before any conversion takes place.
+	valueTransforms map[string]*ValueTransform
+	// gaugeIntervals optionally enforces a minimum export interval per gauge
+	// metric name.
+	gaugeIntervals map[string]*GaugeInterval
+	// dynamicFilters optionally overrides the cached filter decision of a
+	// series with rules changed at runtime.
+	dynamicFilters *DynamicFilters
+	// histogramLayouts remembers the last seen bucket bounds per histogram
+	// so layout changes mid-stream can be detected.
+	histogramLayouts map[uint64][]float64
+	// haMerges optionally merges overlapping samples of the same series from
+	// redundant high-availability targets per metric name.
+	haMerges map[string]HAMergeStrategy
+	// haExports tracks the last exported point of series with an HA merge
+	// strategy so overlapping samples can be merged against it.
+	haExports map[uint64]haExport
+	// minCumulativeInterval drops cumulative points whose interval is
+	// narrower than the limit. The Monitoring API rejects points below its
+	// minimum interval width; since counter values are cumulative from the
+	// reset, the next wide-enough point covers the dropped increments. Zero
+	// disables the filter.
+	minCumulativeInterval time.Duration
+}
+
+// HAMergeStrategy selects how overlapping samples of the same series from
+// redundant high-availability targets are merged.
+type HAMergeStrategy string
+
+const (
+	// HAMergeDefault picks max for cumulative and last for gauge points.
+	HAMergeDefault HAMergeStrategy = ""
+	// HAMergeMax exports the larger value, appropriate for counters whose
+	// redundant sources reset independently.
+	HAMergeMax HAMergeStrategy = "max"
+	// HAMergeLast exports the most recently received value, appropriate for
+	// gauges.
+	HAMergeLast HAMergeStrategy = "last"
+)
+
+// haExport is the last exported point of a series with an HA merge strategy.
+type haExport struct {
+	start, end int64
+	value      float64
+}
+
+// NewSampleBuilder returns a SampleBuilder reading series information from the
+// given getter. bucketFilters, valueTransforms, gaugeIntervals,
+// dynamicFilters, and haMerges may be nil.
+func NewSampleBuilder(series SeriesGetter, bucketFilters map[string]*BucketFilter, maxSampleAge time.Duration, valueTransforms map[string]*ValueTransform, gaugeIntervals map[string]*GaugeInterval, dynamicFilters *DynamicFilters, haMerges map[string]HAMergeStrategy, minCumulativeInterval time.Duration) *SampleBuilder {
+	return &SampleBuilder{
+		series:                series,
+		bucketFilters:         bucketFilters,
+		maxSampleAge:          maxSampleAge,
+		valueTransforms:       valueTransforms,
+		gaugeIntervals:        gaugeIntervals,
+		dynamicFilters:        dynamicFilters,
+		haMerges:              haMerges,
+		haExports:             map[uint64]haExport{},
+		histogramLayouts:      map[uint64][]float64{},
+		minCumulativeInterval: minCumulativeInterval,
+	}
+}
+
+// ValueTransform rewrites the values of a metric before they are converted,
+// fixing up exporters that report wrong units or ranges without redeploying
+// them. It applies to scalar series; histogram bucket series are exempt.
+type ValueTransform struct {
+	// Factor multiplies the value when non-zero, e.g. 0.001 for ms→s.
+	Factor float64
+	// ClampMin and ClampMax bound the value when set.
+	ClampMin *float64
+	ClampMax *float64
+	// InvertBool maps zero to one and any non-zero value to zero.
+	InvertBool bool
+}
+
+// apply returns the transformed value.
+func (t *ValueTransform) apply(v float64) float64 {
+	if t.Factor != 0 {
+		v *= t.Factor
+	}
+	if t.ClampMin != nil && v < *t.ClampMin {
+		v = *t.ClampMin
+	}
+	if t.ClampMax != nil && v > *t.ClampMax {
+		v = *t.ClampMax
+	}
+	if t.InvertBool {
+		if v == 0 {
+			v = 1
+		} else {
+			v = 0
+		}
+	}
+	return v
+}
+
+// GaugeIntervalOp selects how the samples of a window are reduced into the
+// exported point.
+type GaugeIntervalOp string
+
+const (
+	// GaugeIntervalLast exports the last sample of the window.
+	GaugeIntervalLast GaugeIntervalOp = "last"
+	// GaugeIntervalMean exports the mean of the window's samples.
+	GaugeIntervalMean GaugeIntervalOp = "mean"
+	// GaugeIntervalMax exports the maximum of the window's samples.
+	GaugeIntervalMax GaugeIntervalOp = "max"
+)
+
+// GaugeInterval enforces a minimum interval between exported points of a
+// gauge metric. Samples arriving more often are folded into a window and
+// reduced to a single point per interval, cutting cost for gauges scraped
+// far more often than dashboards need. Counters are unaffected; stretching
+// their intervals would distort rates.
+type GaugeInterval struct {
+	// MinInterval is the minimum time between exported points.
+	MinInterval time.Duration
+	// Op is the reduction applied to the window. Empty defaults to
+	// GaugeIntervalLast.
+	Op GaugeIntervalOp
+}
+
+// reduce folds a sample into the series' current window and returns the
+// value to export, if any. The first sample of a series opens the window and
+// is exported as-is so new series appear without delay.
+func (g *GaugeInterval) reduce(e *SeriesCacheEntry, t int64, v float64) (float64, bool) {
+	if e.gaugeWindowStart == 0 {
+		e.gaugeWindowStart = t
+		return v, true
+	}
+	e.gaugeWindowSum += v
+	e.gaugeWindowCount++
+	if e.gaugeWindowCount == 1 || v > e.gaugeWindowMax {
+		e.gaugeWindowMax = v
+	}
+	if t-e.gaugeWindowStart < int64(g.MinInterval/time.Millisecond) {
+		return 0, false
+	}
+	out := v
+	switch g.Op {
+	case GaugeIntervalMean:
+		out = e.gaugeWindowSum / e.gaugeWindowCount
+	case GaugeIntervalMax:
+		out = e.gaugeWindowMax
+	}
+	e.gaugeWindowStart = t
+	e.gaugeWindowSum = 0
+	e.gaugeWindowCount = 0
+	e.gaugeWindowMax = 0
+	return out, true
+}
+
+// BucketFilter configures which histogram bucket bounds are dropped for a
+// metric before its Distribution value is built. Dropping a bound merges its
+// count into the next larger bucket.
+type BucketFilter struct {
+	// DropBounds lists explicit bucket bounds to drop.
+	DropBounds []float64
+	// KeepEvery keeps only every n-th bound when greater than one.
+	KeepEvery int
+	// CollapseEmpty collapses runs of empty buckets by dropping their bounds,
+	// shrinking the Distribution payload without changing any counts. Useful
+	// for wide static bucket layouts that are mostly empty.
+	CollapseEmpty bool
+	// RebucketOnChange converts samples back to the previously seen bucket
+	// layout when the exporter changes its bounds mid-stream, instead of
+	// restarting the cumulative interval.
+	RebucketOnChange bool
+}
+
+// drops returns whether the i-th (sorted) bucket bound should be dropped.
+func (f *BucketFilter) drops(i int, bound float64) bool {
+	if f.KeepEvery > 1 && i%f.KeepEvery != 0 {
+		return true
+	}
+	for _, b := range f.DropBounds {
+		if b == bound {
+			return true
+		}
+	}
+	return false
+}
+
+// Next extracts the next sample from the TSDB input sample list and returns
 // the remainder of the input.
-func (b *sampleBuilder) next(ctx context.Context, samples []tsdb.RefSample) (*monitoring_pb.TimeSeries, uint64, []tsdb.RefSample, error) {
+func (b *SampleBuilder) Next(ctx context.Context, samples []tsdb.RefSample) (*monitoring_pb.TimeSeries, uint64, []tsdb.RefSample, error) {
 	sample := samples[0]
 	tailSamples := samples[1:]
 
 	if math.IsNaN(sample.V) {
 		return nil, 0, tailSamples, nil
 	}
+	if b.maxSampleAge > 0 && time.Since(timestampTime(sample.T)) > b.maxSampleAge {
+		stats.Record(ctx, samplesDroppedMaxAge.M(1))
+		return nil, 0, tailSamples, nil
+	}
 
-	entry, ok, err := b.series.get(ctx, sample.Ref)
+	entry, ok, err := b.series.Get(ctx, sample.Ref)
 	if err != nil {
 		return nil, 0, samples, errors.Wrap(err, "get series information")
 	}
@@ -53,60 +274,107 @@ func (b *sampleBuilder) next(ctx context.Context, samples []tsdb.RefSample) (*mo
 		return nil, 0, tailSamples, nil
 	}
 
+	// OpenMetrics _created series carry the start time of their metric family
+	// as a Unix timestamp in seconds. Consume them to set precise start times
+	// for cumulative series instead of exporting them.
+	if entry.createdFor != 0 {
+		b.series.SetCreatedTimestamp(entry.createdFor, int64(sample.V*1000))
+		return nil, 0, tailSamples, nil
+	}
+
+	// Rewrite the raw value before reset tracking and aggregation so all
+	// downstream consumers see the corrected value.
+	if t := b.valueTransforms[entry.lset.Get("__name__")]; t != nil {
+		sample.V = t.apply(sample.V)
+	}
+
 	if entry.tracker != nil {
 		entry.tracker.newPoint(ctx, entry.lset, sample.T, sample.V)
 	}
+	if entry.gauges != nil {
+		entry.gauges.newPoint(entry.lset, sample.V)
+	}
 
-	if !entry.exported {
+	exported := entry.exported
+	if b.dynamicFilters != nil {
+		exported = b.dynamicFilters.Exported(entry.lset, exported)
+	}
+	if !exported {
 		return nil, 0, tailSamples, nil
 	}
 	// Get a shallow copy of the proto so we can overwrite the point field
 	// and safely send it into the remote queues.
-	ts := *entry.proto
-
-	point := &monitoring_pb.Point{
-		Interval: &monitoring_pb.TimeInterval{
-			EndTime: getTimestamp(sample.T),
-		},
-	}
-	ts.Points = append(ts.Points, point)
+	buf := newPointBuffer(sample.T)
+	ts := &buf.ts
+	*ts = *entry.proto
+	point := &buf.point
+	ts.Points = buf.points[:]
 
 	var resetTimestamp int64
 
 	switch entry.metadata.MetricType {
 	case textparse.MetricTypeCounter:
 		var v float64
-		resetTimestamp, v, ok = b.series.getResetAdjusted(sample.Ref, sample.T, sample.V)
+		resetTimestamp, v, ok = b.series.GetResetAdjusted(sample.Ref, sample.T, sample.V)
 		if !ok {
+			buf.recycle()
 			return nil, 0, tailSamples, nil
 		}
-		point.Interval.StartTime = getTimestamp(resetTimestamp)
-		point.Value = buildTypedValue(entry.metadata.ValueType, v)
+		if ts.MetricKind == metric_pb.MetricDescriptor_DELTA {
+			// DELTA points cover the range since the previous sample rather
+			// than since the last reset, so consecutive intervals do not
+			// overlap. The first point after a reset covers the range since
+			// the reset itself.
+			start := entry.deltaTimestamp
+			if start <= resetTimestamp {
+				start = resetTimestamp
+				entry.deltaValue = 0
+			}
+			buf.setStart(start)
+			point.Value = buildTypedValue(entry.metadata.ValueType, v-entry.deltaValue)
+			entry.deltaValue = v
+			entry.deltaTimestamp = sample.T
+			resetTimestamp = start
+		} else {
+			buf.setStart(resetTimestamp)
+			point.Value = buildTypedValue(entry.metadata.ValueType, v)
+		}
 
 	case textparse.MetricTypeGauge, textparse.MetricTypeUnknown:
-		point.Value = buildTypedValue(entry.metadata.ValueType, sample.V)
+		v := sample.V
+		if g := b.gaugeIntervals[entry.lset.Get("__name__")]; g != nil {
+			var emit bool
+			if v, emit = g.reduce(entry, sample.T, sample.V); !emit {
+				buf.recycle()
+				return nil, 0, tailSamples, nil
+			}
+		}
+		point.Value = buildTypedValue(entry.metadata.ValueType, v)
 
 	case textparse.MetricTypeSummary:
 		switch entry.suffix {
 		case metricSuffixSum:
 			var v float64
-			resetTimestamp, v, ok = b.series.getResetAdjusted(sample.Ref, sample.T, sample.V)
+			resetTimestamp, v, ok = b.series.GetResetAdjusted(sample.Ref, sample.T, sample.V)
 			if !ok {
+				buf.recycle()
 				return nil, 0, tailSamples, nil
 			}
-			point.Interval.StartTime = getTimestamp(resetTimestamp)
+			buf.setStart(resetTimestamp)
 			point.Value = &monitoring_pb.TypedValue{Value: &monitoring_pb.TypedValue_DoubleValue{v}}
 		case metricSuffixCount:
 			var v float64
-			resetTimestamp, v, ok = b.series.getResetAdjusted(sample.Ref, sample.T, sample.V)
+			resetTimestamp, v, ok = b.series.GetResetAdjusted(sample.Ref, sample.T, sample.V)
 			if !ok {
+				buf.recycle()
 				return nil, 0, tailSamples, nil
 			}
-			point.Interval.StartTime = getTimestamp(resetTimestamp)
+			buf.setStart(resetTimestamp)
 			point.Value = &monitoring_pb.TypedValue{Value: &monitoring_pb.TypedValue_Int64Value{int64(v)}}
 		case "": // Actual quantiles.
 			point.Value = &monitoring_pb.TypedValue{Value: &monitoring_pb.TypedValue_DoubleValue{sample.V}}
 		default:
+			buf.recycle()
 			return nil, 0, tailSamples, errors.Errorf("unexpected metric name suffix %q", entry.suffix)
 		}
 
@@ -116,28 +384,124 @@ func (b *sampleBuilder) next(ctx context.Context, samples []tsdb.RefSample) (*mo
 		var v *distribution_pb.Distribution
 		v, resetTimestamp, tailSamples, err = b.buildDistribution(ctx, entry.metadata.Metric, entry.lset, samples)
 		if v == nil || err != nil {
+			buf.recycle()
 			return nil, 0, tailSamples, err
 		}
-		point.Interval.StartTime = getTimestamp(resetTimestamp)
+		buf.setStart(resetTimestamp)
 		point.Value = &monitoring_pb.TypedValue{
 			Value: &monitoring_pb.TypedValue_DistributionValue{v},
 		}
 
+	case textparse.MetricTypeGaugeHistogram:
+		// Every point of a gauge histogram is a self-contained snapshot, so
+		// the raw values convert without any reset tracking.
+		var v *distribution_pb.Distribution
+		v, tailSamples, err = b.buildGaugeDistribution(ctx, entry.metadata.Metric, entry.lset, samples)
+		if v == nil || err != nil {
+			buf.recycle()
+			return nil, 0, tailSamples, err
+		}
+		point.Value = &monitoring_pb.TypedValue{
+			Value: &monitoring_pb.TypedValue_DistributionValue{v},
+		}
+
+	case textparse.MetricTypeStateset:
+		// Each state series is a boolean gauge telling whether the state is
+		// currently active.
+		point.Value = &monitoring_pb.TypedValue{Value: &monitoring_pb.TypedValue_BoolValue{sample.V != 0}}
+
+	case textparse.MetricTypeInfo:
+		// Info metrics carry their payload entirely in labels; the value is
+		// a constant 1.
+		point.Value = &monitoring_pb.TypedValue{Value: &monitoring_pb.TypedValue_Int64Value{1}}
+
 	default:
+		buf.recycle()
 		return nil, 0, samples[1:], errors.Errorf("unexpected metric type %s", entry.metadata.MetricType)
 	}
 
-	if !b.series.updateSampleInterval(entry.hash, resetTimestamp, sample.T) {
-		return nil, 0, tailSamples, nil
+	// Too-frequent counter points produce intervals narrower than the
+	// Monitoring API permits. Coalesce them by dropping the sample; the next
+	// point at or beyond the minimum width covers the dropped increments
+	// since cumulative values always count from the reset.
+	if b.minCumulativeInterval > 0 && ts.MetricKind == metric_pb.MetricDescriptor_CUMULATIVE {
+		if time.Duration(sample.T-resetTimestamp)*time.Millisecond < b.minCumulativeInterval {
+			stats.Record(ctx, samplesCoalesced.M(1))
+			buf.recycle()
+			return nil, 0, tailSamples, nil
+		}
+	}
+
+	if !b.series.UpdateSampleInterval(entry.hash, resetTimestamp, sample.T) {
+		// Redundant HA targets behind one resource produce the same series
+		// after mapping, so their samples reject each other through
+		// overlapping intervals. With a merge strategy configured for the
+		// metric, export a merged point just after the previous one instead
+		// of dropping the sample.
+		strategy, merge := b.haMerges[entry.metadata.Metric]
+		if !merge {
+			buf.recycle()
+			return nil, 0, tailSamples, nil
+		}
+		prev, seen := b.haExports[entry.hash]
+		v, scalar := scalarValue(point.Value)
+		if !seen || !scalar {
+			buf.recycle()
+			return nil, 0, tailSamples, nil
+		}
+		if strategy == HAMergeDefault {
+			if ts.MetricKind == metric_pb.MetricDescriptor_GAUGE {
+				strategy = HAMergeLast
+			} else {
+				strategy = HAMergeMax
+			}
+		}
+		if strategy == HAMergeMax && v <= prev.value {
+			buf.recycle()
+			return nil, 0, tailSamples, nil
+		}
+		end := prev.end + 1
+		buf.end = makeTimestamp(end)
+		if ts.MetricKind != metric_pb.MetricDescriptor_GAUGE {
+			buf.setStart(prev.start)
+		}
+		point.Value = buildTypedValue(entry.metadata.ValueType, v)
+		if !b.series.UpdateSampleInterval(entry.hash, prev.start, end) {
+			buf.recycle()
+			return nil, 0, tailSamples, nil
+		}
+		b.haExports[entry.hash] = haExport{start: prev.start, end: end, value: v}
+		return ts, entry.hash, tailSamples, nil
 	}
-	return &ts, entry.hash, tailSamples, nil
+	if _, ok := b.haMerges[entry.metadata.Metric]; ok {
+		if v, scalar := scalarValue(point.Value); scalar {
+			if b.haExports == nil {
+				b.haExports = map[uint64]haExport{}
+			}
+			b.haExports[entry.hash] = haExport{start: resetTimestamp, end: sample.T, value: v}
+		}
+	}
+	return ts, entry.hash, tailSamples, nil
+}
+
+// scalarValue extracts numeric point values. Merging does not apply to
+// distribution or non-numeric values.
+func scalarValue(v *monitoring_pb.TypedValue) (float64, bool) {
+	switch x := v.Value.(type) {
+	case *monitoring_pb.TypedValue_DoubleValue:
+		return x.DoubleValue, true
+	case *monitoring_pb.TypedValue_Int64Value:
+		return float64(x.Int64Value), true
+	}
+	return 0, false
 }
 
 const (
-	metricSuffixBucket = "_bucket"
-	metricSuffixSum    = "_sum"
-	metricSuffixCount  = "_count"
-	metricSuffixTotal  = "_total"
+	metricSuffixBucket  = "_bucket"
+	metricSuffixSum     = "_sum"
+	metricSuffixCount   = "_count"
+	metricSuffixTotal   = "_total"
+	metricSuffixCreated = "_created"
 )
 
 func stripComplexMetricSuffix(name string) (prefix string, suffix string, ok bool) {
@@ -170,12 +534,60 @@ func getMetricType(prefix string, promName string) string {
 
 // getTimestamp converts a millisecond timestamp into a protobuf timestamp.
 func getTimestamp(t int64) *timestamp_pb.Timestamp {
-	return &timestamp_pb.Timestamp{
+	ts := makeTimestamp(t)
+	return &ts
+}
+
+// makeTimestamp converts a millisecond timestamp into a protobuf timestamp
+// value without allocating.
+func makeTimestamp(t int64) timestamp_pb.Timestamp {
+	return timestamp_pb.Timestamp{
 		Seconds: t / 1000,
 		Nanos:   int32((t % 1000) * int64(time.Millisecond)),
 	}
 }
 
+// pointBuffer bundles the TimeSeries and point protos making up a single
+// sample into one allocation. Buffers of exported samples are handed off
+// downstream and never touched again; buffers of samples dropped during
+// conversion go back to the free list.
+type pointBuffer struct {
+	ts       monitoring_pb.TimeSeries
+	points   [1]*monitoring_pb.Point
+	point    monitoring_pb.Point
+	interval monitoring_pb.TimeInterval
+	start    timestamp_pb.Timestamp
+	end      timestamp_pb.Timestamp
+}
+
+var pointBufferPool = sync.Pool{
+	New: func() interface{} { return new(pointBuffer) },
+}
+
+// newPointBuffer returns a wired-up buffer for a point ending at the given
+// millisecond timestamp.
+func newPointBuffer(endTime int64) *pointBuffer {
+	b := pointBufferPool.Get().(*pointBuffer)
+	*b = pointBuffer{}
+	b.end = makeTimestamp(endTime)
+	b.interval.EndTime = &b.end
+	b.point.Interval = &b.interval
+	b.points[0] = &b.point
+	return b
+}
+
+// recycle returns the buffer to the free list. It must only be called for
+// buffers whose sample was dropped before being handed downstream.
+func (b *pointBuffer) recycle() {
+	pointBufferPool.Put(b)
+}
+
+// setStart fills in the interval start time.
+func (b *pointBuffer) setStart(t int64) {
+	b.start = makeTimestamp(t)
+	b.interval.StartTime = &b.start
+}
+
 type distribution struct {
 	bounds []float64
 	values []int64
@@ -197,7 +609,7 @@ func (d *distribution) Swap(i, j int) {
 // buildDistribution consumes series from the beginning of the input slice that belong to a histogram
 // with the given metric name and label set.
 // It returns the reset timestamp along with the distrubution.
-func (b *sampleBuilder) buildDistribution(
+func (b *SampleBuilder) buildDistribution(
 	ctx context.Context,
 	baseName string,
 	matchLset tsdbLabels.Labels,
@@ -210,12 +622,13 @@ func (b *sampleBuilder) buildDistribution(
 		lastTimestamp  int64
 		dist           = distribution{bounds: make([]float64, 0, 20), values: make([]int64, 0, 20)}
 		skip           = false
+		histRefs       []uint64
 	)
 	// We assume that all series belonging to the histogram are sequential. Consume series
 	// until we hit a new metric.
 Loop:
 	for i, s := range samples {
-		e, ok, err := b.series.get(ctx, s.Ref)
+		e, ok, err := b.series.Get(ctx, s.Ref)
 		if err != nil {
 			return nil, 0, samples, err
 		}
@@ -239,7 +652,7 @@ Loop:
 		}
 		lastTimestamp = s.T
 
-		rt, v, ok := b.series.getResetAdjusted(s.Ref, s.T, s.V)
+		rt, v, ok := b.series.GetResetAdjusted(s.Ref, s.T, s.V)
 
 		switch name[len(baseName):] {
 		case metricSuffixSum:
@@ -266,6 +679,7 @@ Loop:
 		if !ok {
 			skip = true
 		}
+		histRefs = append(histRefs, s.Ref)
 		consumed++
 	}
 	// Don't emit a sample if we explicitly skip it or no reset timestamp was set because the
@@ -276,6 +690,35 @@ Loop:
 	// We do not assume that the buckets in the sample batch are in order, so we sort them again here.
 	// The code below relies on this to convert between Prometheus's and Stackdriver's bucketing approaches.
 	sort.Sort(&dist)
+	filter := b.bucketFilters[baseName]
+	// When the exporter changed its bucket layout mid-stream, the assembled
+	// point would conflict with what was already exported for the cumulative
+	// interval. Re-bucket into the previous layout if configured, otherwise
+	// skip the sample and restart the cumulative interval so the stream
+	// continues with a new reset time and the new layout.
+	layoutKey := createdKey(baseName, matchLset)
+	if b.histogramLayouts == nil {
+		b.histogramLayouts = map[uint64][]float64{}
+	}
+	if prev, ok := b.histogramLayouts[layoutKey]; ok && !boundsEqual(prev, dist.bounds) {
+		if filter != nil && filter.RebucketOnChange {
+			dist = rebucket(dist, prev)
+		} else {
+			for _, ref := range histRefs {
+				b.series.ResetCumulative(ref)
+			}
+			b.histogramLayouts[layoutKey] = append([]float64{}, dist.bounds...)
+			return nil, 0, samples[consumed:], nil
+		}
+	} else if !ok {
+		b.histogramLayouts[layoutKey] = append([]float64{}, dist.bounds...)
+	}
+	return distributionProto(dist, count, sum, filter), resetTimestamp, samples[consumed:], nil
+}
+
+// distributionProto converts sorted cumulative bucket data into Stackdriver's
+// distribution representation, applying the given bucket filter.
+func distributionProto(dist distribution, count, sum float64, filter *BucketFilter) *distribution_pb.Distribution {
 	// Reuse slices we already populated to build final bounds and values.
 	var (
 		bounds           = dist.bounds[:0]
@@ -290,6 +733,13 @@ Loop:
 		if math.IsInf(upper, 1) {
 			upper = lower
 		} else {
+			// Dropped bounds are merged into the next bucket by leaving the
+			// cumulative value for this bound unconsumed. Empty buckets are
+			// collapsed the same way: their cumulative value equals the
+			// previous one, so merging them does not change any count.
+			if filter != nil && (filter.drops(i, upper) || (filter.CollapseEmpty && dist.values[i] == prevVal)) {
+				continue
+			}
 			bounds = append(bounds, upper)
 		}
 
@@ -301,7 +751,7 @@ Loop:
 		prevVal = dist.values[i]
 		values = append(values, val)
 	}
-	d := &distribution_pb.Distribution{
+	return &distribution_pb.Distribution{
 		Count:                 int64(count),
 		Mean:                  mean,
 		SumOfSquaredDeviation: dev,
@@ -314,7 +764,106 @@ Loop:
 		},
 		BucketCounts: values,
 	}
-	return d, resetTimestamp, samples[consumed:], nil
+}
+
+// buildGaugeDistribution consumes the series of a gauge histogram from the
+// beginning of the input slice, analogous to buildDistribution. Gauge
+// histogram points are self-contained snapshots, so the raw sample values are
+// taken and no reset handling or bucket layout tracking applies.
+func (b *SampleBuilder) buildGaugeDistribution(
+	ctx context.Context,
+	baseName string,
+	matchLset tsdbLabels.Labels,
+	samples []tsdb.RefSample,
+) (*distribution_pb.Distribution, []tsdb.RefSample, error) {
+	var (
+		consumed      int
+		count, sum    float64
+		lastTimestamp int64
+		dist          = distribution{bounds: make([]float64, 0, 20), values: make([]int64, 0, 20)}
+		seenCount     bool
+	)
+	// We assume that all series belonging to the histogram are sequential.
+	// Consume series until we hit a new metric.
+Loop:
+	for i, s := range samples {
+		e, ok, err := b.series.Get(ctx, s.Ref)
+		if err != nil {
+			return nil, samples, err
+		}
+		if !ok {
+			consumed++
+			continue
+		}
+		name := e.lset.Get("__name__")
+		if !strings.HasPrefix(name, baseName) || !histogramLabelsEqual(e.lset, matchLset) {
+			break
+		}
+		if i > 0 && s.T != lastTimestamp {
+			break
+		}
+		lastTimestamp = s.T
+
+		switch name[len(baseName):] {
+		case metricSuffixSum:
+			sum = s.V
+		case metricSuffixCount:
+			count = s.V
+			seenCount = true
+		case metricSuffixBucket:
+			upper, err := strconv.ParseFloat(e.lset.Get("le"), 64)
+			if err != nil {
+				consumed++
+				continue
+			}
+			dist.bounds = append(dist.bounds, upper)
+			dist.values = append(dist.values, int64(s.V))
+		default:
+			break Loop
+		}
+		consumed++
+	}
+	// Don't emit a sample without the count series; it holds the overall
+	// count the distribution is built around.
+	if !seenCount {
+		return nil, samples[consumed:], nil
+	}
+	sort.Sort(&dist)
+	return distributionProto(dist, count, sum, b.bucketFilters[baseName]), samples[consumed:], nil
+}
+
+// boundsEqual returns whether two sorted bucket bound slices are identical.
+func boundsEqual(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// rebucket converts the cumulative bucket values of a distribution to the
+// given target bounds. Each target bound receives the cumulative value of the
+// largest source bound not above it, so counts are never attributed to a
+// smaller bucket than they were observed in.
+func rebucket(d distribution, bounds []float64) distribution {
+	out := distribution{
+		bounds: append([]float64{}, bounds...),
+		values: make([]int64, len(bounds)),
+	}
+	for i, upper := range out.bounds {
+		j := sort.SearchFloat64s(d.bounds, upper)
+		if j == len(d.bounds) || d.bounds[j] != upper {
+			j--
+		}
+		if j >= 0 {
+			out.values[i] = d.values[j]
+		}
+	}
+	return out
 }
 
 // histogramLabelsEqual checks whether two label sets for a histogram series are equal aside from their
@@ -356,9 +905,60 @@ func histogramLabelsEqual(a, b tsdbLabels.Labels) bool {
 }
 
 func buildTypedValue(valueType metric_pb.MetricDescriptor_ValueType, v float64) *monitoring_pb.TypedValue {
-	if valueType == metric_pb.MetricDescriptor_INT64 {
+	switch valueType {
+	case metric_pb.MetricDescriptor_INT64:
 		return &monitoring_pb.TypedValue{Value: &monitoring_pb.TypedValue_Int64Value{int64(math.Round(v))}}
+	case metric_pb.MetricDescriptor_BOOL:
+		return &monitoring_pb.TypedValue{Value: &monitoring_pb.TypedValue_BoolValue{v != 0}}
 	}
 	// Default to double, which is the only type supported by Prometheus.
 	return &monitoring_pb.TypedValue{Value: &monitoring_pb.TypedValue_DoubleValue{v}}
 }
+
+// checkValueType validates the value type declared in metric metadata against
+// the Prometheus metric type. The supported combinations are:
+//
+//	counter:        DOUBLE (default), INT64
+//	gauge, unknown: DOUBLE (default), INT64, BOOL (sample values 0 and 1)
+//	summary:        DOUBLE; each series uses its fixed per-suffix type
+//	histogram:      DOUBLE or DISTRIBUTION; always exported as DISTRIBUTION
+//	gaugehistogram: DOUBLE or DISTRIBUTION; always exported as DISTRIBUTION
+//	stateset:       BOOL; each state series reports whether it is active
+//	info:           INT64; the constant value 1 with the payload in labels
+//
+// All other combinations are rejected rather than silently coerced to double.
+func checkValueType(metricType textparse.MetricType, valueType metric_pb.MetricDescriptor_ValueType) error {
+	if valueType == metric_pb.MetricDescriptor_VALUE_TYPE_UNSPECIFIED {
+		return nil
+	}
+	switch metricType {
+	case textparse.MetricTypeCounter:
+		switch valueType {
+		case metric_pb.MetricDescriptor_DOUBLE, metric_pb.MetricDescriptor_INT64:
+			return nil
+		}
+	case textparse.MetricTypeGauge, textparse.MetricTypeUnknown:
+		switch valueType {
+		case metric_pb.MetricDescriptor_DOUBLE, metric_pb.MetricDescriptor_INT64, metric_pb.MetricDescriptor_BOOL:
+			return nil
+		}
+	case textparse.MetricTypeSummary:
+		if valueType == metric_pb.MetricDescriptor_DOUBLE {
+			return nil
+		}
+	case textparse.MetricTypeHistogram, textparse.MetricTypeGaugeHistogram:
+		switch valueType {
+		case metric_pb.MetricDescriptor_DOUBLE, metric_pb.MetricDescriptor_DISTRIBUTION:
+			return nil
+		}
+	case textparse.MetricTypeStateset:
+		if valueType == metric_pb.MetricDescriptor_BOOL {
+			return nil
+		}
+	case textparse.MetricTypeInfo:
+		if valueType == metric_pb.MetricDescriptor_INT64 {
+			return nil
+		}
+	}
+	return errors.Errorf("unsupported value type %s for metric type %s", valueType, metricType)
+}
@@ -16,7 +16,9 @@ package retrieval
 import (
 	"context"
 	"math"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/bjbloemker-google/stackdriver-prometheus-sidecar/metadata"
 	"github.com/bjbloemker-google/stackdriver-prometheus-sidecar/targets"
@@ -33,7 +35,7 @@ import (
 	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
 )
 
-// seriesMap implements seriesGetter.
+// seriesMap implements SeriesGetter.
 type seriesMap map[uint64]labels.Labels
 
 // targetMap implements a TargetGetter that indexes targets by job/instance combination.
@@ -382,6 +384,72 @@ func TestSampleBuilder(t *testing.T) {
 			},
 			result: []*monitoring_pb.TimeSeries{nil, nil, nil},
 		},
+		// Bool gauges. Counters cannot be bools, so that series is rejected
+		// and its samples are skipped.
+		{
+			targets: targetMap{
+				"job1/instance1": &targets.Target{
+					Labels:           promlabels.FromStrings("job", "job1", "instance", "instance1"),
+					DiscoveredLabels: promlabels.FromStrings("__resource_a", "resource2_a"),
+				},
+			},
+			metadata: metadataMap{
+				"job1/instance1/metric1": &metadata.Entry{Metric: "metric1", MetricType: textparse.MetricTypeGauge, ValueType: metric_pb.MetricDescriptor_BOOL},
+				"job1/instance1/metric2": &metadata.Entry{Metric: "metric2", MetricType: textparse.MetricTypeCounter, ValueType: metric_pb.MetricDescriptor_BOOL},
+			},
+			series: seriesMap{
+				1: labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric1"),
+				2: labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric2"),
+			},
+			input: []tsdb.RefSample{
+				{Ref: 1, T: 1000, V: 1},
+				{Ref: 1, T: 2000, V: 0},
+				{Ref: 2, T: 3000, V: 1},
+			},
+			result: []*monitoring_pb.TimeSeries{
+				{ // 0
+					Resource: &monitoredres_pb.MonitoredResource{
+						Type:   "resource2",
+						Labels: map[string]string{"resource_a": "resource2_a"},
+					},
+					Metric: &metric_pb.Metric{
+						Type:   "external.googleapis.com/prometheus/metric1",
+						Labels: map[string]string{},
+					},
+					MetricKind: metric_pb.MetricDescriptor_GAUGE,
+					ValueType:  metric_pb.MetricDescriptor_BOOL,
+					Points: []*monitoring_pb.Point{{
+						Interval: &monitoring_pb.TimeInterval{
+							EndTime: &timestamp_pb.Timestamp{Seconds: 1},
+						},
+						Value: &monitoring_pb.TypedValue{
+							Value: &monitoring_pb.TypedValue_BoolValue{true},
+						},
+					}},
+				},
+				{ // 1
+					Resource: &monitoredres_pb.MonitoredResource{
+						Type:   "resource2",
+						Labels: map[string]string{"resource_a": "resource2_a"},
+					},
+					Metric: &metric_pb.Metric{
+						Type:   "external.googleapis.com/prometheus/metric1",
+						Labels: map[string]string{},
+					},
+					MetricKind: metric_pb.MetricDescriptor_GAUGE,
+					ValueType:  metric_pb.MetricDescriptor_BOOL,
+					Points: []*monitoring_pb.Point{{
+						Interval: &monitoring_pb.TimeInterval{
+							EndTime: &timestamp_pb.Timestamp{Seconds: 2},
+						},
+						Value: &monitoring_pb.TypedValue{
+							Value: &monitoring_pb.TypedValue_BoolValue{false},
+						},
+					}},
+				},
+				nil, // 2: metadata with unsupported value type, series not cached.
+			},
+		},
 		// Summary metrics.
 		{
 			targets: targetMap{
@@ -642,13 +710,15 @@ func TestSampleBuilder(t *testing.T) {
 				},
 			},
 		},
-		// Interval overlap handling.
+		// Series collision handling.
 		{
 			series: seriesMap{
 				1: labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric1"),
 				2: labels.FromStrings("job", "job1", "instance", "instance2", "__name__", "metric1"),
 			},
-			// Both instances map to the same monitored resource and will thus produce the same series.
+			// Both instances map to the same monitored resource and would thus produce
+			// the same series. The series cache detects the collision and keeps only
+			// the smaller input label set, i.e. instance1.
 			targets: targetMap{
 				"job1/instance1": &targets.Target{
 					Labels:           promlabels.FromStrings("job", "job1", "instance", "instance1"),
@@ -664,20 +734,19 @@ func TestSampleBuilder(t *testing.T) {
 				"job1/instance2/metric1": &metadata.Entry{Metric: "metric1", MetricType: textparse.MetricTypeCounter, ValueType: metric_pb.MetricDescriptor_DOUBLE},
 			},
 			input: []tsdb.RefSample{
-				// First sample for both series will define the reset timestamp.
+				// The first sample of the surviving series defines the reset timestamp.
 				{Ref: 1, T: 1000, V: 4},
+				// All samples of the colliding series are dropped.
 				{Ref: 2, T: 1500, V: 5},
-				// The sample for series 2 must be rejected.
 				{Ref: 1, T: 2000, V: 9},
 				{Ref: 2, T: 2500, V: 11},
-				// Both series get reset but the 2nd one is detected first.
-				// The emitted samples should flip over.
 				{Ref: 2, T: 3500, V: 3},
+				// The surviving series resets independently.
 				{Ref: 1, T: 3000, V: 2},
 			},
 			result: []*monitoring_pb.TimeSeries{
 				nil, // Skipped by reset timestamp handling.
-				nil, // Skipped by reset timestamp handling.
+				nil, // Colliding series.
 				{
 					Resource: &monitoredres_pb.MonitoredResource{
 						Type:   "resource2",
@@ -699,7 +768,8 @@ func TestSampleBuilder(t *testing.T) {
 						},
 					}},
 				},
-				nil,
+				nil, // Colliding series.
+				nil, // Colliding series.
 				{
 					Resource: &monitoredres_pb.MonitoredResource{
 						Type:   "resource2",
@@ -713,15 +783,14 @@ func TestSampleBuilder(t *testing.T) {
 					ValueType:  metric_pb.MetricDescriptor_DOUBLE,
 					Points: []*monitoring_pb.Point{{
 						Interval: &monitoring_pb.TimeInterval{
-							StartTime: &timestamp_pb.Timestamp{Seconds: 3, Nanos: 5e8 - 1e6},
-							EndTime:   &timestamp_pb.Timestamp{Seconds: 3, Nanos: 5e8},
+							StartTime: &timestamp_pb.Timestamp{Seconds: 2, Nanos: 1e9 - 1e6},
+							EndTime:   &timestamp_pb.Timestamp{Seconds: 3},
 						},
 						Value: &monitoring_pb.TypedValue{
-							Value: &monitoring_pb.TypedValue_DoubleValue{3},
+							Value: &monitoring_pb.TypedValue_DoubleValue{2},
 						},
 					}},
 				},
-				nil,
 			},
 		},
 		// Customized metric prefix.
@@ -1145,15 +1214,16 @@ func TestSampleBuilder(t *testing.T) {
 		var hashes []uint64
 
 		aggr, _ := NewCounterAggregator(log.NewNopLogger(), new(CounterAggregatorConfig))
-		series := newSeriesCache(nil, "", nil, nil, c.targets, c.metadata, resourceMaps, c.metricPrefix, false, aggr)
+		gaugeAggr, _ := NewGaugeAggregator(log.NewNopLogger(), new(GaugeAggregatorConfig))
+		series := NewSeriesCache(nil, "", nil, nil, c.targets, c.metadata, resourceMaps, c.metricPrefix, nil, nil, "", false, false, aggr, gaugeAggr, nil, nil, nil, 0, 0, nil, "", nil, nil, nil, "")
 		for ref, s := range c.series {
-			series.set(ctx, ref, s, 0)
+			series.Set(ctx, ref, s, 0)
 		}
 
-		b := &sampleBuilder{series: series}
+		b := &SampleBuilder{series: series}
 
 		for k := 0; len(c.input) > 0; k++ {
-			s, h, c.input, err = b.next(context.Background(), c.input)
+			s, h, c.input, err = b.Next(context.Background(), c.input)
 			if err != nil {
 				break
 			}
@@ -1183,3 +1253,770 @@ func TestSampleBuilder(t *testing.T) {
 		}
 	}
 }
+
+func TestSampleBuilderCreatedTimestamp(t *testing.T) {
+	resourceMaps := []ResourceMap{
+		{
+			Type: "resource1",
+			LabelMap: map[string]labelTranslation{
+				"__resource_a": constValue("resource_a"),
+			},
+		},
+	}
+	targets := targetMap{
+		"job1/instance1": &targets.Target{
+			Labels:           promlabels.FromStrings("job", "job1", "instance", "instance1"),
+			DiscoveredLabels: promlabels.FromStrings("__resource_a", "resource1_a"),
+		},
+	}
+	metadata := metadataMap{
+		"job1/instance1/metric1": &metadata.Entry{Metric: "metric1", MetricType: textparse.MetricTypeCounter, ValueType: metric_pb.MetricDescriptor_DOUBLE},
+	}
+	input := []tsdb.RefSample{
+		{Ref: 2, T: 2000, V: 1.5}, // Created timestamp, consumed without output.
+		{Ref: 1, T: 2000, V: 5.5},
+		{Ref: 1, T: 3000, V: 8},
+	}
+	// With the start time known from the _created series, even the first
+	// sample is converted rather than being skipped for reset handling.
+	expected := []*monitoring_pb.TimeSeries{
+		nil, // Consumed _created series.
+		{
+			Resource: &monitoredres_pb.MonitoredResource{
+				Type:   "resource1",
+				Labels: map[string]string{"resource_a": "resource1_a"},
+			},
+			Metric: &metric_pb.Metric{
+				Type:   "external.googleapis.com/prometheus/metric1",
+				Labels: map[string]string{},
+			},
+			MetricKind: metric_pb.MetricDescriptor_CUMULATIVE,
+			ValueType:  metric_pb.MetricDescriptor_DOUBLE,
+			Points: []*monitoring_pb.Point{{
+				Interval: &monitoring_pb.TimeInterval{
+					StartTime: &timestamp_pb.Timestamp{Seconds: 1, Nanos: 5e8},
+					EndTime:   &timestamp_pb.Timestamp{Seconds: 2},
+				},
+				Value: &monitoring_pb.TypedValue{Value: &monitoring_pb.TypedValue_DoubleValue{5.5}},
+			}},
+		},
+		{
+			Resource: &monitoredres_pb.MonitoredResource{
+				Type:   "resource1",
+				Labels: map[string]string{"resource_a": "resource1_a"},
+			},
+			Metric: &metric_pb.Metric{
+				Type:   "external.googleapis.com/prometheus/metric1",
+				Labels: map[string]string{},
+			},
+			MetricKind: metric_pb.MetricDescriptor_CUMULATIVE,
+			ValueType:  metric_pb.MetricDescriptor_DOUBLE,
+			Points: []*monitoring_pb.Point{{
+				Interval: &monitoring_pb.TimeInterval{
+					StartTime: &timestamp_pb.Timestamp{Seconds: 1, Nanos: 5e8},
+					EndTime:   &timestamp_pb.Timestamp{Seconds: 3},
+				},
+				Value: &monitoring_pb.TypedValue{Value: &monitoring_pb.TypedValue_DoubleValue{8}},
+			}},
+		},
+	}
+	ctx := context.Background()
+
+	aggr, _ := NewCounterAggregator(log.NewNopLogger(), new(CounterAggregatorConfig))
+	gaugeAggr, _ := NewGaugeAggregator(log.NewNopLogger(), new(GaugeAggregatorConfig))
+	series := NewSeriesCache(nil, "", nil, nil, targets, metadata, resourceMaps, "", nil, nil, "", false, false, aggr, gaugeAggr, nil, nil, nil, 0, 0, nil, "", nil, nil, nil, "")
+	series.Set(ctx, 1, labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric1_total"), 0)
+	series.Set(ctx, 2, labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric1_created"), 0)
+
+	b := &SampleBuilder{series: series}
+
+	var result []*monitoring_pb.TimeSeries
+	for len(input) > 0 {
+		var s *monitoring_pb.TimeSeries
+		var err error
+		s, _, input, err = b.Next(ctx, input)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		result = append(result, s)
+	}
+	if diff := cmp.Diff(expected, result); len(diff) > 0 {
+		t.Errorf("unexpected result:\n%v", diff)
+	}
+}
+
+func TestSampleBuilderDeltaCounter(t *testing.T) {
+	resourceMaps := []ResourceMap{
+		{
+			Type: "resource1",
+			LabelMap: map[string]labelTranslation{
+				"__resource_a": constValue("resource_a"),
+			},
+		},
+	}
+	targets := targetMap{
+		"job1/instance1": &targets.Target{
+			Labels:           promlabels.FromStrings("job", "job1", "instance", "instance1"),
+			DiscoveredLabels: promlabels.FromStrings("__resource_a", "resource1_a"),
+		},
+	}
+	metadata := metadataMap{
+		"job1/instance1/metric1": &metadata.Entry{Metric: "metric1", MetricType: textparse.MetricTypeCounter, ValueType: metric_pb.MetricDescriptor_DOUBLE},
+	}
+	input := []tsdb.RefSample{
+		{Ref: 1, T: 1000, V: 5.5}, // First sample sets the reset baseline, skipped.
+		{Ref: 1, T: 2000, V: 8},
+		{Ref: 1, T: 3000, V: 2}, // Reset.
+		{Ref: 1, T: 4000, V: 5},
+	}
+	deltaSeries := func(start, end *timestamp_pb.Timestamp, v float64) *monitoring_pb.TimeSeries {
+		return &monitoring_pb.TimeSeries{
+			Resource: &monitoredres_pb.MonitoredResource{
+				Type:   "resource1",
+				Labels: map[string]string{"resource_a": "resource1_a"},
+			},
+			Metric: &metric_pb.Metric{
+				Type:   "external.googleapis.com/prometheus/metric1",
+				Labels: map[string]string{},
+			},
+			MetricKind: metric_pb.MetricDescriptor_DELTA,
+			ValueType:  metric_pb.MetricDescriptor_DOUBLE,
+			Points: []*monitoring_pb.Point{{
+				Interval: &monitoring_pb.TimeInterval{StartTime: start, EndTime: end},
+				Value:    &monitoring_pb.TypedValue{Value: &monitoring_pb.TypedValue_DoubleValue{v}},
+			}},
+		}
+	}
+	// Each point carries the increase since the previous sample over a
+	// non-overlapping interval. The point after the reset covers the range
+	// since the reset itself.
+	expected := []*monitoring_pb.TimeSeries{
+		nil,
+		deltaSeries(&timestamp_pb.Timestamp{Seconds: 1}, &timestamp_pb.Timestamp{Seconds: 2}, 2.5),
+		deltaSeries(&timestamp_pb.Timestamp{Seconds: 2, Nanos: 999e6}, &timestamp_pb.Timestamp{Seconds: 3}, 2),
+		deltaSeries(&timestamp_pb.Timestamp{Seconds: 3}, &timestamp_pb.Timestamp{Seconds: 4}, 3),
+	}
+	ctx := context.Background()
+
+	aggr, _ := NewCounterAggregator(log.NewNopLogger(), new(CounterAggregatorConfig))
+	gaugeAggr, _ := NewGaugeAggregator(log.NewNopLogger(), new(GaugeAggregatorConfig))
+	series := NewSeriesCache(nil, "", nil, nil, targets, metadata, resourceMaps, "", nil, nil, "", false, false, aggr, gaugeAggr, nil,
+		&DeltaConfig{Metrics: map[string]bool{"metric1": true}}, nil, 0, 0, nil, "", nil, nil, nil, "")
+	series.Set(ctx, 1, labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric1"), 0)
+
+	b := &SampleBuilder{series: series}
+
+	var result []*monitoring_pb.TimeSeries
+	for len(input) > 0 {
+		var s *monitoring_pb.TimeSeries
+		var err error
+		s, _, input, err = b.Next(ctx, input)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		result = append(result, s)
+	}
+	if diff := cmp.Diff(expected, result); len(diff) > 0 {
+		t.Errorf("unexpected result:\n%v", diff)
+	}
+}
+
+func TestSampleBuilderValueTransform(t *testing.T) {
+	resourceMaps := []ResourceMap{
+		{
+			Type: "resource1",
+			LabelMap: map[string]labelTranslation{
+				"__resource_a": constValue("resource_a"),
+			},
+		},
+	}
+	targets := targetMap{
+		"job1/instance1": &targets.Target{
+			Labels:           promlabels.FromStrings("job", "job1", "instance", "instance1"),
+			DiscoveredLabels: promlabels.FromStrings("__resource_a", "resource1_a"),
+		},
+	}
+	metadata := metadataMap{
+		"job1/instance1/metric1": &metadata.Entry{Metric: "metric1", MetricType: textparse.MetricTypeGauge, ValueType: metric_pb.MetricDescriptor_DOUBLE},
+	}
+	// The metric reports milliseconds; scale to seconds and clamp negatives.
+	min := 0.0
+	input := []tsdb.RefSample{
+		{Ref: 1, T: 1000, V: 1500},
+		{Ref: 1, T: 2000, V: -250},
+	}
+	ctx := context.Background()
+
+	aggr, _ := NewCounterAggregator(log.NewNopLogger(), new(CounterAggregatorConfig))
+	gaugeAggr, _ := NewGaugeAggregator(log.NewNopLogger(), new(GaugeAggregatorConfig))
+	series := NewSeriesCache(nil, "", nil, nil, targets, metadata, resourceMaps, "", nil, nil, "", false, false, aggr, gaugeAggr, nil, nil, nil, 0, 0, nil, "", nil, nil, nil, "")
+	series.Set(ctx, 1, labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric1"), 0)
+
+	b := &SampleBuilder{series: series, valueTransforms: map[string]*ValueTransform{
+		"metric1": {Factor: 0.001, ClampMin: &min},
+	}}
+
+	var result []*monitoring_pb.TimeSeries
+	for len(input) > 0 {
+		var s *monitoring_pb.TimeSeries
+		var err error
+		s, _, input, err = b.Next(ctx, input)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		result = append(result, s)
+	}
+	if len(result) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(result))
+	}
+	expected := []float64{1.5, 0}
+	for i, want := range expected {
+		got := result[i].Points[0].Value.GetDoubleValue()
+		if got != want {
+			t.Errorf("unexpected value for sample %d: want %v, got %v", i, want, got)
+		}
+	}
+}
+
+func TestSampleBuilderGaugeInterval(t *testing.T) {
+	resourceMaps := []ResourceMap{
+		{
+			Type: "resource1",
+			LabelMap: map[string]labelTranslation{
+				"__resource_a": constValue("resource_a"),
+			},
+		},
+	}
+	targets := targetMap{
+		"job1/instance1": &targets.Target{
+			Labels:           promlabels.FromStrings("job", "job1", "instance", "instance1"),
+			DiscoveredLabels: promlabels.FromStrings("__resource_a", "resource1_a"),
+		},
+	}
+	metadata := metadataMap{
+		"job1/instance1/metric1": &metadata.Entry{Metric: "metric1", MetricType: textparse.MetricTypeGauge, ValueType: metric_pb.MetricDescriptor_DOUBLE},
+	}
+	// The series is scraped every 4 seconds but configured with a 10 second
+	// minimum export interval, so only every third sample produces a point.
+	input := []tsdb.RefSample{
+		{Ref: 1, T: 1000, V: 4},  // First sample, exported as-is.
+		{Ref: 1, T: 5000, V: 8},  // Swallowed.
+		{Ref: 1, T: 9000, V: 2},  // Swallowed.
+		{Ref: 1, T: 13000, V: 5}, // Mean of the window emitted.
+		{Ref: 1, T: 17000, V: 9}, // Swallowed, starts the next window.
+	}
+	ctx := context.Background()
+
+	aggr, _ := NewCounterAggregator(log.NewNopLogger(), new(CounterAggregatorConfig))
+	gaugeAggr, _ := NewGaugeAggregator(log.NewNopLogger(), new(GaugeAggregatorConfig))
+	series := NewSeriesCache(nil, "", nil, nil, targets, metadata, resourceMaps, "", nil, nil, "", false, false, aggr, gaugeAggr, nil, nil, nil, 0, 0, nil, "", nil, nil, nil, "")
+	series.Set(ctx, 1, labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric1"), 0)
+
+	b := &SampleBuilder{series: series, gaugeIntervals: map[string]*GaugeInterval{
+		"metric1": {MinInterval: 10 * time.Second, Op: GaugeIntervalMean},
+	}}
+
+	var result []*monitoring_pb.TimeSeries
+	for len(input) > 0 {
+		var s *monitoring_pb.TimeSeries
+		var err error
+		s, _, input, err = b.Next(ctx, input)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		result = append(result, s)
+	}
+	if len(result) != 5 {
+		t.Fatalf("expected 5 results, got %d", len(result))
+	}
+	if result[0] == nil || result[0].Points[0].Value.GetDoubleValue() != 4 {
+		t.Errorf("expected first sample to be exported, got %v", result[0])
+	}
+	for _, i := range []int{1, 2, 4} {
+		if result[i] != nil {
+			t.Errorf("expected sample %d to be swallowed, got %v", i, result[i])
+		}
+	}
+	// Mean over the samples at T=5000, 9000 and 13000.
+	if result[3] == nil || result[3].Points[0].Value.GetDoubleValue() != 5 {
+		t.Errorf("expected window mean to be emitted, got %v", result[3])
+	}
+	if result[3] != nil && result[3].Points[0].Interval.EndTime.Seconds != 13 {
+		t.Errorf("unexpected point interval %v", result[3].Points[0].Interval)
+	}
+}
+
+// histogramLayoutFixture returns a series cache with a histogram whose bucket
+// layout changes from le={1, +Inf} (refs 3, 4) to le={2, +Inf} (refs 5, 4).
+func histogramLayoutFixture(ctx context.Context) *SeriesCache {
+	resourceMaps := []ResourceMap{
+		{
+			Type: "resource1",
+			LabelMap: map[string]labelTranslation{
+				"__resource_a": constValue("resource_a"),
+			},
+		},
+	}
+	targets := targetMap{
+		"job1/instance1": &targets.Target{
+			Labels:           promlabels.FromStrings("job", "job1", "instance", "instance1"),
+			DiscoveredLabels: promlabels.FromStrings("__resource_a", "resource1_a"),
+		},
+	}
+	metadata := metadataMap{
+		"job1/instance1/metric1": &metadata.Entry{Metric: "metric1", MetricType: textparse.MetricTypeHistogram, ValueType: metric_pb.MetricDescriptor_DOUBLE},
+	}
+	aggr, _ := NewCounterAggregator(log.NewNopLogger(), new(CounterAggregatorConfig))
+	gaugeAggr, _ := NewGaugeAggregator(log.NewNopLogger(), new(GaugeAggregatorConfig))
+	series := NewSeriesCache(nil, "", nil, nil, targets, metadata, resourceMaps, "", nil, nil, "", false, false, aggr, gaugeAggr, nil, nil, nil, 0, 0, nil, "", nil, nil, nil, "")
+	series.Set(ctx, 1, labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric1_sum"), 0)
+	series.Set(ctx, 2, labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric1_count"), 0)
+	series.Set(ctx, 3, labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric1_bucket", "le", "1"), 0)
+	series.Set(ctx, 4, labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric1_bucket", "le", "+Inf"), 0)
+	series.Set(ctx, 5, labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric1_bucket", "le", "2"), 0)
+	return series
+}
+
+func TestSampleBuilderBucketLayoutChange(t *testing.T) {
+	ctx := context.Background()
+	b := &SampleBuilder{series: histogramLayoutFixture(ctx)}
+
+	input := []tsdb.RefSample{
+		// First sample set seeds the reset handling.
+		{Ref: 1, T: 1000, V: 1}, {Ref: 2, T: 1000, V: 1}, {Ref: 3, T: 1000, V: 1}, {Ref: 4, T: 1000, V: 1},
+		// Second set is emitted with the original layout.
+		{Ref: 1, T: 2000, V: 3}, {Ref: 2, T: 2000, V: 2}, {Ref: 3, T: 2000, V: 2}, {Ref: 4, T: 2000, V: 2},
+		// The bucket layout changes: the new series seeds first.
+		{Ref: 1, T: 3000, V: 6}, {Ref: 2, T: 3000, V: 3}, {Ref: 5, T: 3000, V: 3}, {Ref: 4, T: 3000, V: 3},
+		// The complete new layout is detected and restarts the cumulative.
+		{Ref: 1, T: 4000, V: 8}, {Ref: 2, T: 4000, V: 4}, {Ref: 5, T: 4000, V: 4}, {Ref: 4, T: 4000, V: 4},
+		// The restarted interval seeds again.
+		{Ref: 1, T: 5000, V: 9}, {Ref: 2, T: 5000, V: 5}, {Ref: 5, T: 5000, V: 5}, {Ref: 4, T: 5000, V: 5},
+		// And finally emits with the new layout and reset time.
+		{Ref: 1, T: 6000, V: 11}, {Ref: 2, T: 6000, V: 6}, {Ref: 5, T: 6000, V: 6}, {Ref: 4, T: 6000, V: 6},
+	}
+	var result []*monitoring_pb.TimeSeries
+	for len(input) > 0 {
+		var s *monitoring_pb.TimeSeries
+		var err error
+		s, _, input, err = b.Next(ctx, input)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		result = append(result, s)
+	}
+	if len(result) != 6 {
+		t.Fatalf("expected 6 results, got %d", len(result))
+	}
+	for _, i := range []int{0, 2, 3, 4} {
+		if result[i] != nil {
+			t.Errorf("expected sample %d to be skipped, got %v", i, result[i])
+		}
+	}
+	if result[1] == nil {
+		t.Fatal("expected second sample set to be emitted")
+	}
+	d := result[1].Points[0].Value.GetDistributionValue()
+	if bounds := d.BucketOptions.GetExplicitBuckets().Bounds; len(bounds) != 1 || bounds[0] != 1 {
+		t.Errorf("unexpected bounds %v", bounds)
+	}
+	if result[5] == nil {
+		t.Fatal("expected sample set after the layout change to be emitted")
+	}
+	d = result[5].Points[0].Value.GetDistributionValue()
+	if bounds := d.BucketOptions.GetExplicitBuckets().Bounds; len(bounds) != 1 || bounds[0] != 2 {
+		t.Errorf("unexpected bounds %v", bounds)
+	}
+	if d.Count != 1 {
+		t.Errorf("unexpected count %d", d.Count)
+	}
+	if start := result[5].Points[0].Interval.StartTime.Seconds; start != 5 {
+		t.Errorf("expected new reset time at the restart, got start time %d", start)
+	}
+}
+
+func TestSampleBuilderRebucketOnChange(t *testing.T) {
+	ctx := context.Background()
+	b := &SampleBuilder{
+		series:        histogramLayoutFixture(ctx),
+		bucketFilters: map[string]*BucketFilter{"metric1": {RebucketOnChange: true}},
+	}
+
+	input := []tsdb.RefSample{
+		// First sample set seeds the reset handling.
+		{Ref: 1, T: 1000, V: 1}, {Ref: 2, T: 1000, V: 1}, {Ref: 3, T: 1000, V: 1}, {Ref: 4, T: 1000, V: 1},
+		// Second set is emitted and records the original layout.
+		{Ref: 1, T: 2000, V: 3}, {Ref: 2, T: 2000, V: 2}, {Ref: 3, T: 2000, V: 2}, {Ref: 4, T: 2000, V: 2},
+		// The bucket layout changes: the new series seeds first.
+		{Ref: 1, T: 3000, V: 6}, {Ref: 2, T: 3000, V: 3}, {Ref: 5, T: 3000, V: 3}, {Ref: 4, T: 3000, V: 3},
+		// The new layout is converted back to the original one, the
+		// cumulative interval continues uninterrupted.
+		{Ref: 1, T: 4000, V: 8}, {Ref: 2, T: 4000, V: 5}, {Ref: 5, T: 4000, V: 5}, {Ref: 4, T: 4000, V: 5},
+	}
+	var result []*monitoring_pb.TimeSeries
+	for len(input) > 0 {
+		var s *monitoring_pb.TimeSeries
+		var err error
+		s, _, input, err = b.Next(ctx, input)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		result = append(result, s)
+	}
+	if len(result) != 4 || result[0] != nil || result[2] != nil {
+		t.Fatalf("expected the first and third sample sets to be skipped, got %v", result)
+	}
+	if result[3] == nil {
+		t.Fatal("expected re-bucketed sample to be emitted")
+	}
+	d := result[3].Points[0].Value.GetDistributionValue()
+	if bounds := d.BucketOptions.GetExplicitBuckets().Bounds; len(bounds) != 1 || bounds[0] != 1 {
+		t.Errorf("expected original bounds to be kept, got %v", bounds)
+	}
+	// No count can be attributed to the le=1 bucket of the original layout.
+	if len(d.BucketCounts) != 2 || d.BucketCounts[0] != 0 || d.BucketCounts[1] != 4 {
+		t.Errorf("unexpected bucket counts %v", d.BucketCounts)
+	}
+	if start := result[3].Points[0].Interval.StartTime.Seconds; start != 1 {
+		t.Errorf("expected uninterrupted cumulative interval, got start time %d", start)
+	}
+}
+
+func TestSampleBuilderHAMerge(t *testing.T) {
+	resourceMaps := []ResourceMap{
+		{
+			Type: "resource1",
+			LabelMap: map[string]labelTranslation{
+				"__resource_a": constValue("resource_a"),
+			},
+		},
+	}
+	targets := targetMap{
+		"job1/instance1": &targets.Target{
+			Labels:           promlabels.FromStrings("job", "job1", "instance", "instance1"),
+			DiscoveredLabels: promlabels.FromStrings("__resource_a", "resource1_a"),
+		},
+	}
+	metadata := metadataMap{
+		"job1/instance1/metric1": &metadata.Entry{Metric: "metric1", MetricType: textparse.MetricTypeCounter, ValueType: metric_pb.MetricDescriptor_DOUBLE},
+		"job1/instance1/metric2": &metadata.Entry{Metric: "metric2", MetricType: textparse.MetricTypeGauge, ValueType: metric_pb.MetricDescriptor_DOUBLE},
+	}
+	ctx := context.Background()
+
+	aggr, _ := NewCounterAggregator(log.NewNopLogger(), new(CounterAggregatorConfig))
+	gaugeAggr, _ := NewGaugeAggregator(log.NewNopLogger(), new(GaugeAggregatorConfig))
+	series := NewSeriesCache(nil, "", nil, nil, targets, metadata, resourceMaps, "", nil, nil, "", false, false, aggr, gaugeAggr, nil, nil, nil, 0, 0, nil, "", nil, nil, nil, "")
+	// Two redundant targets produce the same series after mapping: the label
+	// sets of refs 1/2 and 3/4 are identical, so their samples collide on the
+	// same output series.
+	series.Set(ctx, 1, labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric1"), 0)
+	series.Set(ctx, 2, labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric1"), 0)
+	series.Set(ctx, 3, labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric2"), 0)
+	series.Set(ctx, 4, labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric2"), 0)
+
+	b := NewSampleBuilder(series, nil, 0, nil, nil, nil, map[string]HAMergeStrategy{
+		"metric1": HAMergeDefault, // Counter, resolves to max.
+		"metric2": HAMergeLast,
+	}, 0)
+
+	input := []tsdb.RefSample{
+		// Both counter replicas seed their reset tracking.
+		{Ref: 1, T: 1000, V: 5},
+		{Ref: 2, T: 1100, V: 7},
+		// The first replica exports normally.
+		{Ref: 1, T: 2000, V: 8},
+		// The second replica overlaps and carries the larger adjusted value,
+		// so a merged point is emitted just after the previous one.
+		{Ref: 2, T: 2100, V: 12},
+		// The gauge exports normally.
+		{Ref: 3, T: 3000, V: 5},
+		// The overlapping gauge replica wins through the last strategy.
+		{Ref: 4, T: 2900, V: 6},
+	}
+	var result []*monitoring_pb.TimeSeries
+	for len(input) > 0 {
+		var s *monitoring_pb.TimeSeries
+		var err error
+		s, _, input, err = b.Next(ctx, input)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		result = append(result, s)
+	}
+	if len(result) != 6 || result[0] != nil || result[1] != nil {
+		t.Fatalf("expected the seeding samples to be skipped, got %v", result)
+	}
+	if result[2] == nil || result[2].Points[0].Value.GetDoubleValue() != 3 {
+		t.Errorf("unexpected first counter export %v", result[2])
+	}
+	if result[3] == nil || result[3].Points[0].Value.GetDoubleValue() != 5 {
+		t.Fatalf("expected merged counter point, got %v", result[3])
+	}
+	iv := result[3].Points[0].Interval
+	if iv.StartTime.Seconds != 1 || iv.EndTime.Nanos != int32(time.Millisecond) {
+		t.Errorf("expected merged point just after the previous one, got %v", iv)
+	}
+	if result[4] == nil || result[4].Points[0].Value.GetDoubleValue() != 5 {
+		t.Errorf("unexpected gauge export %v", result[4])
+	}
+	if result[5] == nil || result[5].Points[0].Value.GetDoubleValue() != 6 {
+		t.Fatalf("expected merged gauge point, got %v", result[5])
+	}
+}
+
+func TestSampleBuilderMaxSampleAge(t *testing.T) {
+	resourceMaps := []ResourceMap{
+		{
+			Type: "resource1",
+			LabelMap: map[string]labelTranslation{
+				"__resource_a": constValue("resource_a"),
+			},
+		},
+	}
+	targets := targetMap{
+		"job1/instance1": &targets.Target{
+			Labels:           promlabels.FromStrings("job", "job1", "instance", "instance1"),
+			DiscoveredLabels: promlabels.FromStrings("__resource_a", "resource1_a"),
+		},
+	}
+	metadata := metadataMap{
+		"job1/instance1/metric1": &metadata.Entry{Metric: "metric1", MetricType: textparse.MetricTypeGauge, ValueType: metric_pb.MetricDescriptor_DOUBLE},
+	}
+	now := time.Now().Unix() * 1000
+	input := []tsdb.RefSample{
+		{Ref: 1, T: 2000, V: 1.5}, // Far beyond the age limit, dropped.
+		{Ref: 1, T: now, V: 2.5},
+	}
+	ctx := context.Background()
+
+	aggr, _ := NewCounterAggregator(log.NewNopLogger(), new(CounterAggregatorConfig))
+	gaugeAggr, _ := NewGaugeAggregator(log.NewNopLogger(), new(GaugeAggregatorConfig))
+	series := NewSeriesCache(nil, "", nil, nil, targets, metadata, resourceMaps, "", nil, nil, "", false, false, aggr, gaugeAggr, nil, nil, nil, 0, 0, nil, "", nil, nil, nil, "")
+	series.Set(ctx, 1, labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric1"), 0)
+
+	b := &SampleBuilder{series: series, maxSampleAge: time.Hour}
+
+	var result []*monitoring_pb.TimeSeries
+	for len(input) > 0 {
+		var s *monitoring_pb.TimeSeries
+		var err error
+		s, _, input, err = b.Next(ctx, input)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		result = append(result, s)
+	}
+	if len(result) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(result))
+	}
+	if result[0] != nil {
+		t.Errorf("expected old sample to be dropped, got %v", result[0])
+	}
+	if result[1] == nil || result[1].Points[0].Value.GetDoubleValue() != 2.5 {
+		t.Errorf("expected recent sample to be converted, got %v", result[1])
+	}
+}
+
+func BenchmarkSampleBuilder(b *testing.B) {
+	resourceMaps := []ResourceMap{
+		{
+			Type:     "resource1",
+			LabelMap: map[string]labelTranslation{"__resource_a": constValue("resource_a")},
+		},
+	}
+	targets := targetMap{
+		"job1/instance1": &targets.Target{
+			Labels:           promlabels.FromStrings("job", "job1", "instance", "instance1"),
+			DiscoveredLabels: promlabels.FromStrings("__resource_a", "resource1_a"),
+		},
+	}
+	metadata := metadataMap{
+		"job1/instance1/metric1": &metadata.Entry{Metric: "metric1", MetricType: textparse.MetricTypeGauge, ValueType: metric_pb.MetricDescriptor_DOUBLE},
+	}
+	logger := log.NewNopLogger()
+	aggr, _ := NewCounterAggregator(logger, new(CounterAggregatorConfig))
+	gaugeAggr, _ := NewGaugeAggregator(logger, new(GaugeAggregatorConfig))
+	series := NewSeriesCache(nil, "", nil, nil, targets, metadata, resourceMaps, "", nil, nil, "", false, false, aggr, gaugeAggr, nil, nil, nil, 0, 0, nil, "", nil, nil, nil, "")
+	sb := &SampleBuilder{series: series}
+	ctx := context.Background()
+
+	const numSeries = 100
+	samples := make([]tsdb.RefSample, 0, numSeries)
+	for i := 0; i < numSeries; i++ {
+		series.Set(ctx, uint64(i), labels.FromStrings(
+			"job", "job1", "instance", "instance1", "__name__", "metric1", "a", strconv.Itoa(i)), 0)
+		samples = append(samples, tsdb.RefSample{Ref: uint64(i), T: 1000, V: float64(i)})
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		in := samples
+		for len(in) > 0 {
+			var err error
+			_, _, in, err = sb.Next(ctx, in)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestSampleBuilderMinCumulativeInterval(t *testing.T) {
+	resourceMaps := []ResourceMap{
+		{
+			Type: "resource1",
+			LabelMap: map[string]labelTranslation{
+				"__resource_a": constValue("resource_a"),
+			},
+		},
+	}
+	targets := targetMap{
+		"job1/instance1": &targets.Target{
+			Labels:           promlabels.FromStrings("job", "job1", "instance", "instance1"),
+			DiscoveredLabels: promlabels.FromStrings("__resource_a", "resource1_a"),
+		},
+	}
+	metadata := metadataMap{
+		"job1/instance1/metric1": &metadata.Entry{Metric: "metric1", MetricType: textparse.MetricTypeCounter, ValueType: metric_pb.MetricDescriptor_DOUBLE},
+		"job1/instance1/metric2": &metadata.Entry{Metric: "metric2", MetricType: textparse.MetricTypeGauge, ValueType: metric_pb.MetricDescriptor_DOUBLE},
+	}
+	ctx := context.Background()
+
+	aggr, _ := NewCounterAggregator(log.NewNopLogger(), new(CounterAggregatorConfig))
+	gaugeAggr, _ := NewGaugeAggregator(log.NewNopLogger(), new(GaugeAggregatorConfig))
+	series := NewSeriesCache(nil, "", nil, nil, targets, metadata, resourceMaps, "", nil, nil, "", false, false, aggr, gaugeAggr, nil, nil, nil, 0, 0, nil, "", nil, nil, nil, "")
+	series.Set(ctx, 1, labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric1"), 0)
+	series.Set(ctx, 2, labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric2"), 0)
+
+	b := NewSampleBuilder(series, nil, 0, nil, nil, nil, nil, 5*time.Second)
+
+	input := []tsdb.RefSample{
+		// The counter seeds its reset tracking.
+		{Ref: 1, T: 1000, V: 5},
+		// Too narrow an interval since the reset, coalesced.
+		{Ref: 1, T: 2000, V: 8},
+		// Wide enough; covers the coalesced increment as well.
+		{Ref: 1, T: 7000, V: 9},
+		// Gauges are not subject to the interval width limit.
+		{Ref: 2, T: 2000, V: 4},
+	}
+	var result []*monitoring_pb.TimeSeries
+	for len(input) > 0 {
+		var s *monitoring_pb.TimeSeries
+		var err error
+		s, _, input, err = b.Next(ctx, input)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		result = append(result, s)
+	}
+	if len(result) != 4 || result[0] != nil {
+		t.Fatalf("expected the seeding sample to be skipped, got %v", result)
+	}
+	if result[1] != nil {
+		t.Fatalf("expected too-narrow counter point to be coalesced, got %v", result[1])
+	}
+	if result[2] == nil || result[2].Points[0].Value.GetDoubleValue() != 4 {
+		t.Fatalf("expected counter export to cover the coalesced increment, got %v", result[2])
+	}
+	iv := result[2].Points[0].Interval
+	if iv.StartTime.Seconds != 1 || iv.EndTime.Seconds != 7 {
+		t.Errorf("unexpected counter interval %v", iv)
+	}
+	if result[3] == nil || result[3].Points[0].Value.GetDoubleValue() != 4 {
+		t.Errorf("expected gauge to be exported unfiltered, got %v", result[3])
+	}
+}
+
+func TestSampleBuilderOpenMetricsTypes(t *testing.T) {
+	resourceMaps := []ResourceMap{
+		{
+			Type: "resource1",
+			LabelMap: map[string]labelTranslation{
+				"__resource_a": constValue("resource_a"),
+			},
+		},
+	}
+	targets := targetMap{
+		"job1/instance1": &targets.Target{
+			Labels:           promlabels.FromStrings("job", "job1", "instance", "instance1"),
+			DiscoveredLabels: promlabels.FromStrings("__resource_a", "resource1_a"),
+		},
+	}
+	metadata := metadataMap{
+		"job1/instance1/metric_states": &metadata.Entry{Metric: "metric_states", MetricType: textparse.MetricTypeStateset},
+		"job1/instance1/metric_info":   &metadata.Entry{Metric: "metric_info", MetricType: textparse.MetricTypeInfo},
+		"job1/instance1/metric_hist":   &metadata.Entry{Metric: "metric_hist", MetricType: textparse.MetricTypeGaugeHistogram},
+	}
+	ctx := context.Background()
+
+	aggr, _ := NewCounterAggregator(log.NewNopLogger(), new(CounterAggregatorConfig))
+	gaugeAggr, _ := NewGaugeAggregator(log.NewNopLogger(), new(GaugeAggregatorConfig))
+	series := NewSeriesCache(nil, "", nil, nil, targets, metadata, resourceMaps, "", nil, nil, "", false, false, aggr, gaugeAggr, nil, nil, nil, 0, 0, nil, "", nil, nil, nil, "")
+	series.Set(ctx, 1, labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric_states", "state", "a"), 0)
+	series.Set(ctx, 2, labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric_info", "version", "v1"), 0)
+	series.Set(ctx, 3, labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric_hist_sum"), 0)
+	series.Set(ctx, 4, labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric_hist_count"), 0)
+	series.Set(ctx, 5, labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric_hist_bucket", "le", "1"), 0)
+	series.Set(ctx, 6, labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric_hist_bucket", "le", "+Inf"), 0)
+
+	b := NewSampleBuilder(series, nil, 0, nil, nil, nil, nil, 0)
+
+	input := []tsdb.RefSample{
+		{Ref: 1, T: 1000, V: 1},
+		{Ref: 2, T: 1000, V: 1},
+		{Ref: 3, T: 2000, V: 3},
+		{Ref: 4, T: 2000, V: 4},
+		{Ref: 5, T: 2000, V: 3},
+		{Ref: 6, T: 2000, V: 4},
+		{Ref: 1, T: 3000, V: 0},
+	}
+	var result []*monitoring_pb.TimeSeries
+	for len(input) > 0 {
+		var s *monitoring_pb.TimeSeries
+		var err error
+		s, _, input, err = b.Next(ctx, input)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		result = append(result, s)
+	}
+	if len(result) != 4 {
+		t.Fatalf("expected 4 points, got %v", result)
+	}
+	// Stateset series are boolean gauges telling whether the state is active.
+	states := result[0]
+	if states.MetricKind != metric_pb.MetricDescriptor_GAUGE || states.ValueType != metric_pb.MetricDescriptor_BOOL {
+		t.Errorf("unexpected stateset series type %s/%s", states.MetricKind, states.ValueType)
+	}
+	if !states.Points[0].Value.GetBoolValue() {
+		t.Errorf("expected active state, got %v", states.Points[0])
+	}
+	if result[3].Points[0].Value.GetBoolValue() {
+		t.Errorf("expected inactive state, got %v", result[3].Points[0])
+	}
+	// Info metrics carry their payload in the labels with a constant value 1.
+	info := result[1]
+	if info.MetricKind != metric_pb.MetricDescriptor_GAUGE || info.ValueType != metric_pb.MetricDescriptor_INT64 {
+		t.Errorf("unexpected info series type %s/%s", info.MetricKind, info.ValueType)
+	}
+	if info.Points[0].Value.GetInt64Value() != 1 || info.Metric.Labels["version"] != "v1" {
+		t.Errorf("unexpected info point %v", info)
+	}
+	// Gauge histograms become distribution-valued gauge snapshots.
+	hist := result[2]
+	if hist.MetricKind != metric_pb.MetricDescriptor_GAUGE || hist.ValueType != metric_pb.MetricDescriptor_DISTRIBUTION {
+		t.Errorf("unexpected gauge histogram series type %s/%s", hist.MetricKind, hist.ValueType)
+	}
+	if hist.Points[0].Interval.StartTime != nil {
+		t.Errorf("unexpected interval start %v", hist.Points[0].Interval)
+	}
+	d := hist.Points[0].Value.GetDistributionValue()
+	if d.Count != 4 || d.Mean != 0.75 {
+		t.Errorf("unexpected distribution %v", d)
+	}
+	if want := []int64{3, 1}; !cmp.Equal(d.BucketCounts, want) {
+		t.Errorf("expected bucket counts %v, got %v", want, d.BucketCounts)
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	timestamp_pb "github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/oauth2/google"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+const bigQueryScope = "https://www.googleapis.com/auth/bigquery.insertdata"
+
+var bigQueryRowErrorsTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "bigquery_row_errors_total",
+		Help:      "Total number of rows BigQuery rejected on streaming insert.",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(bigQueryRowErrorsTotal)
+}
+
+// BigQueryClientConfig configures a BigQueryClient.
+type BigQueryClientConfig struct {
+	Logger  log.Logger
+	Project string
+	Dataset string
+	Table   string
+	Timeout time.Duration
+	// DisableAuth disables OAuth authentication, for use against emulators.
+	DisableAuth bool
+	// Endpoint overrides the BigQuery API base URL, for use in tests.
+	Endpoint string
+}
+
+// BigQueryClient streams converted points into a BigQuery table using the
+// streaming insert API, as an alternative long-term analytics sink next to
+// the Monitoring API. Each point becomes one row holding the metric type,
+// the metric and resource labels as JSON, the value, and the point interval.
+// Implements StorageClient.
+type BigQueryClient struct {
+	logger  log.Logger
+	cfg     *BigQueryClientConfig
+	url     string
+	timeout time.Duration
+	client  *http.Client
+}
+
+// NewBigQueryClient returns a client streaming into the configured table.
+func NewBigQueryClient(cfg *BigQueryClientConfig) *BigQueryClient {
+	logger := cfg.Logger
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "https://bigquery.googleapis.com"
+	}
+	return &BigQueryClient{
+		logger:  logger,
+		cfg:     cfg,
+		timeout: cfg.Timeout,
+		url: fmt.Sprintf("%s/bigquery/v2/projects/%s/datasets/%s/tables/%s/insertAll",
+			endpoint, cfg.Project, cfg.Dataset, cfg.Table),
+	}
+}
+
+// bigQueryRow is the JSON representation of a single inserted row. Label
+// maps are rendered as JSON strings so the table schema stays fixed
+// regardless of label cardinality.
+type bigQueryRow struct {
+	MetricType        string   `json:"metric_type"`
+	MetricKind        string   `json:"metric_kind"`
+	ValueType         string   `json:"value_type"`
+	MetricLabels      string   `json:"metric_labels"`
+	ResourceType      string   `json:"resource_type"`
+	ResourceLabels    string   `json:"resource_labels"`
+	Value             *float64 `json:"value,omitempty"`
+	DistributionValue string   `json:"distribution_value,omitempty"`
+	IntervalStart     string   `json:"interval_start,omitempty"`
+	IntervalEnd       string   `json:"interval_end"`
+}
+
+type bigQueryInsertRequest struct {
+	Kind string              `json:"kind"`
+	Rows []bigQueryInsertRow `json:"rows"`
+}
+
+type bigQueryInsertRow struct {
+	JSON *bigQueryRow `json:"json"`
+}
+
+type bigQueryInsertResponse struct {
+	InsertErrors []struct {
+		Index  int `json:"index"`
+		Errors []struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	} `json:"insertErrors"`
+}
+
+// Store implements StorageClient.
+func (c *BigQueryClient) Store(req *monitoring_pb.CreateTimeSeriesRequest) error {
+	if c.client == nil {
+		if err := c.initClient(); err != nil {
+			return err
+		}
+	}
+	insert := bigQueryInsertRequest{Kind: "bigquery#tableDataInsertAllRequest"}
+	for _, ts := range req.TimeSeries {
+		metricLabels, err := json.Marshal(ts.Metric.GetLabels())
+		if err != nil {
+			return errors.Wrap(err, "marshal metric labels")
+		}
+		resourceLabels, err := json.Marshal(ts.Resource.GetLabels())
+		if err != nil {
+			return errors.Wrap(err, "marshal resource labels")
+		}
+		for _, p := range ts.Points {
+			row := &bigQueryRow{
+				MetricType:     ts.Metric.GetType(),
+				MetricKind:     ts.MetricKind.String(),
+				ValueType:      ts.ValueType.String(),
+				MetricLabels:   string(metricLabels),
+				ResourceType:   ts.Resource.GetType(),
+				ResourceLabels: string(resourceLabels),
+				IntervalStart:  bigQueryTime(p.Interval.GetStartTime()),
+				IntervalEnd:    bigQueryTime(p.Interval.GetEndTime()),
+			}
+			switch v := p.Value.Value.(type) {
+			case *monitoring_pb.TypedValue_DoubleValue:
+				f := v.DoubleValue
+				row.Value = &f
+			case *monitoring_pb.TypedValue_Int64Value:
+				f := float64(v.Int64Value)
+				row.Value = &f
+			case *monitoring_pb.TypedValue_DistributionValue:
+				dist, err := json.Marshal(v.DistributionValue)
+				if err != nil {
+					return errors.Wrap(err, "marshal distribution")
+				}
+				row.DistributionValue = string(dist)
+			}
+			insert.Rows = append(insert.Rows, bigQueryInsertRow{JSON: row})
+		}
+	}
+	if len(insert.Rows) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(&insert)
+	if err != nil {
+		return errors.Wrap(err, "marshal insert request")
+	}
+	ctx := context.Background()
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	httpReq, err := http.NewRequest("POST", c.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "create insert request")
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(httpReq.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "insert rows")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("insert rows: unexpected status %s", resp.Status)
+	}
+	var insertResp bigQueryInsertResponse
+	if err := json.NewDecoder(resp.Body).Decode(&insertResp); err != nil {
+		return errors.Wrap(err, "decode insert response")
+	}
+	// Row-level errors are schema mismatches that will not succeed on retry,
+	// so they are counted and logged rather than surfaced as a batch failure.
+	if n := len(insertResp.InsertErrors); n > 0 {
+		bigQueryRowErrorsTotal.Add(float64(n))
+		first := insertResp.InsertErrors[0]
+		reason, message := "", ""
+		if len(first.Errors) > 0 {
+			reason, message = first.Errors[0].Reason, first.Errors[0].Message
+		}
+		level.Warn(c.logger).Log("msg", "BigQuery rejected rows",
+			"count", n, "reason", reason, "message", message)
+	}
+	return nil
+}
+
+func (c *BigQueryClient) initClient() error {
+	if c.cfg.DisableAuth {
+		c.client = http.DefaultClient
+		return nil
+	}
+	client, err := google.DefaultClient(context.Background(), bigQueryScope)
+	if err != nil {
+		return errors.Wrap(err, "create BigQuery HTTP client")
+	}
+	c.client = client
+	return nil
+}
+
+// Close implements StorageClient.
+func (c *BigQueryClient) Close() error {
+	return nil
+}
+
+// bigQueryTime renders a protobuf timestamp the way BigQuery expects
+// TIMESTAMP values in streaming inserts.
+func bigQueryTime(ts *timestamp_pb.Timestamp) string {
+	if ts == nil {
+		return ""
+	}
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,146 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	timestamp_pb "github.com/golang/protobuf/ptypes/timestamp"
+	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+	monitoredres_pb "google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoring "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+func TestBigQueryClientStore(t *testing.T) {
+	var (
+		gotPath string
+		gotBody bigQueryInsertRequest
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		if err := json.NewDecoder(r.Body).Decode(&gotBody); err != nil {
+			t.Errorf("decoding request failed: %s", err)
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	c := NewBigQueryClient(&BigQueryClientConfig{
+		Project:     "proj",
+		Dataset:     "dataset",
+		Table:       "table",
+		DisableAuth: true,
+		Endpoint:    server.URL,
+	})
+	defer c.Close()
+
+	err := c.Store(&monitoring.CreateTimeSeriesRequest{
+		Name: "projects/proj",
+		TimeSeries: []*monitoring.TimeSeries{
+			{
+				Metric: &metric_pb.Metric{
+					Type:   "external.googleapis.com/prometheus/metric1",
+					Labels: map[string]string{"a": "1"},
+				},
+				Resource: &monitoredres_pb.MonitoredResource{
+					Type:   "gke_container",
+					Labels: map[string]string{"project_id": "proj"},
+				},
+				MetricKind: metric_pb.MetricDescriptor_CUMULATIVE,
+				ValueType:  metric_pb.MetricDescriptor_DOUBLE,
+				Points: []*monitoring.Point{
+					{
+						Interval: &monitoring.TimeInterval{
+							StartTime: &timestamp_pb.Timestamp{Seconds: 100},
+							EndTime:   &timestamp_pb.Timestamp{Seconds: 200},
+						},
+						Value: &monitoring.TypedValue{
+							Value: &monitoring.TypedValue_DoubleValue{DoubleValue: 0.5},
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := "/bigquery/v2/projects/proj/datasets/dataset/tables/table/insertAll"; gotPath != want {
+		t.Errorf("expected request path %q, got %q", want, gotPath)
+	}
+	if len(gotBody.Rows) != 1 {
+		t.Fatalf("expected 1 row, got %d", len(gotBody.Rows))
+	}
+	row := gotBody.Rows[0].JSON
+	if row.MetricType != "external.googleapis.com/prometheus/metric1" {
+		t.Errorf("unexpected metric type %q", row.MetricType)
+	}
+	if row.MetricKind != "CUMULATIVE" || row.ValueType != "DOUBLE" {
+		t.Errorf("unexpected kind/type %q/%q", row.MetricKind, row.ValueType)
+	}
+	if row.MetricLabels != `{"a":"1"}` {
+		t.Errorf("unexpected metric labels %q", row.MetricLabels)
+	}
+	if row.ResourceType != "gke_container" || row.ResourceLabels != `{"project_id":"proj"}` {
+		t.Errorf("unexpected resource %q %q", row.ResourceType, row.ResourceLabels)
+	}
+	if row.Value == nil || *row.Value != 0.5 {
+		t.Errorf("unexpected value %v", row.Value)
+	}
+	if row.IntervalStart != "1970-01-01T00:01:40Z" || row.IntervalEnd != "1970-01-01T00:03:20Z" {
+		t.Errorf("unexpected interval %q %q", row.IntervalStart, row.IntervalEnd)
+	}
+}
+
+func TestBigQueryClientStoreRowErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"insertErrors":[{"index":0,"errors":[{"reason":"invalid","message":"bad row"}]}]}`))
+	}))
+	defer server.Close()
+
+	c := NewBigQueryClient(&BigQueryClientConfig{
+		Project:     "proj",
+		Dataset:     "dataset",
+		Table:       "table",
+		DisableAuth: true,
+		Endpoint:    server.URL,
+	})
+	defer c.Close()
+
+	// Row-level errors are not retryable, so Store must not report them as a
+	// batch failure.
+	err := c.Store(&monitoring.CreateTimeSeriesRequest{
+		TimeSeries: []*monitoring.TimeSeries{
+			{
+				Metric:   &metric_pb.Metric{Type: "external.googleapis.com/prometheus/metric1"},
+				Resource: &monitoredres_pb.MonitoredResource{Type: "global"},
+				Points: []*monitoring.Point{
+					{
+						Interval: &monitoring.TimeInterval{EndTime: &timestamp_pb.Timestamp{Seconds: 1}},
+						Value: &monitoring.TypedValue{
+							Value: &monitoring.TypedValue_Int64Value{Int64Value: 3},
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var chaosInjectionsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "chaos_injections_total",
+		Help:      "Total number of artificial faults injected into the write path, by kind.",
+	},
+	[]string{"kind"},
+)
+
+func init() {
+	prometheus.MustRegister(chaosInjectionsTotal)
+}
+
+// ChaosConfig configures artificial faults injected into the write path.
+type ChaosConfig struct {
+	// ErrorRate is the fraction of Store calls that fail with ErrorCode
+	// instead of reaching the backend.
+	ErrorRate float64
+	// ErrorCode is the gRPC status code of injected errors.
+	ErrorCode codes.Code
+	// Latency is the base delay added to every Store call.
+	Latency time.Duration
+	// LatencyJitter is an additional delay drawn uniformly from
+	// [0, LatencyJitter) on every Store call.
+	LatencyJitter time.Duration
+}
+
+// ChaosClient is a StorageClient that injects artificial errors and latency
+// before forwarding requests to the wrapped client. It exists to validate
+// retry and shedding behavior in staging environments without depending on a
+// misbehaving backend and must not be enabled in production.
+type ChaosClient struct {
+	logger log.Logger
+	cfg    ChaosConfig
+	next   StorageClient
+
+	mtx sync.Mutex
+	rnd *rand.Rand
+}
+
+// NewChaosClient wraps the given client with the configured fault injection.
+func NewChaosClient(logger log.Logger, cfg ChaosConfig, next StorageClient) *ChaosClient {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	return &ChaosClient{
+		logger: logger,
+		cfg:    cfg,
+		next:   next,
+		rnd:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Store implements StorageClient. Injected latency applies to failed calls as
+// well, mimicking a backend that is slow before it errors.
+func (c *ChaosClient) Store(req *monitoring_pb.CreateTimeSeriesRequest) error {
+	delay := c.cfg.Latency
+	c.mtx.Lock()
+	if c.cfg.LatencyJitter > 0 {
+		delay += time.Duration(c.rnd.Int63n(int64(c.cfg.LatencyJitter)))
+	}
+	fail := c.cfg.ErrorRate > 0 && c.rnd.Float64() < c.cfg.ErrorRate
+	c.mtx.Unlock()
+
+	if delay > 0 {
+		chaosInjectionsTotal.WithLabelValues("latency").Inc()
+		time.Sleep(delay)
+	}
+	if fail {
+		chaosInjectionsTotal.WithLabelValues("error").Inc()
+		level.Debug(c.logger).Log("msg", "Injecting artificial write error", "code", c.cfg.ErrorCode)
+		return status.Error(c.cfg.ErrorCode, "artificial error injected by chaos configuration")
+	}
+	return c.next.Store(req)
+}
+
+// Close implements StorageClient.
+func (c *ChaosClient) Close() error {
+	return c.next.Close()
+}
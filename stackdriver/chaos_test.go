@@ -0,0 +1,76 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"testing"
+	"time"
+
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// countingStorageClient records how many requests reached it.
+type countingStorageClient struct {
+	stores int
+}
+
+func (c *countingStorageClient) Store(*monitoring_pb.CreateTimeSeriesRequest) error {
+	c.stores++
+	return nil
+}
+
+func (c *countingStorageClient) Close() error { return nil }
+
+func TestChaosClient_ErrorRate(t *testing.T) {
+	next := &countingStorageClient{}
+	c := NewChaosClient(nil, ChaosConfig{ErrorRate: 1, ErrorCode: codes.Unavailable}, next)
+
+	err := c.Store(&monitoring_pb.CreateTimeSeriesRequest{})
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected injected Unavailable error, got %v", err)
+	}
+	if next.stores != 0 {
+		t.Fatalf("request reached the wrapped client despite injected error")
+	}
+
+	// With a zero error rate every request passes through.
+	c = NewChaosClient(nil, ChaosConfig{}, next)
+	for i := 0; i < 10; i++ {
+		if err := c.Store(&monitoring_pb.CreateTimeSeriesRequest{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if next.stores != 10 {
+		t.Fatalf("expected 10 stored requests, got %d", next.stores)
+	}
+}
+
+func TestChaosClient_Latency(t *testing.T) {
+	next := &countingStorageClient{}
+	c := NewChaosClient(nil, ChaosConfig{Latency: 50 * time.Millisecond}, next)
+
+	start := time.Now()
+	if err := c.Store(&monitoring_pb.CreateTimeSeriesRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("expected at least 50ms of injected latency, got %s", elapsed)
+	}
+	if next.stores != 1 {
+		t.Fatalf("expected 1 stored request, got %d", next.stores)
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"net"
 	"net/url"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -33,11 +34,13 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/oauth"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/resolver/manual"
 	"google.golang.org/grpc/status"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
 	"github.com/prometheus/common/version"
 )
 
@@ -53,6 +56,11 @@ var (
 	// PointCount is a metric.
 	PointCount = stats.Int64("agent.googleapis.com/agent/monitoring/point_count",
 		"count of metric points written to Stackdriver", stats.UnitDimensionless)
+
+	// HedgedRequestCount counts CreateTimeSeries requests for which a hedged
+	// second attempt was sent.
+	HedgedRequestCount = stats.Int64("prometheus_sidecar/hedged_requests",
+		"count of hedged CreateTimeSeries requests", stats.UnitDimensionless)
 )
 
 func init() {
@@ -62,6 +70,10 @@ func init() {
 			TagKeys:     []tag.Key{StatusTag},
 			Aggregation: view.Sum(),
 		},
+		&view.View{
+			Measure:     HedgedRequestCount,
+			Aggregation: view.Sum(),
+		},
 	); err != nil {
 		panic(err)
 	}
@@ -71,11 +83,21 @@ func init() {
 // implementation may hit a single backend, so the application should create a
 // number of these clients.
 type Client struct {
-	logger    log.Logger
-	projectID string
-	url       *url.URL
-	timeout   time.Duration
-	resolver  *manual.Resolver
+	logger         log.Logger
+	projectID      string
+	url            *url.URL
+	timeout        time.Duration
+	resolver       *manual.Resolver
+	retryableCodes map[codes.Code]bool
+	labelMismatch  string
+	hedgingDelay   time.Duration
+	disableAuth    bool
+	tls            bool
+	debugDumper    *DebugDumper
+	errorSummary   *ErrorSummary
+	eventReporter  *EventReporter
+	allowedProject map[string]bool
+	metadata       metadata.MD
 
 	conn *grpc.ClientConn
 }
@@ -87,6 +109,48 @@ type ClientConfig struct {
 	URL       *url.URL
 	Timeout   time.Duration
 	Resolver  *manual.Resolver
+	// RetryableCodes overrides the set of gRPC status codes that are
+	// retried with backoff. If empty, DeadlineExceeded and Unavailable
+	// are retried.
+	RetryableCodes []codes.Code
+	// LabelMismatch selects how writes rejected over a metric descriptor
+	// label mismatch are remediated. Defaults to no remediation.
+	LabelMismatch string
+	// HedgingDelay sends a second hedged CreateTimeSeries attempt if the
+	// first has not completed within the delay, using whichever result
+	// arrives first. Zero disables hedging.
+	HedgingDelay time.Duration
+	// DisableAuth drops the GCP OAuth credentials from the connection so
+	// any backend implementing the Monitoring v3 API can receive the
+	// output. An auth query parameter on the URL takes precedence.
+	DisableAuth bool
+	// TLS secures the transport of connections without GCP credentials,
+	// which otherwise use plaintext. Authenticated connections always use
+	// TLS.
+	TLS bool
+	// DebugDumper, if set, receives every failed CreateTimeSeries request
+	// for offline inspection.
+	DebugDumper *DebugDumper
+	// ErrorSummary, if set, aggregates write failures by status code and
+	// metric type so they can be logged rate-limited and inspected through
+	// the status endpoint.
+	ErrorSummary *ErrorSummary
+	// EventReporter, if set, surfaces fatal write failures as Kubernetes
+	// Events on the sidecar's Pod.
+	EventReporter *EventReporter
+	// ProjectAllowlist restricts cross-project writes. Series whose monitored
+	// resource names a project through its project_id label are only routed
+	// there if the project is in the list; otherwise they are written to the
+	// default project. If empty, all projects are permitted.
+	ProjectAllowlist []string
+	// QuotaProject, if set, is the project that quota and billing of the
+	// Monitoring calls are attributed to, sent as the x-goog-user-project
+	// header. Required when the billing project differs from the
+	// destination project of the written series.
+	QuotaProject string
+	// Metadata is additional gRPC metadata attached to every Monitoring
+	// call as header key/value pairs.
+	Metadata map[string]string
 }
 
 // NewClient creates a new Client.
@@ -95,12 +159,75 @@ func NewClient(conf *ClientConfig) *Client {
 	if logger == nil {
 		logger = log.NewNopLogger()
 	}
+	retryable := map[codes.Code]bool{}
+	if len(conf.RetryableCodes) == 0 {
+		// codes.DeadlineExceeded:
+		//   It is safe to retry
+		//   google.monitoring.v3.MetricService.CreateTimeSeries
+		//   requests with backoff because QueueManager
+		//   enforces in-order writes on a time series, which
+		//   is a requirement for Stackdriver monitoring.
+		//
+		// codes.Unavailable:
+		//   The condition is most likely transient. The request can
+		//   be retried with backoff.
+		retryable[codes.DeadlineExceeded] = true
+		retryable[codes.Unavailable] = true
+	}
+	for _, code := range conf.RetryableCodes {
+		retryable[code] = true
+	}
+	var allowed map[string]bool
+	if len(conf.ProjectAllowlist) > 0 {
+		allowed = map[string]bool{}
+		for _, project := range conf.ProjectAllowlist {
+			allowed[strings.TrimPrefix(project, "projects/")] = true
+		}
+	}
 	return &Client{
-		logger:    logger,
-		projectID: conf.ProjectID,
-		url:       conf.URL,
-		timeout:   conf.Timeout,
-		resolver:  conf.Resolver,
+		logger:         logger,
+		projectID:      conf.ProjectID,
+		url:            conf.URL,
+		timeout:        conf.Timeout,
+		resolver:       conf.Resolver,
+		retryableCodes: retryable,
+		labelMismatch:  conf.LabelMismatch,
+		hedgingDelay:   conf.HedgingDelay,
+		disableAuth:    conf.DisableAuth,
+		tls:            conf.TLS,
+		debugDumper:    conf.DebugDumper,
+		errorSummary:   conf.ErrorSummary,
+		eventReporter:  conf.EventReporter,
+		allowedProject: allowed,
+		metadata:       callMetadata(conf),
+	}
+}
+
+// callMetadata builds the per-call metadata of a configuration, or nil if
+// none is configured.
+func callMetadata(conf *ClientConfig) metadata.MD {
+	if conf.QuotaProject == "" && len(conf.Metadata) == 0 {
+		return nil
+	}
+	md := metadata.MD{}
+	for key, value := range conf.Metadata {
+		md.Append(key, value)
+	}
+	if conf.QuotaProject != "" {
+		md.Set("x-goog-user-project", conf.QuotaProject)
+	}
+	return md
+}
+
+// metadataInterceptor attaches the given metadata, e.g. the quota project
+// header, to every call on the connection.
+func metadataInterceptor(md metadata.MD) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		out := md
+		if existing, ok := metadata.FromOutgoingContext(ctx); ok {
+			out = metadata.Join(existing, md)
+		}
+		return invoker(metadata.NewOutgoingContext(ctx, out), method, req, reply, cc, opts...)
 	}
 }
 
@@ -118,7 +245,7 @@ func (c *Client) getConnection(ctx context.Context) (*grpc.ClientConn, error) {
 
 	useAuth, err := strconv.ParseBool(c.url.Query().Get("auth"))
 	if err != nil {
-		useAuth = true // Default to auth enabled.
+		useAuth = !c.disableAuth // Default to auth enabled unless disabled by configuration.
 	}
 	level.Debug(c.logger).Log(
 		"msg", "is auth enabled",
@@ -133,6 +260,9 @@ func (c *Client) getConnection(ctx context.Context) (*grpc.ClientConn, error) {
 		grpc.WithUserAgent(userAgent),
 		grpc.WithStatsHandler(&ocgrpc.ClientHandler{}),
 	}
+	if len(c.metadata) > 0 {
+		dopts = append(dopts, grpc.WithUnaryInterceptor(metadataInterceptor(c.metadata)))
+	}
 	if useAuth {
 		rpcCreds, err := oauth.NewApplicationDefault(context.Background(), MonitoringWriteScope)
 		if err != nil {
@@ -142,6 +272,8 @@ func (c *Client) getConnection(ctx context.Context) (*grpc.ClientConn, error) {
 		dopts = append(dopts,
 			grpc.WithTransportCredentials(tlsCreds),
 			grpc.WithPerRPCCredentials(rpcCreds))
+	} else if c.tls {
+		dopts = append(dopts, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{})))
 	} else {
 		dopts = append(dopts, grpc.WithInsecure())
 	}
@@ -178,67 +310,136 @@ func (c *Client) Store(req *monitoring.CreateTimeSeriesRequest) error {
 
 	service := monitoring.NewMetricServiceClient(conn)
 
-	errors := make(chan error, len(tss)/MaxTimeseriesesPerRequest+1)
-	var wg sync.WaitGroup
-	for i := 0; i < len(tss); i += MaxTimeseriesesPerRequest {
-		end := i + MaxTimeseriesesPerRequest
-		if end > len(tss) {
-			end = len(tss)
+	// Write each series to the project that owns it. Series whose monitored
+	// resource does not name a project, or names one outside the configured
+	// allowlist, go to the configured default project.
+	groups := map[string][]*monitoring.TimeSeries{}
+	disallowed := 0
+	for _, ts := range tss {
+		name := c.projectID
+		if pid := ts.Resource.GetLabels()["project_id"]; pid != "" && "projects/"+pid != c.projectID {
+			if c.allowedProject == nil || c.allowedProject[pid] {
+				name = "projects/" + pid
+			} else {
+				disallowed++
+			}
 		}
-		wg.Add(1)
-		go func(begin int, end int) {
-			defer wg.Done()
-			req_copy := &monitoring.CreateTimeSeriesRequest{
-				Name:       c.projectID,
-				TimeSeries: req.TimeSeries[begin:end],
+		groups[name] = append(groups[name], ts)
+	}
+	if disallowed > 0 {
+		level.Debug(c.logger).Log(
+			"msg", "Series routed to the default project; destination project not in allowlist",
+			"count", disallowed)
+	}
+
+	errors := make(chan error, len(tss)/MaxTimeseriesesPerRequest+len(groups))
+	var wg sync.WaitGroup
+	for name, group := range groups {
+		for i := 0; i < len(group); i += MaxTimeseriesesPerRequest {
+			end := i + MaxTimeseriesesPerRequest
+			if end > len(group) {
+				end = len(group)
 			}
-			_, err := service.CreateTimeSeries(ctx, req_copy)
-			if err == nil {
-				// The response is empty if all points were successfully written.
-				stats.RecordWithTags(ctx,
-					[]tag.Mutator{tag.Upsert(StatusTag, "0")},
-					PointCount.M(int64(end-begin)))
-			} else {
-				level.Debug(c.logger).Log(
-					"msg", "Partial failure calling CreateTimeSeries",
-					"err", err)
-				status, ok := status.FromError(err)
-				if !ok {
-					level.Warn(c.logger).Log("msg", "Unexpected error message type from Monitoring API", "err", err)
-					errors <- err
-					return
+			wg.Add(1)
+			go func(name string, batch []*monitoring.TimeSeries) {
+				defer wg.Done()
+				req_copy := &monitoring.CreateTimeSeriesRequest{
+					Name:       name,
+					TimeSeries: batch,
 				}
-				for _, details := range status.Details() {
-					if summary, ok := details.(*monitoring.CreateTimeSeriesSummary); ok {
-						level.Debug(c.logger).Log("summary", summary)
-						stats.RecordWithTags(ctx,
-							[]tag.Mutator{tag.Upsert(StatusTag, "0")},
-							PointCount.M(int64(summary.SuccessPointCount)))
-						for _, e := range summary.Errors {
+				err := c.createTimeSeries(ctx, service, req_copy)
+				if err == nil {
+					// The response is empty if all points were successfully written.
+					stats.RecordWithTags(ctx,
+						[]tag.Mutator{tag.Upsert(StatusTag, "0")},
+						PointCount.M(int64(len(batch))))
+				} else {
+					level.Debug(c.logger).Log(
+						"msg", "Partial failure calling CreateTimeSeries",
+						"err", err)
+					if c.debugDumper != nil {
+						c.debugDumper.Dump(req_copy, err)
+					}
+					status, ok := status.FromError(err)
+					if !ok {
+						level.Warn(c.logger).Log("msg", "Unexpected error message type from Monitoring API", "err", err)
+						errors <- err
+						return
+					}
+					if c.errorSummary != nil {
+						// The API does not identify the failed series, so the
+						// status code is attributed to every metric type in
+						// the batch.
+						seen := map[string]bool{}
+						for _, ts := range batch {
+							metricType := ts.Metric.GetType()
+							if !seen[metricType] {
+								seen[metricType] = true
+								c.errorSummary.Record(status.Code(), metricType)
+							}
+						}
+					}
+					if c.eventReporter != nil {
+						switch status.Code() {
+						case codes.PermissionDenied, codes.Unauthenticated:
+							c.eventReporter.ReportPermissionDenied(err)
+						case codes.ResourceExhausted:
+							c.eventReporter.ReportQuotaExhausted(err)
+						case codes.InvalidArgument:
+							if isLabelMismatch(err) {
+								// The API does not identify the failed series;
+								// report the batch's first metric type.
+								c.eventReporter.ReportDescriptorConflict(batch[0].Metric.GetType(), err)
+							}
+						}
+					}
+					for _, details := range status.Details() {
+						if summary, ok := details.(*monitoring.CreateTimeSeriesSummary); ok {
+							level.Debug(c.logger).Log("summary", summary)
 							stats.RecordWithTags(ctx,
-								[]tag.Mutator{tag.Upsert(StatusTag, fmt.Sprint(uint32(e.Status.Code)))},
-								PointCount.M(int64(e.PointCount)))
+								[]tag.Mutator{tag.Upsert(StatusTag, "0")},
+								PointCount.M(int64(summary.SuccessPointCount)))
+							for _, e := range summary.Errors {
+								stats.RecordWithTags(ctx,
+									[]tag.Mutator{tag.Upsert(StatusTag, fmt.Sprint(uint32(e.Status.Code)))},
+									PointCount.M(int64(e.PointCount)))
+							}
 						}
 					}
+					if c.labelMismatch != "" && c.labelMismatch != LabelMismatchIgnore && isLabelMismatch(err) {
+						repaired, rerr := c.remediateLabelMismatch(ctx, req_copy)
+						if rerr != nil {
+							level.Warn(c.logger).Log("msg", "Remediating label mismatch failed", "err", rerr)
+							errors <- err
+							return
+						}
+						if repaired != nil {
+							// The unknown labels were dropped from a clone of the
+							// request. Send the clone directly: a retry through the
+							// queue would resend the original series, whose label
+							// maps are shared with the series cache and must stay
+							// untouched.
+							if rerr := c.createTimeSeries(ctx, service, repaired); rerr != nil {
+								errors <- rerr
+								return
+							}
+							stats.RecordWithTags(ctx,
+								[]tag.Mutator{tag.Upsert(StatusTag, "0")},
+								PointCount.M(int64(len(batch))))
+							return
+						}
+						// The descriptor was repaired; retry the request.
+						errors <- recoverableError{err}
+						return
+					}
+					if c.retryableCodes[status.Code()] {
+						errors <- recoverableError{err}
+					} else {
+						errors <- err
+					}
 				}
-				switch status.Code() {
-				// codes.DeadlineExceeded:
-				//   It is safe to retry
-				//   google.monitoring.v3.MetricService.CreateTimeSeries
-				//   requests with backoff because QueueManager
-				//   enforces in-order writes on a time series, which
-				//   is a requirement for Stackdriver monitoring.
-				//
-				// codes.Unavailable:
-				//   The condition is most likely transient. The request can
-				//   be retried with backoff.
-				case codes.DeadlineExceeded, codes.Unavailable:
-					errors <- recoverableError{err}
-				default:
-					errors <- err
-				}
-			}
-		}(i, end)
+			}(name, group[i:end])
+		}
 	}
 	wg.Wait()
 	close(errors)
@@ -248,6 +449,87 @@ func (c *Client) Store(req *monitoring.CreateTimeSeriesRequest) error {
 	return nil
 }
 
+// CheckPermissions verifies that the configured credentials are allowed to
+// write time series to the target project. It sends an empty CreateTimeSeries
+// request, which the API rejects only after passing its permission checks, so
+// no data is created. Permission errors are translated into a message naming
+// the missing role instead of the opaque PermissionDenied status that would
+// otherwise surface once samples are written.
+func (c *Client) CheckPermissions(ctx context.Context) error {
+	conn, err := c.getConnection(ctx)
+	if err != nil {
+		return errors.Wrap(err, "connecting to Monitoring API")
+	}
+	service := monitoring.NewMetricServiceClient(conn)
+
+	_, err = service.CreateTimeSeries(ctx, &monitoring.CreateTimeSeriesRequest{Name: c.projectID})
+	switch status.Code(err) {
+	case codes.OK, codes.InvalidArgument:
+		// The empty request passed the permission checks.
+		return nil
+	case codes.PermissionDenied:
+		return errors.Errorf("the credentials lack the monitoring.timeSeries.create permission on %q; grant a role that includes it, e.g. roles/monitoring.metricWriter: %v", c.projectID, err)
+	case codes.Unauthenticated:
+		return errors.Errorf("no valid credentials found: %v", err)
+	default:
+		return errors.Wrapf(err, "checking permissions on %q", c.projectID)
+	}
+}
+
+// createTimeSeries calls the CreateTimeSeries RPC, optionally hedging it with
+// a second attempt if the first has not completed within the configured
+// delay. Hedging is only used for idempotent requests, i.e. those containing
+// each time series at most once. The losing attempt then either writes
+// identical data or is rejected as a duplicate write, which is harmless since
+// the winning attempt already succeeded.
+func (c *Client) createTimeSeries(ctx context.Context, service monitoring.MetricServiceClient, req *monitoring.CreateTimeSeriesRequest) error {
+	if c.hedgingDelay <= 0 || !hedgeable(req) {
+		_, err := service.CreateTimeSeries(ctx, req)
+		return err
+	}
+	// Cancel the slower attempt once a result has been accepted.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan error, 2)
+	attempt := func() {
+		_, err := service.CreateTimeSeries(ctx, req)
+		results <- err
+	}
+	go attempt()
+
+	delay := time.NewTimer(c.hedgingDelay)
+	defer delay.Stop()
+	select {
+	case err := <-results:
+		return err
+	case <-delay.C:
+	}
+	stats.Record(ctx, HedgedRequestCount.M(1))
+	go attempt()
+	// Return the first success, or the second error if both attempts fail.
+	if err := <-results; err == nil {
+		return nil
+	}
+	return <-results
+}
+
+// hedgeable returns whether the request may safely be sent twice
+// concurrently. That requires each time series to appear at most once: with
+// duplicates, the two attempts could write the points of a series in
+// conflicting orders.
+func hedgeable(req *monitoring.CreateTimeSeriesRequest) bool {
+	seen := make(map[string]struct{}, len(req.TimeSeries))
+	for _, ts := range req.TimeSeries {
+		key := ts.Metric.String() + "\xff" + ts.Resource.String()
+		if _, ok := seen[key]; ok {
+			return false
+		}
+		seen[key] = struct{}{}
+	}
+	return true
+}
+
 func (c Client) Close() error {
 	if c.conn == nil {
 		return nil
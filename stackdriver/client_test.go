@@ -15,20 +15,26 @@ package stackdriver
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"net"
 	"net/url"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/bjbloemker-google/stackdriver-prometheus-sidecar/opencensus"
 	"github.com/go-kit/kit/log"
 	"github.com/golang/protobuf/proto"
+	empty_pb "github.com/golang/protobuf/ptypes/empty"
 	"go.opencensus.io/metric/metricexport"
+	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+	monitoredres_pb "google.golang.org/genproto/googleapis/api/monitoredres"
 	monitoring "google.golang.org/genproto/googleapis/monitoring/v3"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/resolver"
 	"google.golang.org/grpc/resolver/manual"
 	"google.golang.org/grpc/status"
@@ -177,6 +183,258 @@ func TestStoreErrorHandling(t *testing.T) {
 	}
 }
 
+// hedgeTestServer blocks the first CreateTimeSeries call until its context is
+// canceled and serves all subsequent calls immediately.
+type hedgeTestServer struct {
+	metricServiceServer
+	mtx   sync.Mutex
+	calls int
+}
+
+func (s *hedgeTestServer) CreateTimeSeries(ctx context.Context, req *monitoring.CreateTimeSeriesRequest) (*empty_pb.Empty, error) {
+	s.mtx.Lock()
+	s.calls++
+	first := s.calls == 1
+	s.mtx.Unlock()
+	if first {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return &empty_pb.Empty{}, nil
+}
+
+func TestStoreHedging(t *testing.T) {
+	listener := newLocalListener()
+	grpcServer := grpc.NewServer()
+	server := &hedgeTestServer{}
+	monitoring.RegisterMetricServiceServer(grpcServer, server)
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	serverURL, err := url.Parse("https://" + listener.Addr().String() + "?auth=false")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClient(&ClientConfig{
+		URL:          serverURL,
+		Timeout:      10 * time.Second,
+		HedgingDelay: 50 * time.Millisecond,
+	})
+	// The first attempt hangs, so only the hedged second attempt can make
+	// the write succeed before the timeout.
+	err = c.Store(&monitoring.CreateTimeSeriesRequest{
+		TimeSeries: []*monitoring.TimeSeries{
+			&monitoring.TimeSeries{},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	server.mtx.Lock()
+	calls := server.calls
+	server.mtx.Unlock()
+	if calls != 2 {
+		t.Errorf("expected 2 CreateTimeSeries calls, got %d", calls)
+	}
+}
+
+// routingTestServer records the number of series written to each project.
+type routingTestServer struct {
+	metricServiceServer
+	mtx    sync.Mutex
+	series map[string]int
+}
+
+func (s *routingTestServer) CreateTimeSeries(ctx context.Context, req *monitoring.CreateTimeSeriesRequest) (*empty_pb.Empty, error) {
+	s.mtx.Lock()
+	s.series[req.Name] += len(req.TimeSeries)
+	s.mtx.Unlock()
+	return &empty_pb.Empty{}, nil
+}
+
+func TestStoreProjectAllowlist(t *testing.T) {
+	listener := newLocalListener()
+	grpcServer := grpc.NewServer()
+	server := &routingTestServer{series: map[string]int{}}
+	monitoring.RegisterMetricServiceServer(grpcServer, server)
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	serverURL, err := url.Parse("https://" + listener.Addr().String() + "?auth=false")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClient(&ClientConfig{
+		URL:              serverURL,
+		Timeout:          time.Second,
+		ProjectID:        "projects/default",
+		ProjectAllowlist: []string{"allowed"},
+	})
+	withProject := func(project string) *monitoring.TimeSeries {
+		return &monitoring.TimeSeries{
+			Resource: &monitoredres_pb.MonitoredResource{
+				Labels: map[string]string{"project_id": project},
+			},
+		}
+	}
+	// Series without a resource project go to the default project, series
+	// naming an allowlisted project are routed there, and series naming any
+	// other project fall back to the default project.
+	err = c.Store(&monitoring.CreateTimeSeriesRequest{
+		TimeSeries: []*monitoring.TimeSeries{
+			&monitoring.TimeSeries{},
+			withProject("allowed"),
+			withProject("other"),
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+	if got := server.series["projects/default"]; got != 2 {
+		t.Errorf("expected 2 series in the default project, got %d", got)
+	}
+	if got := server.series["projects/allowed"]; got != 1 {
+		t.Errorf("expected 1 series in project \"allowed\", got %d", got)
+	}
+}
+
+// metadataTestServer records the incoming call metadata.
+type metadataTestServer struct {
+	metricServiceServer
+	mtx sync.Mutex
+	md  metadata.MD
+}
+
+func (s *metadataTestServer) CreateTimeSeries(ctx context.Context, req *monitoring.CreateTimeSeriesRequest) (*empty_pb.Empty, error) {
+	s.mtx.Lock()
+	s.md, _ = metadata.FromIncomingContext(ctx)
+	s.mtx.Unlock()
+	return &empty_pb.Empty{}, nil
+}
+
+func TestStoreCallMetadata(t *testing.T) {
+	listener := newLocalListener()
+	grpcServer := grpc.NewServer()
+	server := &metadataTestServer{}
+	monitoring.RegisterMetricServiceServer(grpcServer, server)
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	serverURL, err := url.Parse("https://" + listener.Addr().String() + "?auth=false")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClient(&ClientConfig{
+		URL:          serverURL,
+		Timeout:      time.Second,
+		QuotaProject: "billing-project",
+		Metadata:     map[string]string{"X-Custom-Header": "value"},
+	})
+	err = c.Store(&monitoring.CreateTimeSeriesRequest{
+		TimeSeries: []*monitoring.TimeSeries{
+			&monitoring.TimeSeries{},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+	if got := server.md.Get("x-goog-user-project"); len(got) != 1 || got[0] != "billing-project" {
+		t.Errorf("unexpected quota project header %v", got)
+	}
+	if got := server.md.Get("x-custom-header"); len(got) != 1 || got[0] != "value" {
+		t.Errorf("unexpected custom header %v", got)
+	}
+}
+
+func TestStoreDisableAuth(t *testing.T) {
+	listener := newLocalListener()
+	grpcServer := grpc.NewServer()
+	monitoring.RegisterMetricServiceServer(grpcServer, &metricServiceServer{nil})
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	// No auth query parameter; the DisableAuth config must select a
+	// plaintext connection without GCP credentials.
+	serverURL, err := url.Parse("https://" + listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClient(&ClientConfig{
+		URL:         serverURL,
+		Timeout:     time.Second,
+		DisableAuth: true,
+	})
+	err = c.Store(&monitoring.CreateTimeSeriesRequest{
+		TimeSeries: []*monitoring.TimeSeries{
+			&monitoring.TimeSeries{},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestCheckPermissions(t *testing.T) {
+	tests := []struct {
+		status  *status.Status
+		wantErr string
+	}{
+		// The API rejects the empty request only after its permission checks.
+		{status: status.New(codes.InvalidArgument, "empty request")},
+		{status: status.New(codes.PermissionDenied, "denied"), wantErr: "roles/monitoring.metricWriter"},
+		{status: status.New(codes.Unauthenticated, "bad credentials"), wantErr: "no valid credentials"},
+		{status: status.New(codes.Unavailable, "unavailable"), wantErr: "checking permissions"},
+	}
+	for _, test := range tests {
+		listener := newLocalListener()
+		grpcServer := grpc.NewServer()
+		monitoring.RegisterMetricServiceServer(grpcServer, &metricServiceServer{test.status})
+		go grpcServer.Serve(listener)
+
+		serverURL, err := url.Parse("https://" + listener.Addr().String() + "?auth=false")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := NewClient(&ClientConfig{
+			ProjectID: "projects/1234",
+			URL:       serverURL,
+			Timeout:   time.Second,
+		})
+		err = c.CheckPermissions(context.Background())
+		if test.wantErr == "" && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.status.Code(), err)
+		}
+		if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+			t.Errorf("%s: expected error containing %q, got %v", test.status.Code(), test.wantErr, err)
+		}
+		c.Close()
+		grpcServer.Stop()
+	}
+}
+
+func TestHedgeable(t *testing.T) {
+	ts1 := &monitoring.TimeSeries{
+		Metric: &metric_pb.Metric{Type: "external.googleapis.com/prometheus/metric1"},
+	}
+	ts2 := &monitoring.TimeSeries{
+		Metric: &metric_pb.Metric{Type: "external.googleapis.com/prometheus/metric2"},
+	}
+	if !hedgeable(&monitoring.CreateTimeSeriesRequest{TimeSeries: []*monitoring.TimeSeries{ts1, ts2}}) {
+		t.Errorf("expected request with distinct series to be hedgeable")
+	}
+	if hedgeable(&monitoring.CreateTimeSeriesRequest{TimeSeries: []*monitoring.TimeSeries{ts1, ts1}}) {
+		t.Errorf("expected request with duplicate series to not be hedgeable")
+	}
+}
+
 func TestEmptyRequest(t *testing.T) {
 	serverURL, err := url.Parse("http://localhost:12345")
 	if err != nil {
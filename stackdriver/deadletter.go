@@ -0,0 +1,106 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+var deadLetteredSamplesTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "dead_lettered_samples_total",
+		Help:      "Total number of permanently rejected samples recorded to the dead-letter sink.",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(deadLetteredSamplesTotal)
+}
+
+// DeadLetterSink records time series that were permanently rejected by the
+// Monitoring API, along with the rejection error, so they can be analyzed or
+// replayed offline instead of vanishing with a log line. Implementations must
+// be safe for concurrent use; shards record rejections independently.
+type DeadLetterSink interface {
+	Record(samples []*monitoring_pb.TimeSeries, reason error) error
+	Close() error
+}
+
+// deadLetterRecord is one JSON line written by the file sink.
+type deadLetterRecord struct {
+	Time   string                      `json:"time"`
+	Error  string                      `json:"error"`
+	Series []*monitoring_pb.TimeSeries `json:"series"`
+}
+
+// FileDeadLetterSink writes rejected series to an io.Writer as JSON lines,
+// one record per rejected batch.
+type FileDeadLetterSink struct {
+	logger log.Logger
+
+	mtx sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+}
+
+// NewFileDeadLetterSink returns a sink writing JSON records to w. If w is an
+// io.Closer, closing the sink closes it.
+func NewFileDeadLetterSink(logger log.Logger, w io.Writer) *FileDeadLetterSink {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	return &FileDeadLetterSink{
+		logger: logger,
+		w:      w,
+		enc:    json.NewEncoder(w),
+	}
+}
+
+// Record implements DeadLetterSink.
+func (s *FileDeadLetterSink) Record(samples []*monitoring_pb.TimeSeries, reason error) error {
+	record := deadLetterRecord{
+		Time:   time.Now().UTC().Format(time.RFC3339),
+		Series: samples,
+	}
+	if reason != nil {
+		record.Error = reason.Error()
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if err := s.enc.Encode(&record); err != nil {
+		return err
+	}
+	deadLetteredSamplesTotal.Add(float64(len(samples)))
+	return nil
+}
+
+// Close implements DeadLetterSink.
+func (s *FileDeadLetterSink) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if closer, ok := s.w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+func TestFileDeadLetterSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewFileDeadLetterSink(nil, &buf)
+
+	samples := []*monitoring_pb.TimeSeries{
+		{Metric: &metric_pb.Metric{Type: "external.googleapis.com/prometheus/metric1"}},
+		{Metric: &metric_pb.Metric{Type: "external.googleapis.com/prometheus/metric2"}},
+	}
+	if err := sink.Record(samples, errors.New("bad points")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Record(samples[:1], nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(lines))
+	}
+	var record deadLetterRecord
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("invalid record line %q: %v", lines[0], err)
+	}
+	if record.Error != "bad points" {
+		t.Errorf("unexpected error %q", record.Error)
+	}
+	if len(record.Series) != 2 {
+		t.Errorf("expected 2 series, got %d", len(record.Series))
+	}
+	if record.Series[0].Metric.Type != "external.googleapis.com/prometheus/metric1" {
+		t.Errorf("unexpected metric type %q", record.Series[0].Metric.Type)
+	}
+	if _, err := time.Parse(time.RFC3339, record.Time); err != nil {
+		t.Errorf("invalid record time %q: %v", record.Time, err)
+	}
+}
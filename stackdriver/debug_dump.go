@@ -0,0 +1,240 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+var debugDumpedRequestsTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "debug_dumped_requests_total",
+		Help:      "Total number of failed CreateTimeSeries requests dumped to the debug directory.",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(debugDumpedRequestsTotal)
+}
+
+const (
+	// debugDumpFilePrefix is the name prefix of the rotated dump files.
+	debugDumpFilePrefix = "rejected-"
+	// debugDumpRedacted replaces label values matching a redaction pattern.
+	debugDumpRedacted = "<redacted>"
+	// debugDumpFileFraction determines the size of a single dump file
+	// relative to the directory budget before it is rotated.
+	debugDumpFileFraction = 8
+)
+
+// DebugDumper writes failed CreateTimeSeries requests to a size-bounded
+// directory of rotating JSON files, so the offending series of rejected
+// batches can be inspected after the fact. Label values matching any of the
+// configured patterns are redacted before writing. It is safe for concurrent
+// use by multiple clients.
+type DebugDumper struct {
+	logger   log.Logger
+	dir      string
+	maxBytes int64
+	redact   []*regexp.Regexp
+
+	mtx      sync.Mutex
+	file     *os.File
+	fileSize int64
+	seq      int
+}
+
+// debugDumpRecord is one JSON line in a dump file.
+type debugDumpRecord struct {
+	Time    string                                 `json:"time"`
+	Error   string                                 `json:"error"`
+	Request *monitoring_pb.CreateTimeSeriesRequest `json:"request"`
+}
+
+// NewDebugDumper returns a dumper writing to dir, keeping at most maxBytes of
+// dump files. The redaction patterns are matched against every metric and
+// resource label value.
+func NewDebugDumper(logger log.Logger, dir string, maxBytes int64, redactPatterns []string) (*DebugDumper, error) {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	var redact []*regexp.Regexp
+	for _, p := range redactPatterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		redact = append(redact, re)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	d := &DebugDumper{
+		logger:   logger,
+		dir:      dir,
+		maxBytes: maxBytes,
+		redact:   redact,
+	}
+	// Continue the file sequence after a restart so existing dumps are not
+	// overwritten.
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		var seq int
+		if n, _ := fmt.Sscanf(info.Name(), debugDumpFilePrefix+"%d.json", &seq); n == 1 && seq > d.seq {
+			d.seq = seq
+		}
+	}
+	return d, nil
+}
+
+// Dump writes the failed request and its error to the debug directory.
+// Failures to write are logged but never propagated; dumping is strictly
+// best-effort debugging aid.
+func (d *DebugDumper) Dump(req *monitoring_pb.CreateTimeSeriesRequest, reason error) {
+	record := debugDumpRecord{
+		Time:    time.Now().UTC().Format(time.RFC3339),
+		Request: d.redactRequest(req),
+	}
+	if reason != nil {
+		record.Error = reason.Error()
+	}
+	b, err := json.Marshal(&record)
+	if err != nil {
+		level.Warn(d.logger).Log("msg", "marshaling debug dump failed", "err", err)
+		return
+	}
+	b = append(b, '\n')
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if d.file != nil && d.fileSize+int64(len(b)) > d.maxBytes/debugDumpFileFraction {
+		d.file.Close()
+		d.file = nil
+	}
+	if d.file == nil {
+		d.seq++
+		f, err := os.Create(filepath.Join(d.dir, fmt.Sprintf("%s%06d.json", debugDumpFilePrefix, d.seq)))
+		if err != nil {
+			level.Warn(d.logger).Log("msg", "creating debug dump file failed", "err", err)
+			return
+		}
+		d.file = f
+		d.fileSize = 0
+		if err := d.enforceBudget(); err != nil {
+			level.Warn(d.logger).Log("msg", "cleaning up debug dump directory failed", "err", err)
+		}
+	}
+	if _, err := d.file.Write(b); err != nil {
+		level.Warn(d.logger).Log("msg", "writing debug dump failed", "err", err)
+		return
+	}
+	d.fileSize += int64(len(b))
+	debugDumpedRequestsTotal.Inc()
+}
+
+// Close closes the current dump file.
+func (d *DebugDumper) Close() error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.file == nil {
+		return nil
+	}
+	err := d.file.Close()
+	d.file = nil
+	return err
+}
+
+// redactRequest returns a copy of the request with all metric and resource
+// label values matching a redaction pattern replaced.
+func (d *DebugDumper) redactRequest(req *monitoring_pb.CreateTimeSeriesRequest) *monitoring_pb.CreateTimeSeriesRequest {
+	if len(d.redact) == 0 {
+		return req
+	}
+	out := proto.Clone(req).(*monitoring_pb.CreateTimeSeriesRequest)
+	for _, ts := range out.TimeSeries {
+		if ts.Metric != nil {
+			d.redactLabels(ts.Metric.Labels)
+		}
+		if ts.Resource != nil {
+			d.redactLabels(ts.Resource.Labels)
+		}
+	}
+	return out
+}
+
+func (d *DebugDumper) redactLabels(labels map[string]string) {
+	for name, value := range labels {
+		for _, re := range d.redact {
+			if re.MatchString(value) {
+				labels[name] = debugDumpRedacted
+				break
+			}
+		}
+	}
+}
+
+// enforceBudget deletes the oldest dump files until the directory is within
+// the configured size budget. The file currently being written is never
+// deleted.
+func (d *DebugDumper) enforceBudget() error {
+	infos, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+	var (
+		dumps []os.FileInfo
+		total int64
+	)
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasPrefix(info.Name(), debugDumpFilePrefix) {
+			continue
+		}
+		dumps = append(dumps, info)
+		total += info.Size()
+	}
+	// The sequence number in the name orders files from oldest to newest.
+	sort.Slice(dumps, func(i, j int) bool { return dumps[i].Name() < dumps[j].Name() })
+	for _, info := range dumps[:len(dumps)-1] {
+		if total <= d.maxBytes {
+			break
+		}
+		if err := os.Remove(filepath.Join(d.dir, info.Name())); err != nil {
+			return err
+		}
+		total -= info.Size()
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+	monitoredres_pb "google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+func TestDebugDumperRedaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debug_dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, err := NewDebugDumper(nil, dir, 1<<20, []string{"^secret-"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &monitoring_pb.CreateTimeSeriesRequest{
+		Name: "projects/1234",
+		TimeSeries: []*monitoring_pb.TimeSeries{
+			{
+				Metric: &metric_pb.Metric{
+					Type:   "external.googleapis.com/prometheus/metric1",
+					Labels: map[string]string{"a": "secret-value", "b": "public"},
+				},
+				Resource: &monitoredres_pb.MonitoredResource{
+					Type:   "resource1",
+					Labels: map[string]string{"c": "secret-resource"},
+				},
+			},
+		},
+	}
+	d.Dump(req, errors.New("bad points"))
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The original request must not be modified by redaction.
+	if req.TimeSeries[0].Metric.Labels["a"] != "secret-value" {
+		t.Errorf("input request was modified")
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "rejected-000001.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record debugDumpRecord
+	if err := json.Unmarshal(b, &record); err != nil {
+		t.Fatalf("invalid record %q: %v", b, err)
+	}
+	if record.Error != "bad points" {
+		t.Errorf("unexpected error %q", record.Error)
+	}
+	labels := record.Request.TimeSeries[0].Metric.Labels
+	if labels["a"] != debugDumpRedacted || labels["b"] != "public" {
+		t.Errorf("unexpected metric labels %v", labels)
+	}
+	if got := record.Request.TimeSeries[0].Resource.Labels["c"]; got != debugDumpRedacted {
+		t.Errorf("unexpected resource label %q", got)
+	}
+}
+
+func TestDebugDumperRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debug_dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A tight budget forces a rotation on every record and deletion of the
+	// oldest files.
+	d, err := NewDebugDumper(nil, dir, 1024, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &monitoring_pb.CreateTimeSeriesRequest{
+		TimeSeries: []*monitoring_pb.TimeSeries{
+			{Metric: &metric_pb.Metric{Type: strings.Repeat("x", 200)}},
+		},
+	}
+	for i := 0; i < 20; i++ {
+		d.Dump(req, nil)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	names := map[string]bool{}
+	for _, info := range infos {
+		total += info.Size()
+		names[info.Name()] = true
+	}
+	// The budget bounds the directory size up to the file currently being
+	// written to.
+	if total > 1024+256 {
+		t.Errorf("dump directory exceeds budget: %d bytes", total)
+	}
+	// The oldest dumps must have been deleted, the most recent one kept.
+	if names["rejected-000001.json"] {
+		t.Errorf("expected oldest dump file to be deleted")
+	}
+	if !names["rejected-000020.json"] {
+		t.Errorf("expected most recent dump file to be present")
+	}
+}
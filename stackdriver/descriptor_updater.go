@@ -0,0 +1,114 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"context"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	label_pb "google.golang.org/genproto/googleapis/api/label"
+	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// DescriptorUpdater asynchronously creates metric descriptors for exported
+// series, propagating the Prometheus HELP text into the descriptor
+// description so Metrics Explorer shows human-readable documentation.
+// Descriptors are written again whenever the HELP text changes.
+type DescriptorUpdater struct {
+	logger  log.Logger
+	client  *MetadataClient
+	updates chan *metric_pb.MetricDescriptor
+
+	mtx sync.Mutex
+	// Map from metric type to the most recently written description.
+	descriptions map[string]string
+}
+
+// NewDescriptorUpdater is the DescriptorUpdater constructor. Descriptor
+// writes go through the given metadata client so they are rate limited
+// independently of the write path.
+func NewDescriptorUpdater(logger log.Logger, client *MetadataClient) *DescriptorUpdater {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	return &DescriptorUpdater{
+		logger:       logger,
+		client:       client,
+		updates:      make(chan *metric_pb.MetricDescriptor, 100),
+		descriptions: map[string]string{},
+	}
+}
+
+// UpdateDescriptor queues a descriptor update for the series if its HELP text
+// has not been written yet or has changed. It never blocks; an update that
+// does not fit in the queue is retried on a later series refresh.
+func (u *DescriptorUpdater) UpdateDescriptor(ts *monitoring_pb.TimeSeries, help string) {
+	if help == "" {
+		return
+	}
+	u.mtx.Lock()
+	if u.descriptions[ts.Metric.Type] == help {
+		u.mtx.Unlock()
+		return
+	}
+	u.descriptions[ts.Metric.Type] = help
+	u.mtx.Unlock()
+
+	d := &metric_pb.MetricDescriptor{
+		Type:        ts.Metric.Type,
+		Description: help,
+		MetricKind:  ts.MetricKind,
+		ValueType:   ts.ValueType,
+	}
+	for key := range ts.Metric.Labels {
+		d.Labels = append(d.Labels, &label_pb.LabelDescriptor{
+			Key:       key,
+			ValueType: label_pb.LabelDescriptor_STRING,
+		})
+	}
+	select {
+	case u.updates <- d:
+	default:
+		u.forget(d)
+	}
+}
+
+// Run writes queued descriptor updates until the context is canceled.
+func (u *DescriptorUpdater) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case d := <-u.updates:
+			if err := u.client.CreateMetricDescriptors(ctx, []*metric_pb.MetricDescriptor{d}); err != nil {
+				level.Warn(u.logger).Log("msg", "Updating metric descriptor failed", "metric", d.Type, "err", err)
+				u.forget(d)
+			}
+		}
+	}
+}
+
+// forget drops the recorded description so a later series refresh queues the
+// update again.
+func (u *DescriptorUpdater) forget(d *metric_pb.MetricDescriptor) {
+	u.mtx.Lock()
+	if u.descriptions[d.Type] == d.Description {
+		delete(u.descriptions, d.Type)
+	}
+	u.mtx.Unlock()
+}
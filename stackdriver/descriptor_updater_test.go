@@ -0,0 +1,107 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+	monitoring "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/grpc"
+)
+
+// descriptorTestServer records the metric descriptors it receives.
+type descriptorTestServer struct {
+	metricServiceServer
+	mtx         sync.Mutex
+	descriptors []*metric_pb.MetricDescriptor
+}
+
+func (s *descriptorTestServer) CreateMetricDescriptor(ctx context.Context, req *monitoring.CreateMetricDescriptorRequest) (*metric_pb.MetricDescriptor, error) {
+	s.mtx.Lock()
+	s.descriptors = append(s.descriptors, req.MetricDescriptor)
+	s.mtx.Unlock()
+	return req.MetricDescriptor, nil
+}
+
+func (s *descriptorTestServer) received() []*metric_pb.MetricDescriptor {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return append([]*metric_pb.MetricDescriptor{}, s.descriptors...)
+}
+
+func TestDescriptorUpdater(t *testing.T) {
+	listener := newLocalListener()
+	grpcServer := grpc.NewServer()
+	server := &descriptorTestServer{}
+	monitoring.RegisterMetricServiceServer(grpcServer, server)
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	serverURL, err := url.Parse("https://" + listener.Addr().String() + "?auth=false")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(&ClientConfig{
+		ProjectID: "projects/1234",
+		URL:       serverURL,
+		Timeout:   time.Second,
+	})
+	defer c.Close()
+
+	u := NewDescriptorUpdater(nil, NewMetadataClient(nil, c, 100, 1))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go u.Run(ctx)
+
+	ts := &monitoring.TimeSeries{
+		Metric: &metric_pb.Metric{
+			Type:   "external.googleapis.com/prometheus/metric1",
+			Labels: map[string]string{"a": "1"},
+		},
+		MetricKind: metric_pb.MetricDescriptor_CUMULATIVE,
+		ValueType:  metric_pb.MetricDescriptor_DOUBLE,
+	}
+	// Unchanged HELP text must result in a single descriptor write; a changed
+	// HELP text triggers another one.
+	u.UpdateDescriptor(ts, "first help")
+	u.UpdateDescriptor(ts, "first help")
+	u.UpdateDescriptor(ts, "second help")
+	u.UpdateDescriptor(ts, "")
+
+	var got []*metric_pb.MetricDescriptor
+	for i := 0; i < 100; i++ {
+		if got = server.received(); len(got) >= 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 descriptor writes, got %d", len(got))
+	}
+	if got[0].Description != "first help" || got[1].Description != "second help" {
+		t.Errorf("unexpected descriptions: %q, %q", got[0].Description, got[1].Description)
+	}
+	if got[0].Type != "external.googleapis.com/prometheus/metric1" {
+		t.Errorf("unexpected descriptor type %q", got[0].Type)
+	}
+	if len(got[0].Labels) != 1 || got[0].Labels[0].Key != "a" {
+		t.Errorf("unexpected descriptor labels %v", got[0].Labels)
+	}
+}
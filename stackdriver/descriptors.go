@@ -0,0 +1,177 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	label_pb "google.golang.org/genproto/googleapis/api/label"
+	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+	monitoring "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DescriptorConfig is the declarative description of a single metric
+// descriptor that should be registered before any points are written.
+type DescriptorConfig struct {
+	Metric      string   `json:"metric"`
+	Description string   `json:"description"`
+	Unit        string   `json:"unit"`
+	MetricKind  string   `json:"metric_kind"`
+	ValueType   string   `json:"value_type"`
+	Labels      []string `json:"labels"`
+}
+
+// BuildMetricDescriptor translates a descriptor config into the Monitoring API
+// representation. The metric type is derived from the given prefix and the
+// Prometheus metric name.
+func BuildMetricDescriptor(prefix string, dc DescriptorConfig) (*metric_pb.MetricDescriptor, error) {
+	if dc.Metric == "" {
+		return nil, errors.New("descriptor must set a metric name")
+	}
+	var kind metric_pb.MetricDescriptor_MetricKind
+	switch dc.MetricKind {
+	case "gauge":
+		kind = metric_pb.MetricDescriptor_GAUGE
+	case "cumulative":
+		kind = metric_pb.MetricDescriptor_CUMULATIVE
+	case "delta":
+		kind = metric_pb.MetricDescriptor_DELTA
+	default:
+		return nil, errors.Errorf("invalid metric kind %q for metric %s", dc.MetricKind, dc.Metric)
+	}
+	var valueType metric_pb.MetricDescriptor_ValueType
+	switch dc.ValueType {
+	case "double":
+		valueType = metric_pb.MetricDescriptor_DOUBLE
+	case "int64":
+		valueType = metric_pb.MetricDescriptor_INT64
+	case "bool":
+		valueType = metric_pb.MetricDescriptor_BOOL
+	case "distribution":
+		valueType = metric_pb.MetricDescriptor_DISTRIBUTION
+	default:
+		return nil, errors.Errorf("invalid value type %q for metric %s", dc.ValueType, dc.Metric)
+	}
+	d := &metric_pb.MetricDescriptor{
+		Type:        prefix + "/" + dc.Metric,
+		Description: dc.Description,
+		Unit:        dc.Unit,
+		MetricKind:  kind,
+		ValueType:   valueType,
+	}
+	for _, l := range dc.Labels {
+		d.Labels = append(d.Labels, &label_pb.LabelDescriptor{
+			Key:       l,
+			ValueType: label_pb.LabelDescriptor_STRING,
+		})
+	}
+	return d, nil
+}
+
+// CreateMetricDescriptors registers the given metric descriptors with the
+// Monitoring API. Existing descriptors of the same type are updated.
+func (c *Client) CreateMetricDescriptors(ctx context.Context, descriptors []*metric_pb.MetricDescriptor) error {
+	conn, err := c.getConnection(ctx)
+	if err != nil {
+		return errors.Wrap(err, "connect to Monitoring API")
+	}
+	service := monitoring.NewMetricServiceClient(conn)
+
+	for _, d := range descriptors {
+		req := &monitoring.CreateMetricDescriptorRequest{
+			Name:             c.projectID,
+			MetricDescriptor: d,
+		}
+		if _, err := service.CreateMetricDescriptor(ctx, req); err != nil {
+			return errors.Wrapf(err, "create metric descriptor %s", d.Type)
+		}
+	}
+	return nil
+}
+
+// ListMetricDescriptors returns all metric descriptors of the project whose
+// type starts with the given prefix.
+func (c *Client) ListMetricDescriptors(ctx context.Context, prefix string) ([]*metric_pb.MetricDescriptor, error) {
+	conn, err := c.getConnection(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "connect to Monitoring API")
+	}
+	service := monitoring.NewMetricServiceClient(conn)
+
+	var (
+		descriptors []*metric_pb.MetricDescriptor
+		pageToken   string
+	)
+	for {
+		resp, err := service.ListMetricDescriptors(ctx, &monitoring.ListMetricDescriptorsRequest{
+			Name:      c.projectID,
+			Filter:    fmt.Sprintf(`metric.type = starts_with("%s/")`, prefix),
+			PageToken: pageToken,
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "list metric descriptors under %q", prefix)
+		}
+		descriptors = append(descriptors, resp.MetricDescriptors...)
+		if resp.NextPageToken == "" {
+			return descriptors, nil
+		}
+		pageToken = resp.NextPageToken
+	}
+}
+
+// GetMetricDescriptor returns the metric descriptor registered for the given
+// metric type, or nil if the project has none.
+func (c *Client) GetMetricDescriptor(ctx context.Context, metricType string) (*metric_pb.MetricDescriptor, error) {
+	conn, err := c.getConnection(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "connect to Monitoring API")
+	}
+	service := monitoring.NewMetricServiceClient(conn)
+
+	d, err := service.GetMetricDescriptor(ctx, &monitoring.GetMetricDescriptorRequest{
+		Name: c.projectID + "/metricDescriptors/" + metricType,
+	})
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "get metric descriptor %s", metricType)
+	}
+	return d, nil
+}
+
+// RewriteDescriptorPrefix returns copies of the given descriptors with the
+// old metric type prefix replaced by the new one. Descriptors not under the
+// old prefix are skipped. The name field is cleared since the copies have
+// not been created yet.
+func RewriteDescriptorPrefix(descriptors []*metric_pb.MetricDescriptor, oldPrefix, newPrefix string) []*metric_pb.MetricDescriptor {
+	rewritten := make([]*metric_pb.MetricDescriptor, 0, len(descriptors))
+	for _, d := range descriptors {
+		if !strings.HasPrefix(d.Type, oldPrefix+"/") {
+			continue
+		}
+		r := proto.Clone(d).(*metric_pb.MetricDescriptor)
+		r.Name = ""
+		r.Type = newPrefix + strings.TrimPrefix(d.Type, oldPrefix)
+		rewritten = append(rewritten, r)
+	}
+	return rewritten
+}
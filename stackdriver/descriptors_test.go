@@ -0,0 +1,87 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"testing"
+
+	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+)
+
+func TestBuildMetricDescriptor(t *testing.T) {
+	d, err := BuildMetricDescriptor("external.googleapis.com/prometheus", DescriptorConfig{
+		Metric:      "http_requests_total",
+		Description: "total requests",
+		Unit:        "1",
+		MetricKind:  "cumulative",
+		ValueType:   "int64",
+		Labels:      []string{"method", "code"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "external.googleapis.com/prometheus/http_requests_total"; d.Type != want {
+		t.Errorf("unexpected type %q, want %q", d.Type, want)
+	}
+	if d.MetricKind != metric_pb.MetricDescriptor_CUMULATIVE {
+		t.Errorf("unexpected metric kind %v", d.MetricKind)
+	}
+	if d.ValueType != metric_pb.MetricDescriptor_INT64 {
+		t.Errorf("unexpected value type %v", d.ValueType)
+	}
+	if len(d.Labels) != 2 || d.Labels[0].Key != "method" {
+		t.Errorf("unexpected labels %v", d.Labels)
+	}
+
+	for _, dc := range []DescriptorConfig{
+		{Metric: "", MetricKind: "gauge", ValueType: "double"},
+		{Metric: "m", MetricKind: "bogus", ValueType: "double"},
+		{Metric: "m", MetricKind: "gauge", ValueType: "bogus"},
+	} {
+		if _, err := BuildMetricDescriptor("p", dc); err == nil {
+			t.Errorf("expected error for config %+v", dc)
+		}
+	}
+}
+
+func TestRewriteDescriptorPrefix(t *testing.T) {
+	descriptors := []*metric_pb.MetricDescriptor{
+		{
+			Name:       "projects/p/metricDescriptors/external.googleapis.com%2Fprometheus%2Fmetric1",
+			Type:       "external.googleapis.com/prometheus/metric1",
+			MetricKind: metric_pb.MetricDescriptor_CUMULATIVE,
+			ValueType:  metric_pb.MetricDescriptor_INT64,
+		},
+		// Not under the old prefix, must be skipped.
+		{Type: "custom.googleapis.com/other/metric2"},
+	}
+	rewritten := RewriteDescriptorPrefix(descriptors, "external.googleapis.com/prometheus", "custom.googleapis.com/migrated")
+	if len(rewritten) != 1 {
+		t.Fatalf("expected 1 rewritten descriptor, got %d", len(rewritten))
+	}
+	if want := "custom.googleapis.com/migrated/metric1"; rewritten[0].Type != want {
+		t.Errorf("unexpected type %q, want %q", rewritten[0].Type, want)
+	}
+	if rewritten[0].Name != "" {
+		t.Errorf("expected cleared name, got %q", rewritten[0].Name)
+	}
+	if rewritten[0].MetricKind != metric_pb.MetricDescriptor_CUMULATIVE {
+		t.Errorf("unexpected metric kind %v", rewritten[0].MetricKind)
+	}
+	// The input descriptor is not modified.
+	if descriptors[0].Type != "external.googleapis.com/prometheus/metric1" {
+		t.Errorf("input descriptor was modified: %q", descriptors[0].Type)
+	}
+}
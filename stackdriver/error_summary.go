@@ -0,0 +1,138 @@
+/*
+Copyright 2020 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stackdriver
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"google.golang.org/grpc/codes"
+)
+
+// errorClass identifies one class of CreateTimeSeries failures.
+type errorClass struct {
+	code       codes.Code
+	metricType string
+}
+
+// ErrorClassCount is one row of the error summary: how often an error class
+// occurred since startup and when it was last seen.
+type ErrorClassCount struct {
+	Code       string
+	MetricType string
+	Count      int64
+	LastSeen   time.Time
+}
+
+// ErrorSummary aggregates CreateTimeSeries failures by status code and metric
+// type so each distinct error class is logged once per interval with a count
+// instead of once per rejected batch.
+type ErrorSummary struct {
+	logger   log.Logger
+	interval time.Duration
+	quit     chan struct{}
+
+	mtx sync.Mutex
+	// Counts of the current logging interval, cleared on every flush.
+	pending map[errorClass]int64
+	// Counts since startup, served through Summary.
+	total map[errorClass]*ErrorClassCount
+}
+
+// NewErrorSummary creates an error summary that logs the error classes seen
+// during each interval once the interval ends.
+func NewErrorSummary(logger log.Logger, interval time.Duration) *ErrorSummary {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	s := &ErrorSummary{
+		logger:   logger,
+		interval: interval,
+		quit:     make(chan struct{}),
+		pending:  map[errorClass]int64{},
+		total:    map[errorClass]*ErrorClassCount{},
+	}
+	go s.logLoop()
+	return s
+}
+
+// Record counts one failure of the given class.
+func (s *ErrorSummary) Record(code codes.Code, metricType string) {
+	class := errorClass{code: code, metricType: metricType}
+	s.mtx.Lock()
+	s.pending[class]++
+	t, ok := s.total[class]
+	if !ok {
+		t = &ErrorClassCount{Code: code.String(), MetricType: metricType}
+		s.total[class] = t
+	}
+	t.Count++
+	t.LastSeen = time.Now()
+	s.mtx.Unlock()
+}
+
+func (s *ErrorSummary) logLoop() {
+	tick := time.NewTicker(s.interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-tick.C:
+			s.flush()
+		}
+	}
+}
+
+// flush writes one log line per error class seen since the last flush.
+func (s *ErrorSummary) flush() {
+	s.mtx.Lock()
+	pending := s.pending
+	s.pending = map[errorClass]int64{}
+	s.mtx.Unlock()
+
+	for class, count := range pending {
+		level.Warn(s.logger).Log("msg", "Writes failed",
+			"code", class.code.String(), "metric_type", class.metricType, "count", count)
+	}
+}
+
+// Summary returns the cumulative counts of all error classes, ordered by
+// descending count.
+func (s *ErrorSummary) Summary() []ErrorClassCount {
+	s.mtx.Lock()
+	out := make([]ErrorClassCount, 0, len(s.total))
+	for _, t := range s.total {
+		out = append(out, *t)
+	}
+	s.mtx.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		if out[i].Code != out[j].Code {
+			return out[i].Code < out[j].Code
+		}
+		return out[i].MetricType < out[j].MetricType
+	})
+	return out
+}
+
+// Close stops the periodic logging.
+func (s *ErrorSummary) Close() {
+	close(s.quit)
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2020 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stackdriver
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"google.golang.org/grpc/codes"
+)
+
+func TestErrorSummary(t *testing.T) {
+	logBuffer := &bytes.Buffer{}
+	s := NewErrorSummary(log.NewLogfmtLogger(log.NewSyncWriter(logBuffer)), time.Hour)
+	defer s.Close()
+
+	s.Record(codes.InvalidArgument, "external.googleapis.com/prometheus/metric1")
+	s.Record(codes.InvalidArgument, "external.googleapis.com/prometheus/metric1")
+	s.Record(codes.NotFound, "external.googleapis.com/prometheus/metric2")
+
+	summary := s.Summary()
+	if len(summary) != 2 {
+		t.Fatalf("expected 2 error classes, got %d", len(summary))
+	}
+	if summary[0].Code != "InvalidArgument" || summary[0].Count != 2 {
+		t.Errorf("unexpected first error class %+v", summary[0])
+	}
+	if summary[1].Code != "NotFound" || summary[1].Count != 1 {
+		t.Errorf("unexpected second error class %+v", summary[1])
+	}
+
+	// A flush logs each pending class once and leaves the cumulative counts
+	// untouched.
+	s.flush()
+	if got := strings.Count(logBuffer.String(), "Writes failed"); got != 2 {
+		t.Errorf("expected 2 log lines, got %d: %v", got, logBuffer)
+	}
+	logBuffer.Reset()
+	s.flush()
+	if logBuffer.Len() != 0 {
+		t.Errorf("expected no log lines after flushing again, got: %v", logBuffer)
+	}
+	if summary := s.Summary(); len(summary) != 2 {
+		t.Errorf("expected 2 error classes after flush, got %d", len(summary))
+	}
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2020 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stackdriver
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/golang/protobuf/ptypes/duration"
+	"github.com/pkg/errors"
+	monitoring "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// HealthAlertPolicies returns the standard health alert policies for a
+// sidecar whose own metrics are exported under the given metric type prefix:
+// one each for replay lag, sample drop rate, and Monitoring API errors. The
+// policies require that Prometheus scrapes the sidecar so the metrics are
+// forwarded like any other series.
+func HealthAlertPolicies(prefix string) []*monitoring.AlertPolicy {
+	return []*monitoring.AlertPolicy{
+		// The progress file is rewritten every minute while the reader makes
+		// progress, so a stale file means the sidecar is stuck or far behind.
+		thresholdPolicy(
+			"Prometheus sidecar: WAL replay lag",
+			fmt.Sprintf(`metric.type="%s/prometheus_sidecar_progress_file_age_seconds"`, prefix),
+			monitoring.Aggregation_ALIGN_MAX,
+			1800,
+		),
+		// Samples that exhausted their retry budget are dropped for good.
+		thresholdPolicy(
+			"Prometheus sidecar: dropped samples",
+			fmt.Sprintf(`metric.type="%s/prometheus_remote_storage_failed_samples_total"`, prefix),
+			monitoring.Aggregation_ALIGN_RATE,
+			0,
+		),
+		// A persistently elevated retry rate points at API-side errors even
+		// if the retries eventually succeed.
+		thresholdPolicy(
+			"Prometheus sidecar: Monitoring API errors",
+			fmt.Sprintf(`metric.type="%s/prometheus_remote_storage_retried_sends_total"`, prefix),
+			monitoring.Aggregation_ALIGN_RATE,
+			1,
+		),
+	}
+}
+
+// thresholdPolicy builds a single-condition alert policy that fires when the
+// aligned value of the filtered series exceeds the threshold for five
+// minutes.
+func thresholdPolicy(name, filter string, aligner monitoring.Aggregation_Aligner, threshold float64) *monitoring.AlertPolicy {
+	return &monitoring.AlertPolicy{
+		DisplayName: name,
+		Combiner:    monitoring.AlertPolicy_OR,
+		Conditions: []*monitoring.AlertPolicy_Condition{{
+			DisplayName: name,
+			Condition: &monitoring.AlertPolicy_Condition_ConditionThreshold{
+				ConditionThreshold: &monitoring.AlertPolicy_Condition_MetricThreshold{
+					Filter: filter,
+					Aggregations: []*monitoring.Aggregation{{
+						AlignmentPeriod:  &duration.Duration{Seconds: 300},
+						PerSeriesAligner: aligner,
+					}},
+					Comparison:     monitoring.ComparisonType_COMPARISON_GT,
+					ThresholdValue: threshold,
+					Duration:       &duration.Duration{Seconds: 300},
+				},
+			},
+		}},
+	}
+}
+
+// CreateAlertPolicies registers the given alert policies in the client's
+// project. The credentials need a role that includes alert policy creation,
+// e.g. roles/monitoring.editor.
+func (c *Client) CreateAlertPolicies(ctx context.Context, policies []*monitoring.AlertPolicy) error {
+	conn, err := c.getConnection(ctx)
+	if err != nil {
+		return errors.Wrap(err, "connect to Monitoring API")
+	}
+	service := monitoring.NewAlertPolicyServiceClient(conn)
+
+	for _, p := range policies {
+		req := &monitoring.CreateAlertPolicyRequest{
+			Name:        c.projectID,
+			AlertPolicy: p,
+		}
+		if _, err := service.CreateAlertPolicy(ctx, req); err != nil {
+			return errors.Wrapf(err, "create alert policy %q", p.DisplayName)
+		}
+	}
+	return nil
+}
+
+// healthDashboardTemplate is the dashboard configuration in the format of the
+// Monitoring dashboards API, parameterized by the metric type prefix. The
+// dashboards API has no generated gRPC bindings in this tree, so the
+// configuration is emitted for import with gcloud.
+const healthDashboardTemplate = `{
+  "displayName": "Stackdriver Prometheus Sidecar",
+  "gridLayout": {
+    "columns": "2",
+    "widgets": [
+      {
+        "title": "Samples processed and produced per second",
+        "xyChart": {
+          "dataSets": [
+            {
+              "timeSeriesQuery": {
+                "timeSeriesFilter": {
+                  "filter": "metric.type=\"%[1]s/prometheus_sidecar_samples_processed\"",
+                  "aggregation": {"alignmentPeriod": "60s", "perSeriesAligner": "ALIGN_RATE"}
+                }
+              }
+            },
+            {
+              "timeSeriesQuery": {
+                "timeSeriesFilter": {
+                  "filter": "metric.type=\"%[1]s/prometheus_sidecar_samples_produced\"",
+                  "aggregation": {"alignmentPeriod": "60s", "perSeriesAligner": "ALIGN_RATE"}
+                }
+              }
+            }
+          ]
+        }
+      },
+      {
+        "title": "WAL replay lag",
+        "xyChart": {
+          "dataSets": [
+            {
+              "timeSeriesQuery": {
+                "timeSeriesFilter": {
+                  "filter": "metric.type=\"%[1]s/prometheus_sidecar_progress_file_age_seconds\"",
+                  "aggregation": {"alignmentPeriod": "60s", "perSeriesAligner": "ALIGN_MAX"}
+                }
+              }
+            }
+          ]
+        }
+      },
+      {
+        "title": "Queue length",
+        "xyChart": {
+          "dataSets": [
+            {
+              "timeSeriesQuery": {
+                "timeSeriesFilter": {
+                  "filter": "metric.type=\"%[1]s/prometheus_remote_storage_queue_length\"",
+                  "aggregation": {"alignmentPeriod": "60s", "perSeriesAligner": "ALIGN_MAX"}
+                }
+              }
+            }
+          ]
+        }
+      },
+      {
+        "title": "Failed and retried sends per second",
+        "xyChart": {
+          "dataSets": [
+            {
+              "timeSeriesQuery": {
+                "timeSeriesFilter": {
+                  "filter": "metric.type=\"%[1]s/prometheus_remote_storage_failed_samples_total\"",
+                  "aggregation": {"alignmentPeriod": "60s", "perSeriesAligner": "ALIGN_RATE"}
+                }
+              }
+            },
+            {
+              "timeSeriesQuery": {
+                "timeSeriesFilter": {
+                  "filter": "metric.type=\"%[1]s/prometheus_remote_storage_retried_sends_total\"",
+                  "aggregation": {"alignmentPeriod": "60s", "perSeriesAligner": "ALIGN_RATE"}
+                }
+              }
+            }
+          ]
+        }
+      }
+    ]
+  }
+}
+`
+
+// HealthDashboardJSON returns the standard sidecar health dashboard
+// configuration for the given metric type prefix.
+func HealthDashboardJSON(prefix string) string {
+	return fmt.Sprintf(healthDashboardTemplate, prefix)
+}
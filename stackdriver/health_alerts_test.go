@@ -0,0 +1,54 @@
+/*
+Copyright 2020 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stackdriver
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestHealthAlertPolicies(t *testing.T) {
+	const prefix = "external.googleapis.com/prometheus"
+	policies := HealthAlertPolicies(prefix)
+	if len(policies) != 3 {
+		t.Fatalf("expected 3 policies, got %d", len(policies))
+	}
+	for _, p := range policies {
+		if p.DisplayName == "" {
+			t.Errorf("policy without display name: %v", p)
+		}
+		if len(p.Conditions) != 1 {
+			t.Fatalf("expected 1 condition in policy %q, got %d", p.DisplayName, len(p.Conditions))
+		}
+		threshold := p.Conditions[0].GetConditionThreshold()
+		if threshold == nil {
+			t.Fatalf("expected threshold condition in policy %q", p.DisplayName)
+		}
+		if !strings.Contains(threshold.Filter, prefix+"/") {
+			t.Errorf("filter %q does not reference the metric prefix", threshold.Filter)
+		}
+	}
+}
+
+func TestHealthDashboardJSON(t *testing.T) {
+	const prefix = "custom.googleapis.com/testing"
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(HealthDashboardJSON(prefix)), &doc); err != nil {
+		t.Fatalf("dashboard configuration is not valid JSON: %s", err)
+	}
+	if !strings.Contains(HealthDashboardJSON(prefix), prefix+"/") {
+		t.Error("dashboard configuration does not reference the metric prefix")
+	}
+}
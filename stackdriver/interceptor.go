@@ -0,0 +1,88 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"plugin"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+var interceptorDroppedSamplesTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "interceptor_dropped_samples_total",
+		Help:      "Total number of samples dropped because the write interceptor returned an error.",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(interceptorDroppedSamplesTotal)
+}
+
+// WriteInterceptor inspects and optionally mutates each TimeSeries just
+// before it is queued for sending, e.g. to add a mandatory cost-center
+// metric label. The series passed in is the interceptor's own copy and may
+// be mutated freely. Returning an error drops the sample.
+// Implementations must be safe for concurrent use.
+type WriteInterceptor interface {
+	Intercept(series *monitoring_pb.TimeSeries) error
+}
+
+// WriteInterceptorFunc adapts a plain function to the WriteInterceptor
+// interface.
+type WriteInterceptorFunc func(*monitoring_pb.TimeSeries) error
+
+// Intercept implements WriteInterceptor.
+func (f WriteInterceptorFunc) Intercept(series *monitoring_pb.TimeSeries) error {
+	return f(series)
+}
+
+// NewPluginInterceptor loads a WriteInterceptor from a Go plugin, so users
+// can hook custom mutation logic into the sidecar without forking it. The
+// plugin must export either a variable "Interceptor" implementing
+// WriteInterceptor or a function
+//
+//	func Intercept(*monitoring_pb.TimeSeries) error
+//
+// Go plugins are only supported on some platforms; see the plugin package
+// documentation.
+func NewPluginInterceptor(path string) (WriteInterceptor, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open interceptor plugin %s", path)
+	}
+	if sym, err := p.Lookup("Interceptor"); err == nil {
+		if i, ok := sym.(WriteInterceptor); ok {
+			return i, nil
+		}
+		if i, ok := sym.(*WriteInterceptor); ok {
+			return *i, nil
+		}
+		return nil, errors.Errorf("symbol Interceptor in plugin %s does not implement WriteInterceptor", path)
+	}
+	sym, err := p.Lookup("Intercept")
+	if err != nil {
+		return nil, errors.Wrapf(err, "plugin %s exports neither Interceptor nor Intercept", path)
+	}
+	f, ok := sym.(func(*monitoring_pb.TimeSeries) error)
+	if !ok {
+		return nil, errors.Errorf("symbol Intercept in plugin %s has unexpected type %T", path, sym)
+	}
+	return WriteInterceptorFunc(f), nil
+}
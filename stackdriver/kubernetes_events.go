@@ -0,0 +1,165 @@
+/*
+Copyright 2020 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stackdriver
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// eventCreator is the subset of the Kubernetes events client the reporter
+// uses, separated out for testing.
+type eventCreator interface {
+	Create(*core_v1.Event) (*core_v1.Event, error)
+}
+
+// Event reasons attached to the sidecar's Pod. They show up in the Reason
+// column of `kubectl describe pod` and `kubectl get events`.
+const (
+	eventReasonPermissionDenied   = "SidecarPermissionDenied"
+	eventReasonDescriptorConflict = "SidecarDescriptorConflict"
+	eventReasonQuotaExhausted     = "SidecarQuotaExhausted"
+)
+
+// quotaEventThreshold is how many quota rejections must be observed before an
+// event is emitted. A single ResourceExhausted response can be a transient
+// spike; only persistent exhaustion is worth an operator's attention.
+const quotaEventThreshold = 10
+
+// EventReporter emits Kubernetes Events on the sidecar's own Pod for fatal
+// export conditions, so operators see them in `kubectl describe pod` without
+// trawling logs. Events are rate-limited per reason.
+type EventReporter struct {
+	logger      log.Logger
+	events      eventCreator
+	ref         core_v1.ObjectReference
+	minInterval time.Duration
+
+	mtx sync.Mutex
+	// lastSent is when an event was last emitted, per reason.
+	lastSent map[string]time.Time
+	// quotaStreak counts quota rejections since the last quota event.
+	quotaStreak int
+}
+
+// NewEventReporter creates a reporter that attaches events to the Pod named
+// by the POD_NAME and NAMESPACE_NAME downward API environment variables,
+// authenticating with the in-cluster service account credentials. The service
+// account needs permission to create events in the Pod's namespace.
+func NewEventReporter(logger log.Logger, minInterval time.Duration) (*EventReporter, error) {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	podName := os.Getenv("POD_NAME")
+	namespace := os.Getenv("NAMESPACE_NAME")
+	if podName == "" || namespace == "" {
+		return nil, errors.New("the POD_NAME and NAMESPACE_NAME environment variables must be set through the downward API")
+	}
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "in-cluster configuration")
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating Kubernetes client")
+	}
+	return &EventReporter{
+		logger:      logger,
+		events:      clientset.CoreV1().Events(namespace),
+		ref:         core_v1.ObjectReference{Kind: "Pod", Name: podName, Namespace: namespace},
+		minInterval: minInterval,
+		lastSent:    map[string]time.Time{},
+	}, nil
+}
+
+// ReportPermissionDenied emits an event for writes rejected over missing
+// credentials or permissions. This condition never resolves on its own.
+func (r *EventReporter) ReportPermissionDenied(err error) {
+	if r == nil {
+		return
+	}
+	r.emit(eventReasonPermissionDenied, fmt.Sprintf(
+		"Writing time series to the Monitoring API failed: %s. Grant the sidecar's credentials a role that includes the monitoring.timeSeries.create permission, e.g. roles/monitoring.metricWriter.", err))
+}
+
+// ReportDescriptorConflict emits an event for writes rejected because the
+// series conflicts with the registered metric descriptor.
+func (r *EventReporter) ReportDescriptorConflict(metricType string, err error) {
+	if r == nil {
+		return
+	}
+	r.emit(eventReasonDescriptorConflict, fmt.Sprintf(
+		"Time series for %s conflict with the registered metric descriptor: %s. Delete the descriptor or configure --stackdriver.on-descriptor-label-mismatch.", metricType, err))
+}
+
+// ReportQuotaExhausted counts a quota rejection and emits an event once the
+// rejections persist.
+func (r *EventReporter) ReportQuotaExhausted(err error) {
+	if r == nil {
+		return
+	}
+	r.mtx.Lock()
+	r.quotaStreak++
+	persistent := r.quotaStreak >= quotaEventThreshold
+	if persistent {
+		r.quotaStreak = 0
+	}
+	r.mtx.Unlock()
+	if !persistent {
+		return
+	}
+	r.emit(eventReasonQuotaExhausted, fmt.Sprintf(
+		"The Monitoring API persistently rejects writes over exhausted quota: %s. Request a quota increase or reduce the exported series through --include or counter aggregation.", err))
+}
+
+// emit creates a Warning event on the Pod unless one with the same reason was
+// emitted within the rate limit interval.
+func (r *EventReporter) emit(reason, message string) {
+	r.mtx.Lock()
+	if time.Since(r.lastSent[reason]) < r.minInterval {
+		r.mtx.Unlock()
+		return
+	}
+	r.lastSent[reason] = time.Now()
+	r.mtx.Unlock()
+
+	now := meta_v1.Time{Time: time.Now()}
+	_, err := r.events.Create(&core_v1.Event{
+		ObjectMeta: meta_v1.ObjectMeta{
+			GenerateName: "stackdriver-prometheus-sidecar.",
+			Namespace:    r.ref.Namespace,
+		},
+		InvolvedObject: r.ref,
+		Reason:         reason,
+		Message:        message,
+		Type:           core_v1.EventTypeWarning,
+		Source:         core_v1.EventSource{Component: "stackdriver-prometheus-sidecar"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	})
+	if err != nil {
+		level.Warn(r.logger).Log("msg", "Emitting Kubernetes event failed", "reason", reason, "err", err)
+	}
+}
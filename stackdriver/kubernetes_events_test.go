@@ -0,0 +1,89 @@
+/*
+Copyright 2020 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stackdriver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	core_v1 "k8s.io/api/core/v1"
+)
+
+type fakeEventCreator struct {
+	events []*core_v1.Event
+}
+
+func (f *fakeEventCreator) Create(e *core_v1.Event) (*core_v1.Event, error) {
+	f.events = append(f.events, e)
+	return e, nil
+}
+
+func newTestEventReporter(creator eventCreator, minInterval time.Duration) *EventReporter {
+	return &EventReporter{
+		events:      creator,
+		ref:         core_v1.ObjectReference{Kind: "Pod", Name: "pod1", Namespace: "ns1"},
+		minInterval: minInterval,
+		lastSent:    map[string]time.Time{},
+	}
+}
+
+func TestEventReporterRateLimit(t *testing.T) {
+	creator := &fakeEventCreator{}
+	r := newTestEventReporter(creator, time.Hour)
+
+	err := errors.New("rpc error: code = PermissionDenied")
+	r.ReportPermissionDenied(err)
+	r.ReportPermissionDenied(err)
+
+	if len(creator.events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(creator.events))
+	}
+	e := creator.events[0]
+	if e.Reason != eventReasonPermissionDenied {
+		t.Errorf("unexpected reason %q", e.Reason)
+	}
+	if e.Type != core_v1.EventTypeWarning {
+		t.Errorf("unexpected event type %q", e.Type)
+	}
+	if e.InvolvedObject.Name != "pod1" || e.InvolvedObject.Namespace != "ns1" {
+		t.Errorf("unexpected involved object %v", e.InvolvedObject)
+	}
+
+	// A different reason is not affected by the permission event's limit.
+	r.ReportDescriptorConflict("external.googleapis.com/prometheus/metric1", err)
+	if len(creator.events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(creator.events))
+	}
+}
+
+func TestEventReporterQuotaThreshold(t *testing.T) {
+	creator := &fakeEventCreator{}
+	r := newTestEventReporter(creator, 0)
+
+	err := errors.New("rpc error: code = ResourceExhausted")
+	for i := 0; i < quotaEventThreshold-1; i++ {
+		r.ReportQuotaExhausted(err)
+	}
+	if len(creator.events) != 0 {
+		t.Fatalf("expected no event below the threshold, got %d", len(creator.events))
+	}
+	r.ReportQuotaExhausted(err)
+	if len(creator.events) != 1 {
+		t.Fatalf("expected 1 event at the threshold, got %d", len(creator.events))
+	}
+	if creator.events[0].Reason != eventReasonQuotaExhausted {
+		t.Errorf("unexpected reason %q", creator.events[0].Reason)
+	}
+}
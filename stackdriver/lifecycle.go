@@ -0,0 +1,97 @@
+/*
+Copyright 2020 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stackdriver
+
+import (
+	"strings"
+	"time"
+
+	timestamp_pb "github.com/golang/protobuf/ptypes/timestamp"
+	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+	monitoredres_pb "google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoring "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// lifecycleMetricSuffix is appended to the metrics prefix to form the type of
+// the lifecycle event metric.
+const lifecycleMetricSuffix = "/sidecar/lifecycle"
+
+// LifecycleReporter writes a synthetic gauge point on sidecar startup and
+// shutdown, labeled with the event, binary version, and a hash of the
+// effective configuration. Gaps in customer dashboards can then be correlated
+// with sidecar restarts and config changes by charting the lifecycle metric
+// alongside.
+type LifecycleReporter struct {
+	client     *Client
+	metricType string
+	resource   *monitoredres_pb.MonitoredResource
+	version    string
+	configHash string
+}
+
+// NewLifecycleReporter returns a reporter writing through the given client.
+// The metric type is built from the metrics prefix, and the points are
+// written against the global resource of the project named by the
+// "projects/<id>" resource string.
+func NewLifecycleReporter(client *Client, projectIDResource, metricsPrefix, version, configHash string) *LifecycleReporter {
+	return &LifecycleReporter{
+		client:     client,
+		metricType: metricsPrefix + lifecycleMetricSuffix,
+		resource: &monitoredres_pb.MonitoredResource{
+			Type: "global",
+			Labels: map[string]string{
+				"project_id": strings.TrimPrefix(projectIDResource, "projects/"),
+			},
+		},
+		version:    version,
+		configHash: configHash,
+	}
+}
+
+// ReportStartup writes the startup event point.
+func (r *LifecycleReporter) ReportStartup() error {
+	return r.report("startup")
+}
+
+// ReportShutdown writes the shutdown event point.
+func (r *LifecycleReporter) ReportShutdown() error {
+	return r.report("shutdown")
+}
+
+func (r *LifecycleReporter) report(event string) error {
+	now := time.Now()
+	return r.client.Store(&monitoring.CreateTimeSeriesRequest{
+		TimeSeries: []*monitoring.TimeSeries{{
+			Metric: &metric_pb.Metric{
+				Type: r.metricType,
+				Labels: map[string]string{
+					"event":       event,
+					"version":     r.version,
+					"config_hash": r.configHash,
+				},
+			},
+			Resource:   r.resource,
+			MetricKind: metric_pb.MetricDescriptor_GAUGE,
+			ValueType:  metric_pb.MetricDescriptor_INT64,
+			Points: []*monitoring.Point{{
+				Interval: &monitoring.TimeInterval{
+					EndTime: &timestamp_pb.Timestamp{Seconds: now.Unix(), Nanos: int32(now.Nanosecond())},
+				},
+				Value: &monitoring.TypedValue{
+					Value: &monitoring.TypedValue_Int64Value{Int64Value: 1},
+				},
+			}},
+		}},
+	})
+}
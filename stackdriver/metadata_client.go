@@ -0,0 +1,142 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
+	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// metadataRetryBackoff is the initial delay before a failed descriptor call
+// is retried. It doubles on every attempt up to metadataMaxBackoff.
+const (
+	metadataRetryBackoff = time.Second
+	metadataMaxBackoff   = 30 * time.Second
+)
+
+// MetadataClient issues metric descriptor calls over a connection dedicated
+// to metadata traffic, with its own rate limit and retry policy. It keeps
+// descriptor churn from contending with point writes, which use separate
+// clients and quota.
+type MetadataClient struct {
+	logger     log.Logger
+	client     *Client
+	limiter    *rate.Limiter
+	maxRetries int
+}
+
+// NewMetadataClient wraps the given client, which must not be shared with the
+// write path. Calls are limited to maxRate per second and retriable errors
+// are retried with backoff up to maxRetries attempts; zero allows unlimited
+// retries.
+func NewMetadataClient(logger log.Logger, client *Client, maxRate float64, maxRetries int) *MetadataClient {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	burst := int(maxRate)
+	if burst < 1 {
+		burst = 1
+	}
+	return &MetadataClient{
+		logger:     logger,
+		client:     client,
+		limiter:    rate.NewLimiter(rate.Limit(maxRate), burst),
+		maxRetries: maxRetries,
+	}
+}
+
+// CreateMetricDescriptors registers the given metric descriptors, subject to
+// the client's rate limit and retry policy.
+func (m *MetadataClient) CreateMetricDescriptors(ctx context.Context, descriptors []*metric_pb.MetricDescriptor) error {
+	return m.call(ctx, "create metric descriptors", func() error {
+		return m.client.CreateMetricDescriptors(ctx, descriptors)
+	})
+}
+
+// GetMetricDescriptor returns the metric descriptor registered for the given
+// metric type, or nil if the project has none.
+func (m *MetadataClient) GetMetricDescriptor(ctx context.Context, metricType string) (*metric_pb.MetricDescriptor, error) {
+	var d *metric_pb.MetricDescriptor
+	err := m.call(ctx, "get metric descriptor", func() error {
+		var err error
+		d, err = m.client.GetMetricDescriptor(ctx, metricType)
+		return err
+	})
+	return d, err
+}
+
+// ListMetricDescriptors returns all metric descriptors of the project whose
+// type starts with the given prefix.
+func (m *MetadataClient) ListMetricDescriptors(ctx context.Context, prefix string) ([]*metric_pb.MetricDescriptor, error) {
+	var ds []*metric_pb.MetricDescriptor
+	err := m.call(ctx, "list metric descriptors", func() error {
+		var err error
+		ds, err = m.client.ListMetricDescriptors(ctx, prefix)
+		return err
+	})
+	return ds, err
+}
+
+// Close releases the resources of the underlying client.
+func (m *MetadataClient) Close() error {
+	return m.client.Close()
+}
+
+// call runs f after acquiring a rate limiter token, retrying retriable errors
+// with exponential backoff.
+func (m *MetadataClient) call(ctx context.Context, op string, f func() error) error {
+	backoff := metadataRetryBackoff
+	for attempts := 1; ; attempts++ {
+		if err := m.limiter.Wait(ctx); err != nil {
+			return err
+		}
+		err := f()
+		if err == nil || !metadataRetriable(err) {
+			return err
+		}
+		if m.maxRetries > 0 && attempts >= m.maxRetries {
+			return err
+		}
+		level.Warn(m.logger).Log("msg", "Retrying metadata call", "op", op, "attempt", attempts, "err", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > metadataMaxBackoff {
+			backoff = metadataMaxBackoff
+		}
+	}
+}
+
+// metadataRetriable reports whether a failed descriptor call is worth
+// retrying. Descriptor calls share none of the write path's quota, so only
+// transient conditions qualify.
+func metadataRetriable(err error) bool {
+	switch status.Code(errors.Cause(err)) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
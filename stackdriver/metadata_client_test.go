@@ -0,0 +1,93 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+	monitoring "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// flakyMetadataServer fails a number of requests with Unavailable before
+// succeeding.
+type flakyMetadataServer struct {
+	metricServiceServer
+	mtx      sync.Mutex
+	failures int
+	requests int
+}
+
+func (s *flakyMetadataServer) GetMetricDescriptor(ctx context.Context, req *monitoring.GetMetricDescriptorRequest) (*metric_pb.MetricDescriptor, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.requests++
+	if s.failures > 0 {
+		s.failures--
+		return nil, status.Error(codes.Unavailable, "flaky")
+	}
+	return &metric_pb.MetricDescriptor{Type: "external.googleapis.com/prometheus/metric1"}, nil
+}
+
+func TestMetadataClient_Retry(t *testing.T) {
+	listener := newLocalListener()
+	grpcServer := grpc.NewServer()
+	server := &flakyMetadataServer{failures: 2}
+	monitoring.RegisterMetricServiceServer(grpcServer, server)
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	serverURL, err := url.Parse("https://" + listener.Addr().String() + "?auth=false")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(&ClientConfig{
+		ProjectID: "projects/1234",
+		URL:       serverURL,
+		Timeout:   time.Second,
+	})
+	defer c.Close()
+
+	m := NewMetadataClient(nil, c, 100, 0)
+	d, err := m.GetMetricDescriptor(context.Background(), "external.googleapis.com/prometheus/metric1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d == nil || d.Type != "external.googleapis.com/prometheus/metric1" {
+		t.Fatalf("unexpected descriptor %v", d)
+	}
+	if server.requests != 3 {
+		t.Fatalf("expected 3 attempts, got %d", server.requests)
+	}
+
+	// With exhausted retries the last error is returned.
+	server.failures = 2
+	server.requests = 0
+	m = NewMetadataClient(nil, c, 100, 2)
+	if _, err := m.GetMetricDescriptor(context.Background(), "external.googleapis.com/prometheus/metric1"); status.Code(errors.Cause(err)) != codes.Unavailable {
+		t.Fatalf("expected Unavailable error, got %v", err)
+	}
+	if server.requests != 2 {
+		t.Fatalf("expected 2 attempts, got %d", server.requests)
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2/google"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+const pubSubScope = "https://www.googleapis.com/auth/pubsub"
+
+// PubSubClientConfig configures a PubSubClient.
+type PubSubClientConfig struct {
+	Logger log.Logger
+	// Topic is the full topic resource name, "projects/<project>/topics/<topic>".
+	Topic   string
+	Timeout time.Duration
+	// DisableAuth disables OAuth authentication, for use against emulators.
+	DisableAuth bool
+	// Endpoint overrides the Pub/Sub API base URL, for use in tests.
+	Endpoint string
+}
+
+// PubSubClient publishes converted series to a Pub/Sub topic, so custom
+// downstream pipelines can consume the sidecar's conversion output. Each
+// TimeSeries is published as one serialized protobuf message whose ordering
+// key is a hash of the series identity, keeping points of a series in order
+// for subscribers that enable ordered delivery.
+// Implements StorageClient.
+type PubSubClient struct {
+	logger  log.Logger
+	cfg     *PubSubClientConfig
+	url     string
+	timeout time.Duration
+	client  *http.Client
+}
+
+// NewPubSubClient returns a client publishing to the configured topic.
+func NewPubSubClient(cfg *PubSubClientConfig) *PubSubClient {
+	logger := cfg.Logger
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "https://pubsub.googleapis.com"
+	}
+	return &PubSubClient{
+		logger:  logger,
+		cfg:     cfg,
+		timeout: cfg.Timeout,
+		url:     fmt.Sprintf("%s/v1/%s:publish", endpoint, cfg.Topic),
+	}
+}
+
+type pubSubPublishRequest struct {
+	Messages []pubSubMessage `json:"messages"`
+}
+
+type pubSubMessage struct {
+	// Data is base64-encoded by the JSON encoder, as the API expects.
+	Data        []byte `json:"data"`
+	OrderingKey string `json:"orderingKey,omitempty"`
+}
+
+// Store implements StorageClient.
+func (c *PubSubClient) Store(req *monitoring_pb.CreateTimeSeriesRequest) error {
+	if c.client == nil {
+		if err := c.initClient(); err != nil {
+			return err
+		}
+	}
+	publish := pubSubPublishRequest{Messages: make([]pubSubMessage, 0, len(req.TimeSeries))}
+	for _, ts := range req.TimeSeries {
+		data, err := proto.Marshal(ts)
+		if err != nil {
+			return errors.Wrap(err, "marshal time series")
+		}
+		publish.Messages = append(publish.Messages, pubSubMessage{
+			Data:        data,
+			OrderingKey: seriesOrderingKey(ts),
+		})
+	}
+	if len(publish.Messages) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(&publish)
+	if err != nil {
+		return errors.Wrap(err, "marshal publish request")
+	}
+	ctx := context.Background()
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	httpReq, err := http.NewRequest("POST", c.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "create publish request")
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(httpReq.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "publish messages")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("publish messages: unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func (c *PubSubClient) initClient() error {
+	if c.cfg.DisableAuth {
+		c.client = http.DefaultClient
+		return nil
+	}
+	client, err := google.DefaultClient(context.Background(), pubSubScope)
+	if err != nil {
+		return errors.Wrap(err, "create Pub/Sub HTTP client")
+	}
+	c.client = client
+	return nil
+}
+
+// Close implements StorageClient.
+func (c *PubSubClient) Close() error {
+	return nil
+}
+
+// seriesOrderingKey hashes the series identity - resource and metric type
+// plus all their labels - so all points of one series share an ordering key.
+func seriesOrderingKey(ts *monitoring_pb.TimeSeries) string {
+	h := fnv.New64a()
+	h.Write([]byte(ts.Resource.GetType()))
+	writeSortedLabels(h, ts.Resource.GetLabels())
+	h.Write([]byte(ts.Metric.GetType()))
+	writeSortedLabels(h, ts.Metric.GetLabels())
+	return fmt.Sprintf("%x", h.Sum64())
+}
+
+func writeSortedLabels(h io.Writer, labels map[string]string) {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		h.Write([]byte(name))
+		h.Write([]byte{0xff})
+		h.Write([]byte(labels[name]))
+		h.Write([]byte{0xff})
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	timestamp_pb "github.com/golang/protobuf/ptypes/timestamp"
+	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+	monitoredres_pb "google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoring "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+func TestPubSubClientStore(t *testing.T) {
+	var (
+		gotPath string
+		gotBody pubSubPublishRequest
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		if err := json.NewDecoder(r.Body).Decode(&gotBody); err != nil {
+			t.Errorf("decoding request failed: %s", err)
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	c := NewPubSubClient(&PubSubClientConfig{
+		Topic:       "projects/proj/topics/metrics",
+		DisableAuth: true,
+		Endpoint:    server.URL,
+	})
+	defer c.Close()
+
+	series := func(value float64) *monitoring.TimeSeries {
+		return &monitoring.TimeSeries{
+			Metric: &metric_pb.Metric{
+				Type:   "external.googleapis.com/prometheus/metric1",
+				Labels: map[string]string{"a": "1"},
+			},
+			Resource: &monitoredres_pb.MonitoredResource{
+				Type:   "gke_container",
+				Labels: map[string]string{"project_id": "proj"},
+			},
+			Points: []*monitoring.Point{
+				{
+					Interval: &monitoring.TimeInterval{EndTime: &timestamp_pb.Timestamp{Seconds: 1}},
+					Value: &monitoring.TypedValue{
+						Value: &monitoring.TypedValue_DoubleValue{DoubleValue: value},
+					},
+				},
+			},
+		}
+	}
+	other := series(2)
+	other.Metric.Labels = map[string]string{"a": "2"}
+
+	err := c.Store(&monitoring.CreateTimeSeriesRequest{
+		TimeSeries: []*monitoring.TimeSeries{series(1), series(2), other},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := "/v1/projects/proj/topics/metrics:publish"; gotPath != want {
+		t.Errorf("expected request path %q, got %q", want, gotPath)
+	}
+	if len(gotBody.Messages) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(gotBody.Messages))
+	}
+	// The message payload is the serialized TimeSeries proto.
+	var decoded monitoring.TimeSeries
+	if err := proto.Unmarshal(gotBody.Messages[0].Data, &decoded); err != nil {
+		t.Fatalf("unmarshaling message failed: %s", err)
+	}
+	if !proto.Equal(&decoded, series(1)) {
+		t.Errorf("unexpected message payload %v", &decoded)
+	}
+	// Points of the same series share an ordering key; distinct series do not.
+	if gotBody.Messages[0].OrderingKey == "" {
+		t.Errorf("expected non-empty ordering key")
+	}
+	if gotBody.Messages[0].OrderingKey != gotBody.Messages[1].OrderingKey {
+		t.Errorf("expected equal ordering keys, got %q and %q",
+			gotBody.Messages[0].OrderingKey, gotBody.Messages[1].OrderingKey)
+	}
+	if gotBody.Messages[0].OrderingKey == gotBody.Messages[2].OrderingKey {
+		t.Errorf("expected distinct ordering keys for distinct series")
+	}
+}
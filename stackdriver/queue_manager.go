@@ -14,7 +14,9 @@
 package stackdriver
 
 import (
+	"context"
 	"math"
+	"strconv"
 	"sync"
 	"time"
 
@@ -25,7 +27,10 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/prometheus/config"
 	"golang.org/x/time/rate"
+	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+	monitoredres_pb "google.golang.org/genproto/googleapis/api/monitoredres"
 	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/grpc/status"
 )
 
 // String constants for instrumentation.
@@ -42,6 +47,10 @@ const (
 	// Limit to 1 log event every 10s
 	logRateLimit = 0.1
 	logBurst     = 10
+
+	// replayDoneMargin is how close (in bytes) the tail offset must be to the
+	// WAL size before the initial replay is considered complete.
+	replayDoneMargin = 1 << 20
 )
 
 var (
@@ -100,8 +109,73 @@ var (
 		},
 		[]string{queue},
 	)
+	retriedSendsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "retried_sends_total",
+			Help:      "Total number of sample batch sends retried after a recoverable error.",
+		},
+		[]string{queue},
+	)
+	queueMemoryBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "queue_memory_bytes_estimate",
+			Help:      "Estimated bytes held by samples queued to be sent to the remote storage.",
+		},
+		[]string{queue},
+	)
+	shardQueueLength = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "shard_queue_length",
+			Help:      "The number of samples queued on an individual shard.",
+		},
+		[]string{queue, "shard"},
+	)
+	inflightRequests = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "inflight_requests",
+			Help:      "The number of CreateTimeSeries RPCs currently in flight.",
+		},
+		[]string{queue},
+	)
+	// The sidecar_* delivery metrics below are intended for user-defined SLOs
+	// on the sidecar's own delivery, so their names and labels are stable
+	// regardless of the queue name.
+	pointsExportedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "sidecar_points_exported_total",
+			Help: "Total number of points successfully delivered to the Monitoring API.",
+		},
+	)
+	pointsFailedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sidecar_points_failed_total",
+			Help: "Total number of points dropped because delivery to the Monitoring API failed, by gRPC status code.",
+		},
+		[]string{"code"},
+	)
+	exportLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "sidecar_export_latency_seconds",
+			Help:    "Latency of CreateTimeSeries calls to the Monitoring API per shard.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"shard"},
+	)
 )
 
+// ApproxTimeSeriesBytes is a conservative estimate of the in-memory size of a
+// TimeSeries proto with a single point. It is used to translate a memory
+// budget into queue and shard bounds.
+const ApproxTimeSeriesBytes = 2048
+
 func init() {
 	prometheus.MustRegister(succeededSamplesTotal)
 	prometheus.MustRegister(failedSamplesTotal)
@@ -109,12 +183,21 @@ func init() {
 	prometheus.MustRegister(queueLength)
 	prometheus.MustRegister(queueCapacity)
 	prometheus.MustRegister(numShards)
+	prometheus.MustRegister(retriedSendsTotal)
+	prometheus.MustRegister(queueMemoryBytes)
+	prometheus.MustRegister(shardQueueLength)
+	prometheus.MustRegister(inflightRequests)
+	prometheus.MustRegister(pointsExportedTotal)
+	prometheus.MustRegister(pointsFailedTotal)
+	prometheus.MustRegister(exportLatency)
 }
 
 // StorageClient defines an interface for sending a batch of samples to an
 // external timeseries database.
 type StorageClient interface {
-	// Store stores the given metric families in the remote storage.
+	// Store stores the given metric families in the remote storage. The
+	// time series slice of the request is reused by the caller and must not
+	// be retained after Store returns.
 	Store(*monitoring_pb.CreateTimeSeriesRequest) error
 	// Release the resources allocated by the client.
 	Close() error
@@ -147,10 +230,44 @@ type QueueManager struct {
 
 	tailer               *tail.Tailer
 	lastSize, lastOffset int
+
+	// replayLimiter bounds the rate (in samples per second) at which samples
+	// are sent while the initial WAL replay is still in progress.
+	replayLimiter *rate.Limiter
+	maxRetries    int
+	deadLetter    DeadLetterSink
+	interceptor   WriteInterceptor
+	// fixedShards pins the shard count and disables dynamic resharding.
+	// Zero selects dynamic sharding.
+	fixedShards int
+	// shardAssigner maps series hashes to shards. Defaults to JumpHash.
+	shardAssigner ShardAssigner
+}
+
+// ShardAssigner maps a series hash to a shard index in [0, numShards). It
+// must be a pure function so that a series is assigned the same shard on
+// every call, which keeps the points of a series ordered.
+type ShardAssigner func(hash uint64, numShards int) int
+
+// JumpHash is the jump consistent hash by Lamping and Veach
+// (https://arxiv.org/abs/1406.2294). As a pure function of the series hash, a
+// series keeps its shard across restarts, and a shard count change moves only
+// 1/numShards of the series to a different shard.
+func JumpHash(hash uint64, numShards int) int {
+	var b, j int64 = -1, 0
+	for j < int64(numShards) {
+		b = j
+		hash = hash*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((hash>>33)+1)))
+	}
+	return int(b)
 }
 
-// NewQueueManager builds a new QueueManager.
-func NewQueueManager(logger log.Logger, cfg config.QueueConfig, clientFactory StorageClientFactory, tailer *tail.Tailer) (*QueueManager, error) {
+// NewQueueManager builds a new QueueManager. A positive replayRate bounds the
+// send rate (in samples per second) until the tailer has caught up with the
+// WAL head. A positive fixedShards pins the shard count and disables dynamic
+// resharding.
+func NewQueueManager(logger log.Logger, cfg config.QueueConfig, clientFactory StorageClientFactory, tailer *tail.Tailer, replayRate float64, maxRetries int, deadLetter DeadLetterSink, interceptor WriteInterceptor, fixedShards int) (*QueueManager, error) {
 	if logger == nil {
 		logger = log.NewNopLogger()
 	}
@@ -171,13 +288,33 @@ func NewQueueManager(logger log.Logger, cfg config.QueueConfig, clientFactory St
 		walSize:            newEWMARate(ewmaWeight, shardUpdateDuration),
 		walOffset:          newEWMARate(ewmaWeight, shardUpdateDuration),
 		tailer:             tailer,
+		maxRetries:         maxRetries,
+		deadLetter:         deadLetter,
+		interceptor:        interceptor,
+		fixedShards:        fixedShards,
+		shardAssigner:      JumpHash,
 	}
-	lastSize, err := tailer.Size()
-	if err != nil {
-		return nil, errors.Wrap(err, "get WAL size")
+	if fixedShards > 0 {
+		t.numShards = fixedShards
+	}
+	// The tailer is nil when samples are not read from a WAL, e.g. in
+	// federation mode. Sharding then falls back to the send rates alone.
+	if tailer != nil {
+		lastSize, err := tailer.Size()
+		if err != nil {
+			return nil, errors.Wrap(err, "get WAL size")
+		}
+		t.lastSize = lastSize
+		t.lastOffset = tailer.Offset()
+	}
+
+	if replayRate > 0 {
+		burst := int(replayRate)
+		if burst < MaxTimeseriesesPerRequest {
+			burst = MaxTimeseriesesPerRequest
+		}
+		t.replayLimiter = rate.NewLimiter(rate.Limit(replayRate), burst)
 	}
-	t.lastSize = lastSize
-	t.lastOffset = tailer.Offset()
 
 	t.shards = t.newShardCollection(t.numShards)
 	numShards.WithLabelValues(t.queueName).Set(float64(t.numShards))
@@ -191,16 +328,50 @@ func NewQueueManager(logger log.Logger, cfg config.QueueConfig, clientFactory St
 	return t, nil
 }
 
+// SetShardAssigner replaces the function that maps series hashes to shards.
+// It must be called before Start.
+func (t *QueueManager) SetShardAssigner(assigner ShardAssigner) {
+	t.shardAssigner = assigner
+}
+
 // Append queues a sample to be sent to the Stackdriver API.
 // Always returns nil.
 func (t *QueueManager) Append(hash uint64, sample *monitoring_pb.TimeSeries) error {
+	if t.interceptor != nil {
+		// The series' nested messages are shared with the series cache, so
+		// hand the interceptor its own copy to mutate freely.
+		s := *sample
+		if sample.Metric != nil {
+			s.Metric = &metric_pb.Metric{Type: sample.Metric.Type, Labels: copyLabelMap(sample.Metric.Labels)}
+		}
+		if sample.Resource != nil {
+			s.Resource = &monitoredres_pb.MonitoredResource{Type: sample.Resource.Type, Labels: copyLabelMap(sample.Resource.Labels)}
+		}
+		if err := t.interceptor.Intercept(&s); err != nil {
+			interceptorDroppedSamplesTotal.Inc()
+			if t.logLimiter.Allow() {
+				level.Warn(t.logger).Log("msg", "Write interceptor rejected sample", "err", err)
+			}
+			return nil
+		}
+		sample = &s
+	}
 	queueLength.WithLabelValues(t.queueName).Inc()
+	queueMemoryBytes.WithLabelValues(t.queueName).Add(ApproxTimeSeriesBytes)
 	t.shardsMtx.RLock()
 	t.shards.enqueue(hash, sample)
 	t.shardsMtx.RUnlock()
 	return nil
 }
 
+func copyLabelMap(labels map[string]string) map[string]string {
+	out := make(map[string]string, len(labels))
+	for name, value := range labels {
+		out[name] = value
+	}
+	return out
+}
+
 // Start the queue manager sending samples to the remote storage.
 // Does not block.
 func (t *QueueManager) Start() error {
@@ -248,11 +419,17 @@ func (t *QueueManager) updateShardsLoop() {
 func (t *QueueManager) calculateDesiredShards() {
 	// Get current wal size and offset but don't return on failure so we can
 	// always call tick() for all rates below.
-	wsz, err := t.tailer.Size()
-	if err != nil {
-		level.Error(t.logger).Log("msg", "get WAL size", "err", err)
+	var (
+		wsz, woff int
+		err       error
+	)
+	if t.tailer != nil {
+		wsz, err = t.tailer.Size()
+		if err != nil {
+			level.Error(t.logger).Log("msg", "get WAL size", "err", err)
+		}
+		woff = t.tailer.Offset()
 	}
-	woff := t.tailer.Offset()
 
 	t.walSize.incr(int64(wsz - t.lastSize))
 	t.walOffset.incr(int64(woff - t.lastOffset))
@@ -268,6 +445,12 @@ func (t *QueueManager) calculateDesiredShards() {
 	t.walSize.tick()
 	t.walOffset.tick()
 
+	// The shard count is pinned; the rates above are still ticked so their
+	// values remain meaningful for debugging.
+	if t.fixedShards > 0 {
+		return
+	}
+
 	if err != nil {
 		return
 	}
@@ -361,12 +544,14 @@ func (t *QueueManager) reshard(n int) {
 	newShards := t.newShardCollection(n)
 	oldShards := t.shards
 	t.shards = newShards
-	oldShards.stop()
 	t.shardsMtx.Unlock()
 
-	// We start the newShards after we have stopped (the therefore completely
-	// flushed) the oldShards, to guarantee we only every deliver samples in
-	// order.
+	// Drain the retiring collection outside the lock so appends are not
+	// blocked while its in-flight RPCs run to completion. Everything the old
+	// shards have not sent yet migrates into the new collection, which only
+	// starts once the old one has fully stopped, so the points of each series
+	// are still delivered in order.
+	oldShards.drainTo(newShards)
 	newShards.start()
 }
 
@@ -375,43 +560,103 @@ type queueEntry struct {
 	sample *monitoring_pb.TimeSeries
 }
 
+// Shard classes partition the queue by metric kind. Cumulative and delta
+// points must be delivered in order per series, while gauge points have no
+// ordering constraints and can be batched more aggressively.
+const (
+	shardClassCumulative = iota
+	shardClassGauge
+	numShardClasses
+)
+
+// shardClassParams holds the independent batching parameters of one shard
+// class.
+type shardClassParams struct {
+	name              string
+	maxSamplesPerSend int
+	batchSendDeadline time.Duration
+}
+
+// shardClasses derives the per-class batching parameters from the queue
+// configuration. Gauge batches fill up to the API request limit and may wait
+// twice the configured deadline to fill.
+func (t *QueueManager) shardClasses() [numShardClasses]shardClassParams {
+	return [numShardClasses]shardClassParams{
+		shardClassCumulative: {
+			name:              "cumulative",
+			maxSamplesPerSend: t.cfg.MaxSamplesPerSend,
+			batchSendDeadline: time.Duration(t.cfg.BatchSendDeadline),
+		},
+		shardClassGauge: {
+			name:              "gauge",
+			maxSamplesPerSend: MaxTimeseriesesPerRequest,
+			batchSendDeadline: 2 * time.Duration(t.cfg.BatchSendDeadline),
+		},
+	}
+}
+
 type shard struct {
-	queue chan queueEntry
-	// A reusable cache of samples that were already seen in a sample batch.
+	queue  chan queueEntry
+	params shardClassParams
+	// Entries migrated from a retiring shard collection during a reshard.
+	// They are sent ahead of anything received on the queue.
+	inherited []queueEntry
+}
+
+// projectBatch accumulates the pending samples of one destination project.
+// Keeping a batch per project packs the requests sent to the API even when
+// multi-project routing splits writes on project boundaries.
+type projectBatch struct {
+	pending []queueEntry
+	// A reusable cache of samples that are already in pending.
 	seen map[uint64]struct{}
 }
 
-func (s *shard) resetSeen() {
-	for k := range s.seen {
-		delete(s.seen, k)
+func (b *projectBatch) resetSeen() {
+	for k := range b.seen {
+		delete(b.seen, k)
 	}
 }
 
-func newShard(cfg config.QueueConfig) shard {
+func newShard(cfg config.QueueConfig, params shardClassParams) shard {
 	return shard{
-		queue: make(chan queueEntry, cfg.Capacity),
-		seen:  map[uint64]struct{}{},
+		queue:  make(chan queueEntry, cfg.Capacity),
+		params: params,
 	}
 }
 
 type shardCollection struct {
-	qm     *QueueManager
+	qm *QueueManager
+	// Shards of all classes; class i occupies shards[i*numShards:(i+1)*numShards].
 	shards []shard
-	done   chan struct{}
-	wg     sync.WaitGroup
+	// numShards is the shard count per class.
+	numShards int
+	done      chan struct{}
+	wg        sync.WaitGroup
+
+	// drainc is closed to make the shards stop sending and hand everything
+	// they have not sent yet back through unsent.
+	drainc chan struct{}
+	mtx    sync.Mutex
+	unsent []queueEntry
 }
 
 func (t *QueueManager) newShardCollection(numShards int) *shardCollection {
-	shards := make([]shard, numShards)
-	for i := 0; i < numShards; i++ {
-		shards[i] = newShard(t.cfg)
+	classes := t.shardClasses()
+	shards := make([]shard, 0, numShards*numShardClasses)
+	for _, params := range classes {
+		for i := 0; i < numShards; i++ {
+			shards = append(shards, newShard(t.cfg, params))
+		}
 	}
 	s := &shardCollection{
-		qm:     t,
-		shards: shards,
-		done:   make(chan struct{}),
+		qm:        t,
+		shards:    shards,
+		numShards: numShards,
+		done:      make(chan struct{}),
+		drainc:    make(chan struct{}),
 	}
-	s.wg.Add(numShards)
+	s.wg.Add(len(shards))
 	return s
 }
 
@@ -422,34 +667,76 @@ func (s *shardCollection) start() {
 }
 
 func (s *shardCollection) stop() {
-	for _, shard := range s.shards {
-		close(shard.queue)
+	for i := range s.shards {
+		close(s.shards[i].queue)
 	}
 	s.wg.Wait()
+	// Drop the per-shard gauges so downsharding doesn't leave stale series.
+	for i := range s.shards {
+		shardQueueLength.DeleteLabelValues(s.qm.queueName, strconv.Itoa(i))
+	}
 	level.Debug(s.qm.logger).Log("msg", "Stopped resharding")
 }
 
+// shardClass returns the shard class a sample belongs to.
+func shardClass(sample *monitoring_pb.TimeSeries) int {
+	if sample.MetricKind == metric_pb.MetricDescriptor_GAUGE {
+		return shardClassGauge
+	}
+	return shardClassCumulative
+}
+
 func (s *shardCollection) enqueue(hash uint64, sample *monitoring_pb.TimeSeries) {
 	s.qm.samplesIn.incr(1)
-	shardIndex := hash % uint64(len(s.shards))
+	shardIndex := shardClass(sample)*s.numShards + s.qm.shardAssigner(hash, s.numShards)
+	shardQueueLength.WithLabelValues(s.qm.queueName, strconv.Itoa(int(shardIndex))).Inc()
 	s.shards[shardIndex].queue <- queueEntry{sample: sample, hash: hash}
 }
 
+// drainTo makes the collection's shards stop sending and migrates every entry
+// they have not sent yet into next, which must not have been started. In-flight
+// RPCs are awaited rather than canceled mid-batch, so a reshard never
+// duplicates or drops points.
+func (s *shardCollection) drainTo(next *shardCollection) {
+	close(s.drainc)
+	s.wg.Wait()
+	// Remove the per-shard gauges that next's smaller shard count will not
+	// reuse so downsharding doesn't leave stale series.
+	for i := len(next.shards); i < len(s.shards); i++ {
+		shardQueueLength.DeleteLabelValues(s.qm.queueName, strconv.Itoa(i))
+	}
+	for _, entry := range s.unsent {
+		next.inherit(entry)
+	}
+	level.Debug(s.qm.logger).Log("msg", "Migrated unsent samples to new shards", "count", len(s.unsent))
+	s.unsent = nil
+}
+
+// inherit places an entry on the shard it maps to under this collection's
+// shard count, ahead of anything received on the queue. It must only be called
+// before the collection is started.
+func (s *shardCollection) inherit(entry queueEntry) {
+	shardIndex := shardClass(entry.sample)*s.numShards + s.qm.shardAssigner(entry.hash, s.numShards)
+	shardQueueLength.WithLabelValues(s.qm.queueName, strconv.Itoa(shardIndex)).Inc()
+	s.shards[shardIndex].inherited = append(s.shards[shardIndex].inherited, entry)
+}
+
 func (s *shardCollection) runShard(i int) {
 	defer s.wg.Done()
 	client := s.qm.clientFactory.New()
 	defer client.Close()
-	shard := s.shards[i]
+	shard := &s.shards[i]
+	shardLabel := strconv.Itoa(i)
+	shardQueue := shardQueueLength.WithLabelValues(s.qm.queueName, shardLabel)
 
 	// Send batches of at most MaxSamplesPerSend samples to the remote storage.
 	// If we have fewer samples than that, flush them out after a deadline
-	// anyways.
-	pendingSamples := make([]*monitoring_pb.TimeSeries, 0, s.qm.cfg.MaxSamplesPerSend)
-	// Fingerprint of time series contained in pendingSamples. Gets reset
-	// whenever samples are extracted from pendingSamples.
-	shard.resetSeen()
+	// anyways. Samples are batched by the project their monitored resource
+	// routes them to, so each request targets a single project.
+	batches := map[string]*projectBatch{}
+	numPending := 0
 
-	timer := time.NewTimer(time.Duration(s.qm.cfg.BatchSendDeadline))
+	timer := time.NewTimer(shard.params.batchSendDeadline)
 	stop := func() {
 		if !timer.Stop() {
 			select {
@@ -460,56 +747,135 @@ func (s *shardCollection) runShard(i int) {
 	}
 	defer stop()
 
+	// The unwrap buffer is reused across batches; clients only read it while
+	// the send is in flight.
+	var scratch []*monitoring_pb.TimeSeries
+	sendBatch := func(b *projectBatch) {
+		scratch = scratch[:0]
+		for _, e := range b.pending {
+			scratch = append(scratch, e.sample)
+		}
+		s.sendSamples(client, shardLabel, scratch)
+		numPending -= len(b.pending)
+		b.pending = b.pending[:0]
+		b.resetSeen()
+	}
+	sendAll := func() {
+		for _, b := range batches {
+			if len(b.pending) > 0 {
+				sendBatch(b)
+			}
+		}
+	}
+	add := func(entry queueEntry) {
+		// The project_id resource label selects the destination project; the
+		// client falls back to the default project when it is unset or not
+		// permitted.
+		project := entry.sample.Resource.GetLabels()["project_id"]
+		b := batches[project]
+		if b == nil {
+			b = &projectBatch{seen: map[uint64]struct{}{}}
+			batches[project] = b
+		}
+		// If the batch contains a point for the incoming time series, send
+		// all its pending points to Stackdriver, and start a new list. This
+		// prevents adding two points for the same time series to a single
+		// request, which Stackdriver rejects.
+		_, seen := b.seen[entry.hash]
+		if !seen {
+			b.pending = append(b.pending, entry)
+			b.seen[entry.hash] = struct{}{}
+			numPending++
+		}
+		if len(b.pending) >= shard.params.maxSamplesPerSend || seen {
+			sendBatch(b)
+			stop()
+			timer.Reset(shard.params.batchSendDeadline)
+		}
+		if seen {
+			b.pending = append(b.pending, entry)
+			b.seen[entry.hash] = struct{}{}
+			numPending++
+		}
+	}
+
+	// Entries migrated from a retiring collection are processed before
+	// anything that was appended after the collections were swapped.
+	for _, entry := range shard.inherited {
+		queueLength.WithLabelValues(s.qm.queueName).Dec()
+		shardQueue.Dec()
+		queueMemoryBytes.WithLabelValues(s.qm.queueName).Sub(ApproxTimeSeriesBytes)
+		add(entry)
+	}
+	shard.inherited = nil
+
 	for {
 		select {
 		case entry, ok := <-shard.queue:
-			fp, sample := entry.hash, entry.sample
-
 			if !ok {
-				if len(pendingSamples) > 0 {
-					s.sendSamples(client, pendingSamples)
+				if numPending > 0 {
+					sendAll()
 				}
 				return
 			}
 			queueLength.WithLabelValues(s.qm.queueName).Dec()
-
-			// If pendingSamples contains a point for the
-			// incoming time series, send all pending points
-			// to Stackdriver, and start a new list. This
-			// prevents adding two points for the same time
-			// series to a single request, which Stackdriver
-			// rejects.
-			_, seen := shard.seen[fp]
-			if !seen {
-				pendingSamples = append(pendingSamples, sample)
-				shard.seen[fp] = struct{}{}
-			}
-			if len(pendingSamples) >= s.qm.cfg.MaxSamplesPerSend || seen {
-				s.sendSamples(client, pendingSamples)
-				pendingSamples = pendingSamples[:0]
-				shard.resetSeen()
-
-				stop()
-				timer.Reset(time.Duration(s.qm.cfg.BatchSendDeadline))
+			shardQueue.Dec()
+			queueMemoryBytes.WithLabelValues(s.qm.queueName).Sub(ApproxTimeSeriesBytes)
+			add(entry)
+		case <-timer.C:
+			if numPending > 0 {
+				sendAll()
 			}
-			if seen {
-				pendingSamples = append(pendingSamples, sample)
-				shard.seen[fp] = struct{}{}
+			timer.Reset(shard.params.batchSendDeadline)
+		case <-s.drainc:
+			// The successor collection takes over everything not sent yet.
+			// The in-flight RPC, if any, completed above; the queue remainder
+			// follows the pending batch so the points of each series stay in
+			// order. Pending entries left the queue already, so their queue
+			// gauges are restored before they are requeued.
+			queueLength.WithLabelValues(s.qm.queueName).Add(float64(numPending))
+			queueMemoryBytes.WithLabelValues(s.qm.queueName).Add(float64(numPending * ApproxTimeSeriesBytes))
+			unsent := make([]queueEntry, 0, numPending)
+			for _, b := range batches {
+				unsent = append(unsent, b.pending...)
 			}
-		case <-timer.C:
-			if len(pendingSamples) > 0 {
-				s.sendSamples(client, pendingSamples)
-				pendingSamples = pendingSamples[:0]
-				shard.resetSeen()
+			for {
+				select {
+				case entry := <-shard.queue:
+					shardQueue.Dec()
+					unsent = append(unsent, entry)
+					continue
+				default:
+				}
+				break
 			}
-			timer.Reset(time.Duration(s.qm.cfg.BatchSendDeadline))
+			s.mtx.Lock()
+			s.unsent = append(s.unsent, unsent...)
+			s.mtx.Unlock()
+			return
 		}
 	}
 }
 
-func (s *shardCollection) sendSamples(client StorageClient, samples []*monitoring_pb.TimeSeries) {
+// replaying returns whether the initial WAL replay is still in progress, i.e.
+// the tail offset is not near the current WAL size yet.
+func (t *QueueManager) replaying() bool {
+	if t.tailer == nil {
+		return false
+	}
+	size, err := t.tailer.Size()
+	if err != nil {
+		return false
+	}
+	return t.tailer.Offset()+replayDoneMargin < size
+}
+
+func (s *shardCollection) sendSamples(client StorageClient, shardLabel string, samples []*monitoring_pb.TimeSeries) {
 	begin := time.Now()
-	s.sendSamplesWithBackoff(client, samples)
+	if s.qm.replayLimiter != nil && s.qm.replaying() {
+		s.qm.replayLimiter.WaitN(context.Background(), len(samples))
+	}
+	s.sendSamplesWithBackoff(client, shardLabel, samples)
 
 	// These counters are used to calculate the dynamic sharding, and as such
 	// should be maintained irrespective of success or failure.
@@ -518,22 +884,34 @@ func (s *shardCollection) sendSamples(client StorageClient, samples []*monitorin
 }
 
 // sendSamples to the remote storage with backoff for recoverable errors.
-func (s *shardCollection) sendSamplesWithBackoff(client StorageClient, samples []*monitoring_pb.TimeSeries) {
+func (s *shardCollection) sendSamplesWithBackoff(client StorageClient, shardLabel string, samples []*monitoring_pb.TimeSeries) {
 	backoff := s.qm.cfg.MinBackoff
-	for {
+	var finalErr error
+	for attempts := 1; ; attempts++ {
 		begin := time.Now()
+		inflightRequests.WithLabelValues(s.qm.queueName).Inc()
 		err := client.Store(&monitoring_pb.CreateTimeSeriesRequest{TimeSeries: samples})
+		inflightRequests.WithLabelValues(s.qm.queueName).Dec()
 
 		sentBatchDuration.WithLabelValues(s.qm.queueName).Observe(time.Since(begin).Seconds())
+		exportLatency.WithLabelValues(shardLabel).Observe(time.Since(begin).Seconds())
 		if err == nil {
 			succeededSamplesTotal.WithLabelValues(s.qm.queueName).Add(float64(len(samples)))
+			pointsExportedTotal.Add(float64(len(samples)))
 			return
 		}
 
 		if _, ok := err.(recoverableError); !ok {
 			level.Warn(s.qm.logger).Log("msg", "Unrecoverable error sending samples to remote storage", "err", err)
+			finalErr = err
+			break
+		}
+		if s.qm.maxRetries > 0 && attempts >= s.qm.maxRetries {
+			level.Warn(s.qm.logger).Log("msg", "Dropping samples after exhausting retries", "attempts", attempts, "err", err)
+			finalErr = err
 			break
 		}
+		retriedSendsTotal.WithLabelValues(s.qm.queueName).Inc()
 		time.Sleep(time.Duration(backoff))
 		backoff = backoff * 2
 		if backoff > s.qm.cfg.MaxBackoff {
@@ -542,4 +920,15 @@ func (s *shardCollection) sendSamplesWithBackoff(client StorageClient, samples [
 	}
 
 	failedSamplesTotal.WithLabelValues(s.qm.queueName).Add(float64(len(samples)))
+	// Unwrap the retry marker so the original gRPC status code labels the
+	// failure counter.
+	if r, ok := finalErr.(recoverableError); ok {
+		finalErr = r.error
+	}
+	pointsFailedTotal.WithLabelValues(status.Code(finalErr).String()).Add(float64(len(samples)))
+	if s.qm.deadLetter != nil {
+		if err := s.qm.deadLetter.Record(samples, finalErr); err != nil {
+			level.Warn(s.qm.logger).Log("msg", "Recording rejected samples to dead-letter sink failed", "err", err)
+		}
+	}
 }
@@ -29,6 +29,7 @@ import (
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/config"
 	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+	monitoredres_pb "google.golang.org/genproto/googleapis/api/monitoredres"
 	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
 )
 
@@ -164,7 +165,7 @@ func TestSampleDeliverySimple(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	m, err := NewQueueManager(nil, cfg, c, tailer)
+	m, err := NewQueueManager(nil, cfg, c, tailer, 0, 0, nil, nil, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -210,7 +211,7 @@ func TestSampleDeliveryMultiShard(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	m, err := NewQueueManager(nil, cfg, c, tailer)
+	m, err := NewQueueManager(nil, cfg, c, tailer, 0, 0, nil, nil, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -264,7 +265,7 @@ func TestSampleDeliveryTimeout(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	m, err := NewQueueManager(nil, cfg, c, tailer)
+	m, err := NewQueueManager(nil, cfg, c, tailer, 0, 0, nil, nil, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -315,7 +316,7 @@ func TestSampleDeliveryOrder(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	m, err := NewQueueManager(nil, config.DefaultQueueConfig, c, tailer)
+	m, err := NewQueueManager(nil, config.DefaultQueueConfig, c, tailer, 0, 0, nil, nil, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -376,8 +377,8 @@ func (t *QueueManager) queueLen() int {
 	t.shardsMtx.Lock()
 	defer t.shardsMtx.Unlock()
 	queueLength := 0
-	for _, shard := range t.shards.shards {
-		queueLength += len(shard.queue)
+	for i := range t.shards.shards {
+		queueLength += len(t.shards.shards[i].queue)
 	}
 	return queueLength
 }
@@ -397,12 +398,16 @@ func TestSpawnNotMoreThanMaxConcurrentSendsGoroutines(t *testing.T) {
 
 	var samples []*monitoring_pb.TimeSeries
 	for i := 0; i < n; i++ {
-		samples = append(samples, newTestSample(
+		sample := newTestSample(
 			fmt.Sprintf("test_metric_%d", i),
 			1234567890001,
 			2234567890001,
 			float64(i),
-		))
+		)
+		// Use cumulative samples so batches are capped by the configured
+		// MaxSamplesPerSend rather than the gauge class's larger limit.
+		sample.MetricKind = metric_pb.MetricDescriptor_CUMULATIVE
+		samples = append(samples, sample)
 	}
 
 	c := NewTestBlockedStorageClient()
@@ -414,7 +419,7 @@ func TestSpawnNotMoreThanMaxConcurrentSendsGoroutines(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	m, err := NewQueueManager(nil, cfg, c, tailer)
+	m, err := NewQueueManager(nil, cfg, c, tailer, 0, 0, nil, nil, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -457,3 +462,407 @@ func TestSpawnNotMoreThanMaxConcurrentSendsGoroutines(t *testing.T) {
 		t.Errorf("Saw %d concurrent sends, expected 1", numCalls)
 	}
 }
+
+func TestFixedShards(t *testing.T) {
+	c := NewTestStorageClient(t)
+	m, err := NewQueueManager(nil, config.DefaultQueueConfig, c, nil, 0, 0, nil, nil, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.numShards != 3 {
+		t.Errorf("expected 3 shards, got %d", m.numShards)
+	}
+	// With a fixed shard count, recalculating the desired shards must not
+	// trigger a reshard.
+	m.calculateDesiredShards()
+	select {
+	case n := <-m.reshardChan:
+		t.Errorf("unexpected reshard to %d shards", n)
+	default:
+	}
+	if m.numShards != 3 {
+		t.Errorf("expected 3 shards after recalculation, got %d", m.numShards)
+	}
+}
+
+func TestShardClassRouting(t *testing.T) {
+	c := NewTestStorageClient(t)
+	m, err := NewQueueManager(nil, config.DefaultQueueConfig, c, nil, 0, 0, nil, nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 2 * numShardClasses; len(m.shards.shards) != want {
+		t.Fatalf("expected %d shards, got %d", want, len(m.shards.shards))
+	}
+	cumulative := newTestSample("test_metric_cumulative", 1234567890000, 2234567890000, 1)
+	cumulative.MetricKind = metric_pb.MetricDescriptor_CUMULATIVE
+	m.shards.enqueue(1, cumulative)
+	gauge := newTestSample("test_metric_gauge", 1234567890000, 2234567890000, 2)
+	m.shards.enqueue(1, gauge)
+
+	// Samples with the same hash must land in the same shard position of
+	// their respective class.
+	shard := JumpHash(1, 2)
+	if got := len(m.shards.shards[shard].queue); got != 1 {
+		t.Errorf("expected cumulative sample in shard %d, got queue length %d", shard, got)
+	}
+	if got := len(m.shards.shards[2+shard].queue); got != 1 {
+		t.Errorf("expected gauge sample in shard %d, got queue length %d", 2+shard, got)
+	}
+}
+
+func TestWriteInterceptor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	n := 10
+
+	var samples []*monitoring_pb.TimeSeries
+	for i := 0; i < n; i++ {
+		samples = append(samples, newTestSample(
+			fmt.Sprintf("test_metric_%d", i),
+			1234567890000,
+			2234567890000,
+			float64(i),
+		))
+	}
+
+	// The interceptor drops the first metric and labels all others.
+	interceptor := WriteInterceptorFunc(func(s *monitoring_pb.TimeSeries) error {
+		if s.Metric.Type == "test_metric_0" {
+			return fmt.Errorf("rejected")
+		}
+		s.Metric.Labels["cost_center"] = "42"
+		return nil
+	})
+
+	var expected []*monitoring_pb.TimeSeries
+	for _, s := range samples[1:] {
+		e := *s
+		e.Metric = &metric_pb.Metric{Type: s.Metric.Type, Labels: map[string]string{"cost_center": "42"}}
+		expected = append(expected, &e)
+	}
+
+	c := NewTestStorageClient(t)
+	c.expectSamples(expected)
+
+	cfg := config.DefaultQueueConfig
+	cfg.Capacity = n
+	cfg.MaxSamplesPerSend = n - 1
+
+	tailer, err := tail.Tail(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewQueueManager(nil, cfg, c, tailer, 0, 0, nil, interceptor, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, s := range samples {
+		m.Append(uint64(i), s)
+	}
+	m.Start()
+	defer m.Stop()
+
+	c.waitForExpectedSamples(t)
+
+	// The input series must not have been mutated.
+	if len(samples[1].Metric.Labels) != 0 {
+		t.Fatalf("input series was mutated: %v", samples[1].Metric)
+	}
+}
+
+func TestJumpHash(t *testing.T) {
+	const numShards = 8
+	// The assignment must be deterministic and in range.
+	for hash := uint64(0); hash < 1000; hash++ {
+		shard := JumpHash(hash, numShards)
+		if shard < 0 || shard >= numShards {
+			t.Fatalf("shard %d for hash %d out of range", shard, hash)
+		}
+		if again := JumpHash(hash, numShards); again != shard {
+			t.Fatalf("hash %d assigned to shards %d and %d", hash, shard, again)
+		}
+	}
+	// Growing the shard count by one must only move about 1/numShards of the
+	// series to a different shard.
+	moved := 0
+	const series = 10000
+	for hash := uint64(0); hash < series; hash++ {
+		if JumpHash(hash, numShards) != JumpHash(hash, numShards+1) {
+			moved++
+		}
+	}
+	if max := 2 * series / (numShards + 1); moved > max {
+		t.Fatalf("%d of %d series moved, expected at most %d", moved, series, max)
+	}
+}
+
+// reshardStorageClient records received samples per series without blocking on
+// Close, so shards can retire while expected samples are still outstanding.
+type reshardStorageClient struct {
+	mtx      sync.Mutex
+	received map[string][]*monitoring_pb.TimeSeries
+	count    int
+	expected int
+	donec    chan struct{}
+}
+
+func newReshardStorageClient(expected int) *reshardStorageClient {
+	return &reshardStorageClient{
+		received: map[string][]*monitoring_pb.TimeSeries{},
+		expected: expected,
+		donec:    make(chan struct{}),
+	}
+}
+
+func (c *reshardStorageClient) Store(req *monitoring_pb.CreateTimeSeriesRequest) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, ts := range req.TimeSeries {
+		c.received[ts.Metric.Type] = append(c.received[ts.Metric.Type], ts)
+		c.count++
+	}
+	if c.count >= c.expected {
+		select {
+		case <-c.donec:
+		default:
+			close(c.donec)
+		}
+	}
+	return nil
+}
+
+func (c *reshardStorageClient) New() StorageClient { return c }
+
+func (c *reshardStorageClient) Name() string { return "reshardstorageclient" }
+
+func (c *reshardStorageClient) Close() error { return nil }
+
+func TestReshardUnderLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ts := 10
+	n := 50 * ts
+
+	expected := map[string][]*monitoring_pb.TimeSeries{}
+	var samples []*monitoring_pb.TimeSeries
+	for i := 0; i < n; i++ {
+		sample := newTestSample(
+			fmt.Sprintf("test_metric_%d", i%ts),
+			1234567890001,
+			1234567890001+int64(i),
+			float64(i),
+		)
+		// Cumulative points must survive resharding in order.
+		sample.MetricKind = metric_pb.MetricDescriptor_CUMULATIVE
+		samples = append(samples, sample)
+		expected[sample.Metric.Type] = append(expected[sample.Metric.Type], sample)
+	}
+
+	c := newReshardStorageClient(n)
+
+	cfg := config.DefaultQueueConfig
+	cfg.MaxShards = 10
+	cfg.MaxSamplesPerSend = 10
+	cfg.BatchSendDeadline = model.Duration(50 * time.Millisecond)
+
+	tailer, err := tail.Tail(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewQueueManager(nil, cfg, c, tailer, 0, 0, nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.Start()
+	defer m.Stop()
+
+	// Reshard repeatedly while samples are being appended. Every point must
+	// still be delivered exactly once and in order per series.
+	appended := make(chan struct{})
+	go func() {
+		defer close(appended)
+		for i, s := range samples {
+			m.Append(uint64(i%ts), s)
+		}
+	}()
+	for _, numShards := range []int{3, 5, 2, 8, 1} {
+		m.reshard(numShards)
+	}
+	<-appended
+
+	select {
+	case <-c.donec:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for samples, received %d of %d", c.count, n)
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.count != n {
+		t.Fatalf("expected %d samples, received %d", n, c.count)
+	}
+	if !reflect.DeepEqual(expected, c.received) {
+		t.Fatalf("expected %v, got %v", expected, c.received)
+	}
+}
+
+func TestReshardAwaitsInflight(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := NewTestBlockedStorageClient()
+
+	cfg := config.DefaultQueueConfig
+	cfg.MaxShards = 4
+	cfg.MaxSamplesPerSend = 10
+	cfg.Capacity = 100
+
+	tailer, err := tail.Tail(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewQueueManager(nil, cfg, c, tailer, 0, 0, nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.Start()
+	defer m.Stop()
+
+	// Fill one batch to get an RPC in flight plus some queued remainder.
+	for i := 0; i < cfg.MaxSamplesPerSend+5; i++ {
+		sample := newTestSample(
+			fmt.Sprintf("test_metric_%d", i),
+			1234567890001,
+			2234567890001,
+			float64(i),
+		)
+		sample.MetricKind = metric_pb.MetricDescriptor_CUMULATIVE
+		m.Append(uint64(i), sample)
+	}
+	for i := 0; i < 100 && c.NumCalls() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if c.NumCalls() != 1 {
+		t.Fatalf("expected 1 in-flight send, got %d", c.NumCalls())
+	}
+
+	// Resharding must wait for the blocked RPC instead of canceling it.
+	resharded := make(chan struct{})
+	go func() {
+		m.reshard(4)
+		close(resharded)
+	}()
+	select {
+	case <-resharded:
+		t.Fatal("reshard finished while an RPC was still in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	c.unlock()
+	select {
+	case <-resharded:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for reshard to finish")
+	}
+}
+
+// batchRecordingStorageClient records the destination projects of each write
+// request.
+type batchRecordingStorageClient struct {
+	mtx      sync.Mutex
+	requests [][]string
+	expected int
+	received int
+	donec    chan struct{}
+}
+
+func (c *batchRecordingStorageClient) Store(req *monitoring_pb.CreateTimeSeriesRequest) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	projects := make([]string, 0, len(req.TimeSeries))
+	for _, ts := range req.TimeSeries {
+		projects = append(projects, ts.Resource.GetLabels()["project_id"])
+	}
+	c.requests = append(c.requests, projects)
+	c.received += len(req.TimeSeries)
+	if c.received == c.expected {
+		close(c.donec)
+	}
+	return nil
+}
+
+func (c *batchRecordingStorageClient) New() StorageClient { return c }
+
+func (c *batchRecordingStorageClient) Name() string { return "batchrecordingstorageclient" }
+
+func (c *batchRecordingStorageClient) Close() error { return nil }
+
+func TestProjectAwareBatching(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := config.DefaultQueueConfig
+	cfg.Capacity = 100
+	cfg.MaxSamplesPerSend = 4
+
+	c := &batchRecordingStorageClient{expected: 16, donec: make(chan struct{})}
+
+	tailer, err := tail.Tail(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewQueueManager(nil, cfg, c, tailer, 0, 0, nil, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Start()
+	defer m.Stop()
+
+	// Interleave samples routed to two destination projects. Each project's
+	// batch must fill up on its own instead of producing mixed requests that
+	// the client would have to split into fragments.
+	for i := 0; i < 16; i++ {
+		s := newTestSample(fmt.Sprintf("test_metric_%d", i), 1234567890000, 2234567890000, float64(i))
+		s.MetricKind = metric_pb.MetricDescriptor_CUMULATIVE
+		s.Resource = &monitoredres_pb.MonitoredResource{
+			Type:   "resource",
+			Labels: map[string]string{"project_id": fmt.Sprintf("project%d", i%2)},
+		}
+		m.Append(uint64(i), s)
+	}
+
+	select {
+	case <-c.donec:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for samples")
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, projects := range c.requests {
+		if len(projects) != cfg.MaxSamplesPerSend {
+			t.Errorf("expected a full batch of %d samples, got %d", cfg.MaxSamplesPerSend, len(projects))
+		}
+		for _, project := range projects[1:] {
+			if project != projects[0] {
+				t.Errorf("request mixes destination projects: %v", projects)
+			}
+		}
+	}
+}
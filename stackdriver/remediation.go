@@ -0,0 +1,150 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"context"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	label_pb "google.golang.org/genproto/googleapis/api/label"
+	monitoring "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Supported values for the label mismatch remediation mode.
+const (
+	// LabelMismatchIgnore leaves rejected writes alone.
+	LabelMismatchIgnore = "none"
+	// LabelMismatchDropLabel removes labels unknown to the existing
+	// descriptor from the rejected series and retries.
+	LabelMismatchDropLabel = "drop-label"
+	// LabelMismatchRecreate deletes and recreates the descriptor with the
+	// union of old and new labels, then retries. This discards the metric's
+	// existing history in Stackdriver, so it is opt-in.
+	LabelMismatchRecreate = "recreate"
+)
+
+var labelMismatchRemediations = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "label_mismatch_remediations_total",
+		Help:      "Total number of automatic remediations of metric descriptor label mismatches, by action taken.",
+	},
+	[]string{"action"},
+)
+
+func init() {
+	prometheus.MustRegister(labelMismatchRemediations)
+}
+
+// isLabelMismatch reports whether err indicates that a write was rejected
+// because the metric's existing descriptor does not define one of the labels.
+func isLabelMismatch(err error) bool {
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.InvalidArgument {
+		return false
+	}
+	return strings.Contains(strings.ToLower(st.Message()), "label")
+}
+
+// remediateLabelMismatch repairs the label mismatch for every metric in the
+// rejected request so a retry can succeed. In drop-label mode the unknown
+// labels are removed from a clone of the request, which is returned for the
+// caller to resend; the series' nested messages are shared with the series
+// cache and must not be modified. In recreate mode the descriptor is deleted
+// and recreated with the new labels and no clone is returned, so the caller
+// retries the original request.
+func (c *Client) remediateLabelMismatch(ctx context.Context, req *monitoring.CreateTimeSeriesRequest) (*monitoring.CreateTimeSeriesRequest, error) {
+	conn, err := c.getConnection(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "connect to Monitoring API")
+	}
+	service := monitoring.NewMetricServiceClient(conn)
+
+	var repaired *monitoring.CreateTimeSeriesRequest
+
+	byMetric := map[string][]*monitoring.TimeSeries{}
+	for _, ts := range req.TimeSeries {
+		byMetric[ts.Metric.GetType()] = append(byMetric[ts.Metric.GetType()], ts)
+	}
+	for metricType, tss := range byMetric {
+		name := c.projectID + "/metricDescriptors/" + metricType
+		descriptor, err := service.GetMetricDescriptor(ctx,
+			&monitoring.GetMetricDescriptorRequest{Name: name})
+		if err != nil {
+			return nil, errors.Wrapf(err, "get metric descriptor %s", metricType)
+		}
+		known := map[string]bool{}
+		for _, l := range descriptor.Labels {
+			known[l.Key] = true
+		}
+		extra := map[string]bool{}
+		for _, ts := range tss {
+			for key := range ts.Metric.Labels {
+				if !known[key] {
+					extra[key] = true
+				}
+			}
+		}
+		if len(extra) == 0 {
+			continue
+		}
+		switch c.labelMismatch {
+		case LabelMismatchDropLabel:
+			if repaired == nil {
+				repaired = proto.Clone(req).(*monitoring.CreateTimeSeriesRequest)
+			}
+			for _, ts := range repaired.TimeSeries {
+				if ts.Metric.GetType() != metricType {
+					continue
+				}
+				for key := range extra {
+					delete(ts.Metric.Labels, key)
+				}
+			}
+			level.Info(c.logger).Log("msg", "Dropped labels unknown to the metric descriptor",
+				"metric", metricType, "labels", len(extra))
+			labelMismatchRemediations.WithLabelValues("drop_label").Inc()
+		case LabelMismatchRecreate:
+			for key := range extra {
+				descriptor.Labels = append(descriptor.Labels, &label_pb.LabelDescriptor{
+					Key:       key,
+					ValueType: label_pb.LabelDescriptor_STRING,
+				})
+			}
+			if _, err := service.DeleteMetricDescriptor(ctx,
+				&monitoring.DeleteMetricDescriptorRequest{Name: name}); err != nil {
+				return nil, errors.Wrapf(err, "delete metric descriptor %s", metricType)
+			}
+			descriptor.Name = ""
+			if _, err := service.CreateMetricDescriptor(ctx, &monitoring.CreateMetricDescriptorRequest{
+				Name:             c.projectID,
+				MetricDescriptor: descriptor,
+			}); err != nil {
+				return nil, errors.Wrapf(err, "recreate metric descriptor %s", metricType)
+			}
+			level.Info(c.logger).Log("msg", "Recreated metric descriptor with new labels",
+				"metric", metricType, "labels", len(extra))
+			labelMismatchRemediations.WithLabelValues("recreate").Inc()
+		}
+	}
+	return repaired, nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// schemaFetchTimeout bounds the descriptor lookup on first sight of a metric.
+const schemaFetchTimeout = time.Minute
+
+var schemaEnforcementsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "schema_enforcements_total",
+		Help:      "Total number of label adjustments made to conform series to their existing metric descriptors, by action.",
+	},
+	[]string{"action"},
+)
+
+func init() {
+	prometheus.MustRegister(schemaEnforcementsTotal)
+}
+
+// SchemaEnforcer is a WriteInterceptor that conforms series to the metric
+// descriptors already registered in the project. On first sight of a metric
+// type it fetches the existing descriptor and caches its label schema; labels
+// the descriptor does not define are dropped from the series before they are
+// queued, instead of triggering InvalidArgument errors at write time. Metrics
+// without a registered descriptor pass through unchanged. Intended for
+// organizations that curate their descriptors ahead of time.
+type SchemaEnforcer struct {
+	logger log.Logger
+	client *MetadataClient
+	next   WriteInterceptor
+
+	mtx sync.Mutex
+	// Allowed label keys per metric type. A nil map marks a metric without
+	// a registered descriptor.
+	schemas map[string]map[string]bool
+}
+
+// NewSchemaEnforcer returns an enforcer fetching descriptors through the
+// given metadata client. Conformed series are passed on to next, if set.
+func NewSchemaEnforcer(logger log.Logger, client *MetadataClient, next WriteInterceptor) *SchemaEnforcer {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	return &SchemaEnforcer{
+		logger:  logger,
+		client:  client,
+		next:    next,
+		schemas: map[string]map[string]bool{},
+	}
+}
+
+// Intercept implements WriteInterceptor.
+func (e *SchemaEnforcer) Intercept(series *monitoring_pb.TimeSeries) error {
+	if schema := e.schema(series.Metric.GetType()); schema != nil {
+		for key := range series.Metric.Labels {
+			if !schema[key] {
+				delete(series.Metric.Labels, key)
+				schemaEnforcementsTotal.WithLabelValues("drop_label").Inc()
+			}
+		}
+	}
+	if e.next != nil {
+		return e.next.Intercept(series)
+	}
+	return nil
+}
+
+// schema returns the allowed label keys of a metric type, fetching and
+// caching the descriptor on first sight. It returns nil if the metric has no
+// registered descriptor or the lookup failed; the series then passes through
+// unenforced.
+func (e *SchemaEnforcer) schema(metricType string) map[string]bool {
+	e.mtx.Lock()
+	schema, ok := e.schemas[metricType]
+	e.mtx.Unlock()
+	if ok {
+		return schema
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), schemaFetchTimeout)
+	defer cancel()
+	descriptor, err := e.client.GetMetricDescriptor(ctx, metricType)
+	if err != nil {
+		// Not cached, so the lookup is retried with the next sample.
+		level.Warn(e.logger).Log("msg", "Fetching metric descriptor failed, series passes through unenforced",
+			"metric", metricType, "err", err)
+		return nil
+	}
+	if descriptor != nil {
+		schema = map[string]bool{}
+		for _, l := range descriptor.Labels {
+			schema[l.Key] = true
+		}
+	}
+	e.mtx.Lock()
+	e.schemas[metricType] = schema
+	e.mtx.Unlock()
+	return schema
+}
@@ -0,0 +1,130 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	label_pb "google.golang.org/genproto/googleapis/api/label"
+	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+	monitoring "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// schemaTestServer serves a fixed set of metric descriptors and counts the
+// lookups it receives.
+type schemaTestServer struct {
+	metricServiceServer
+	mtx         sync.Mutex
+	descriptors map[string]*metric_pb.MetricDescriptor
+	requests    int
+}
+
+func (s *schemaTestServer) GetMetricDescriptor(ctx context.Context, req *monitoring.GetMetricDescriptorRequest) (*metric_pb.MetricDescriptor, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.requests++
+	if d, ok := s.descriptors[req.Name]; ok {
+		return d, nil
+	}
+	return nil, status.Error(codes.NotFound, "descriptor not found")
+}
+
+func (s *schemaTestServer) requestCount() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.requests
+}
+
+func TestSchemaEnforcer(t *testing.T) {
+	listener := newLocalListener()
+	grpcServer := grpc.NewServer()
+	server := &schemaTestServer{
+		descriptors: map[string]*metric_pb.MetricDescriptor{
+			"projects/1234/metricDescriptors/external.googleapis.com/prometheus/metric1": {
+				Type: "external.googleapis.com/prometheus/metric1",
+				Labels: []*label_pb.LabelDescriptor{
+					{Key: "keep", ValueType: label_pb.LabelDescriptor_STRING},
+				},
+			},
+		},
+	}
+	monitoring.RegisterMetricServiceServer(grpcServer, server)
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	serverURL, err := url.Parse("https://" + listener.Addr().String() + "?auth=false")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(&ClientConfig{
+		ProjectID: "projects/1234",
+		URL:       serverURL,
+		Timeout:   time.Second,
+	})
+	defer c.Close()
+
+	e := NewSchemaEnforcer(nil, NewMetadataClient(nil, c, 100, 1), nil)
+
+	series := &monitoring.TimeSeries{
+		Metric: &metric_pb.Metric{
+			Type:   "external.googleapis.com/prometheus/metric1",
+			Labels: map[string]string{"keep": "1", "drop": "2"},
+		},
+	}
+	if err := e.Intercept(series); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := series.Metric.Labels["keep"]; !ok {
+		t.Errorf("label %q defined in the descriptor was dropped", "keep")
+	}
+	if _, ok := series.Metric.Labels["drop"]; ok {
+		t.Errorf("label %q not defined in the descriptor was kept", "drop")
+	}
+
+	// A metric without a registered descriptor passes through unchanged.
+	unregistered := &monitoring.TimeSeries{
+		Metric: &metric_pb.Metric{
+			Type:   "external.googleapis.com/prometheus/metric2",
+			Labels: map[string]string{"a": "1", "b": "2"},
+		},
+	}
+	if err := e.Intercept(unregistered); err != nil {
+		t.Fatal(err)
+	}
+	if len(unregistered.Metric.Labels) != 2 {
+		t.Errorf("unexpected labels %v for metric without descriptor", unregistered.Metric.Labels)
+	}
+
+	// The schemas are cached, so repeated series must not trigger lookups.
+	requests := server.requestCount()
+	for i := 0; i < 5; i++ {
+		if err := e.Intercept(series); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Intercept(unregistered); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := server.requestCount(); got != requests {
+		t.Errorf("expected %d descriptor lookups, got %d", requests, got)
+	}
+}
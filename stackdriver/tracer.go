@@ -0,0 +1,220 @@
+/*
+Copyright 2020 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stackdriver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	timestamp_pb "github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+	monitoredres_pb "google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoring "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// tracerMetricSuffix is appended to the metrics prefix to form the type of
+// the tracer metric.
+const tracerMetricSuffix = "/sidecar/tracer"
+
+// tracerPollInterval is how often a probe polls the Monitoring API for the
+// written point.
+const tracerPollInterval = 2 * time.Second
+
+var (
+	tracerProbesTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "tracer_probes_total",
+			Help:      "Total number of tracer probes attempted.",
+		},
+	)
+	tracerProbeFailuresTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "tracer_probe_failures_total",
+			Help:      "Total number of tracer probes whose point did not become readable in time.",
+		},
+	)
+	tracerLatencySeconds = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "tracer_latency_seconds",
+			Help:      "End-to-end latency from writing a tracer point until it is readable through the Monitoring API.",
+			Buckets:   prometheus.ExponentialBuckets(0.5, 2, 10),
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(tracerProbesTotal)
+	prometheus.MustRegister(tracerProbeFailuresTotal)
+	prometheus.MustRegister(tracerLatencySeconds)
+}
+
+// Tracer periodically writes a known tracer series through the Monitoring
+// API and reads it back, measuring how long the written point takes to
+// become visible. The measured ingestion latency and the probe success rate
+// are exported as sidecar metrics, giving an end-to-end SLI of the export
+// path that covers authentication, quota, and ingestion delay rather than
+// only request acceptance.
+type Tracer struct {
+	logger     log.Logger
+	client     *Client
+	projectID  string
+	metricType string
+	resource   *monitoredres_pb.MonitoredResource
+	// instance distinguishes concurrent sidecars writing the tracer metric.
+	instance string
+	interval time.Duration
+}
+
+// NewTracer returns a tracer probing through the given client every
+// interval. The metric type is built from the metrics prefix, and points are
+// written against the global resource of the project named by the
+// "projects/<id>" resource string.
+func NewTracer(logger log.Logger, client *Client, projectIDResource, metricsPrefix string, interval time.Duration) *Tracer {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	hostname, _ := os.Hostname()
+	return &Tracer{
+		logger:     logger,
+		client:     client,
+		projectID:  projectIDResource,
+		metricType: metricsPrefix + tracerMetricSuffix,
+		resource: &monitoredres_pb.MonitoredResource{
+			Type: "global",
+			Labels: map[string]string{
+				"project_id": strings.TrimPrefix(projectIDResource, "projects/"),
+			},
+		},
+		instance: fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+		interval: interval,
+	}
+}
+
+// Run probes at the configured interval until the context is canceled.
+func (t *Tracer) Run(ctx context.Context) {
+	tick := time.NewTicker(t.interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			tracerProbesTotal.Inc()
+			latency, err := t.probe(ctx)
+			if err != nil {
+				tracerProbeFailuresTotal.Inc()
+				level.Warn(t.logger).Log("msg", "tracer probe failed", "err", err)
+				continue
+			}
+			tracerLatencySeconds.Observe(latency.Seconds())
+			level.Debug(t.logger).Log("msg", "tracer probe succeeded", "latency", latency)
+		}
+	}
+}
+
+// probe writes one tracer point and polls until it is readable, returning
+// the elapsed time. The probe gives up when the next probe is due.
+func (t *Tracer) probe(ctx context.Context) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.interval)
+	defer cancel()
+
+	start := time.Now()
+	// The written value identifies this probe when reading back.
+	value := start.UnixNano()
+
+	err := t.client.Store(&monitoring.CreateTimeSeriesRequest{
+		TimeSeries: []*monitoring.TimeSeries{{
+			Metric: &metric_pb.Metric{
+				Type:   t.metricType,
+				Labels: map[string]string{"instance": t.instance},
+			},
+			Resource:   t.resource,
+			MetricKind: metric_pb.MetricDescriptor_GAUGE,
+			ValueType:  metric_pb.MetricDescriptor_INT64,
+			Points: []*monitoring.Point{{
+				Interval: &monitoring.TimeInterval{
+					EndTime: &timestamp_pb.Timestamp{Seconds: start.Unix(), Nanos: int32(start.Nanosecond())},
+				},
+				Value: &monitoring.TypedValue{
+					Value: &monitoring.TypedValue_Int64Value{Int64Value: value},
+				},
+			}},
+		}},
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "write tracer point")
+	}
+
+	for {
+		visible, err := t.pointVisible(ctx, start, value)
+		if err != nil {
+			return 0, errors.Wrap(err, "read tracer point")
+		}
+		if visible {
+			return time.Since(start), nil
+		}
+		select {
+		case <-ctx.Done():
+			return 0, errors.New("tracer point not readable before the next probe")
+		case <-time.After(tracerPollInterval):
+		}
+	}
+}
+
+// pointVisible reads the tracer series back and reports whether the point
+// written with the given value is present.
+func (t *Tracer) pointVisible(ctx context.Context, start time.Time, value int64) (bool, error) {
+	conn, err := t.client.getConnection(ctx)
+	if err != nil {
+		return false, err
+	}
+	service := monitoring.NewMetricServiceClient(conn)
+
+	now := time.Now()
+	resp, err := service.ListTimeSeries(ctx, &monitoring.ListTimeSeriesRequest{
+		Name: t.projectID,
+		Filter: fmt.Sprintf(`metric.type = "%s" AND metric.labels.instance = "%s"`,
+			t.metricType, t.instance),
+		Interval: &monitoring.TimeInterval{
+			StartTime: &timestamp_pb.Timestamp{Seconds: start.Unix() - 1},
+			EndTime:   &timestamp_pb.Timestamp{Seconds: now.Unix(), Nanos: int32(now.Nanosecond())},
+		},
+		View: monitoring.ListTimeSeriesRequest_FULL,
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, ts := range resp.TimeSeries {
+		for _, p := range ts.Points {
+			if v, ok := p.Value.Value.(*monitoring.TypedValue_Int64Value); ok && v.Int64Value == value {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2020 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stackdriver
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	empty_pb "github.com/golang/protobuf/ptypes/empty"
+	monitoring "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/grpc"
+)
+
+// tracerTestServer accepts written series and serves them back on
+// ListTimeSeries.
+type tracerTestServer struct {
+	metricServiceServer
+
+	mtx    sync.Mutex
+	series []*monitoring.TimeSeries
+}
+
+func (s *tracerTestServer) CreateTimeSeries(ctx context.Context, req *monitoring.CreateTimeSeriesRequest) (*empty_pb.Empty, error) {
+	s.mtx.Lock()
+	s.series = append(s.series, req.TimeSeries...)
+	s.mtx.Unlock()
+	return &empty_pb.Empty{}, nil
+}
+
+func (s *tracerTestServer) ListTimeSeries(ctx context.Context, req *monitoring.ListTimeSeriesRequest) (*monitoring.ListTimeSeriesResponse, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return &monitoring.ListTimeSeriesResponse{TimeSeries: s.series}, nil
+}
+
+func TestTracerProbe(t *testing.T) {
+	listener := newLocalListener()
+	grpcServer := grpc.NewServer()
+	server := &tracerTestServer{}
+	monitoring.RegisterMetricServiceServer(grpcServer, server)
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	serverURL, err := url.Parse("https://" + listener.Addr().String() + "?auth=false")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(&ClientConfig{
+		URL:     serverURL,
+		Timeout: time.Second,
+	})
+	defer c.Close()
+
+	tracer := NewTracer(nil, c, "projects/test", "external.googleapis.com/prometheus", 10*time.Second)
+	latency, err := tracer.probe(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected probe error: %s", err)
+	}
+	if latency <= 0 {
+		t.Errorf("expected positive latency, got %v", latency)
+	}
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+	if len(server.series) != 1 {
+		t.Fatalf("expected 1 written series, got %d", len(server.series))
+	}
+	ts := server.series[0]
+	if ts.Metric.GetType() != "external.googleapis.com/prometheus/sidecar/tracer" {
+		t.Errorf("unexpected metric type %q", ts.Metric.GetType())
+	}
+	if ts.Metric.GetLabels()["instance"] == "" {
+		t.Errorf("expected non-empty instance label")
+	}
+}
+
+func TestTracerProbeFailure(t *testing.T) {
+	listener := newLocalListener()
+	grpcServer := grpc.NewServer()
+	// The default test server does not implement ListTimeSeries, so the
+	// readback fails.
+	monitoring.RegisterMetricServiceServer(grpcServer, &metricServiceServer{nil})
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	serverURL, err := url.Parse("https://" + listener.Addr().String() + "?auth=false")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(&ClientConfig{
+		URL:     serverURL,
+		Timeout: time.Second,
+	})
+	defer c.Close()
+
+	tracer := NewTracer(nil, c, "projects/test", "external.googleapis.com/prometheus", 10*time.Second)
+	if _, err := tracer.probe(context.Background()); err == nil {
+		t.Fatal("expected probe error")
+	}
+}
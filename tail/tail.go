@@ -43,32 +43,43 @@ type Tailer struct {
 	offset      int // Bytes read within the current reader.
 }
 
+// checkpointOpenRetries is how often opening the last checkpoint is retried
+// when it is deleted while we open it, i.e. when we race with the Prometheus
+// TSDB replacing it with a newer one.
+const checkpointOpenRetries = 3
+
 // Tail the prometheus/tsdb write ahead log in the given directory. Checkpoints
 // are read before reading any WAL segments.
-// Tailing may fail if we are racing with the DB itself in deleting obsolete checkpoints
-// and segments. The caller should implement relevant logic to retry in those cases.
+// Tailing transparently handles the DB deleting obsolete checkpoints and
+// segments while we read them.
 func Tail(ctx context.Context, dir string) (*Tailer, error) {
 	t := &Tailer{
 		ctx: ctx,
 		dir: dir,
 	}
-	cpdir, k, err := tsdb.LastCheckpoint(dir)
-	if errors.Cause(err) == tsdb.ErrNotFound {
-		t.cur = ioutil.NopCloser(bytes.NewReader(nil))
-		t.nextSegment = 0
-	} else {
+	for retry := 0; ; retry++ {
+		cpdir, k, err := tsdb.LastCheckpoint(dir)
+		if errors.Cause(err) == tsdb.ErrNotFound {
+			t.cur = ioutil.NopCloser(bytes.NewReader(nil))
+			t.nextSegment = 0
+			return t, nil
+		}
 		if err != nil {
 			return nil, errors.Wrap(err, "retrieve last checkpoint")
 		}
 		// Open the entire checkpoint first. It has to be consumed before
 		// the tailer proceeds to any segments.
 		t.cur, err = wal.NewSegmentsReader(cpdir)
-		if err != nil {
+		if err == nil {
+			t.nextSegment = k + 1
+			return t, nil
+		}
+		// The checkpoint may have been replaced by a newer one while we
+		// were opening it. Resolve it again in that case.
+		if !os.IsNotExist(errors.Cause(err)) || retry >= checkpointOpenRetries {
 			return nil, errors.Wrap(err, "open checkpoint")
 		}
-		t.nextSegment = k + 1
 	}
-	return t, nil
 }
 
 type segmentRef struct {
@@ -131,6 +142,13 @@ func (t *Tailer) incNextSegment() {
 	t.mtx.Unlock()
 }
 
+func (t *Tailer) setNextSegment(n int) {
+	t.mtx.Lock()
+	t.nextSegment = n
+	t.offset = 0
+	t.mtx.Unlock()
+}
+
 func (t *Tailer) getNextSegment() int {
 	t.mtx.Lock()
 	v := t.nextSegment
@@ -198,6 +216,35 @@ func (t *Tailer) Read(b []byte) (int, error) {
 				backoff = maxBackoff
 			}
 			continue
+		} else if err == errSegmentTruncated {
+			// The expected segment was deleted by a WAL truncation while we
+			// were waiting for it. Its contents are covered by the checkpoint
+			// the truncation created, so resume reading there. Checkpoint and
+			// segment files are both page-aligned record streams, so switching
+			// between them at a segment boundary keeps the stream well-formed.
+			// Samples re-read from the checkpoint are deduplicated downstream.
+			cpdir, k, cperr := tsdb.LastCheckpoint(t.dir)
+			if cperr != nil {
+				t.incOffset(n)
+				return n, errors.Wrap(cperr, "retrieve last checkpoint")
+			}
+			if k < t.getNextSegment() {
+				t.incOffset(n)
+				return n, errors.Errorf("segment %d truncated without a covering checkpoint", t.getNextSegment())
+			}
+			cp, cperr := wal.NewSegmentsReader(cpdir)
+			if cperr != nil {
+				// The checkpoint itself may have been replaced already again.
+				if os.IsNotExist(errors.Cause(cperr)) {
+					continue
+				}
+				t.incOffset(n)
+				return n, errors.Wrap(cperr, "open checkpoint")
+			}
+			t.cur.Close()
+			t.cur = cp
+			t.setNextSegment(k + 1)
+			continue
 		} else if err != nil {
 			t.incOffset(n)
 			return n, errors.Wrap(err, "open next segment")
@@ -207,6 +254,10 @@ func (t *Tailer) Read(b []byte) (int, error) {
 	}
 }
 
+// errSegmentTruncated is returned by openSegment if the requested segment no
+// longer exists because the WAL was truncated after a checkpoint.
+var errSegmentTruncated = errors.New("segment truncated")
+
 func openSegment(dir string, n int) (io.ReadCloser, error) {
 	files, err := fileutil.ReadDir(dir)
 	if err != nil {
@@ -218,7 +269,7 @@ func openSegment(dir string, n int) (io.ReadCloser, error) {
 			continue
 		}
 		if k > n {
-			return nil, errors.Errorf("next segment %d too high, expected %d", n, k)
+			return nil, errSegmentTruncated
 		}
 		return wal.OpenReadSegment(filepath.Join(dir, fn))
 	}
@@ -20,6 +20,7 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -103,6 +104,113 @@ func TestTailFuzz(t *testing.T) {
 	}
 }
 
+// TestTailTruncation verifies that the tailer transparently continues from
+// the last checkpoint when the segments it was about to read are deleted by
+// a concurrent WAL truncation.
+func TestTailTruncation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_tail_truncation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Open the tailer against the empty WAL so it expects segment 0 next.
+	rc, err := Tail(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	// Write records across several small segments.
+	w, err := wal.NewSize(nil, nil, dir, 32*1024, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written [][]byte
+	for i := 0; i < 200; i++ {
+		rec := make([]byte, 1024)
+		if _, err := rand.Read(rec); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Log(rec); err != nil {
+			t.Fatal(err)
+		}
+		written = append(written, rec)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	segs, err := listSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segs) < 4 {
+		t.Fatalf("expected at least 4 segments, got %d", len(segs))
+	}
+
+	// Simulate a truncation: create a checkpoint covering the first three
+	// segments and delete them before the tailer has read anything.
+	cpdir := filepath.Join(dir, "checkpoint.00002")
+	cp, err := wal.New(nil, nil, cpdir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var checkpointed [][]byte
+	for i := 0; i < 10; i++ {
+		rec := make([]byte, 1024)
+		if _, err := rand.Read(rec); err != nil {
+			t.Fatal(err)
+		}
+		if err := cp.Log(rec); err != nil {
+			t.Fatal(err)
+		}
+		checkpointed = append(checkpointed, rec)
+	}
+	if err := cp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range segs[:3] {
+		if err := os.Remove(filepath.Join(dir, s.name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Reading must not fail. We expect the checkpoint records first, followed
+	// by the records of the remaining segments.
+	go func() {
+		time.Sleep(2 * time.Second)
+		cancel()
+	}()
+	var read [][]byte
+	wr := wal.NewReader(rc)
+	for wr.Next() {
+		read = append(read, append([]byte(nil), wr.Record()...))
+	}
+	if wr.Err() != nil {
+		t.Fatal(wr.Err())
+	}
+	if len(read) <= len(checkpointed) {
+		t.Fatalf("expected more than %d records, got %d", len(checkpointed), len(read))
+	}
+	for i, rec := range checkpointed {
+		if !bytes.Equal(read[i], rec) {
+			t.Fatalf("checkpoint record %d doesn't match", i)
+		}
+	}
+	// The remaining records must be a contiguous suffix of what was written.
+	rest := read[len(checkpointed):]
+	if len(rest) > len(written) || !bytes.Equal(rest[len(rest)-1], written[len(written)-1]) {
+		t.Fatalf("unexpected final record")
+	}
+	for i, rec := range rest {
+		if !bytes.Equal(rec, written[len(written)-len(rest)+i]) {
+			t.Fatalf("segment record %d doesn't match", i)
+		}
+	}
+}
+
 func BenchmarkTailFuzz(t *testing.B) {
 	dir, err := ioutil.TempDir("", "test_tail")
 	if err != nil {
@@ -24,6 +24,7 @@ import (
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/pkg/labels"
 )
 
@@ -172,6 +173,45 @@ func (c *Cache) Get(ctx context.Context, lset labels.Labels) (*Target, error) {
 	return t, nil
 }
 
+// Snapshot returns a JSON-encoded copy of the current cache contents, which
+// can be passed to LoadSnapshot to prime the cache of a restarting sidecar.
+// The cache key is not serializable, so targets are stored as a flat list and
+// regrouped on load.
+func (c *Cache) Snapshot() ([]byte, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	var all []*Target
+	for _, ts := range c.targets {
+		all = append(all, ts...)
+	}
+	return json.Marshal(all)
+}
+
+// LoadSnapshot primes the cache with target data produced by Snapshot.
+// Existing entries are left untouched and loaded entries are replaced through
+// regular refreshes as usual.
+func (c *Cache) LoadSnapshot(b []byte) error {
+	var all []*Target
+	if err := json.Unmarshal(b, &all); err != nil {
+		return errors.Wrap(err, "decode target snapshot")
+	}
+	grouped := map[string][]*Target{}
+	for _, target := range all {
+		key := cacheKey(target.Labels.Get("job"), target.Labels.Get("instance"))
+		grouped[key] = append(grouped[key], target)
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for key, ts := range grouped {
+		if _, ok := c.targets[key]; !ok {
+			c.targets[key] = ts
+		}
+	}
+	return nil
+}
+
 // targetMatch returns the first target in the entry that matches all labels of the input
 // set iff it has them set.
 // This way metric labels are skipped while consistent target labels are considered.
@@ -200,6 +240,22 @@ type apiResponse struct {
 type Target struct {
 	Labels           labels.Labels `json:"labels"`
 	DiscoveredLabels labels.Labels `json:"discoveredLabels"`
+	// ScrapeInterval is reported by Prometheus 2.20 and later and empty for
+	// older versions.
+	ScrapeInterval string `json:"scrapeInterval,omitempty"`
+}
+
+// ScrapeIntervalDuration returns the target's scrape interval, or zero if the
+// API did not report one or it could not be parsed.
+func (t *Target) ScrapeIntervalDuration() time.Duration {
+	if t.ScrapeInterval == "" {
+		return 0
+	}
+	d, err := model.ParseDuration(t.ScrapeInterval)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(d)
 }
 
 // DropTargetLabels drops labels from the series that are found in the target with
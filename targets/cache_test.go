@@ -301,3 +301,34 @@ func TestDropTargetLabels(t *testing.T) {
 		}
 	}
 }
+
+func TestTargetCache_Snapshot(t *testing.T) {
+	c := NewCache(nil, nil, nil)
+	c.targets = map[string][]*Target{
+		cacheKey("job1", "instance1"): {
+			{
+				Labels:           labels.FromStrings("job", "job1", "instance", "instance1"),
+				DiscoveredLabels: labels.FromStrings("__resource_a", "resource_a"),
+			},
+		},
+	}
+	b, err := c.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewCache(nil, nil, nil)
+	// Existing entries take precedence over the snapshot.
+	existing := []*Target{{Labels: labels.FromStrings("job", "job2", "instance", "instance1")}}
+	loaded.targets[cacheKey("job2", "instance1")] = existing
+
+	if err := loaded.LoadSnapshot(b); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.targets[cacheKey("job1", "instance1")], c.targets[cacheKey("job1", "instance1")]) {
+		t.Fatalf("unexpected loaded targets %v", loaded.targets)
+	}
+	if !reflect.DeepEqual(loaded.targets[cacheKey("job2", "instance1")], existing) {
+		t.Fatalf("existing entry was overwritten: %v", loaded.targets)
+	}
+}